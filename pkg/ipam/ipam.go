@@ -18,6 +18,7 @@ import (
 	"context"
 	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
 )
 
 func ExecAdd(plugin string, netconf []byte) (types.Result, error) {
@@ -31,3 +32,37 @@ func ExecCheck(plugin string, netconf []byte) error {
 func ExecDel(plugin string, netconf []byte) error {
 	return invoke.DelegateDel(context.TODO(), plugin, netconf, nil)
 }
+
+// SplitForeignIPs removes the IPs that the IPAM plugin assigned to another
+// interface than ifName, such as a VLAN subinterface it configured itself,
+// from res and returns them. The main plugin only configures the remaining
+// IPs on ifName, and reports the foreign ones with AppendForeignIPs.
+func SplitForeignIPs(res *current.Result, ifName string) []*current.IPConfig {
+	var own, foreign []*current.IPConfig
+	for _, ipc := range res.IPs {
+		if ipc.Interface != nil && *ipc.Interface >= 0 && *ipc.Interface < len(res.Interfaces) &&
+			res.Interfaces[*ipc.Interface].Name != ifName {
+			foreign = append(foreign, ipc)
+		} else {
+			own = append(own, ipc)
+		}
+	}
+	res.IPs = own
+	return foreign
+}
+
+// AppendForeignIPs adds the IPs returned by SplitForeignIPs for ipamResult,
+// and the interfaces they are assigned to, to the main plugin's result.
+func AppendForeignIPs(result, ipamResult *current.Result, foreign []*current.IPConfig) {
+	indexes := map[int]int{}
+	for _, ipc := range foreign {
+		idx, ok := indexes[*ipc.Interface]
+		if !ok {
+			result.Interfaces = append(result.Interfaces, ipamResult.Interfaces[*ipc.Interface])
+			idx = len(result.Interfaces) - 1
+			indexes[*ipc.Interface] = idx
+		}
+		ipc.Interface = current.Int(idx)
+		result.IPs = append(result.IPs, ipc)
+	}
+}
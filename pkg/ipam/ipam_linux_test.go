@@ -185,6 +185,31 @@ var _ = Describe("ConfigureIface", func() {
 		Expect(err).NotTo(HaveOccurred())
 	})
 
+	It("leaves the addresses of other interfaces to the IPAM plugin", func() {
+		// e.g. a VLAN subinterface the IPAM plugin configured itself
+		result.Interfaces[1].Name = LINK_NAME + ".100"
+		result.IPs[1].Interface = current.Int(1)
+		foreign := SplitForeignIPs(result, LINK_NAME)
+		Expect(foreign).To(HaveLen(1))
+		Expect(result.IPs).To(HaveLen(1))
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(ConfigureIface(LINK_NAME, result)).To(Succeed())
+
+			link, err := netlink.LinkByName(LINK_NAME)
+			Expect(err).NotTo(HaveOccurred())
+			v6addrs, err := netlink.AddrList(link, syscall.AF_INET6)
+			Expect(err).NotTo(HaveOccurred())
+			for _, a := range v6addrs {
+				Expect(ipNetEqual(a.IPNet, ipv6)).To(BeFalse())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
 	It("configures a link with routes using address gateways", func() {
 		result.Routes[0].GW = nil
 		result.Routes[1].GW = nil
@@ -294,3 +319,44 @@ var _ = Describe("ConfigureIface", func() {
 		Expect(err).NotTo(HaveOccurred())
 	})
 })
+
+var _ = Describe("SplitForeignIPs", func() {
+	It("moves the addresses of other interfaces to the main plugin's result", func() {
+		ipamResult := &current.Result{
+			Interfaces: []*current.Interface{
+				{Name: "eth0.100", Sandbox: "/var/run/netns/a"},
+				{Name: "eth0", Sandbox: "/var/run/netns/a"},
+			},
+			IPs: []*current.IPConfig{
+				{Interface: current.Int(0), Address: *mustParseCIDR("10.0.100.2/24")},
+				{Address: *mustParseCIDR("10.0.0.2/24")},
+				{Interface: current.Int(1), Address: *mustParseCIDR("10.0.1.2/24")},
+				{Interface: current.Int(0), Address: *mustParseCIDR("10.0.100.3/24")},
+			},
+		}
+		foreign := SplitForeignIPs(ipamResult, "eth0")
+		Expect(ipamResult.IPs).To(Equal([]*current.IPConfig{
+			{Address: *mustParseCIDR("10.0.0.2/24")},
+			{Interface: current.Int(1), Address: *mustParseCIDR("10.0.1.2/24")},
+		}))
+
+		result := &current.Result{
+			Interfaces: []*current.Interface{{Name: "veth0"}, {Name: "eth0", Sandbox: "/var/run/netns/a"}},
+			IPs:        []*current.IPConfig{{Interface: current.Int(1), Address: *mustParseCIDR("10.0.0.2/24")}},
+		}
+		AppendForeignIPs(result, ipamResult, foreign)
+		Expect(result.Interfaces).To(HaveLen(3))
+		Expect(result.Interfaces[2].Name).To(Equal("eth0.100"))
+		Expect(result.IPs).To(Equal([]*current.IPConfig{
+			{Interface: current.Int(1), Address: *mustParseCIDR("10.0.0.2/24")},
+			{Interface: current.Int(2), Address: *mustParseCIDR("10.0.100.2/24")},
+			{Interface: current.Int(2), Address: *mustParseCIDR("10.0.100.3/24")},
+		}))
+	})
+})
+
+func mustParseCIDR(s string) *net.IPNet {
+	ipn, err := types.ParseCIDR(s)
+	Expect(err).NotTo(HaveOccurred())
+	return ipn
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// annotationRequestedIP on a pod asks the DHCP server for that address, e.g.
+// to get a reservation without changing the network configuration.
+const annotationRequestedIP = "cni.dhcp/requested-ip"
+
+// Annotations the daemon writes to pods with the state of their lease
+const (
+	annotationLeaseIP     = "cni.dhcp/lease-ip"
+	annotationLeaseExpiry = "cni.dhcp/lease-expiry"
+	annotationServer      = "cni.dhcp/server"
+)
+
+const podLookupTimeout = 10 * time.Second
+
+// podRequestedIP returns the address in the pod's requested-ip annotation,
+// or nil if there is none. Lookup failures are logged, since the annotation
+// is only a hint to the server.
+func (d *DHCP) podRequestedIP(namespace, name string) net.IP {
+	if d.k8sClient == nil || name == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), podLookupTimeout)
+	defer cancel()
+	pod, err := d.k8sClient.Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		log.Printf("failed to look up pod %s/%s for %s annotation: %v", namespace, name, annotationRequestedIP, err)
+		return nil
+	}
+
+	value, ok := pod.Annotations[annotationRequestedIP]
+	if !ok {
+		return nil
+	}
+	ip := net.ParseIP(strings.TrimSpace(value)).To4()
+	if ip == nil {
+		log.Printf("pod %s/%s: ignoring invalid %s annotation %q", namespace, name, annotationRequestedIP, value)
+	}
+	return ip
+}
+
+// podAnnotator writes the address, expiry and server of leases to their pods'
+// annotations, so they can be seen with kubectl.
+type podAnnotator struct {
+	pods typedcorev1.PodsGetter
+}
+
+// annotate patches the pod of the lease in the background. Pods with several
+// leases show the one acquired or renewed last.
+func (a *podAnnotator) annotate(info LeaseInfo) {
+	if a == nil || info.Pod == "" {
+		return
+	}
+	go func() {
+		if err := a.patch(info); err != nil {
+			log.Printf("%v: failed to annotate pod %s/%s: %v", info.ClientID, info.Namespace, info.Pod, err)
+		}
+	}()
+}
+
+func (a *podAnnotator) patch(info LeaseInfo) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				annotationLeaseIP:     info.IP,
+				annotationLeaseExpiry: info.ExpireTime.UTC().Format(time.RFC3339),
+				annotationServer:      info.Server,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), podLookupTimeout)
+	defer cancel()
+	_, err = a.pods.Pods(info.Namespace).Patch(ctx, info.Pod, k8stypes.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
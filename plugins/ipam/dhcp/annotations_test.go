@@ -0,0 +1,90 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	kapiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPodRequestedIP(t *testing.T) {
+	pod := func(name, annotation string) *kapiv1.Pod {
+		p := &kapiv1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+		if annotation != "" {
+			p.Annotations = map[string]string{annotationRequestedIP: annotation}
+		}
+		return p
+	}
+	client := fake.NewSimpleClientset(
+		pod("annotated", " 192.168.1.50 "),
+		pod("invalid", "192.168.1"),
+		pod("plain", ""),
+	)
+	d := &DHCP{k8sClient: client.CoreV1()}
+
+	tests := []struct {
+		pod  string
+		want net.IP
+	}{
+		{"annotated", net.ParseIP("192.168.1.50")},
+		{"invalid", nil},
+		{"plain", nil},
+		{"missing", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := d.podRequestedIP("default", tt.pod); !got.Equal(tt.want) {
+			t.Errorf("podRequestedIP(%q) = %v, want %v", tt.pod, got, tt.want)
+		}
+	}
+}
+
+func TestPodAnnotatorPatch(t *testing.T) {
+	client := fake.NewSimpleClientset(&kapiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "web",
+			Annotations: map[string]string{"other": "kept"},
+		},
+	})
+	a := &podAnnotator{pods: client.CoreV1()}
+
+	expiry := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	info := LeaseInfo{Namespace: "default", Pod: "web", IP: "192.168.1.50", Server: "192.168.1.1", ExpireTime: expiry}
+	if err := a.patch(info); err != nil {
+		t.Fatal(err)
+	}
+
+	pod, err := client.CoreV1().Pods("default").Get(context.TODO(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		annotationLeaseIP:     "192.168.1.50",
+		annotationLeaseExpiry: "2021-06-01T12:00:00Z",
+		annotationServer:      "192.168.1.1",
+		"other":               "kept",
+	} {
+		if got := pod.Annotations[key]; got != want {
+			t.Errorf("annotation %s = %q, want %q", key, got, want)
+		}
+	}
+}
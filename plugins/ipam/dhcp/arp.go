@@ -0,0 +1,191 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Probing is shortened compared to RFC 5227, which takes several seconds,
+// to keep pod startup fast.
+const (
+	arpProbeNum  = 2
+	arpProbeWait = 500 * time.Millisecond
+)
+
+// Announcements follow RFC 5227 section 2.3, at a shorter interval. Only
+// the first one is sent before returning.
+const (
+	arpAnnounceNum      = 2
+	arpAnnounceInterval = 500 * time.Millisecond
+)
+
+const (
+	arpOpRequest = 1
+	arpOpReply   = 2
+	arpPacketLen = 28
+)
+
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.LittleEndian.Uint16(b[:])
+}
+
+// arpPacket builds an Ethernet/IPv4 ARP packet.
+func arpPacket(op uint16, senderMAC net.HardwareAddr, senderIP net.IP, targetMAC net.HardwareAddr, targetIP net.IP) []byte {
+	pkt := make([]byte, arpPacketLen)
+	binary.BigEndian.PutUint16(pkt[0:2], 1)      // Ethernet
+	binary.BigEndian.PutUint16(pkt[2:4], 0x0800) // IPv4
+	pkt[4] = 6
+	pkt[5] = 4
+	binary.BigEndian.PutUint16(pkt[6:8], op)
+	copy(pkt[8:14], senderMAC)
+	copy(pkt[14:18], senderIP.To4())
+	copy(pkt[18:24], targetMAC)
+	copy(pkt[24:28], targetIP.To4())
+	return pkt
+}
+
+// arpProbe checks whether ip is in use on the link, as described in RFC 5227:
+// ARP requests with an all-zero sender address are sent for ip, and any ARP
+// packet from another host with ip as sender, or probing for ip itself,
+// means the address is taken. It must be called in the link's namespace.
+func arpProbe(link netlink.Link, ip net.IP) (bool, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return false, err
+	}
+	defer unix.Close(fd)
+
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{
+		Ifindex:  link.Attrs().Index,
+		Protocol: htons(unix.ETH_P_ARP),
+	}); err != nil {
+		return false, err
+	}
+
+	bcast := unix.SockaddrLinklayer{
+		Ifindex:  link.Attrs().Index,
+		Protocol: htons(unix.ETH_P_ARP),
+		Halen:    6,
+	}
+	copy(bcast.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	mac := link.Attrs().HardwareAddr
+	probe := arpPacket(arpOpRequest, mac, net.IPv4zero, make(net.HardwareAddr, 6), ip)
+	ip = ip.To4()
+
+	buf := make([]byte, 1500)
+	for i := 0; i < arpProbeNum; i++ {
+		if err := unix.Sendto(fd, probe, 0, &bcast); err != nil {
+			return false, fmt.Errorf("failed to send ARP probe: %v", err)
+		}
+
+		deadline := time.Now().Add(arpProbeWait)
+		for {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				break
+			}
+			tv := unix.NsecToTimeval(remaining.Nanoseconds())
+			if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+				return false, err
+			}
+
+			n, _, err := unix.Recvfrom(fd, buf, 0)
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			} else if err != nil {
+				return false, err
+			}
+			if arpConflicts(buf[:n], mac, ip) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// arpAnnounce sends gratuitous ARP requests for ip from the link, so that
+// switches and neighbours, e.g. the router, update their tables right away
+// instead of talking to the previous owner of the address until their
+// entries time out. It must be called in the link's namespace.
+func arpAnnounce(link netlink.Link, ip net.IP) error {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return err
+	}
+
+	bcast := unix.SockaddrLinklayer{
+		Ifindex:  link.Attrs().Index,
+		Protocol: htons(unix.ETH_P_ARP),
+		Halen:    6,
+	}
+	copy(bcast.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	announcement := arpPacket(arpOpRequest, link.Attrs().HardwareAddr, ip, make(net.HardwareAddr, 6), ip)
+	if err := unix.Sendto(fd, announcement, 0, &bcast); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to send gratuitous ARP: %v", err)
+	}
+
+	// the socket stays on the link, so the rest is sent without the namespace
+	go func() {
+		defer unix.Close(fd)
+		for i := 1; i < arpAnnounceNum; i++ {
+			time.Sleep(arpAnnounceInterval)
+			if err := unix.Sendto(fd, announcement, 0, &bcast); err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// usesARP reports whether ARP is used to resolve addresses on the link,
+// which isn't the case e.g. for ipvlan in L3 mode or tunnels.
+func usesARP(link netlink.Link) bool {
+	return len(link.Attrs().HardwareAddr) == 6 && link.Attrs().RawFlags&unix.IFF_NOARP == 0
+}
+
+// arpConflicts reports whether an ARP packet from another host claims or
+// probes for ip.
+func arpConflicts(pkt []byte, mac net.HardwareAddr, ip net.IP) bool {
+	if len(pkt) < arpPacketLen || pkt[4] != 6 || pkt[5] != 4 {
+		return false
+	}
+	op := binary.BigEndian.Uint16(pkt[6:8])
+	if op != arpOpRequest && op != arpOpReply {
+		return false
+	}
+
+	senderMAC := net.HardwareAddr(pkt[8:14])
+	if bytes.Equal(senderMAC, mac) {
+		return false
+	}
+	senderIP := net.IP(pkt[14:18])
+	targetIP := net.IP(pkt[24:28])
+
+	return senderIP.Equal(ip) || (op == arpOpRequest && senderIP.Equal(net.IPv4zero) && targetIP.Equal(ip))
+}
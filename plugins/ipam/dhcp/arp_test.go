@@ -0,0 +1,43 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestUsesARP(t *testing.T) {
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	tests := []struct {
+		name  string
+		attrs netlink.LinkAttrs
+		want  bool
+	}{
+		{name: "ethernet", attrs: netlink.LinkAttrs{HardwareAddr: mac}, want: true},
+		{name: "noarp", attrs: netlink.LinkAttrs{HardwareAddr: mac, RawFlags: unix.IFF_NOARP}},
+		{name: "no hardware address", attrs: netlink.LinkAttrs{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := usesARP(&netlink.Dummy{LinkAttrs: tt.attrs}); got != tt.want {
+				t.Errorf("usesARP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
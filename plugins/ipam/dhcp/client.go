@@ -16,108 +16,242 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"syscall"
+	"time"
 
-	"github.com/d2g/dhcp4"
-	"github.com/d2g/dhcp4client"
+	"github.com/insomniacslk/dhcp/dhcpv4"
 )
 
 const (
 	MaxDHCPLen = 576
 )
 
-//Send the Discovery Packet to the Broadcast Channel
-func DhcpSendDiscoverPacket(c *dhcp4client.Client, options dhcp4.Options) (dhcp4.Packet, error) {
-	discoveryPacket := c.DiscoverPacket()
-
-	for opt, data := range options {
-		discoveryPacket.AddOption(opt, data)
-	}
+// dhcpConn is the connection messages are exchanged on, in wire format, so
+// that the wrappers of a lease's connection, e.g. traceConn, see them as sent
+// and received. Reads return syscall.EAGAIN once the read timeout expires.
+type dhcpConn interface {
+	Write(packet []byte) error
+	ReadFrom() ([]byte, net.IP, error)
+	SetReadTimeout(t time.Duration) error
+	Close() error
+}
 
-	discoveryPacket.PadToMinSize()
-	return discoveryPacket, c.SendPacket(discoveryPacket)
+// timeoutError is returned when no matching reply arrives in time.
+type timeoutError struct {
+	timeout time.Duration
 }
 
-//Send Request Based On the offer Received.
-func DhcpSendRequest(c *dhcp4client.Client, options dhcp4.Options, offerPacket *dhcp4.Packet) (dhcp4.Packet, error) {
-	requestPacket := c.RequestPacket(offerPacket)
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("no DHCP reply received within %v", e.timeout)
+}
 
-	for opt, data := range options {
-		requestPacket.AddOption(opt, data)
-	}
+// dhcpClient exchanges the messages of a lease on its connection.
+type dhcpClient struct {
+	conn    dhcpConn
+	hwAddr  net.HardwareAddr
+	timeout time.Duration
+	// ask servers to broadcast their replies
+	broadcast bool
+}
 
-	requestPacket.PadToMinSize()
+func (c *dhcpClient) Close() error {
+	return c.conn.Close()
+}
 
-	return requestPacket, c.SendPacket(requestPacket)
+func (c *dhcpClient) send(msg *dhcpv4.DHCPv4) error {
+	return c.conn.Write(msg.ToBytes())
 }
 
-//Send Decline to the received acknowledgement.
-func DhcpSendDecline(c *dhcp4client.Client, acknowledgementPacket *dhcp4.Packet, options dhcp4.Options) (dhcp4.Packet, error) {
-	declinePacket := c.DeclinePacket(acknowledgementPacket)
+// withOptions adds options, e.g. the ones configured for the lease. The
+// options set by later modifiers take precedence.
+func withOptions(options dhcpv4.Options) dhcpv4.Modifier {
+	return func(d *dhcpv4.DHCPv4) {
+		for code, data := range options {
+			d.Options[code] = data
+		}
+	}
+}
 
-	for opt, data := range options {
-		declinePacket.AddOption(opt, data)
+//Send the Discovery Packet to the Broadcast Channel
+func DhcpSendDiscoverPacket(c *dhcpClient, options dhcpv4.Options) (*dhcpv4.DHCPv4, error) {
+	discoveryPacket, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(c.hwAddr),
+		dhcpv4.WithBroadcast(c.broadcast),
+		withOptions(options),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover),
+	)
+	if err != nil {
+		return nil, err
 	}
+	return discoveryPacket, c.send(discoveryPacket)
+}
 
-	declinePacket.PadToMinSize()
+//Send Request Based On the offer Received.
+func DhcpSendRequest(c *dhcpClient, options dhcpv4.Options, offerPacket *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) {
+	requestPacket, err := dhcpv4.New(
+		dhcpv4.WithTransactionID(offerPacket.TransactionID),
+		dhcpv4.WithHwAddr(c.hwAddr),
+		dhcpv4.WithClientIP(offerPacket.ClientIPAddr),
+		dhcpv4.WithServerIP(offerPacket.ServerIPAddr),
+		dhcpv4.WithBroadcast(c.broadcast),
+		withOptions(options),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		// the request asks for the offered address
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(offerPacket.YourIPAddr)),
+		dhcpv4.WithOptionCopied(offerPacket, dhcpv4.OptionServerIdentifier),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return requestPacket, c.send(requestPacket)
+}
 
-	return declinePacket, c.SendPacket(declinePacket)
+//Send Decline to the received acknowledgement.
+func DhcpSendDecline(c *dhcpClient, acknowledgementPacket *dhcpv4.DHCPv4, options dhcpv4.Options) (*dhcpv4.DHCPv4, error) {
+	declinePacket, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(acknowledgementPacket.ClientHWAddr),
+		withOptions(options),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeDecline),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(acknowledgementPacket.YourIPAddr)),
+		dhcpv4.WithOptionCopied(acknowledgementPacket, dhcpv4.OptionServerIdentifier),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return declinePacket, c.send(declinePacket)
 }
 
 //Lets do a Full DHCP Request.
-func DhcpRequest(c *dhcp4client.Client, options dhcp4.Options) (bool, dhcp4.Packet, error) {
+func DhcpRequest(c *dhcpClient, options dhcpv4.Options) (bool, *dhcpv4.DHCPv4, error) {
 	discoveryPacket, err := DhcpSendDiscoverPacket(c, options)
 	if err != nil {
 		return false, discoveryPacket, err
 	}
 
-	offerPacket, err := c.GetOffer(&discoveryPacket)
+	offerPacket, err := DhcpReceive(c.conn, c.timeout, discoveryPacket, dhcpv4.MessageTypeOffer)
 	if err != nil {
 		return false, offerPacket, err
 	}
 
-	requestPacket, err := DhcpSendRequest(c, options, &offerPacket)
+	requestPacket, err := DhcpSendRequest(c, options, offerPacket)
 	if err != nil {
 		return false, requestPacket, err
 	}
 
-	acknowledgement, err := c.GetAcknowledgement(&requestPacket)
+	acknowledgement, err := DhcpReceive(c.conn, c.timeout, requestPacket, dhcpv4.MessageTypeAck, dhcpv4.MessageTypeNak)
 	if err != nil {
 		return false, acknowledgement, err
 	}
 
-	acknowledgementOptions := acknowledgement.ParseOptions()
-	if dhcp4.MessageType(acknowledgementOptions[dhcp4.OptionDHCPMessageType][0]) != dhcp4.ACK {
-		return false, acknowledgement, nil
+	return acknowledgement.MessageType() == dhcpv4.MessageTypeAck, acknowledgement, nil
+}
+
+//Do a DHCP Request asking for Rapid Commit. A server supporting it answers the Discover
+//with an Acknowledgement directly, otherwise the regular exchange is completed from the Offer.
+func DhcpRapidCommitRequest(c *dhcpClient, timeout time.Duration, options dhcpv4.Options) (bool, *dhcpv4.DHCPv4, error) {
+	rapidOptions := dhcpv4.Options{dhcpv4.OptionRapidCommit.Code(): {}}
+	for opt, data := range options {
+		rapidOptions[opt] = data
 	}
 
-	return true, acknowledgement, nil
-}
+	discoveryPacket, err := DhcpSendDiscoverPacket(c, rapidOptions)
+	if err != nil {
+		return false, discoveryPacket, err
+	}
 
-//Renew a lease backed on the Acknowledgement Packet.
-//Returns Successful, The AcknowledgementPacket, Any Errors
-func DhcpRenew(c *dhcp4client.Client, acknowledgement dhcp4.Packet, options dhcp4.Options) (bool, dhcp4.Packet, error) {
-	renewRequest := c.RenewalRequestPacket(&acknowledgement)
+	reply, err := DhcpReceive(c.conn, timeout, discoveryPacket,
+		dhcpv4.MessageTypeOffer, dhcpv4.MessageTypeAck, dhcpv4.MessageTypeNak)
+	if err != nil {
+		return false, reply, err
+	}
 
-	for opt, data := range options {
-		renewRequest.AddOption(opt, data)
+	switch reply.MessageType() {
+	case dhcpv4.MessageTypeAck:
+		// an ACK to a Discover is only valid if it carries the Rapid Commit option
+		if !reply.Options.Has(dhcpv4.OptionRapidCommit) {
+			return false, reply, fmt.Errorf("DHCP server sent an ACK without Rapid Commit")
+		}
+		return true, reply, nil
+	case dhcpv4.MessageTypeNak:
+		return false, reply, nil
+	}
+
+	// The server does not support Rapid Commit, continue from the offer
+	requestPacket, err := DhcpSendRequest(c, options, reply)
+	if err != nil {
+		return false, requestPacket, err
 	}
 
-	renewRequest.PadToMinSize()
+	acknowledgement, err := DhcpReceive(c.conn, c.timeout, requestPacket, dhcpv4.MessageTypeAck, dhcpv4.MessageTypeNak)
+	if err != nil {
+		return false, acknowledgement, err
+	}
+
+	return acknowledgement.MessageType() == dhcpv4.MessageTypeAck, acknowledgement, nil
+}
+
+//Wait for a reply to the given packet with one of the given message types.
+//Unrelated and malformed packets are discarded.
+func DhcpReceive(conn dhcpConn, timeout time.Duration, request *dhcpv4.DHCPv4, msgTypes ...dhcpv4.MessageType) (*dhcpv4.DHCPv4, error) {
+	start := time.Now()
+
+	for {
+		remaining := timeout - time.Since(start)
+		if remaining < 0 {
+			return nil, &timeoutError{timeout: timeout}
+		}
+
+		conn.SetReadTimeout(remaining)
+		readBuffer, _, err := conn.ReadFrom()
+		if err != nil {
+			if errno, ok := err.(syscall.Errno); ok && errno == syscall.EAGAIN {
+				return nil, &timeoutError{timeout: timeout}
+			}
+			return nil, err
+		}
+
+		reply, err := dhcpv4.FromBytes(readBuffer)
+		if err != nil || reply.OpCode != dhcpv4.OpcodeBootReply || reply.TransactionID != request.TransactionID {
+			continue
+		}
+
+		for _, t := range msgTypes {
+			if reply.MessageType() == t {
+				return reply, nil
+			}
+		}
+	}
+}
 
-	err := c.SendPacket(renewRequest)
+//Renew a lease backed on the Acknowledgement Packet.
+//Returns Successful, The AcknowledgementPacket, Any Errors
+func DhcpRenew(c *dhcpClient, acknowledgement *dhcpv4.DHCPv4, options dhcpv4.Options) (bool, *dhcpv4.DHCPv4, error) {
+	renewRequest, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(acknowledgement.ClientHWAddr),
+		dhcpv4.WithClientIP(acknowledgement.YourIPAddr),
+		dhcpv4.WithServerIP(acknowledgement.ServerIPAddr),
+		dhcpv4.WithBroadcast(c.broadcast),
+		withOptions(options),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(acknowledgement.YourIPAddr)),
+		dhcpv4.WithOptionCopied(acknowledgement, dhcpv4.OptionServerIdentifier),
+	)
 	if err != nil {
+		return false, nil, err
+	}
+
+	if err := c.send(renewRequest); err != nil {
 		return false, renewRequest, err
 	}
 
-	newAcknowledgement, err := c.GetAcknowledgement(&renewRequest)
+	newAcknowledgement, err := DhcpReceive(c.conn, c.timeout, renewRequest, dhcpv4.MessageTypeAck, dhcpv4.MessageTypeNak)
 	if err != nil {
 		return false, newAcknowledgement, err
 	}
 
-	newAcknowledgementOptions := newAcknowledgement.ParseOptions()
-	if dhcp4.MessageType(newAcknowledgementOptions[dhcp4.OptionDHCPMessageType][0]) != dhcp4.ACK {
-		msg := newAcknowledgementOptions[dhcp4.OptionMessage]
-		return false, newAcknowledgement, fmt.Errorf("dhcp server responded: %s", msg)
+	if newAcknowledgement.MessageType() != dhcpv4.MessageTypeAck {
+		return false, newAcknowledgement, fmt.Errorf("dhcp server responded: %s", newAcknowledgement.Message())
 	}
 
 	return true, newAcknowledgement, nil
@@ -125,14 +259,42 @@ func DhcpRenew(c *dhcp4client.Client, acknowledgement dhcp4.Packet, options dhcp
 
 //Release a lease backed on the Acknowledgement Packet.
 //Returns Any Errors
-func DhcpRelease(c *dhcp4client.Client, acknowledgement dhcp4.Packet, options dhcp4.Options) error {
-	release := c.ReleasePacket(&acknowledgement)
+func DhcpRelease(c *dhcpClient, acknowledgement *dhcpv4.DHCPv4, options dhcpv4.Options) error {
+	release, err := dhcpv4.NewReleaseFromACK(acknowledgement, withOptions(options),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease),
+		dhcpv4.WithOptionCopied(acknowledgement, dhcpv4.OptionServerIdentifier))
+	if err != nil {
+		return err
+	}
 
-	for opt, data := range options {
-		release.AddOption(opt, data)
+	return c.send(release)
+}
+
+//Inform the server of an externally configured address and wait for the Acknowledgement
+//carrying the local configuration parameters.
+func DhcpInform(c *dhcpClient, hwAddr net.HardwareAddr, ciaddr net.IP, options dhcpv4.Options) (*dhcpv4.DHCPv4, error) {
+	informPacket, err := dhcpv4.NewInform(hwAddr, ciaddr.To4(),
+		// the address is not configured on the interface yet, so ask for a broadcast reply
+		dhcpv4.WithBroadcast(true),
+		withOptions(options),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeInform),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.send(informPacket); err != nil {
+		return informPacket, err
 	}
 
-	release.PadToMinSize()
+	acknowledgement, err := DhcpReceive(c.conn, c.timeout, informPacket, dhcpv4.MessageTypeAck, dhcpv4.MessageTypeNak)
+	if err != nil {
+		return acknowledgement, err
+	}
+
+	if acknowledgement.MessageType() != dhcpv4.MessageTypeAck {
+		return acknowledgement, fmt.Errorf("dhcp server responded: %s", acknowledgement.Message())
+	}
 
-	return c.SendPacket(release)
+	return acknowledgement, nil
 }
@@ -0,0 +1,84 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"strings"
+	"sync/atomic"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// Codes of the CNI errors returned for DHCP failures, so that runtimes and
+// automation can tell them apart. The spec leaves codes from 100 to plugins.
+const (
+	// no DHCP server answered, worth retrying later
+	errCodeNoOffer uint = 100
+	// the server rejected the request, e.g. for the requested address
+	errCodeNak uint = 101
+	// the plugin couldn't reach the daemon, e.g. while it restarts
+	errCodeDaemonUnreachable uint = 102
+	// the lease file couldn't be read or written
+	errCodeLeaseStore uint = 103
+)
+
+// exchangeError is the error of an exchange that ran out of tries.
+func (l *DHCPLease) exchangeError() error {
+	if atomic.LoadUint32(&l.nakd) == 1 {
+		return types.NewError(errCodeNak, "DHCP server rejected the request", l.clientID)
+	}
+	return types.NewError(errCodeNoOffer, "no DHCP server answered", l.clientID)
+}
+
+func leaseStoreError(err error) error {
+	return types.NewError(errCodeLeaseStore, "failed to access the lease store", err.Error())
+}
+
+// rpcError prepares an error returned by a CNI method for net/rpc, which
+// only passes on the text of errors: CNI errors are sent as the JSON the
+// plugin prints.
+func rpcError(err error) error {
+	var cniErr *types.Error
+	if !errors.As(err, &cniErr) {
+		return err
+	}
+	data, jsonErr := json.Marshal(cniErr)
+	if jsonErr != nil {
+		return err
+	}
+	return errors.New(string(data))
+}
+
+// callError returns the CNI error sent by rpcError, if any, or describes
+// the failure of the call.
+func callError(method string, err error) error {
+	if text := err.Error(); strings.HasPrefix(text, "{") {
+		cniErr := &types.Error{}
+		if json.Unmarshal([]byte(text), cniErr) == nil && cniErr.Code != 0 {
+			return cniErr
+		}
+	}
+	if err == rpc.ErrShutdown || err == io.ErrUnexpectedEOF {
+		// the daemon went away during the call
+		return types.NewError(errCodeDaemonUnreachable, "lost the connection to the DHCP daemon",
+			fmt.Sprintf("error calling %v: %v", method, err))
+	}
+	return fmt.Errorf("error calling %v: %v", method, err)
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestCallError(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		code uint
+		text string
+	}{{
+		name: "cni error",
+		err:  rpc.ServerError(rpcError(types.NewError(errCodeNoOffer, "no DHCP server answered", "c1/net/eth0")).Error()),
+		code: errCodeNoOffer,
+		text: "no DHCP server answered; c1/net/eth0",
+	}, {
+		name: "wrapped cni error",
+		err:  rpc.ServerError(rpcError(fmt.Errorf("eth1: %w", types.NewError(errCodeNak, "DHCP server rejected the request", ""))).Error()),
+		code: errCodeNak,
+		text: "DHCP server rejected the request",
+	}, {
+		name: "daemon gone",
+		err:  rpc.ErrShutdown,
+		code: errCodeDaemonUnreachable,
+		text: "lost the connection to the DHCP daemon; error calling DHCP.Allocate: connection is shut down",
+	}, {
+		name: "other error",
+		err:  rpc.ServerError(rpcError(errors.New("error parsing netconf: EOF")).Error()),
+		text: "error calling DHCP.Allocate: error parsing netconf: EOF",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := callError("DHCP.Allocate", tc.err)
+			var cniErr *types.Error
+			if errors.As(err, &cniErr) != (tc.code != 0) {
+				t.Fatalf("got %#v, want code %d", err, tc.code)
+			}
+			if cniErr != nil && cniErr.Code != tc.code {
+				t.Errorf("got code %d, want %d", cniErr.Code, tc.code)
+			}
+			if err.Error() != tc.text {
+				t.Errorf("got %q, want %q", err.Error(), tc.text)
+			}
+		})
+	}
+}
+
+func TestExchangeError(t *testing.T) {
+	l := &DHCPLease{clientID: "c1/net/eth0"}
+	if err := l.exchangeError().(*types.Error); err.Code != errCodeNoOffer {
+		t.Errorf("got code %d without a NAK, want %d", err.Code, errCodeNoOffer)
+	}
+	l.nakd = 1
+	if err := l.exchangeError().(*types.Error); err.Code != errCodeNak {
+		t.Errorf("got code %d after a NAK, want %d", err.Code, errCodeNak)
+	}
+}
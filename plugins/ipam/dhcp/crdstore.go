@@ -0,0 +1,225 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// DHCPLease custom resources, see k8s.yaml
+var leaseGVR = schema.GroupVersionResource{Group: "cni.dhcp", Version: "v1", Resource: "dhcpleases"}
+
+// labelLeaseNode selects the lease objects of a node.
+const labelLeaseNode = "cni.dhcp/node"
+
+const crdStoreTimeout = 30 * time.Second
+
+// crdLeaseStore keeps each lease in a DHCPLease object in the namespace of
+// its pod, so leases survive reimaging the node and are visible cluster-wide.
+// Leases without a pod are kept in the default namespace.
+type crdLeaseStore struct {
+	client   dynamic.Interface
+	nodeName string
+	// objects as last loaded or saved by name, to skip unchanged leases
+	saved map[string]*unstructured.Unstructured
+}
+
+func newCRDLeaseStore(client dynamic.Interface, nodeName string) (*crdLeaseStore, error) {
+	if nodeName == "" {
+		return nil, fmt.Errorf("the kubernetes lease store requires the NODENAME variable")
+	}
+	return &crdLeaseStore{
+		client:   client,
+		nodeName: nodeName,
+		saved:    map[string]*unstructured.Unstructured{},
+	}, nil
+}
+
+// leaseObjectName derives the object name from the client ID, which may
+// contain characters not allowed in names.
+func leaseObjectName(clientID string) string {
+	sum := sha256.Sum256([]byte(clientID))
+	return "lease-" + hex.EncodeToString(sum[:16])
+}
+
+func leaseObjectNamespace(lease *PersistedLeased) string {
+	if lease.K8sNamespace == "" {
+		return metav1.NamespaceDefault
+	}
+	return lease.K8sNamespace
+}
+
+func (s *crdLeaseStore) load() ([]PersistedLeased, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), crdStoreTimeout)
+	defer cancel()
+
+	list, err := s.client.Resource(leaseGVR).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: labelLeaseNode + "=" + s.nodeName,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list DHCPLease objects: %v", err)
+	}
+
+	var leases []PersistedLeased
+	for i := range list.Items {
+		obj := &list.Items[i]
+		lease, err := leaseFromObject(obj)
+		if err != nil {
+			// deleted when the store is rewritten
+			log.Printf("Invalid DHCPLease %s/%s: %v", obj.GetNamespace(), obj.GetName(), err)
+			lease = &PersistedLeased{}
+		}
+		leases = append(leases, *lease)
+		s.saved[obj.GetName()] = obj
+	}
+	return leases, nil
+}
+
+// save creates or updates the objects of the leases and deletes the ones of
+// leases that are gone. It tries all of them, returning the first error.
+func (s *crdLeaseStore) save(leases []PersistedLeased) error {
+	ctx, cancel := context.WithTimeout(context.Background(), crdStoreTimeout)
+	defer cancel()
+
+	var firstErr error
+	keep := map[string]bool{}
+	for i := range leases {
+		obj, err := s.leaseObject(&leases[i])
+		if err == nil {
+			err = s.put(ctx, obj)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to save lease %v: %v", leases[i].ClientID, err)
+		}
+		keep[leaseObjectName(leases[i].ClientID)] = true
+	}
+
+	for name, obj := range s.saved {
+		if keep[name] {
+			continue
+		}
+		err := s.client.Resource(leaseGVR).Namespace(obj.GetNamespace()).Delete(ctx, name, metav1.DeleteOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to delete DHCPLease %s/%s: %v", obj.GetNamespace(), name, err)
+			}
+			continue
+		}
+		delete(s.saved, name)
+	}
+	return firstErr
+}
+
+// put writes obj unless it's unchanged since the last save.
+func (s *crdLeaseStore) put(ctx context.Context, obj *unstructured.Unstructured) error {
+	resource := s.client.Resource(leaseGVR).Namespace(obj.GetNamespace())
+
+	var err error
+	var written *unstructured.Unstructured
+	if saved, ok := s.saved[obj.GetName()]; ok {
+		if equalSpec(saved, obj) {
+			return nil
+		}
+		obj.SetResourceVersion(saved.GetResourceVersion())
+		written, err = resource.Update(ctx, obj, metav1.UpdateOptions{})
+		if k8serrors.IsNotFound(err) {
+			obj.SetResourceVersion("")
+			written, err = resource.Create(ctx, obj, metav1.CreateOptions{})
+		}
+	} else {
+		written, err = resource.Create(ctx, obj, metav1.CreateOptions{})
+		if k8serrors.IsAlreadyExists(err) {
+			// left behind by an earlier daemon on this node
+			var existing *unstructured.Unstructured
+			if existing, err = resource.Get(ctx, obj.GetName(), metav1.GetOptions{}); err == nil {
+				obj.SetResourceVersion(existing.GetResourceVersion())
+				written, err = resource.Update(ctx, obj, metav1.UpdateOptions{})
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	s.saved[obj.GetName()] = written
+	return nil
+}
+
+func (s *crdLeaseStore) check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), crdStoreTimeout)
+	defer cancel()
+
+	_, err := s.client.Resource(leaseGVR).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: labelLeaseNode + "=" + s.nodeName,
+		Limit:         1,
+	})
+	return err
+}
+
+func (s *crdLeaseStore) leaseObject(lease *PersistedLeased) (*unstructured.Unstructured, error) {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return nil, err
+	}
+	// keep numbers as they are, durations don't fit in a float64
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var spec map[string]interface{}
+	if err := dec.Decode(&spec); err != nil {
+		return nil, err
+	}
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	obj.SetAPIVersion(leaseGVR.GroupVersion().String())
+	obj.SetKind("DHCPLease")
+	obj.SetName(leaseObjectName(lease.ClientID))
+	obj.SetNamespace(leaseObjectNamespace(lease))
+	obj.SetLabels(map[string]string{labelLeaseNode: s.nodeName})
+	return obj, nil
+}
+
+func leaseFromObject(obj *unstructured.Unstructured) (*PersistedLeased, error) {
+	spec, ok := obj.Object["spec"]
+	if !ok {
+		return nil, fmt.Errorf("no spec")
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	lease := &PersistedLeased{}
+	if err := json.Unmarshal(data, lease); err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+func equalSpec(a, b *unstructured.Unstructured) bool {
+	specA, _ := json.Marshal(a.Object["spec"])
+	specB, _ := json.Marshal(b.Object["spec"])
+	return string(specA) == string(specB)
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestCRDLeaseStore(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{leaseGVR: "DHCPLeaseList"})
+	store, err := newCRDLeaseStore(client, "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expire := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	leases := []PersistedLeased{
+		{ClientID: "c1/ns/eth0", K8sNamespace: "pods", K8sPodName: "web", ExpireTime: expire, Timeout: 10 * time.Second, MaxLeaseTime: 1234567890123},
+		{ClientID: "c2/ns/eth0", ExpireTime: expire},
+	}
+	if err := store.save(leases); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := client.Resource(leaseGVR).Namespace("pods").Get(context.TODO(), leaseObjectName("c1/ns/eth0"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := obj.GetLabels()[labelLeaseNode]; got != "node-a" {
+		t.Errorf("node label = %q, want node-a", got)
+	}
+	if _, err := client.Resource(leaseGVR).Namespace("default").Get(context.TODO(), leaseObjectName("c2/ns/eth0"), metav1.GetOptions{}); err != nil {
+		t.Errorf("lease without pod not in default namespace: %v", err)
+	}
+
+	// a new daemon on the node loads the leases
+	reloaded, err := newCRDLeaseStore(client, "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := reloaded.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("loaded %d leases, want 2", len(got))
+	}
+	for _, lease := range got {
+		want := leases[0]
+		if lease.ClientID != want.ClientID {
+			want = leases[1]
+		}
+		if !reflect.DeepEqual(lease, want) {
+			t.Errorf("loaded %+v, want %+v", lease, want)
+		}
+	}
+
+	other, _ := newCRDLeaseStore(client, "node-b")
+	if got, err := other.load(); err != nil || len(got) != 0 {
+		t.Errorf("other node loaded %v, %v, want no leases", got, err)
+	}
+
+	// released leases are deleted, renewed ones updated
+	leases[0].ExpireTime = expire.Add(time.Hour)
+	if err := reloaded.save(leases[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.load(); err != nil || len(got) != 1 || !got[0].ExpireTime.Equal(leases[0].ExpireTime) {
+		t.Errorf("after save loaded %+v, %v, want the renewed lease", got, err)
+	}
+	if err := reloaded.check(); err != nil {
+		t.Errorf("check() = %v", err)
+	}
+}
@@ -15,76 +15,135 @@
 package main
 
 import (
-	"context"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/coreos/go-systemd/v22/activation"
-	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"github.com/insomniacslk/dhcp/dhcpv4"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/time/rate"
 )
 
 const listenFdsStart = 3
-const savedLeaseLocation = "/run/dhcp-leases.json"
+
+const (
+	clientIDTypeContainerID = "containerID"
+	clientIDTypeMAC         = "mac"
+	clientIDTypePodHash     = "podHash"
+)
+
+const (
+	hostnamePodName          = "podName"
+	hostnamePodNameNamespace = "podName.namespace"
+	hostnameNone             = "none"
+)
+
+// default of the -lease-file flag, relative to the host root
+const defaultLeaseFile = "/run/dhcp-leases.json"
 
 var errNoMoreTries = errors.New("no more tries")
 
+// Delay before the lease store is written after a change, so the changes of
+// concurrent requests are written at once
+const persistDelay = 100 * time.Millisecond
+
 type DHCP struct {
-	mux             sync.Mutex
-	leases          map[string]*DHCPLease
+	leases *leaseMap
+	// leases loaded at startup whose netns didn't exist, see resolvePendingLeases
+	pending         *leaseMap
 	hostNetnsPrefix string
-	clientTimeout   time.Duration
-	clientResendMax time.Duration
-	broadcast       bool
-	k8sClient       v1.CoreV1Interface
+	// changed when the settings are reloaded
+	defaultsMux sync.RWMutex
+	defaults    leaseDefaults
+	k8sClient   v1.CoreV1Interface
+	// nil unless allocation backoff is enabled
+	backoff *allocationBackoff
+	// serializes operations on the same client ID
+	clientLocks keyedMutex
+	// serializes writes of the lease store
+	persistMux sync.Mutex
+	store      leaseStore
+	// set once the last write before shutdown or handover is done, so that
+	// pending writes don't overwrite it, guarded by persistMux
+	persistStopped bool
+	// signals the lease store writer, the store is written synchronously when nil
+	persistPending chan struct{}
+	// name of the node the daemon runs on, from the NODENAME variable
+	nodeName string
+	// held while maintaining leases kept in the cluster
+	nodeLock *nodeLock
+	// set when the node lock is lost, see stepDown
+	steppedDown int32
+	// addresses asked for by stableIP leases
+	stableAddresses *stableAddresses
+	// shared with all leases
+	env leaseEnv
 }
 
 type IPAMArgs struct {
 	types.CommonArgs
 	K8S_POD_NAME               types.UnmarshallableString
 	K8S_POD_NAMESPACE          types.UnmarshallableString
+	K8S_POD_UID                types.UnmarshallableString
 	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+	MAC                        types.UnmarshallableString
+	// sent as host-name instead of the pod name, e.g. the guest name of a VM
+	HOSTNAME types.UnmarshallableString
 }
 
-func newDHCP(clientTimeout, clientResendMax time.Duration, broadcast bool, k8s v1.CoreV1Interface) (*DHCP, error) {
-	leases, err := LoadSavedLeases(savedLeaseLocation, clientTimeout, clientResendMax, broadcast)
+func newDHCP(store leaseStore, defaults leaseDefaults, env leaseEnv, k8s v1.CoreV1Interface) (*DHCP, error) {
+	leases, pending, err := LoadSavedLeases(store, defaults)
 	dhcp := &DHCP{
-		leases:          make(map[string]*DHCPLease),
-		clientTimeout:   clientTimeout,
-		clientResendMax: clientResendMax,
-		k8sClient:       k8s,
+		leases:         newLeaseMap(nil),
+		pending:        newLeaseMap(nil),
+		store:          store,
+		persistPending: make(chan struct{}, 1),
+		defaults:       defaults,
+		k8sClient:      k8s,
+		env:            env,
 	}
 	if err != nil {
-		fmt.Printf("Failed to load leases: %v%n", err)
+		fmt.Printf("Failed to load leases: %v\n", err)
 	}
+	dhcp.env.reacquired = dhcp.requestPersist
 
+	// leases of pods deleted while the daemon wasn't running are released
+	// by validateLeases once the daemon is up
+	for _, val := range pending {
+		val.env = dhcp.env
+		dhcp.pending.set(val.clientID, val)
+	}
 	for _, val := range leases {
-		if val.k8sPodName != "" {
-			getOptions := metav1.GetOptions{}
-			_, err := k8s.Pods(val.k8sNamespace).Get(context.TODO(), val.k8sPodName, getOptions)
-			if k8serrors.IsNotFound(err) {
-				fmt.Printf("Pod %s wasn't found running on the cluster. Removing.\n", val.k8sPodName)
-				continue
-			} else if err != nil {
-				return nil, err
-			}
-		}
+		val.env = dhcp.env
 		dhcp.setLease(val.clientID, val)
 		err := val.StartMaintaining()
 		if err != nil {
@@ -92,10 +151,11 @@ func newDHCP(clientTimeout, clientResendMax time.Duration, broadcast bool, k8s v
 		}
 	}
 
-	err = PersistActiveLeases(savedLeaseLocation, dhcp.leases)
+	err = dhcp.persistLeases()
 	if err != nil {
 		return nil, err
 	}
+	go dhcp.runPersister()
 
 	return dhcp, nil
 }
@@ -111,6 +171,170 @@ func generateClientID(containerID string, netName string, ifName string) string
 	return clientID
 }
 
+// parseHardwareAddr returns the hardware address the exchange is performed
+// with, from CNI_ARGS or else the mac setting. It's nil when the interface's
+// own address is used.
+func parseHardwareAddr(confMAC string, args IPAMArgs) (net.HardwareAddr, error) {
+	mac := string(args.MAC)
+	if mac == "" {
+		mac = confMAC
+	}
+	if mac == "" {
+		return nil, nil
+	}
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil || len(hwAddr) != 6 {
+		return nil, fmt.Errorf("invalid mac %q", mac)
+	}
+	return hwAddr, nil
+}
+
+// linkHardwareAddr returns the hardware address of the interface in the
+// netns at path, or an error if it has none, e.g. for a tunnel or loopback.
+func linkHardwareAddr(path, ifName string) (net.HardwareAddr, error) {
+	var hwAddr net.HardwareAddr
+	err := withLeaseNetNS(path, func(ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("error looking up %q: %v", ifName, err)
+		}
+		hwAddr = link.Attrs().HardwareAddr
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(hwAddr) != 6 || bytes.Equal(hwAddr, make(net.HardwareAddr, 6)) {
+		return nil, fmt.Errorf("interface %q has no Ethernet address", ifName)
+	}
+	return hwAddr, nil
+}
+
+// generateClientIdentifier returns the client identifier option value, type
+// octet included, for the given clientIDType. A nil result means the
+// identifier is derived from the lease clientID. The "mac" type uses hwAddr,
+// the configured address or else the one of the container's interface.
+func generateClientIdentifier(idType, containerID, netName, ifName string, hwAddr net.HardwareAddr, args IPAMArgs) ([]byte, error) {
+	switch idType {
+	case "", clientIDTypeContainerID:
+		return nil, nil
+	case clientIDTypeMAC:
+		if hwAddr == nil {
+			return nil, fmt.Errorf("clientIDType %q requires the hardware address of %q", idType, ifName)
+		}
+		// type 1 is Ethernet, see RFC 1700 hardware types
+		return append([]byte{1}, hwAddr...), nil
+	case clientIDTypePodHash:
+		if args.K8S_POD_NAMESPACE == "" || args.K8S_POD_NAME == "" {
+			return nil, fmt.Errorf("clientIDType %q requires K8S_POD_NAMESPACE and K8S_POD_NAME", idType)
+		}
+		// network and interface names are included so multiple attachments of one pod don't collide
+		sum := sha256.Sum256([]byte(string(args.K8S_POD_NAMESPACE) + "/" + string(args.K8S_POD_NAME) + "/" + netName + "/" + ifName))
+		return append([]byte{0}, hex.EncodeToString(sum[:16])...), nil
+	default:
+		return nil, fmt.Errorf("unknown clientIDType %q", idType)
+	}
+}
+
+// generateHostname returns the host-name option value for a pod according to
+// the sendHostname mode. An explicit hostname from runtimeConfig or CNI_ARGS
+// replaces the pod name, unless the mode is "none". An empty result means no
+// host-name should be sent.
+func generateHostname(mode, runtimeHostname string, args IPAMArgs) (string, error) {
+	podName := string(args.K8S_POD_NAME)
+	namespace := string(args.K8S_POD_NAMESPACE)
+
+	var hostname string
+	switch mode {
+	case "", hostnamePodName:
+		hostname = podName
+	case hostnamePodNameNamespace:
+		if podName != "" && namespace != "" {
+			hostname = podName + "." + namespace
+		} else {
+			hostname = podName
+		}
+	case hostnameNone:
+		return "", nil
+	default:
+		return "", fmt.Errorf("unknown sendHostname mode %q", mode)
+	}
+	if args.HOSTNAME != "" {
+		hostname = string(args.HOSTNAME)
+	}
+	if runtimeHostname != "" {
+		hostname = runtimeHostname
+	}
+
+	// Option length is a single octet, see RFC 2132 section 3.14
+	if len(hostname) > 255 {
+		hostname = hostname[0:255]
+	}
+	return hostname, nil
+}
+
+// generateFQDN renders the FQDN template for a pod and encodes it as the
+// Client FQDN option payload. A nil result means no option should be sent.
+func generateFQDN(conf *FQDNConfig, args IPAMArgs) ([]byte, error) {
+	if conf == nil || conf.Template == "" {
+		return nil, nil
+	}
+
+	name := podTemplateReplacer(string(args.K8S_POD_NAMESPACE), string(args.K8S_POD_NAME)).Replace(conf.Template)
+	if strings.Contains(name, "{{") {
+		return nil, fmt.Errorf("unknown placeholder in FQDN template %q", conf.Template)
+	}
+
+	var flags byte
+	if conf.ServerUpdate {
+		flags |= fqdnFlagServerUpdate
+	}
+	if conf.NoServerUpdate {
+		flags |= fqdnFlagNoServerUpdate
+	}
+	if conf.Encoded {
+		flags |= fqdnFlagEncoded
+	}
+	return encodeClientFQDN(name, flags)
+}
+
+// generateAgentInfo renders the Relay Agent Information templates for a pod
+// and encodes the option payload. A nil result means no option should be
+// sent.
+func generateAgentInfo(conf *AgentInfoConfig, nodeName string, args IPAMArgs) ([]byte, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	circuitID, remoteID := conf.CircuitID, conf.RemoteID
+	if circuitID == "" {
+		circuitID = "{{nodeName}}"
+	}
+	if remoteID == "" {
+		remoteID = "{{namespace}}/{{podName}}"
+		if args.K8S_POD_NAME == "" {
+			remoteID = ""
+		}
+	}
+
+	replacer := strings.NewReplacer(
+		"{{nodeName}}", nodeName,
+		"{{podName}}", string(args.K8S_POD_NAME),
+		"{{namespace}}", string(args.K8S_POD_NAMESPACE),
+	)
+	circuitID = replacer.Replace(circuitID)
+	remoteID = replacer.Replace(remoteID)
+	if strings.Contains(circuitID+remoteID, "{{") {
+		return nil, fmt.Errorf("unknown placeholder in agentInfo template")
+	}
+
+	opt, err := encodeAgentInfo(circuitID, remoteID)
+	if err != nil || len(opt) == 0 {
+		return nil, err
+	}
+	return opt, nil
+}
+
 // Allocate acquires an IP from a DHCP server for a specified container.
 // The acquired lease will be maintained until Release() is called.
 func (d *DHCP) Allocate(args *skel.CmdArgs, result *current.Result) error {
@@ -119,141 +343,886 @@ func (d *DHCP) Allocate(args *skel.CmdArgs, result *current.Result) error {
 		return fmt.Errorf("error parsing netconf: %v", err)
 	}
 
+	_, err := d.allocate(args, &conf, result, nil)
+	return rpcError(err)
+}
+
+// AllocateWithOptions is like Allocate, but also returns the server and
+// timers of the primary address's lease and the options listed in
+// exposeOptions.
+func (d *DHCP) AllocateWithOptions(args *skel.CmdArgs, reply *AllocateReply) error {
+	conf := NetConf{}
+	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
+		return fmt.Errorf("error parsing netconf: %v", err)
+	}
+
+	reply.Result = &current.Result{CNIVersion: current.ImplementedSpecVersion}
+	l, err := d.allocate(args, &conf, reply.Result, nil)
+	if err != nil {
+		return rpcError(err)
+	}
+	reply.Lease = l.times(time.Now())
+	reply.Options, err = exposeOptions(l.ack.Options, conf.IPAM.ExposeOptions)
+	return err
+}
+
+// allocate acquires a lease for the attachment configured by conf, asking
+// for requestedIP unless it is nil, in which case the pod's requested-ip
+// annotation is used, if any. It returns the lease of the primary address.
+func (d *DHCP) allocate(args *skel.CmdArgs, conf *NetConf, result *current.Result, requestedIP net.IP) (*DHCPLease, error) {
+	if err := d.checkActive(); err != nil {
+		return nil, err
+	}
+
 	var ipamArgs IPAMArgs
 	if err := types.LoadArgs(args.Args, &ipamArgs); err != nil {
-		return fmt.Errorf("failed to parse args: %v", err)
+		return nil, fmt.Errorf("failed to parse args: %v", err)
 	}
 
 	optsRequesting, optsProviding, err := prepareOptions(args.Args, conf.IPAM.ProvideOptions, conf.IPAM.RequestOptions)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	for _, option := range conf.IPAM.ExposeOptions {
+		code, err := parseOptionName(string(option))
+		if err != nil {
+			return nil, fmt.Errorf("invalid exposeOptions entry: %v", err)
+		}
+		if _, ok := optsRequesting[code]; !ok {
+			optsRequesting[code] = false
+		}
+	}
+	if vendorClass := conf.IPAM.VendorClassIdentifier; vendorClass != "" {
+		if len(vendorClass) > 255 {
+			return nil, fmt.Errorf("vendorClassIdentifier too long: %q", vendorClass)
+		}
+		if _, ok := optsProviding[dhcpv4.OptionClassIdentifier.Code()]; !ok {
+			optsProviding[dhcpv4.OptionClassIdentifier.Code()] = []byte(vendorClass)
+		}
+	}
+
+	hostname, err := generateHostname(conf.IPAM.SendHostname, conf.RuntimeConfig.Hostname, ipamArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	fqdn, err := generateFQDN(conf.IPAM.FQDN, ipamArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	agentInfo, err := generateAgentInfo(conf.IPAM.AgentInfo, d.nodeName, ipamArgs)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := optsProviding[dhcpv4.OptionRelayAgentInformation.Code()]; !ok && agentInfo != nil {
+		optsProviding[dhcpv4.OptionRelayAgentInformation.Code()] = agentInfo
 	}
 
 	clientID := generateClientID(args.ContainerID, conf.Name, args.IfName)
 	hostNetns := d.hostNetnsPrefix + args.Netns
-	l, err := AcquireLease(clientID, hostNetns, args.IfName,
-		optsRequesting, optsProviding, ipamArgs,
-		d.clientTimeout, d.clientResendMax, d.broadcast)
+	hwAddr, err := parseHardwareAddr(conf.IPAM.MAC, ipamArgs)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	clientIDType := conf.IPAM.ClientIDType
+	if conf.IPAM.StableIP {
+		switch clientIDType {
+		case "":
+			clientIDType = clientIDTypePodHash
+		case clientIDTypeContainerID:
+			return nil, fmt.Errorf("stableIP requires a clientIDType that outlives the container")
+		}
+	}
+	idAddr := hwAddr
+	if clientIDType == clientIDTypeMAC && idAddr == nil {
+		if idAddr, err = linkHardwareAddr(hostNetns, args.IfName); err != nil {
+			return nil, err
+		}
+	}
+	clientIdentifier, err := generateClientIdentifier(clientIDType, args.ContainerID, conf.Name, args.IfName, idAddr, ipamArgs)
+	if err != nil {
+		return nil, err
 	}
 
-	ipn, err := l.IPNet()
+	defaults := d.leaseDefaults()
+	overrides, err := parseNetworkOverrides(conf.IPAM)
 	if err != nil {
-		l.Stop()
-		return err
+		return nil, err
+	}
+	minRenewalTime, maxLeaseTime := overrides.leaseTimeBounds(defaults)
+	timeout, retry, broadcast, err := overrides.resolve(defaults)
+	if err != nil {
+		return nil, err
+	}
+	if hwAddr != nil {
+		// unicast replies would be addressed to hwAddr
+		broadcast = true
 	}
 
-	d.setLease(clientID, l)
+	relay, err := parseRelayConfig(conf.IPAM.Relay)
+	if err != nil {
+		return nil, err
+	}
 
-	err = PersistActiveLeases(savedLeaseLocation, d.leases)
+	allowedServers, err := parseAllowedServers(conf.IPAM.AllowedServers)
 	if err != nil {
-		fmt.Printf("Failed to persist: %v", err)
-		return err
+		return nil, err
 	}
 
-	result.IPs = []*current.IPConfig{{
-		Address: *ipn,
-		Gateway: l.Gateway(),
-	}}
-	result.Routes = l.Routes()
+	excludeRanges, err := parseExcludeRanges(conf.IPAM.ExcludeRanges)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	fallback, err := parseFallbackConfig(conf.IPAM.Fallback)
+	if err != nil {
+		return nil, err
+	}
+
+	rogueServers, err := parseRogueServerAction(conf.IPAM.RogueServers)
+	if err != nil {
+		return nil, err
+	}
+
+	serverChange, err := parseServerChangePolicy(conf.IPAM.ServerChange)
+	if err != nil {
+		return nil, err
+	}
+
+	expiryPolicy, err := parseExpiryPolicy(conf.IPAM.ExpiryPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	routePolicy, err := parseRoutePolicy(conf.IPAM.RoutePolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	clientSocket, err := parseClientSocket(conf.IPAM.ClientSocket)
+	if err != nil {
+		return nil, err
+	}
+
+	marking, err := parsePacketMarking(conf.IPAM.DSCP, conf.IPAM.SocketPriority)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateVLAN(args.IfName, conf.IPAM.VLAN); err != nil {
+		return nil, err
+	}
+	if conf.IPAM.VLAN != 0 && conf.IPAM.Inform {
+		return nil, fmt.Errorf("vlan is not supported with inform")
+	}
+
+	if _, ok := optsRequesting[dhcpv4.OptionInterfaceMTU.Code()]; !ok && !conf.IPAM.IgnoreMTU {
+		optsRequesting[dhcpv4.OptionInterfaceMTU.Code()] = false
+	}
+
+	ifName := vlanLinkName(args.IfName, conf.IPAM.VLAN)
+	lc := leaseConfig{
+		clientID:         clientID,
+		clientIdentifier: clientIdentifier,
+		netns:            hostNetns,
+		ifName:           ifName,
+		hostname:         hostname,
+		fqdn:             fqdn,
+		optsRequesting:   optsRequesting,
+		optsProviding:    optsProviding,
+		args:             ipamArgs,
+		timeout:          timeout,
+		retry:            retry,
+		broadcast:        broadcast,
+		rapidCommit:      conf.IPAM.RapidCommit,
+		arpProbe:         conf.IPAM.ArpProbe,
+		minRenewalTime:   minRenewalTime,
+		maxLeaseTime:     maxLeaseTime,
+		relay:            relay,
+		allowedServers:   allowedServers,
+		excludeRanges:    excludeRanges,
+		fallback:         fallback,
+		network:          conf.Name,
+		rogueServers:     rogueServers,
+		serverChange:     serverChange,
+		hwAddr:           hwAddr,
+		expiryPolicy:     expiryPolicy,
+		routePolicy:      routePolicy,
+		ignoreMTU:        conf.IPAM.IgnoreMTU,
+		clientSocket:     clientSocket,
+		marking:          marking,
+		stableIP:         conf.IPAM.StableIP,
+		overrides:        overrides,
+		env:              d.env,
+	}
+
+	if conf.IPAM.Inform {
+		unlock := d.clientLocks.lock(clientID)
+		defer unlock()
+		return d.inform(conf, lc, result)
+	}
+
+	leaseIDs, err := leaseClientIDs(clientID, conf.IPAM.Addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	// the result of plugins earlier in the chain, e.g. with IPv6 addresses
+	prevResult, err := loadPrevResult(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	vlanCreated := false
+	if conf.IPAM.VLAN != 0 {
+		err := withLeaseNetNS(hostNetns, func(ns.NetNS) error {
+			var err error
+			vlanCreated, err = ensureVLANLink(args.IfName, conf.IPAM.VLAN)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if requestedIP == nil {
+		requestedIP = d.podRequestedIP(string(ipamArgs.K8S_POD_NAMESPACE), string(ipamArgs.K8S_POD_NAME))
+	}
+
+	acquire := func(clientID string, clientIdentifier []byte, requestedIP net.IP, vlanCreated bool) (*DHCPLease, *net.IPNet, error) {
+		// exchanges for other clients proceed in parallel
+		unlock := d.clientLocks.lock(clientID)
+		defer unlock()
+
+		if err := d.backoff.check(clientID); err != nil {
+			return nil, nil, err
+		}
+
+		c := lc
+		c.clientID = clientID
+		c.clientIdentifier = clientIdentifier
+		c.requestedIP = requestedIP
+		c.vlanCreated = vlanCreated
+		l, err := AcquireLease(c)
+		if err != nil {
+			d.backoff.failed(clientID)
+			d.env.events.warn(string(ipamArgs.K8S_POD_NAMESPACE), string(ipamArgs.K8S_POD_NAME), eventReasonAllocateFailed, err.Error())
+			return nil, nil, err
+		}
+
+		ipn, err := l.IPNet()
+		if err != nil {
+			l.Stop()
+			return nil, nil, err
+		}
+
+		if conf.IPAM.VLAN != 0 {
+			// the main plugin configures its own interface only
+			if err := l.inNetNS(func() error { return l.configureLink(ipn) }); err != nil {
+				l.Stop()
+				return nil, nil, fmt.Errorf("failed to configure %v on %v: %v", ipn, ifName, err)
+			}
+		}
+
+		d.backoff.succeeded(clientID)
+		if l.stableIP {
+			d.stableAddresses.leased(clientIdentifier, ipn.IP)
+		}
+		d.setLease(clientID, l)
+		return l, ipn, nil
+	}
+
+	var leases []*DHCPLease
+	for i, id := range leaseIDs {
+		identifier := clientIdentifier
+		if identifier != nil && len(leaseIDs) > 1 {
+			// the server tells the leases apart by the client identifier
+			identifier = append(append([]byte{}, identifier...), fmt.Sprintf("-%d", i)...)
+		}
+
+		ip := requestedIP
+		if ip == nil && conf.IPAM.StableIP {
+			ip = d.stableAddresses.lookup(identifier)
+		}
+		// the first lease owns the VLAN link
+		l, ipn, err := acquire(id, identifier, ip, vlanCreated && i == 0)
+		if err != nil {
+			for _, id := range leaseIDs[:i] {
+				d.removeLease(id)
+			}
+			if vlanCreated {
+				withLeaseNetNS(hostNetns, func(ns.NetNS) error {
+					return deleteVLANLink(ifName)
+				})
+			}
+			return nil, err
+		}
+		// only the first lease asks for a specific address
+		requestedIP = nil
+
+		leases = append(leases, l)
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Address: *ipn,
+			Gateway: l.Gateway(),
+		})
+	}
+
+	d.requestPersist()
+
+	// routes and options are taken from the first lease
+	result.Routes = leases[0].Routes()
+	result.DNS = leases[0].DNS()
+	if prevResult != nil {
+		mergePrevResult(result, prevResult, args.IfName)
+	}
+	if conf.IPAM.VLAN != 0 {
+		result.Interfaces = append(result.Interfaces, &current.Interface{Name: ifName, Sandbox: args.Netns})
+		for _, ipc := range result.IPs[:len(leases)] {
+			ipc.Interface = current.Int(len(result.Interfaces) - 1)
+		}
+	}
+
+	return leases[0], nil
+}
+
+// leaseClientIDs returns the client IDs of the leases acquired for an
+// attachment. With more than one address, the index is appended to the
+// attachment's client ID.
+func leaseClientIDs(clientID string, addresses int) ([]string, error) {
+	if addresses < 0 {
+		return nil, fmt.Errorf("invalid number of addresses %d", addresses)
+	}
+	if addresses <= 1 {
+		return []string{clientID}, nil
+	}
+
+	ids := make([]string, addresses)
+	for i := range ids {
+		suffix := fmt.Sprintf("-%d", i)
+		base := clientID
+		if len(base)+len(suffix) > 254 {
+			base = base[0 : 254-len(suffix)]
+		}
+		ids[i] = base + suffix
+	}
+	return ids, nil
+}
+
+// parseDurationOverride parses a duration from the ipam config, falling back
+// to the daemon-wide default when it is not set.
+func parseDurationOverride(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	dur, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if dur < 0 {
+		return 0, fmt.Errorf("duration %q is negative", value)
+	}
+	return dur, nil
+}
+
+// inform fetches options for the address assigned in prevResult and merges
+// them into it. The returned lease only carries the options and is not kept
+// for the container.
+func (d *DHCP) inform(conf *NetConf, lc leaseConfig, result *current.Result) (*DHCPLease, error) {
+	prevResult, err := loadPrevResult(conf)
+	if err != nil {
+		return nil, err
+	}
+	if prevResult == nil {
+		return nil, fmt.Errorf("inform mode requires a prevResult")
+	}
+
+	var ipc *current.IPConfig
+	for _, ip := range prevResult.IPs {
+		if ip.Address.IP.To4() != nil {
+			ipc = ip
+			break
+		}
+	}
+	if ipc == nil {
+		return nil, fmt.Errorf("prevResult has no IPv4 address to inform about")
+	}
+
+	l, err := InformLease(lc, ipc.Address.IP)
+	if err != nil {
+		return nil, err
+	}
+
+	*result = *prevResult
+	result.CNIVersion = current.ImplementedSpecVersion
+	if ipc.Gateway == nil {
+		ipc.Gateway = l.Gateway()
+	}
+	for _, route := range l.Routes() {
+		if !containsRoute(result.Routes, route) {
+			result.Routes = append(result.Routes, route)
+		}
+	}
+	mergeDNS(&result.DNS, l.DNS())
+
+	return l, nil
+}
+
+// loadPrevResult returns the prevResult of the config, nil if there is none.
+func loadPrevResult(conf *NetConf) (*current.Result, error) {
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, fmt.Errorf("could not parse prevResult: %v", err)
+	}
+	if conf.PrevResult == nil {
+		return nil, nil
+	}
+	prevResult, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert prevResult: %v", err)
+	}
+	return prevResult, nil
+}
+
+// mergePrevResult adds the addresses, routes and DNS settings of prevResult
+// that result doesn't have, e.g. IPv6 addresses configured by another plugin.
+// The acquired addresses come first and refer to ifName's entry in the
+// interfaces of prevResult, if any.
+func mergePrevResult(result, prevResult *current.Result, ifName string) {
+	var ifIndex *int
+	for i, iface := range prevResult.Interfaces {
+		if iface.Name == ifName {
+			ifIndex = current.Int(i)
+			break
+		}
+	}
+
+	ips := result.IPs
+	for _, ipc := range ips {
+		if ipc.Interface == nil {
+			ipc.Interface = ifIndex
+		}
+	}
+	for _, prev := range prevResult.IPs {
+		duplicate := false
+		for _, ipc := range result.IPs {
+			if ipc.Address.IP.Equal(prev.Address.IP) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			ips = append(ips, prev)
+		}
+	}
+
+	routes := prevResult.Routes
+	for _, route := range result.Routes {
+		if !containsRoute(routes, route) {
+			routes = append(routes, route)
+		}
+	}
+
+	dns := prevResult.DNS
+	mergeDNS(&dns, result.DNS)
+
+	result.Interfaces = prevResult.Interfaces
+	result.IPs = ips
+	result.Routes = routes
+	result.DNS = dns
+}
+
+// mergeDNS fills the settings missing in dns from other.
+func mergeDNS(dns *types.DNS, other types.DNS) {
+	if len(dns.Nameservers) == 0 {
+		dns.Nameservers = other.Nameservers
+	}
+	if dns.Domain == "" {
+		dns.Domain = other.Domain
+	}
+	if len(dns.Search) == 0 {
+		dns.Search = other.Search
+	}
+}
+
+func containsRoute(routes []*types.Route, route *types.Route) bool {
+	for _, r := range routes {
+		if r.Dst.String() == route.Dst.String() && r.GW.Equal(route.GW) {
+			return true
+		}
+	}
+	return false
 }
 
 // Release stops maintenance of the lease acquired in Allocate()
 // and sends a release msg to the DHCP server.
 func (d *DHCP) Release(args *skel.CmdArgs, reply *struct{}) error {
+	if err := d.checkActive(); err != nil {
+		return err
+	}
+
+	conf := NetConf{}
+	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
+		return fmt.Errorf("error parsing netconf: %v", err)
+	}
+
+	clientID := generateClientID(args.ContainerID, conf.Name, args.IfName)
+	leaseIDs, err := leaseClientIDs(clientID, conf.IPAM.Addresses)
+	if err != nil {
+		return err
+	}
+	// the subinterface is deleted with the primary lease's address
+	primary := d.getLease(clientID)
+	for _, id := range leaseIDs {
+		d.removeLease(id)
+	}
+	if primary != nil && primary.vlanCreated {
+		if err := primary.inNetNS(func() error { return deleteVLANLink(primary.linkName()) }); err != nil {
+			log.Printf("%v: failed to delete %v: %v", clientID, primary.linkName(), err)
+		}
+	}
+
+	return nil
+}
+
+// Check verifies that the leases acquired in Allocate() are still valid: they
+// haven't expired or been NAK'd, and their addresses are configured on the
+// interface.
+func (d *DHCP) Check(args *skel.CmdArgs, reply *struct{}) error {
 	conf := NetConf{}
 	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
 		return fmt.Errorf("error parsing netconf: %v", err)
 	}
+	if conf.IPAM.Inform {
+		// no lease is kept in inform mode
+		return nil
+	}
 
 	clientID := generateClientID(args.ContainerID, conf.Name, args.IfName)
+	leaseIDs, err := leaseClientIDs(clientID, conf.IPAM.Addresses)
+	if err != nil {
+		return err
+	}
+	for _, id := range leaseIDs {
+		if err := d.checkLease(id, d.hostNetnsPrefix+args.Netns, vlanLinkName(args.IfName, conf.IPAM.VLAN)); err != nil {
+			return rpcError(err)
+		}
+	}
+	return nil
+}
+
+// checkLease checks a single lease of the attachment.
+func (d *DHCP) checkLease(clientID, netns, ifName string) error {
+	l := d.getLease(clientID)
+	if l == nil {
+		return fmt.Errorf("no lease found for %v", clientID)
+	}
+	if !l.infinite && time.Now().After(l.expireTime) {
+		return fmt.Errorf("lease for %v expired at %v", clientID, l.expireTime)
+	}
+	if atomic.LoadUint32(&l.nakd) == 1 {
+		return types.NewError(errCodeNak, "DHCP server rejected the lease", clientID)
+	}
+
+	ip := l.ack.YourIPAddr
+	return ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("error looking up %q: %v", ifName, err)
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return fmt.Errorf("failed to list addresses of %q: %v", ifName, err)
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return nil
+			}
+		}
+		return fmt.Errorf("leased address %v is not configured on %q", ip, ifName)
+	})
+}
+
+// removeLease stops maintaining the lease, which releases it, and forgets it.
+func (d *DHCP) removeLease(clientID string) {
+	unlock := d.clientLocks.lock(clientID)
+	defer unlock()
+
 	if l := d.getLease(clientID); l != nil {
 		l.Stop()
+		if l.stableIP {
+			d.stableAddresses.released(l.clientIdentifier, l.ack.YourIPAddr)
+		}
 		d.clearLease(clientID)
+	} else if d.pending != nil && d.pending.get(clientID) != nil {
+		d.pending.delete(clientID)
+		d.requestPersist()
 	}
-
-	return nil
 }
 
 func (d *DHCP) getLease(clientID string) *DHCPLease {
-	d.mux.Lock()
-	defer d.mux.Unlock()
+	// TODO(eyakubovich): hash it to avoid collisions
+	return d.leases.get(clientID)
+}
 
+func (d *DHCP) setLease(clientID string, l *DHCPLease) {
+	// TODO(eyakubovich): hash it to avoid collisions
+	d.leases.set(clientID, l)
+}
+
+// func (d *DHCP) clearLease(contID, netName, ifName string) {
+func (d *DHCP) clearLease(clientID string) {
 	// TODO(eyakubovich): hash it to avoid collisions
-	l, ok := d.leases[clientID]
-	if !ok {
+	d.leases.delete(clientID)
+	d.requestPersist()
+}
+
+// persistLeases writes the lease store. The lease table is only locked to
+// take a copy, not during the write.
+func (d *DHCP) persistLeases() error {
+	d.persistMux.Lock()
+	defer d.persistMux.Unlock()
+	return d.writeLeases()
+}
+
+// writeLeases writes the lease store, with persistMux held.
+func (d *DHCP) writeLeases() error {
+	if d.persistStopped {
 		return nil
 	}
-	return l
+	if d.checkActive() != nil {
+		// the store belongs to the daemon taking over
+		return nil
+	}
+
+	leases := d.leases.all()
+	if d.pending != nil {
+		// kept until their netns shows up or the grace period ends
+		for clientID, l := range d.pending.all() {
+			if _, ok := leases[clientID]; !ok {
+				leases[clientID] = l
+			}
+		}
+	}
+	return PersistActiveLeases(d.store, leases)
 }
 
-func (d *DHCP) setLease(clientID string, l *DHCPLease) {
-	d.mux.Lock()
-	defer d.mux.Unlock()
+// requestPersist has the lease store written by runPersister, or right away
+// if it's not running.
+func (d *DHCP) requestPersist() {
+	if d.env.oneShot {
+		// oneShotCall writes the store once the call succeeded
+		return
+	}
+	if d.persistPending == nil {
+		// stdout carries the CNI result without the daemon
+		if err := d.persistLeases(); err != nil {
+			log.Printf("Failed to persist: %v", err)
+		}
+		return
+	}
+	select {
+	case d.persistPending <- struct{}{}:
+	default:
+		// a write is pending already
+	}
+}
 
-	// TODO(eyakubovich): hash it to avoid collisions
-	d.leases[clientID] = l
+// runPersister writes the lease store after changes, at most once per
+// persistDelay, so requests don't wait for it.
+func (d *DHCP) runPersister() {
+	for range d.persistPending {
+		time.Sleep(persistDelay)
+		if err := d.persistLeases(); err != nil {
+			log.Printf("Failed to persist: %v", err)
+		}
+	}
 }
 
-//func (d *DHCP) clearLease(contID, netName, ifName string) {
-func (d *DHCP) clearLease(clientID string) {
-	d.mux.Lock()
-	defer d.mux.Unlock()
+// flushPersist writes the pending changes to the lease store right away,
+// on shutdown, and drops the writes requested afterwards.
+func (d *DHCP) flushPersist() {
+	d.persistMux.Lock()
+	defer d.persistMux.Unlock()
 
-	// TODO(eyakubovich): hash it to avoid collisions
-	delete(d.leases, clientID)
+	if err := d.writeLeases(); err != nil {
+		log.Printf("Failed to persist: %v", err)
+	}
+	d.persistStopped = true
+}
 
-	err := PersistActiveLeases(savedLeaseLocation, d.leases)
-	if err != nil {
-		fmt.Printf("Failed to persist: %v", err)
+// releaseAll stops maintenance of all leases, sends a release msg for each
+// of them and removes them from the persisted store.
+func (d *DHCP) releaseAll() {
+	leases := d.leases.takeAll()
+
+	var wg sync.WaitGroup
+	for _, l := range leases {
+		wg.Add(1)
+		go func(l *DHCPLease) {
+			defer wg.Done()
+			l.Stop()
+		}(l)
 	}
+	wg.Wait()
+
+	d.flushPersist()
 }
 
-func getListener(socketPath string) (net.Listener, error) {
-	l, err := activation.Listeners()
+// daemonListeners are the sockets the daemon serves.
+type daemonListeners struct {
+	// the RPC API, on unix sockets only so that callers can be identified
+	rpc []net.Listener
+	// the health endpoints
+	health []net.Listener
+}
+
+// FileDescriptorName values of activation sockets selecting what they serve
+const (
+	activationNameRPC    = "rpc"
+	activationNameHealth = "health"
+)
+
+func getListeners(socketPath string, access *socketAccess) (*daemonListeners, error) {
+	named, err := activation.ListenersWithNames()
 	if err != nil {
 		return nil, err
 	}
+	if len(named) > 0 {
+		return sortActivationListeners(named)
+	}
 
-	switch {
-	case len(l) == 0:
-		if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
-			return nil, err
-		}
-		return net.Listen("unix", socketPath)
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := access.apply(socketPath); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %v", err)
+	}
+	return &daemonListeners{rpc: []net.Listener{listener}}, nil
+}
 
-	case len(l) == 1:
-		if l[0] == nil {
-			return nil, fmt.Errorf("LISTEN_FDS=1 but no FD found")
+// sortActivationListeners assigns the sockets passed by systemd by their
+// FileDescriptorName, "rpc" or "health", or else by type: unix sockets
+// serve the RPC API and TCP sockets the health endpoints.
+func sortActivationListeners(named map[string][]net.Listener) (*daemonListeners, error) {
+	listeners := &daemonListeners{}
+	for name, ls := range named {
+		for _, l := range ls {
+			_, isUnix := l.(*net.UnixListener)
+			switch {
+			case name == activationNameHealth || name != activationNameRPC && !isUnix:
+				listeners.health = append(listeners.health, l)
+			case isUnix:
+				listeners.rpc = append(listeners.rpc, l)
+			default:
+				return nil, fmt.Errorf("socket %q is not a unix socket, the RPC API can't be served on it", name)
+			}
 		}
-		return l[0], nil
-
-	default:
-		return nil, fmt.Errorf("Too many (%v) FDs passed through socket activation", len(l))
 	}
+	if len(listeners.rpc) == 0 {
+		return nil, fmt.Errorf("no unix socket for the RPC API passed through socket activation")
+	}
+	return listeners, nil
 }
 
-func runDaemon(
-	pidfilePath, hostPrefix, socketPath string,
-	dhcpClientTimeout time.Duration, resendMax time.Duration, broadcast bool,
-) error {
+// daemonConfig holds the settings the daemon is started with, from its flags.
+type daemonConfig struct {
+	pidfilePath          string
+	hostPrefix           string
+	socketPath           string
+	leaseFile            string
+	timeout              time.Duration
+	resendMax            time.Duration
+	broadcast            bool
+	minRenewal           time.Duration
+	maxLease             time.Duration
+	releaseOnExit        bool
+	standby              bool
+	takeover             bool
+	eventWebhookURL      string
+	healthAddress        string
+	healthMaxExchangeAge time.Duration
+	gcInterval           time.Duration
+	watchPods            bool
+	rateLimit            float64
+	rateBurst            int
+	backoffBase          time.Duration
+	backoffMax           time.Duration
+	annotatePods         bool
+	leaseStoreType       string
+	pendingGrace         time.Duration
+	socketAccess         *socketAccess
+	auth                 *rpcAuth
+	hostInterfaces       []string
+	configFile           string
+	heartbeatInterval    time.Duration
+	unavailableAfter     int
+	stableIPRetention    time.Duration
+	renewalJitter        float64
+	traceTransactions    int
+}
+
+func runDaemon(c daemonConfig) error {
 	// since other goroutines (on separate threads) will change namespaces,
 	// ensure the RPC server does not get scheduled onto those
 	runtime.LockOSThread()
 
+	var err error
+	if hostNetNS, err = ns.GetCurrentNS(); err != nil {
+		return fmt.Errorf("failed to get daemon network namespace: %v", err)
+	}
+
 	// Write the pidfile
-	if pidfilePath != "" {
-		if !filepath.IsAbs(pidfilePath) {
-			return fmt.Errorf("Error writing pidfile %q: path not absolute", pidfilePath)
+	if c.pidfilePath != "" {
+		if !filepath.IsAbs(c.pidfilePath) {
+			return fmt.Errorf("Error writing pidfile %q: path not absolute", c.pidfilePath)
+		}
+		if err := ioutil.WriteFile(c.pidfilePath, []byte(fmt.Sprintf("%d", os.Getpid())), 0644); err != nil {
+			return fmt.Errorf("Error writing pidfile %q: %v", c.pidfilePath, err)
 		}
-		if err := ioutil.WriteFile(pidfilePath, []byte(fmt.Sprintf("%d", os.Getpid())), 0644); err != nil {
-			return fmt.Errorf("Error writing pidfile %q: %v", pidfilePath, err)
+	}
+
+	var handedOver *handover
+	if c.takeover {
+		if handedOver, err = receiveHandover(c.hostPrefix + c.socketPath); err != nil {
+			log.Printf("Socket handover failed, asking the active daemon to persist its leases: %v", err)
+			if err := requestHandover(c.hostPrefix+c.socketPath, c.auth.token); err != nil {
+				log.Printf("Handover failed, waiting for the active daemon to exit: %v", err)
+			}
+		}
+	}
+
+	// like the socket, the lease file is relative to the host root
+	c.leaseFile = c.hostPrefix + c.leaseFile
+	storeLock, err := acquireStoreLock(storeLockPath(c.leaseFile), c.standby || c.takeover)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Close()
+
+	if (c.standby || c.takeover) && os.Getenv("LISTEN_FDS") == "" && handedOver == nil {
+		// the previous daemon may have left its socket behind
+		if err := os.Remove(c.hostPrefix + c.socketPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale socket: %v", err)
 		}
 	}
 
+	env := leaseEnv{
+		renewalJitter: c.renewalJitter,
+		// created even when disabled, so tracing can be enabled by reloading the config
+		trace: newTransactionLog(c.traceTransactions),
+	}
+	if c.eventWebhookURL != "" {
+		env.webhook = newEventWebhook(c.eventWebhookURL)
+	}
+	if c.rateLimit > 0 {
+		env.limiter = rate.NewLimiter(rate.Limit(c.rateLimit), c.rateBurst)
+	}
+
 	config, err := rest.InClusterConfig()
 
 	if err != nil {
@@ -265,25 +1234,163 @@ func runDaemon(
 		return fmt.Errorf("couldn't create Kubernetes client: %v", err)
 	}
 
-	l, err := getListener(hostPrefix + socketPath)
-	if err != nil {
+	env.events = newPodEventRecorder(clientset, os.Getenv("NODENAME"))
+	if c.annotatePods {
+		env.annotations = &podAnnotator{pods: clientset.CoreV1()}
+	}
+
+	var listeners *daemonListeners
+	if handedOver != nil {
+		listeners = &daemonListeners{rpc: handedOver.listeners}
+	} else if listeners, err = getListeners(c.hostPrefix+c.socketPath, c.socketAccess); err != nil {
 		return fmt.Errorf("Error getting listener: %v", err)
 	}
+	// handed over to the next daemon, unlike the wrappers
+	unixListeners := append([]net.Listener{}, listeners.rpc...)
+	for i, l := range listeners.rpc {
+		listeners.rpc[i] = &peerCredListener{Listener: l, access: c.socketAccess}
+	}
+
+	var store leaseStore = &fileLeaseStore{path: c.leaseFile}
+	var lock *nodeLock
+	if c.leaseStoreType == leaseStoreKubernetes {
+		dynamicClient, err := dynamic.NewForConfig(config)
+		if err != nil {
+			return fmt.Errorf("couldn't create Kubernetes client: %v", err)
+		}
+		if store, err = newCRDLeaseStore(dynamicClient, os.Getenv("NODENAME")); err != nil {
+			return err
+		}
+		lockNamespace := os.Getenv("POD_NAMESPACE")
+		if lockNamespace == "" {
+			lockNamespace = metav1.NamespaceSystem
+		}
+		lock = newNodeLock(clientset.CoordinationV1().Leases(lockNamespace), os.Getenv("NODENAME"))
+		if err := lock.acquire(c.standby || c.takeover); err != nil {
+			return err
+		}
+	} else if c.leaseStoreType != leaseStoreFile {
+		return fmt.Errorf("unknown lease store %q", c.leaseStoreType)
+	}
+	if handedOver != nil && handedOver.leases != nil {
+		store = &handedOverStore{leaseStore: store, leases: handedOver.leases}
+	}
 
-	dhcp, err := newDHCP(dhcpClientTimeout, resendMax, broadcast, clientset.CoreV1())
+	reloader := &settingsReloader{
+		path: c.configFile,
+		flags: daemonSettings{
+			defaults: leaseDefaults{
+				timeout:        c.timeout,
+				resendMax:      c.resendMax,
+				broadcast:      c.broadcast,
+				minRenewalTime: c.minRenewal,
+				maxLeaseTime:   c.maxLease,
+			},
+			socketAllowedUIDs: c.socketAccess.allowedUIDs,
+			cniAllowedUIDs:    c.auth.allowedUIDs,
+			traceTransactions: c.traceTransactions,
+		},
+		socket: c.socketAccess,
+		auth:   c.auth,
+	}
+	settings, err := reloader.read()
 	if err != nil {
 		return err
 	}
-	dhcp.hostNetnsPrefix = hostPrefix
-	dhcp.broadcast = broadcast
+
+	dhcp, err := newDHCP(store, settings.defaults, env, clientset.CoreV1())
+	if err != nil {
+		return err
+	}
+	dhcp.hostNetnsPrefix = c.hostPrefix
+	dhcp.nodeLock = lock
+	if lock != nil {
+		go func() {
+			<-lock.lost
+			dhcp.stepDown()
+		}()
+	}
+	dhcp.nodeName = os.Getenv("NODENAME")
+	dhcp.stableAddresses = loadStableAddresses(stableAddressesPath(c.leaseFile), c.stableIPRetention)
+	reloader.dhcp = dhcp
+	reloader.apply(settings)
+	reloader.reloadOnSIGHUP()
+	if c.backoffBase > 0 {
+		dhcp.backoff = newAllocationBackoff(c.backoffBase, c.backoffMax)
+	}
+
+	go dhcp.validateLeases()
+	go dhcp.resolvePendingLeases(c.pendingGrace)
+	dhcp.maintainHostInterfaces(c.hostInterfaces)
 
 	if err = SetNodeIsOfflineState(clientset, false); err != nil {
 		return err
 	}
+	if c.heartbeatInterval > 0 {
+		heartbeat := &nodeHeartbeat{
+			nodes:            clientset.CoreV1().Nodes(),
+			nodeName:         os.Getenv("NODENAME"),
+			interval:         c.heartbeatInterval,
+			failureThreshold: int64(c.unavailableAfter),
+		}
+		go heartbeat.run()
+	}
 	fmt.Println("Daemon ready to receive requests")
 
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigCh
+		if c.releaseOnExit {
+			log.Printf("Received %v, releasing all leases", sig)
+			dhcp.releaseAll()
+		} else {
+			log.Printf("Received %v, exiting", sig)
+			dhcp.flushPersist()
+		}
+		if lock != nil {
+			lock.release()
+		}
+		os.Exit(0)
+	}()
+
+	if c.gcInterval > 0 {
+		go dhcp.runLeaseGC(c.gcInterval)
+	}
+	if c.watchPods {
+		dhcp.watchPodDeletions(clientset, os.Getenv("NODENAME"), make(chan struct{}))
+	}
+
 	rpc.Register(dhcp)
-	rpc.HandleHTTP()
-	http.Serve(l, nil)
-	return nil
+	conns := &rpcConns{}
+	http.Handle(rpc.DefaultRPCPath, &rpcHandler{server: rpc.DefaultServer, auth: c.auth, conns: conns})
+	handoverHandler := &handoverHandler{dhcp: dhcp, conns: conns, listeners: unixListeners, exit: dhcp.exitAfterHandover}
+	http.Handle(handoverPath, handoverHandler)
+	health := &healthChecker{
+		dhcp: dhcp,
+		// the path of a socket passed by systemd may differ from -socketpath
+		socketPath:     listeners.rpc[0].Addr().String(),
+		store:          store,
+		maxExchangeAge: c.healthMaxExchangeAge,
+	}
+	if c.healthAddress != "" {
+		serveHealth(c.healthAddress, health)
+	}
+	for _, l := range listeners.health {
+		serveHealthOn(l, health)
+	}
+	// DELs connect from now on, those that couldn't before are in the journal
+	go dhcp.replayReleaseJournal(releaseJournalPath(c.hostPrefix + c.socketPath))
+	// the listeners are open and the saved leases are loaded at this point
+	notifyReady()
+	startWatchdog(health.checkAlive)
+	for _, l := range listeners.rpc[1:] {
+		go conns.serve(l, nil)
+	}
+	err = conns.serve(listeners.rpc[0], nil)
+	if handoverHandler.isStarted() {
+		// the listeners were closed for the handover, which exits when done
+		select {}
+	}
+	return err
 }
@@ -0,0 +1,244 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+func TestLeaseClientIDs(t *testing.T) {
+	long := strings.Repeat("x", 254)
+	tests := []struct {
+		name      string
+		clientID  string
+		addresses int
+		want      []string
+		wantErr   bool
+	}{
+		{"default", "c/net/eth0", 0, []string{"c/net/eth0"}, false},
+		{"single", "c/net/eth0", 1, []string{"c/net/eth0"}, false},
+		{"multiple", "c/net/eth0", 3, []string{"c/net/eth0-0", "c/net/eth0-1", "c/net/eth0-2"}, false},
+		{"truncated", long, 2, []string{long[:252] + "-0", long[:252] + "-1"}, false},
+		{"negative", "c/net/eth0", -1, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := leaseClientIDs(tt.clientID, tt.addresses)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("leaseClientIDs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("leaseClientIDs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHardwareAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		confMAC string
+		argsMAC string
+		want    string
+		wantErr bool
+	}{
+		{name: "interface address"},
+		{name: "config", confMAC: "02:00:00:00:00:01", want: "02:00:00:00:00:01"},
+		{name: "CNI_ARGS take precedence", confMAC: "02:00:00:00:00:01", argsMAC: "02:00:00:00:00:02", want: "02:00:00:00:00:02"},
+		{name: "invalid", confMAC: "02:00:00:00:00", wantErr: true},
+		{name: "not ethernet", argsMAC: "00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := IPAMArgs{}
+			args.MAC.UnmarshalText([]byte(tt.argsMAC))
+			got, err := parseHardwareAddr(tt.confMAC, args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHardwareAddr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want == "" && got != nil || tt.want != "" && got.String() != tt.want {
+				t.Errorf("parseHardwareAddr() = %v, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinkHardwareAddr(t *testing.T) {
+	if _, err := linkHardwareAddr("/proc/self/ns/net", "lo"); err == nil {
+		t.Errorf("linkHardwareAddr() accepted the loopback address")
+	}
+	if _, err := linkHardwareAddr("/proc/self/ns/net", "missing0"); err == nil {
+		t.Errorf("linkHardwareAddr() accepted a missing interface")
+	}
+}
+
+func TestGenerateClientIdentifier(t *testing.T) {
+	args := IPAMArgs{}
+	args.K8S_POD_NAME.UnmarshalText([]byte("web-0"))
+	args.K8S_POD_NAMESPACE.UnmarshalText([]byte("ns"))
+	hwAddr, _ := net.ParseMAC("02:00:00:00:00:01")
+
+	gen := func(idType, containerID, ifName string, hwAddr net.HardwareAddr, args IPAMArgs) []byte {
+		t.Helper()
+		id, err := generateClientIdentifier(idType, containerID, "net", ifName, hwAddr, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	if id := gen("", "c1", "eth0", hwAddr, args); id != nil {
+		t.Errorf("default identifier = %x, want nil", id)
+	}
+	if id := gen("containerID", "c1", "eth0", hwAddr, args); id != nil {
+		t.Errorf("containerID identifier = %x, want nil", id)
+	}
+
+	if id := gen("mac", "c1", "eth0", hwAddr, args); !bytes.Equal(id, append([]byte{1}, hwAddr...)) {
+		t.Errorf("mac identifier = %x, want the configured address", id)
+	}
+	if _, err := generateClientIdentifier("mac", "c1", "net", "eth0", nil, args); err == nil {
+		t.Errorf("mac identifier accepted without a hardware address")
+	}
+
+	hash := gen("podHash", "c1", "eth0", nil, args)
+	if hash[0] != 0 || len(hash) != 33 {
+		t.Errorf("podHash identifier = %x, want a type 0 hex hash", hash)
+	}
+	if id := gen("podHash", "c2", "eth0", nil, args); !bytes.Equal(id, hash) {
+		t.Errorf("podHash identifier depends on the container ID")
+	}
+	if _, err := generateClientIdentifier("podHash", "c1", "net", "eth0", nil, IPAMArgs{}); err == nil {
+		t.Errorf("podHash accepted without pod name")
+	}
+	if _, err := generateClientIdentifier("uuid", "c1", "net", "eth0", nil, args); err == nil {
+		t.Errorf("unknown clientIDType accepted")
+	}
+}
+
+func TestGenerateHostname(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		runtime  string
+		argsName string
+		want     string
+	}{
+		{name: "pod name", want: "web-0"},
+		{name: "namespace", mode: "podName.namespace", want: "web-0.ns"},
+		{name: "CNI_ARGS", mode: "podName.namespace", argsName: "guest", want: "guest"},
+		{name: "runtimeConfig takes precedence", runtime: "vm1", argsName: "guest", want: "vm1"},
+		{name: "none", mode: "none", runtime: "vm1", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := IPAMArgs{}
+			args.K8S_POD_NAME.UnmarshalText([]byte("web-0"))
+			args.K8S_POD_NAMESPACE.UnmarshalText([]byte("ns"))
+			args.HOSTNAME.UnmarshalText([]byte(tt.argsName))
+			got, err := generateHostname(tt.mode, tt.runtime, args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("generateHostname() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergePrevResult(t *testing.T) {
+	mustCIDR := func(s string) net.IPNet {
+		ip, ipn, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipn.IP = ip
+		return *ipn
+	}
+	defaultRoute := types.Route{Dst: mustCIDR("0.0.0.0/0"), GW: net.ParseIP("192.168.1.1")}
+	v6Route := types.Route{Dst: mustCIDR("::/0"), GW: net.ParseIP("fd00::1")}
+
+	prevResult := &current.Result{
+		Interfaces: []*current.Interface{{Name: "host0"}, {Name: "eth0", Sandbox: "/var/run/netns/pod"}},
+		IPs: []*current.IPConfig{
+			{Interface: current.Int(1), Address: mustCIDR("fd00::10/64")},
+			{Interface: current.Int(1), Address: mustCIDR("192.168.1.10/24")},
+		},
+		Routes: []*types.Route{&v6Route},
+		DNS:    types.DNS{Nameservers: []string{"fd00::53"}},
+	}
+	result := &current.Result{
+		IPs:    []*current.IPConfig{{Address: mustCIDR("192.168.1.10/24"), Gateway: net.ParseIP("192.168.1.1")}},
+		Routes: []*types.Route{&defaultRoute},
+		DNS:    types.DNS{Nameservers: []string{"192.168.1.53"}, Domain: "example.com"},
+	}
+
+	mergePrevResult(result, prevResult, "eth0")
+
+	want := &current.Result{
+		Interfaces: prevResult.Interfaces,
+		IPs: []*current.IPConfig{
+			{Interface: current.Int(1), Address: mustCIDR("192.168.1.10/24"), Gateway: net.ParseIP("192.168.1.1")},
+			{Interface: current.Int(1), Address: mustCIDR("fd00::10/64")},
+		},
+		Routes: []*types.Route{&v6Route, &defaultRoute},
+		DNS:    types.DNS{Nameservers: []string{"fd00::53"}, Domain: "example.com"},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("mergePrevResult() = %v, want %v", result, want)
+	}
+}
+
+func TestInformPrevResult(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		wantErr string
+	}{
+		{
+			name:    "no prevResult",
+			conf:    `{"cniVersion": "1.0.0", "name": "net", "type": "dhcp", "ipam": {"inform": true}}`,
+			wantErr: "inform mode requires a prevResult",
+		},
+		{
+			name: "no IPv4 address",
+			conf: `{"cniVersion": "1.0.0", "name": "net", "type": "dhcp", "ipam": {"inform": true},
+				"prevResult": {"cniVersion": "1.0.0", "ips": [{"address": "fd00::10/64"}]}}`,
+			wantErr: "prevResult has no IPv4 address to inform about",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &NetConf{}
+			if err := json.Unmarshal([]byte(tt.conf), conf); err != nil {
+				t.Fatal(err)
+			}
+			d := &DHCP{}
+			_, err := d.inform(conf, leaseConfig{clientID: "c/net/eth0", ifName: "eth0"}, &current.Result{})
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("inform() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+func parseExcludeRanges(ranges []string) ([]*net.IPNet, error) {
+	var excluded []*net.IPNet
+	for _, r := range ranges {
+		_, ipn, err := net.ParseCIDR(r)
+		if err != nil || ipn.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid exclude range %q", r)
+		}
+		excluded = append(excluded, ipn)
+	}
+	return excluded, nil
+}
+
+// excludedRange returns the range ip falls in, nil if it is not excluded.
+func excludedRange(ranges []*net.IPNet, ip net.IP) *net.IPNet {
+	for _, ipn := range ranges {
+		if ipn.Contains(ip) {
+			return ipn
+		}
+	}
+	return nil
+}
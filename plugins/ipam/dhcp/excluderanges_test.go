@@ -0,0 +1,51 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseExcludeRanges(t *testing.T) {
+	ranges, err := parseExcludeRanges([]string{"10.0.0.0/28", "10.0.1.5/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		ip       string
+		excluded string
+	}{
+		{"10.0.0.1", "10.0.0.0/28"},
+		{"10.0.0.15", "10.0.0.0/28"},
+		{"10.0.0.16", ""},
+		{"10.0.1.5", "10.0.1.5/32"},
+		{"10.0.1.6", ""},
+	} {
+		got := ""
+		if r := excludedRange(ranges, net.ParseIP(tc.ip)); r != nil {
+			got = r.String()
+		}
+		if got != tc.excluded {
+			t.Errorf("%s: excluded by %q, expected %q", tc.ip, got, tc.excluded)
+		}
+	}
+
+	for _, r := range []string{"10.0.0.1", "fd00::/64", "10.0.0.0/33"} {
+		if _, err := parseExcludeRanges([]string{r}); err == nil {
+			t.Errorf("%s: no error", r)
+		}
+	}
+}
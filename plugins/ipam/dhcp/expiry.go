@@ -0,0 +1,149 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// the interface is brought down when the lease expires
+	expiryPolicyDown = "down"
+	// the address is removed and a new lease acquired
+	expiryPolicyReacquire = "reacquire"
+	// the address stays on the interface while rebinding goes on
+	expiryPolicyKeep = "keep"
+	// the address is removed and the lease no longer maintained
+	expiryPolicyRemove = "remove"
+	// the pod is deleted, so that its controller replaces it
+	expiryPolicyEvict = "evict"
+)
+
+// how long to wait before trying to get a new lease again after expiry
+const reacquireRetryInterval = 10 * time.Second
+
+func parseExpiryPolicy(policy string) (string, error) {
+	switch policy {
+	case "", expiryPolicyDown:
+		return expiryPolicyDown, nil
+	case expiryPolicyReacquire, expiryPolicyKeep, expiryPolicyRemove, expiryPolicyEvict:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown expiryPolicy %q", policy)
+	}
+}
+
+// removeAddress removes the address of the expired lease from the link, so
+// the pod stops using it. It must be called in the link's namespace.
+func (l *DHCPLease) removeAddress() {
+	ipn, err := l.IPNet()
+	if err != nil {
+		return
+	}
+	err = netlink.AddrDel(l.link, &netlink.Addr{IPNet: ipn})
+	if err != nil && err != syscall.EADDRNOTAVAIL {
+		log.Printf("%v: failed to remove %v from %v: %v", l.clientID, ipn, l.link.Attrs().Name, err)
+	}
+}
+
+// expire applies the policies that stop maintaining the lease, once it
+// expired. It must be called in the link's namespace.
+func (l *DHCPLease) expire() {
+	switch l.expiryPolicy {
+	case expiryPolicyRemove:
+		log.Printf("%v: lease expired, removing the address", l.clientID)
+		l.removeAddress()
+		l.expiryEvent("the address was removed")
+		return
+	case expiryPolicyEvict:
+		if l.env.events.deletePod(l.k8sNamespace, l.k8sPodName, eventReasonLeaseExpired, l.expiryMessage("deleting the pod")) {
+			log.Printf("%v: lease expired, deleting pod %s/%s", l.clientID, l.k8sNamespace, l.k8sPodName)
+			return
+		}
+		log.Printf("%v: lease expired, but the pod can't be deleted without a Kubernetes client", l.clientID)
+	}
+	log.Printf("%v: lease expired, bringing interface DOWN", l.clientID)
+	l.downIface()
+	l.expiryEvent("the interface was brought down")
+}
+
+func (l *DHCPLease) expiryMessage(action string) string {
+	return fmt.Sprintf("lease of %v expired, %s", l.ack.YourIPAddr, action)
+}
+
+// expiryEvent tells the pod's owner that the lease expired and what was
+// done about it.
+func (l *DHCPLease) expiryEvent(action string) {
+	l.env.events.warn(l.k8sNamespace, l.k8sPodName, eventReasonLeaseExpired, l.expiryMessage(action))
+}
+
+// reacquire gets a new lease once the previous one expired and configures
+// its address and routes on the link. The pod is told with an event when the
+// address changed.
+func (l *DHCPLease) reacquire() error {
+	old, err := l.IPNet()
+	if err != nil {
+		return err
+	}
+	if err := l.acquire(); err != nil {
+		return err
+	}
+	ipn, err := l.IPNet()
+	if err != nil {
+		return err
+	}
+	if err := l.configureLink(ipn); err != nil {
+		return fmt.Errorf("failed to configure %v on %v: %v", ipn, l.link.Attrs().Name, err)
+	}
+
+	if !ipn.IP.Equal(old.IP) {
+		msg := fmt.Sprintf("lease of %v expired, the interface now has %v", old.IP, ipn.IP)
+		log.Printf("%v: %s", l.clientID, msg)
+		l.env.events.warn(l.k8sNamespace, l.k8sPodName, eventReasonAddressChanged, msg)
+	}
+	return nil
+}
+
+// configureLink adds the lease's address and routes to the link. Routes
+// present already are left alone.
+func (l *DHCPLease) configureLink(ipn *net.IPNet) error {
+	err := netlink.AddrAdd(l.link, &netlink.Addr{IPNet: ipn})
+	if err != nil && err != syscall.EEXIST {
+		return err
+	}
+
+	for _, r := range l.Routes() {
+		gw := r.GW
+		if gw == nil {
+			gw = l.Gateway()
+		}
+		dst := r.Dst
+		err := netlink.RouteAdd(&netlink.Route{
+			LinkIndex: l.link.Attrs().Index,
+			Dst:       &dst,
+			Gw:        gw,
+		})
+		if err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to add route to %v: %v", &dst, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	kapiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestParseExpiryPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    string
+		wantErr bool
+	}{
+		{"", expiryPolicyDown, false},
+		{"down", expiryPolicyDown, false},
+		{"reacquire", expiryPolicyReacquire, false},
+		{"keep", expiryPolicyKeep, false},
+		{"remove", expiryPolicyRemove, false},
+		{"evict", expiryPolicyEvict, false},
+		{"restart", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseExpiryPolicy(tt.policy)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseExpiryPolicy(%q) = %q, %v, want %q, error %v", tt.policy, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestDeletePod(t *testing.T) {
+	client := fake.NewSimpleClientset(&kapiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "web-0", UID: "uid-1"},
+	})
+	recorder := record.NewFakeRecorder(1)
+	r := &podEventRecorder{pods: client.CoreV1(), recorder: recorder}
+
+	if !r.deletePod("ns", "web-0", eventReasonLeaseExpired, "lease of 10.0.0.2 expired, deleting the pod") {
+		t.Fatalf("deletePod() found nothing to delete")
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, eventReasonLeaseExpired) {
+			t.Errorf("unexpected event %q", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event posted")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := client.CoreV1().Pods("ns").Get(context.TODO(), "web-0", metav1.GetOptions{})
+		if err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pod was not deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var none *podEventRecorder
+	if none.deletePod("ns", "web-0", eventReasonLeaseExpired, "") {
+		t.Errorf("deletePod() without a client reported a deletion")
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	// how often DHCP is tried again for a lease from the fallback pool
+	fallbackRetryInterval = time.Minute
+	// addresses found in use on the link before giving up
+	fallbackMaxConflicts = 5
+)
+
+type fallbackPool struct {
+	subnet  *net.IPNet
+	start   net.IP
+	end     net.IP
+	gateway net.IP
+}
+
+func parseFallbackConfig(conf *FallbackConfig) (*fallbackPool, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	_, subnet, err := net.ParseCIDR(conf.Subnet)
+	if err != nil || subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid fallback subnet %q", conf.Subnet)
+	}
+	p := &fallbackPool{subnet: subnet}
+
+	// by default, the pool spans the subnet without its network and
+	// broadcast addresses
+	p.start = ipAdd(subnet.IP.To4(), 1)
+	p.end = ipAdd(lastIP(subnet), -1)
+	if conf.RangeStart != "" {
+		if p.start = net.ParseIP(conf.RangeStart).To4(); p.start == nil || !subnet.Contains(p.start) {
+			return nil, fmt.Errorf("invalid fallback rangeStart %q", conf.RangeStart)
+		}
+	}
+	if conf.RangeEnd != "" {
+		if p.end = net.ParseIP(conf.RangeEnd).To4(); p.end == nil || !subnet.Contains(p.end) {
+			return nil, fmt.Errorf("invalid fallback rangeEnd %q", conf.RangeEnd)
+		}
+	}
+	if ipToUint32(p.start) > ipToUint32(p.end) {
+		return nil, fmt.Errorf("fallback range %v-%v is empty", p.start, p.end)
+	}
+	if conf.Gateway != "" {
+		if p.gateway = net.ParseIP(conf.Gateway).To4(); p.gateway == nil || !subnet.Contains(p.gateway) {
+			return nil, fmt.Errorf("invalid fallback gateway %q", conf.Gateway)
+		}
+	}
+	return p, nil
+}
+
+// fallbackAddrs holds the fallback addresses handed out by the daemon, so
+// that they are not assigned twice.
+var fallbackAddrs = struct {
+	sync.Mutex
+	inUse map[string]bool
+}{inUse: map[string]bool{}}
+
+func claimFallbackAddress(ip net.IP) bool {
+	fallbackAddrs.Lock()
+	defer fallbackAddrs.Unlock()
+	if fallbackAddrs.inUse[ip.String()] {
+		return false
+	}
+	fallbackAddrs.inUse[ip.String()] = true
+	return true
+}
+
+func freeFallbackAddress(ip net.IP) {
+	fallbackAddrs.Lock()
+	defer fallbackAddrs.Unlock()
+	delete(fallbackAddrs.inUse, ip.String())
+}
+
+// next claims the next address of the pool that isn't handed out by the
+// daemon already and for which inUse returns false.
+func (p *fallbackPool) next(inUse func(net.IP) bool) (net.IP, error) {
+	conflicts := 0
+	for n := ipToUint32(p.start); n <= ipToUint32(p.end); n++ {
+		ip := uint32ToIP(n)
+		if ip.Equal(p.gateway) || !claimFallbackAddress(ip) {
+			continue
+		}
+		if !inUse(ip) {
+			return ip, nil
+		}
+		freeFallbackAddress(ip)
+		if conflicts++; conflicts == fallbackMaxConflicts {
+			break
+		}
+	}
+	return nil, fmt.Errorf("no free address in fallback range %v-%v", p.start, p.end)
+}
+
+// ack returns the acknowledgement the lease of a fallback address is based
+// on. It carries the options a server would send for the address, but no
+// server identifier or lease time.
+func (p *fallbackPool) ack(hwAddr net.HardwareAddr, ip net.IP) (*dhcpv4.DHCPv4, error) {
+	mods := []dhcpv4.Modifier{
+		dhcpv4.WithHwAddr(hwAddr),
+		dhcpv4.WithYourIP(ip),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
+		dhcpv4.WithNetmask(p.subnet.Mask),
+	}
+	if p.gateway != nil {
+		mods = append(mods, dhcpv4.WithRouter(p.gateway))
+	}
+	pkt, err := dhcpv4.New(mods...)
+	if err != nil {
+		return nil, err
+	}
+	pkt.OpCode = dhcpv4.OpcodeBootReply
+	return pkt, nil
+}
+
+// useFallback bases the lease on an address of the fallback pool, after
+// probing that it's not in use on the link. It must be called in the link's
+// namespace.
+func (l *DHCPLease) useFallback(p *fallbackPool) error {
+	ip, err := p.next(func(ip net.IP) bool {
+		inUse, err := arpProbe(l.link, ip)
+		if err != nil {
+			log.Printf("%v: ARP probe for %v failed: %v", l.clientID, ip, err)
+		}
+		return inUse
+	})
+	if err != nil {
+		return err
+	}
+
+	ack, err := p.ack(l.hardwareAddr(), ip)
+	if err != nil {
+		freeFallbackAddress(ip)
+		return err
+	}
+	l.announceAddress(ip)
+	l.ack = ack
+	l.extendFallback(time.Now())
+	atomic.StoreUint32(&l.synthetic, 1)
+	return nil
+}
+
+// extendFallback schedules the next attempt to get a real lease. The lease
+// doesn't expire while the daemon keeps trying.
+func (l *DHCPLease) extendFallback(now time.Time) {
+	l.renewalTime = now.Add(fallbackRetryInterval)
+	l.rebindingTime = l.renewalTime
+	l.expireTime = l.renewalTime.Add(fallbackRetryInterval)
+}
+
+func (l *DHCPLease) isSynthetic() bool {
+	return atomic.LoadUint32(&l.synthetic) == 1
+}
+
+// replaceFallback tries to get a real lease for the fallback address. The
+// pod keeps its address, so the lease is only replaced if the server hands
+// out the same one.
+func (l *DHCPLease) replaceFallback() error {
+	ip := l.ack.YourIPAddr
+	l.requestedIP = ip
+	l.requiredIP = ip
+	defer func() { l.requiredIP = nil }()
+
+	if err := l.acquire(); err != nil {
+		return err
+	}
+	atomic.StoreUint32(&l.synthetic, 0)
+	freeFallbackAddress(ip)
+	return nil
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+func ipAdd(ip net.IP, n int) net.IP {
+	return uint32ToIP(uint32(int64(ipToUint32(ip)) + int64(n)))
+}
+
+func lastIP(subnet *net.IPNet) net.IP {
+	ip := make(net.IP, 4)
+	for i := range ip {
+		ip[i] = subnet.IP.To4()[i] | ^subnet.Mask[i]
+	}
+	return ip
+}
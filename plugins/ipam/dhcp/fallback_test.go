@@ -0,0 +1,116 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestParseFallbackConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		conf      FallbackConfig
+		wantStart string
+		wantEnd   string
+		wantErr   bool
+	}{
+		{"whole subnet", FallbackConfig{Subnet: "192.168.1.0/24"}, "192.168.1.1", "192.168.1.254", false},
+		{"range", FallbackConfig{Subnet: "192.168.1.0/24", RangeStart: "192.168.1.240", RangeEnd: "192.168.1.250"}, "192.168.1.240", "192.168.1.250", false},
+		{"invalid subnet", FallbackConfig{Subnet: "192.168.1.0"}, "", "", true},
+		{"start outside subnet", FallbackConfig{Subnet: "192.168.1.0/24", RangeStart: "192.168.2.1"}, "", "", true},
+		{"empty range", FallbackConfig{Subnet: "192.168.1.0/24", RangeStart: "192.168.1.20", RangeEnd: "192.168.1.10"}, "", "", true},
+		{"gateway outside subnet", FallbackConfig{Subnet: "192.168.1.0/24", Gateway: "10.0.0.1"}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parseFallbackConfig(&tt.conf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFallbackConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if p.start.String() != tt.wantStart || p.end.String() != tt.wantEnd {
+				t.Errorf("parseFallbackConfig() range = %v-%v, want %v-%v", p.start, p.end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestFallbackPoolNext(t *testing.T) {
+	p, err := parseFallbackConfig(&FallbackConfig{
+		Subnet:     "192.168.1.0/24",
+		RangeStart: "192.168.1.1",
+		RangeEnd:   "192.168.1.4",
+		Gateway:    "192.168.1.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	taken := net.ParseIP("192.168.1.2").To4()
+	inUse := func(ip net.IP) bool { return ip.Equal(taken) }
+	defer freeFallbackAddress(net.ParseIP("192.168.1.3"))
+	defer freeFallbackAddress(net.ParseIP("192.168.1.4"))
+
+	// the gateway and addresses in use on the link are skipped
+	ip, err := p.next(inUse)
+	if err != nil || ip.String() != "192.168.1.3" {
+		t.Fatalf("next() = %v, %v, want 192.168.1.3", ip, err)
+	}
+	// as are the ones handed out already
+	ip, err = p.next(inUse)
+	if err != nil || ip.String() != "192.168.1.4" {
+		t.Fatalf("next() = %v, %v, want 192.168.1.4", ip, err)
+	}
+	if ip, err = p.next(inUse); err == nil {
+		t.Fatalf("next() = %v, want error for exhausted pool", ip)
+	}
+
+	// freed addresses are handed out again
+	freeFallbackAddress(net.ParseIP("192.168.1.3"))
+	ip, err = p.next(inUse)
+	if err != nil || ip.String() != "192.168.1.3" {
+		t.Fatalf("next() = %v, %v, want 192.168.1.3", ip, err)
+	}
+}
+
+func TestFallbackPoolAck(t *testing.T) {
+	p, err := parseFallbackConfig(&FallbackConfig{Subnet: "192.168.1.0/24", Gateway: "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hwAddr := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	ack, err := p.ack(hwAddr, net.ParseIP("192.168.1.10").To4())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &DHCPLease{ack: ack}
+
+	ipn, err := l.IPNet()
+	if err != nil || ipn.String() != "192.168.1.10/24" {
+		t.Errorf("IPNet() = %v, %v, want 192.168.1.10/24", ipn, err)
+	}
+	if gw := l.Gateway(); !gw.Equal(net.ParseIP("192.168.1.1")) {
+		t.Errorf("Gateway() = %v, want 192.168.1.1", gw)
+	}
+	if l.ack.Options.Has(dhcpv4.OptionServerIdentifier) {
+		t.Errorf("fallback ack has a server identifier")
+	}
+}
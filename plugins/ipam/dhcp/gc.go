@@ -0,0 +1,94 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+// how long to wait before listing the pods again after a failure
+const podListRetryInterval = 30 * time.Second
+
+// runLeaseGC periodically releases leases of pods that no longer exist,
+// e.g. because CNI DEL was never called for them.
+func (d *DHCP) runLeaseGC(interval time.Duration) {
+	for range time.Tick(interval) {
+		d.collectOrphanedLeases(context.TODO())
+	}
+}
+
+func (d *DHCP) collectOrphanedLeases(ctx context.Context) error {
+	orphaned, err := d.findOrphanedLeases(ctx)
+	if err != nil {
+		log.Printf("Failed to look for leases of deleted pods: %v", err)
+		return err
+	}
+	for clientID, l := range orphaned {
+		log.Printf("%v: pod %s/%s no longer exists, releasing lease", clientID, l.k8sNamespace, l.k8sPodName)
+		d.removeLease(clientID)
+	}
+	return nil
+}
+
+// validateLeases releases the leases loaded at startup whose pod was deleted
+// while the daemon wasn't running. It retries until the pods could be listed.
+func (d *DHCP) validateLeases() {
+	for d.collectOrphanedLeases(context.TODO()) != nil {
+		time.Sleep(podListRetryInterval)
+	}
+}
+
+// findOrphanedLeases returns the leases whose pod was deleted. Leases without
+// pod metadata are skipped. The pods of the node are listed at once rather
+// than looked up one by one, which is a lot of requests on busy nodes.
+func (d *DHCP) findOrphanedLeases(ctx context.Context) (map[string]*DHCPLease, error) {
+	leases := d.leases.all()
+	for clientID, l := range leases {
+		if l.k8sPodName == "" {
+			delete(leases, clientID)
+		}
+	}
+
+	orphaned := map[string]*DHCPLease{}
+	if len(leases) == 0 {
+		return orphaned, nil
+	}
+
+	// listed after taking the leases, so pods of new leases are included
+	var opts metav1.ListOptions
+	if d.nodeName != "" {
+		opts.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", d.nodeName).String()
+	}
+	pods, err := d.k8sClient.Pods(metav1.NamespaceAll).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool, len(pods.Items))
+	for _, pod := range pods.Items {
+		existing[pod.Namespace+"/"+pod.Name] = true
+	}
+
+	for clientID, l := range leases {
+		if !existing[l.k8sNamespace+"/"+l.k8sPodName] {
+			orphaned[clientID] = l
+		}
+	}
+	return orphaned, nil
+}
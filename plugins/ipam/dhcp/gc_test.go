@@ -0,0 +1,55 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	kapiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestFindOrphanedLeases(t *testing.T) {
+	client := fake.NewSimpleClientset(&kapiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "running"},
+	})
+	d := &DHCP{
+		k8sClient: client.CoreV1(),
+		leases: newLeaseMap(map[string]*DHCPLease{
+			"running": {k8sNamespace: "default", k8sPodName: "running"},
+			"deleted": {k8sNamespace: "default", k8sPodName: "deleted"},
+			"other":   {k8sNamespace: "other", k8sPodName: "running"},
+			"no-pod":  {},
+		}),
+	}
+
+	orphaned, err := d.findOrphanedLeases(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for clientID := range orphaned {
+		got = append(got, clientID)
+	}
+	sort.Strings(got)
+
+	if want := []string{"deleted", "other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("findOrphanedLeases() = %v, want %v", got, want)
+	}
+}
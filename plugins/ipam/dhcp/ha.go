@@ -0,0 +1,332 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexflint/go-filemutex"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+// storeLockPath returns the path of the lock next to the lease file. The
+// daemon maintaining the leases holds it for its whole lifetime. A standby
+// daemon waits for it, and takes over the persisted leases once the active
+// daemon exits or crashes.
+func storeLockPath(leaseFile string) string {
+	return leaseFile + ".lock"
+}
+
+// The lease store lock only covers daemons sharing the node's /run. When the
+// leases are kept in the cluster, the active daemon also holds a Lease object
+// named after the node, renewed well before it expires.
+const (
+	nodeLockDuration = 30 * time.Second
+	nodeLockRetry    = 5 * time.Second
+)
+
+// Give the RPC reply to a handover request time to reach the caller
+const handoverExitDelay = 100 * time.Millisecond
+
+// acquireStoreLock takes the lease store lock. When standby is false, it
+// fails if another daemon is active, instead of waiting for it to exit.
+func acquireStoreLock(path string, standby bool) (*filemutex.FileMutex, error) {
+	m, err := filemutex.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lease store lock %q: %v", path, err)
+	}
+
+	if !standby {
+		if err := m.TryLock(); err != nil {
+			m.Close()
+			return nil, fmt.Errorf("lease store lock %q is held by another daemon: %v", path, err)
+		}
+		return m, nil
+	}
+
+	log.Printf("Standing by for lease store lock %q", path)
+	if err := m.Lock(); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("failed to lock lease store %q: %v", path, err)
+	}
+	log.Printf("Lease store lock acquired, taking over")
+	return m, nil
+}
+
+// nodeLock is a coordination.k8s.io Lease held by the active daemon of a node.
+type nodeLock struct {
+	leases   coordinationclient.LeaseInterface
+	name     string
+	identity string
+	// time of the last successful renewal
+	renewed time.Time
+	// closed when renewals failed for longer than nodeLockDuration
+	lost     chan struct{}
+	lostOnce sync.Once
+}
+
+func newNodeLock(leases coordinationclient.LeaseInterface, nodeName string) *nodeLock {
+	hostname, _ := os.Hostname()
+	return &nodeLock{
+		leases:   leases,
+		name:     "dhcp-daemon-" + nodeName,
+		identity: fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		lost:     make(chan struct{}),
+	}
+}
+
+// acquire takes the node lock. Like acquireStoreLock, it fails if another
+// daemon holds it, unless standby is set. A lock that's not renewed is taken
+// over once it expires.
+func (n *nodeLock) acquire(standby bool) error {
+	logged := false
+	for {
+		held, err := n.tryAcquire(time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to acquire node lock %q: %v", n.name, err)
+		}
+		if held {
+			if logged {
+				log.Printf("Node lock %q acquired, taking over", n.name)
+			}
+			n.renewed = time.Now()
+			go n.renew()
+			return nil
+		}
+		if !standby {
+			return fmt.Errorf("node lock %q is held by another daemon", n.name)
+		}
+		if !logged {
+			log.Printf("Standing by for node lock %q", n.name)
+			logged = true
+		}
+		time.Sleep(nodeLockRetry)
+	}
+}
+
+// tryAcquire takes or renews the lock unless another daemon holds it. It
+// returns false if it's held or was taken concurrently.
+func (n *nodeLock) tryAcquire(now time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), nodeLockRetry)
+	defer cancel()
+
+	seconds := int32(nodeLockDuration / time.Second)
+	lease, err := n.leases.Get(ctx, n.name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Name: n.name}}
+		lease.Spec.HolderIdentity = &n.identity
+		lease.Spec.LeaseDurationSeconds = &seconds
+		lease.Spec.AcquireTime = &metav1.MicroTime{Time: now}
+		lease.Spec.RenewTime = &metav1.MicroTime{Time: now}
+		_, err = n.leases.Create(ctx, lease, metav1.CreateOptions{})
+		if k8serrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	} else if err != nil {
+		return false, err
+	}
+
+	if !n.heldBy(lease) && !lockFree(lease, now) {
+		return false, nil
+	}
+	if !n.heldBy(lease) {
+		lease.Spec.HolderIdentity = &n.identity
+		lease.Spec.AcquireTime = &metav1.MicroTime{Time: now}
+	}
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.RenewTime = &metav1.MicroTime{Time: now}
+	_, err = n.leases.Update(ctx, lease, metav1.UpdateOptions{})
+	if k8serrors.IsConflict(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (n *nodeLock) heldBy(lease *coordinationv1.Lease) bool {
+	return lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity == n.identity
+}
+
+// lockFree reports whether the lock was released or has expired.
+func lockFree(lease *coordinationv1.Lease, now time.Time) bool {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" {
+		return true
+	}
+	if spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return now.After(spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second))
+}
+
+// renew keeps the lock held. Should it be taken over, another daemon may be
+// maintaining the leases already, so the daemon exits right away.
+func (n *nodeLock) renew() {
+	for {
+		time.Sleep(nodeLockDuration / 3)
+		if err := n.renewAt(time.Now()); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// renewAt renews the lock. Once renewals failed for longer than the lock
+// duration, a standby daemon may take the lock over, so lost is closed for
+// the daemon to step down. It returns an error when the daemon has to exit:
+// when the lock was taken over, or renewed again after stepping down, in
+// which case a restart reloads the leases from the store.
+func (n *nodeLock) renewAt(now time.Time) error {
+	held, err := n.tryAcquire(now)
+	switch {
+	case err != nil:
+		log.Printf("Failed to renew node lock %q: %v", n.name, err)
+		if now.Sub(n.renewed) > nodeLockDuration {
+			n.lostOnce.Do(func() {
+				log.Printf("Node lock %q not renewed since %v, stepping down", n.name, n.renewed)
+				close(n.lost)
+			})
+		}
+		return nil
+	case !held:
+		return fmt.Errorf("node lock %q was taken over by another daemon", n.name)
+	case n.isLost():
+		return fmt.Errorf("node lock %q renewed after stepping down, exiting to reload the leases", n.name)
+	}
+	n.renewed = now
+	return nil
+}
+
+// isLost reports whether the daemon stepped down.
+func (n *nodeLock) isLost() bool {
+	select {
+	case <-n.lost:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees the lock so a standby daemon doesn't wait for it to expire.
+func (n *nodeLock) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), nodeLockRetry)
+	defer cancel()
+
+	lease, err := n.leases.Get(ctx, n.name, metav1.GetOptions{})
+	if err != nil || !n.heldBy(lease) {
+		return
+	}
+	empty := ""
+	lease.Spec.HolderIdentity = &empty
+	if _, err := n.leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		log.Printf("Failed to release node lock %q: %v", n.name, err)
+	}
+}
+
+// requestHandover asks the daemon serving socketPath to stop maintaining its
+// leases without releasing them, persist them and exit. token is sent if the
+// daemons require one.
+func requestHandover(socketPath, token string) error {
+	client, err := dialDaemon(socketPath, token)
+	if err != nil {
+		return fmt.Errorf("error dialing DHCP daemon: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Call("DHCP.Handover", struct{}{}, &struct{}{}); err != nil {
+		return fmt.Errorf("error calling DHCP.Handover: %v", err)
+	}
+	return nil
+}
+
+// Handover detaches all leases, persists them for the daemon taking over and
+// exits, which releases the lease store lock.
+func (d *DHCP) Handover(_ struct{}, _ *struct{}) error {
+	d.detachAll()
+	d.exitAfterHandover()
+	return nil
+}
+
+// detachAll stops maintaining the leases without releasing them and
+// persists them for the daemon taking over. It returns them, pending leases
+// included.
+func (d *DHCP) detachAll() []PersistedLeased {
+	d.persistMux.Lock()
+	defer d.persistMux.Unlock()
+	leases := d.leases.lockAll()
+	defer d.leases.unlockAll()
+
+	log.Printf("Handing over %d leases", len(leases))
+	for _, l := range leases {
+		l.Detach()
+	}
+	if d.pending != nil {
+		for clientID, l := range d.pending.all() {
+			if _, ok := leases[clientID]; !ok {
+				leases[clientID] = l
+			}
+		}
+	}
+
+	persisted := persistedLeases(leases)
+	if err := d.store.save(persisted); err != nil {
+		log.Printf("Failed to persist leases for handover: %v", err)
+	}
+	// the store belongs to the daemon taking over, pending writes are dropped
+	d.persistStopped = true
+	return persisted
+}
+
+// stepDown stops maintaining the leases when the node lock is lost, without
+// releasing them or writing the store, since another daemon may be taking
+// them over. The daemon reports not ready and refuses CNI calls from then on.
+func (d *DHCP) stepDown() {
+	if !atomic.CompareAndSwapInt32(&d.steppedDown, 0, 1) {
+		return
+	}
+	leases := d.leases.lockAll()
+	defer d.leases.unlockAll()
+
+	log.Printf("Stepping down, no longer maintaining %d leases", len(leases))
+	for _, l := range leases {
+		l.Detach()
+	}
+}
+
+// checkActive fails once the daemon stepped down.
+func (d *DHCP) checkActive() error {
+	if atomic.LoadInt32(&d.steppedDown) != 0 {
+		return fmt.Errorf("daemon stepped down after failing to renew its node lock")
+	}
+	return nil
+}
+
+func (d *DHCP) exitAfterHandover() {
+	go func() {
+		time.Sleep(handoverExitDelay)
+		if d.nodeLock != nil {
+			d.nodeLock.release()
+		}
+		os.Exit(0)
+	}()
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestNodeLock(t *testing.T) {
+	leases := fake.NewSimpleClientset().CoordinationV1().Leases("kube-system")
+	active := &nodeLock{leases: leases, name: "dhcp-daemon-node-a", identity: "active"}
+	standby := &nodeLock{leases: leases, name: "dhcp-daemon-node-a", identity: "standby"}
+	now := time.Now()
+
+	if held, err := active.tryAcquire(now); err != nil || !held {
+		t.Fatalf("tryAcquire() = %v, %v, want the free lock", held, err)
+	}
+	if held, err := active.tryAcquire(now.Add(nodeLockDuration / 3)); err != nil || !held {
+		t.Errorf("renewal = %v, %v, want the lock kept", held, err)
+	}
+	if held, err := standby.tryAcquire(now.Add(nodeLockDuration / 2)); err != nil || held {
+		t.Errorf("tryAcquire() of a held lock = %v, %v, want false", held, err)
+	}
+
+	// a lock that isn't renewed is taken over
+	if held, err := standby.tryAcquire(now.Add(2 * nodeLockDuration)); err != nil || !held {
+		t.Errorf("tryAcquire() of an expired lock = %v, %v, want true", held, err)
+	}
+	if held, err := active.tryAcquire(now.Add(2 * nodeLockDuration)); err != nil || held {
+		t.Errorf("renewal of a lost lock = %v, %v, want false", held, err)
+	}
+
+	// a released lock is free right away
+	standby.release()
+	if held, err := active.tryAcquire(now.Add(2 * nodeLockDuration)); err != nil || !held {
+		t.Errorf("tryAcquire() of a released lock = %v, %v, want true", held, err)
+	}
+}
+
+func TestNodeLockStepDown(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	var unavailable int32
+	client.PrependReactor("*", "leases", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if atomic.LoadInt32(&unavailable) != 0 {
+			return true, nil, errors.New("API server unavailable")
+		}
+		return false, nil, nil
+	})
+	lock := &nodeLock{
+		leases:   client.CoordinationV1().Leases("kube-system"),
+		name:     "dhcp-daemon-node-a",
+		identity: "active",
+		lost:     make(chan struct{}),
+	}
+	now := time.Now()
+	if held, err := lock.tryAcquire(now); err != nil || !held {
+		t.Fatalf("tryAcquire() = %v, %v, want the free lock", held, err)
+	}
+	lock.renewed = now
+
+	atomic.StoreInt32(&unavailable, 1)
+	if err := lock.renewAt(now.Add(nodeLockDuration / 3)); err != nil || lock.isLost() {
+		t.Errorf("a failed renewal = %v, lost %v, want the lock kept", err, lock.isLost())
+	}
+	if err := lock.renewAt(now.Add(nodeLockDuration + time.Second)); err != nil || !lock.isLost() {
+		t.Errorf("renewals failing for the lock duration = %v, lost %v, want to step down", err, lock.isLost())
+	}
+
+	// the daemon exits to reload the leases once it holds the lock again
+	atomic.StoreInt32(&unavailable, 0)
+	if err := lock.renewAt(now.Add(nodeLockDuration + 2*time.Second)); err == nil {
+		t.Errorf("renewal after stepping down succeeded")
+	}
+}
+
+func TestStepDown(t *testing.T) {
+	l := &DHCPLease{clientID: "a", stop: make(chan struct{})}
+	store := &memLeaseStore{}
+	d := &DHCP{leases: newLeaseMap(map[string]*DHCPLease{"a": l}), store: store}
+
+	if err := d.checkActive(); err != nil {
+		t.Fatal(err)
+	}
+	d.stepDown()
+	if err := d.checkActive(); err == nil {
+		t.Errorf("checkActive() succeeded after stepping down")
+	}
+	if atomic.LoadUint32(&l.detached) == 0 {
+		t.Errorf("lease still maintained")
+	}
+	if err := d.persistLeases(); err != nil || store.leases != nil {
+		t.Errorf("persisted %v, %v after stepping down", store.leases, err)
+	}
+	if _, err := d.allocate(nil, nil, nil, nil); err == nil {
+		t.Errorf("allocated after stepping down")
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// A daemon started with -takeover first asks the active one to hand over
+// its listening sockets along with its leases, through a CONNECT request
+// for handoverPath on the RPC socket. The active daemon stops accepting
+// connections, lets the CNI calls in progress finish and passes the sockets
+// with SCM_RIGHTS, so that calls made during an upgrade queue up on the
+// socket instead of failing, and the leases are maintained again as soon as
+// the new daemon starts. Daemons that don't support it are asked to persist
+// their leases with DHCP.Handover instead.
+const handoverPath = "/_dhcpHandover_"
+
+// handoverHeader starts the reply carrying the sockets, the leases follow
+// as JSON.
+const handoverHeader = "HTTP/1.0 200 Handing over\n\n"
+
+const (
+	// bounds the wait for the CNI calls in progress
+	handoverDrainTimeout = 30 * time.Second
+	// of the sockets passed at once
+	handoverMaxFDs = 16
+)
+
+// rpcConns counts the connections to the RPC API, so that a handover can
+// wait for the calls in progress.
+type rpcConns struct {
+	active  sync.WaitGroup
+	serving sync.WaitGroup
+}
+
+// track is the http.Server ConnState hook. Hijacked connections are done
+// once their handler returns.
+func (c *rpcConns) track(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		c.active.Add(1)
+	case http.StateClosed:
+		c.active.Done()
+	}
+}
+
+func (c *rpcConns) hijackedDone() {
+	if c != nil {
+		c.active.Done()
+	}
+}
+
+// serve serves handler, nil for http.DefaultServeMux, on l until it's closed.
+func (c *rpcConns) serve(l net.Listener, handler http.Handler) error {
+	c.serving.Add(1)
+	defer c.serving.Done()
+	srv := &http.Server{Handler: handler, ConnState: c.track}
+	return srv.Serve(l)
+}
+
+// drain waits for the connections to be closed once the listeners are,
+// at most for timeout. It returns false on timeout.
+func (c *rpcConns) drain(timeout time.Duration) bool {
+	c.serving.Wait()
+	done := make(chan struct{})
+	go func() {
+		c.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// handoverHandler hands the daemon over to a process of the same user.
+type handoverHandler struct {
+	dhcp  *DHCP
+	conns *rpcConns
+	// the unix sockets the RPC API is served on
+	listeners []net.Listener
+	// exits the daemon once the handover is done
+	exit    func()
+	started uint32
+}
+
+func (h *handoverHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		http.Error(w, "405 must CONNECT", http.StatusMethodNotAllowed)
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Printf("handover hijacking %v: %v", req.RemoteAddr, err)
+		return
+	}
+	// not a call the handover waits for
+	h.conns.hijackedDone()
+	defer conn.Close()
+
+	cred, err := peerCred(conn)
+	if err != nil || cred.Uid != uint32(os.Getuid()) {
+		io.WriteString(conn, "HTTP/1.0 403 Forbidden\n\n")
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&h.started, 0, 1) {
+		io.WriteString(conn, "HTTP/1.0 409 Conflict\n\n")
+		return
+	}
+
+	files, err := h.socketFiles()
+	if err != nil {
+		log.Printf("Not handing over: %v", err)
+		io.WriteString(conn, "HTTP/1.0 500 Internal Server Error\n\n")
+		atomic.StoreUint32(&h.started, 0)
+		return
+	}
+	defer closeFiles(files)
+
+	log.Printf("Handing over to PID %d", cred.Pid)
+	if err := h.handOver(conn.(*net.UnixConn), files); err != nil {
+		// the leases are persisted, the new daemon can take them over
+		log.Printf("Handover failed: %v", err)
+	}
+	h.exit()
+}
+
+func (h *handoverHandler) isStarted() bool {
+	return atomic.LoadUint32(&h.started) == 1
+}
+
+// socketFiles returns copies of the listening sockets, which stay open once
+// the listeners are closed.
+func (h *handoverHandler) socketFiles() ([]*os.File, error) {
+	var files []*os.File
+	for _, l := range h.listeners {
+		ul, ok := l.(*net.UnixListener)
+		if !ok {
+			closeFiles(files)
+			return nil, fmt.Errorf("%v is not a unix socket", l.Addr())
+		}
+		f, err := ul.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// handOver stops serving, detaches the leases and passes them along with
+// the sockets in files.
+func (h *handoverHandler) handOver(conn *net.UnixConn, files []*os.File) error {
+	for _, l := range h.listeners {
+		// the new daemon serves the same path
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		l.Close()
+	}
+	if !h.conns.drain(handoverDrainTimeout) {
+		log.Printf("Handing over with CNI calls still in progress")
+	}
+	leases := h.dhcp.detachAll()
+
+	var fds []int
+	for _, f := range files {
+		fds = append(fds, int(f.Fd()))
+	}
+	if _, _, err := conn.WriteMsgUnix([]byte(handoverHeader), unix.UnixRights(fds...), nil); err != nil {
+		return fmt.Errorf("failed to pass the sockets: %v", err)
+	}
+	if err := json.NewEncoder(conn).Encode(leases); err != nil {
+		return fmt.Errorf("failed to pass the leases: %v", err)
+	}
+	return nil
+}
+
+// handover is what the previous daemon handed over.
+type handover struct {
+	listeners []net.Listener
+	// nil if they are to be loaded from the store
+	leases []PersistedLeased
+}
+
+// receiveHandover asks the daemon serving socketPath to hand its sockets
+// and leases over.
+func receiveHandover(socketPath string) (*handover, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing DHCP daemon: %v", err)
+	}
+	defer conn.Close()
+	unixConn := conn.(*net.UnixConn)
+
+	if _, err := io.WriteString(conn, "CONNECT "+handoverPath+" HTTP/1.0\n\n"); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(handoverMaxFDs*4))
+	n, oobn, _, _, err := unixConn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(string(buf[:n]), handoverHeader) {
+		status := strings.SplitN(string(buf[:n]), "\n", 2)[0]
+		return nil, fmt.Errorf("unexpected response: %q", strings.TrimSpace(status))
+	}
+	listeners, err := handoverListeners(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+
+	h := &handover{listeners: listeners}
+	// the leases may have been read along with the header
+	body := io.MultiReader(bytes.NewReader(buf[len(handoverHeader):n]), conn)
+	if err := json.NewDecoder(body).Decode(&h.leases); err != nil {
+		log.Printf("Failed to read the handed over leases, loading them from the store: %v", err)
+		h.leases = nil
+	}
+	return h, nil
+}
+
+// handoverListeners returns the listening sockets passed in oob.
+func handoverListeners(oob []byte) ([]net.Listener, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := unix.ParseUnixRights(&msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, rights...)
+	}
+
+	var listeners []net.Listener
+	for _, fd := range fds {
+		f := os.NewFile(uintptr(fd), "handover")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err == nil {
+			listeners = append(listeners, l)
+		} else {
+			log.Printf("Ignoring a handed over socket: %v", err)
+		}
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no socket was handed over")
+	}
+	return listeners, nil
+}
+
+// handedOverStore loads the leases handed over by the previous daemon
+// instead of the persisted ones.
+type handedOverStore struct {
+	leaseStore
+	leases []PersistedLeased
+}
+
+func (s *handedOverStore) load() ([]PersistedLeased, error) {
+	leases := s.leases
+	if leases == nil {
+		return s.leaseStore.load()
+	}
+	s.leases = nil
+	return leases, nil
+}
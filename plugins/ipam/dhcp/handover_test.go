@@ -0,0 +1,121 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSocketHandover(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "dhcp.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &DHCP{
+		leases:  newLeaseMap(nil),
+		pending: newLeaseMap(nil),
+		store:   &fileLeaseStore{path: filepath.Join(dir, "leases.json")},
+	}
+	d.setLease("c1/net/eth0", &DHCPLease{clientID: "c1/net/eth0", stop: make(chan struct{})})
+
+	conns := &rpcConns{}
+	exited := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle(handoverPath, &handoverHandler{
+		dhcp:      d,
+		conns:     conns,
+		listeners: []net.Listener{listener},
+		exit:      func() { close(exited) },
+	})
+	served := make(chan struct{})
+	go func() {
+		conns.serve(listener, mux)
+		close(served)
+	}()
+
+	h, err := receiveHandover(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the old listener is still served")
+	}
+	<-exited
+
+	if len(h.leases) != 1 || h.leases[0].ClientID != "c1/net/eth0" {
+		t.Errorf("got leases %+v", h.leases)
+	}
+	if l := d.getLease("c1/net/eth0"); l.detached != 1 {
+		t.Error("the lease was not detached")
+	}
+	if len(h.listeners) != 1 {
+		t.Fatalf("got %d listeners", len(h.listeners))
+	}
+	defer h.listeners[0].Close()
+
+	// the socket path keeps working with the handed over listener
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	accepted, err := h.listeners[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+}
+
+func TestHandedOverStore(t *testing.T) {
+	store := &handedOverStore{
+		leaseStore: &fileLeaseStore{path: filepath.Join(t.TempDir(), "leases.json")},
+		leases:     []PersistedLeased{{ClientID: "c1/net/eth0"}},
+	}
+	leases, err := store.load()
+	if err != nil || len(leases) != 1 {
+		t.Fatalf("got %v, %v", leases, err)
+	}
+	if err := store.save(nil); err != nil {
+		t.Fatal(err)
+	}
+	// later loads read the store
+	if leases, err := store.load(); err != nil || len(leases) != 0 {
+		t.Errorf("got %v, %v after the handed over leases were loaded", leases, err)
+	}
+}
+
+func TestReceiveHandoverUnsupported(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "dhcp.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// daemons predating the socket handover have no handler for it
+	go http.Serve(listener, http.NewServeMux())
+
+	if _, err := receiveHandover(socketPath); err == nil {
+		t.Error("expected an error from a daemon without socket handover")
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync/atomic"
+	"time"
+)
+
+// time of the last successful DHCP exchange in unix nanoseconds, zero if none
+var lastExchange int64
+
+// number of DHCP attempts that failed since the last successful exchange
+var failedExchanges int64
+
+func recordExchange() {
+	atomic.StoreInt64(&lastExchange, time.Now().UnixNano())
+	atomic.StoreInt64(&failedExchanges, 0)
+}
+
+func recordExchangeFailure() {
+	atomic.AddInt64(&failedExchanges, 1)
+}
+
+// healthChecker implements the /healthz and /readyz endpoints.
+type healthChecker struct {
+	dhcp       *DHCP
+	socketPath string
+	store      leaseStore
+	// readiness fails when leases are maintained, but no exchange succeeded
+	// for this long. Disabled when zero.
+	maxExchangeAge time.Duration
+}
+
+// checkRPC verifies that the RPC listener accepts connections.
+func (h *healthChecker) checkRPC() error {
+	client, err := rpc.DialHTTP("unix", h.socketPath)
+	if err != nil {
+		return fmt.Errorf("RPC listener not serving: %v", err)
+	}
+	return client.Close()
+}
+
+// checkAlive verifies that the RPC listener accepts connections and that the
+// lease table is not held by a stuck request. It blocks in the latter case.
+func (h *healthChecker) checkAlive() error {
+	h.dhcp.leases.lockAll()
+	h.dhcp.leases.unlockAll()
+	return h.checkRPC()
+}
+
+// checkStore verifies that the lease store is writable.
+func (h *healthChecker) checkStore() error {
+	if err := h.store.check(); err != nil {
+		return fmt.Errorf("lease store not writable: %v", err)
+	}
+	return nil
+}
+
+// checkExchange verifies that a DHCP exchange succeeded recently.
+func (h *healthChecker) checkExchange() error {
+	if h.maxExchangeAge == 0 {
+		return nil
+	}
+
+	if h.dhcp.leases.len() == 0 {
+		return nil
+	}
+
+	last := atomic.LoadInt64(&lastExchange)
+	if last == 0 {
+		return fmt.Errorf("no successful DHCP exchange yet")
+	}
+	if age := time.Since(time.Unix(0, last)); age > h.maxExchangeAge {
+		return fmt.Errorf("last successful DHCP exchange was %v ago", age.Round(time.Second))
+	}
+	return nil
+}
+
+func (h *healthChecker) handler(checks ...func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, check := range checks {
+			if err := check(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// mux routes the health endpoints.
+func (h *healthChecker) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", h.handler(h.checkRPC))
+	mux.Handle("/readyz", h.handler(h.dhcp.checkActive, h.checkRPC, h.checkStore, h.checkExchange))
+	return mux
+}
+
+// serveHealth serves the health endpoints on address in the background.
+func serveHealth(address string, h *healthChecker) {
+	go func() {
+		if err := http.ListenAndServe(address, h.mux()); err != nil {
+			log.Printf("Health endpoints on %q stopped: %v", address, err)
+		}
+	}()
+}
+
+// serveHealthOn serves the health endpoints on a socket passed by systemd.
+func serveHealthOn(l net.Listener, h *healthChecker) {
+	go func() {
+		if err := http.Serve(l, h.mux()); err != nil {
+			log.Printf("Health endpoints on %v stopped: %v", l.Addr(), err)
+		}
+	}()
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckExchange(t *testing.T) {
+	defer atomic.StoreInt64(&lastExchange, atomic.LoadInt64(&lastExchange))
+
+	tests := []struct {
+		name         string
+		maxAge       time.Duration
+		leases       int
+		lastExchange time.Time
+		wantErr      bool
+	}{
+		{name: "disabled", maxAge: 0, leases: 1},
+		{name: "no leases", maxAge: time.Minute},
+		{name: "never exchanged", maxAge: time.Minute, leases: 1, wantErr: true},
+		{name: "recent", maxAge: time.Minute, leases: 1, lastExchange: time.Now()},
+		{name: "stale", maxAge: time.Minute, leases: 1, lastExchange: time.Now().Add(-time.Hour), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &DHCP{leases: newLeaseMap(nil)}
+			for i := 0; i < tt.leases; i++ {
+				d.leases.set(string(rune('a'+i)), &DHCPLease{})
+			}
+			var last int64
+			if !tt.lastExchange.IsZero() {
+				last = tt.lastExchange.UnixNano()
+			}
+			atomic.StoreInt64(&lastExchange, last)
+
+			h := &healthChecker{dhcp: d, maxExchangeAge: tt.maxAge}
+			if err := h.checkExchange(); (err != nil) != tt.wantErr {
+				t.Errorf("checkExchange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// Leases of host interfaces, such as the uplink of the bridge, have no netns
+// path and are maintained in the daemon's namespace. Unlike container leases,
+// the daemon configures their address and routes itself.
+const hostLeasePrefix = "host/"
+
+// withLeaseNetNS runs f in the netns at path, or in the daemon's namespace
+// for host leases, whose path is empty.
+func withLeaseNetNS(path string, f func(ns.NetNS) error) error {
+	if path != "" {
+		return ns.WithNetNSPath(path, f)
+	}
+	if hostNetNS == nil {
+		return fmt.Errorf("host leases require the daemon network namespace")
+	}
+	return hostNetNS.Do(f)
+}
+
+// parseHostInterfaces splits the comma-separated -host-interfaces flag.
+func parseHostInterfaces(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// maintainHostInterfaces acquires leases for the host interfaces that have
+// none yet, e.g. from before a restart. Interfaces are retried until they
+// get a lease, since the uplink may not be up when the daemon starts.
+func (d *DHCP) maintainHostInterfaces(names []string) {
+	for _, name := range names {
+		go func(name string) {
+			for {
+				err := d.acquireHostLease(name)
+				if err == nil {
+					return
+				}
+				log.Printf("%v: %v", hostLeasePrefix+name, err)
+				time.Sleep(reacquireRetryInterval)
+			}
+		}(name)
+	}
+}
+
+func (d *DHCP) acquireHostLease(ifName string) error {
+	clientID := hostLeasePrefix + ifName
+	unlock := d.clientLocks.lock(clientID)
+	defer unlock()
+
+	if d.getLease(clientID) != nil {
+		return nil
+	}
+
+	optsRequesting, optsProviding, err := prepareOptions("", nil, nil)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	defaults := d.leaseDefaults()
+
+	// bringing the uplink down on expiry would cut off the node, and its
+	// MTU is left to the host's network configuration
+	l, err := AcquireLease(leaseConfig{
+		clientID:       clientID,
+		ifName:         ifName,
+		hostname:       hostname,
+		optsRequesting: optsRequesting,
+		optsProviding:  optsProviding,
+		timeout:        defaults.timeout,
+		retry:          defaultRetryPolicy(defaults.resendMax),
+		broadcast:      defaults.broadcast,
+		minRenewalTime: defaults.minRenewalTime,
+		maxLeaseTime:   defaults.maxLeaseTime,
+		rogueServers:   rogueServerNone,
+		serverChange:   serverChangeWarn,
+		expiryPolicy:   expiryPolicyReacquire,
+		ignoreMTU:      true,
+		clientSocket:   clientSocketPacket,
+		env:            d.env,
+	})
+	if err != nil {
+		return err
+	}
+
+	ipn, err := l.IPNet()
+	if err == nil {
+		err = withLeaseNetNS("", func(_ ns.NetNS) error {
+			return l.configureLink(ipn)
+		})
+	}
+	if err != nil {
+		l.Stop()
+		return fmt.Errorf("failed to configure %v: %v", ifName, err)
+	}
+
+	log.Printf("%v: configured %v on host interface %v", clientID, ipn, ifName)
+	d.setLease(clientID, l)
+	d.requestPersist()
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+func TestParseHostInterfaces(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+	}{
+		{"", nil},
+		{"eth1", []string{"eth1"}},
+		{"eth1, br0,,", []string{"eth1", "br0"}},
+	}
+	for _, tt := range tests {
+		if got := parseHostInterfaces(tt.list); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseHostInterfaces(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestWithLeaseNetNSHost(t *testing.T) {
+	defer func(saved ns.NetNS) { hostNetNS = saved }(hostNetNS)
+
+	hostNetNS = nil
+	if err := withLeaseNetNS("", func(ns.NetNS) error { return nil }); err == nil {
+		t.Error("host lease without the daemon namespace succeeded")
+	}
+
+	current, err := ns.GetCurrentNS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer current.Close()
+	hostNetNS = current
+
+	ran := false
+	if err := withLeaseNetNS("", func(ns.NetNS) error { ran = true; return nil }); err != nil || !ran {
+		t.Errorf("withLeaseNetNS() = %v, ran %v, want f run in the daemon namespace", err, ran)
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/rpc"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	defaultCNICacheDir = "/var/lib/cni/results"
+	defaultNetnsDir    = "/var/run/netns"
+)
+
+// ImportRequest asks the daemon to take over the lease for an address that
+// was acquired by another DHCP daemon, e.g. the upstream one.
+type ImportRequest struct {
+	Args skel.CmdArgs
+	IP   net.IP
+}
+
+// Import acquires a lease for the container, asking the server for the
+// address the container already has. The upstream daemon uses the same
+// client identifier, so the server normally hands out the same address. If
+// it doesn't, the new lease is released again, since the container keeps
+// its configured address.
+func (d *DHCP) Import(req *ImportRequest, result *current.Result) error {
+	conf := NetConf{}
+	if err := json.Unmarshal(req.Args.StdinData, &conf); err != nil {
+		return fmt.Errorf("error parsing netconf: %v", err)
+	}
+	if conf.IPAM.Addresses > 1 {
+		return fmt.Errorf("importing attachments with multiple addresses is not supported")
+	}
+	clientID := generateClientID(req.Args.ContainerID, conf.Name, req.Args.IfName)
+	if d.getLease(clientID) != nil {
+		return fmt.Errorf("lease for %v already exists", clientID)
+	}
+
+	result.CNIVersion = current.ImplementedSpecVersion
+	if _, err := d.allocate(&req.Args, &conf, result, req.IP); err != nil {
+		return err
+	}
+	if len(result.IPs) == 0 || !result.IPs[0].Address.IP.Equal(req.IP) {
+		d.removeLease(clientID)
+		return fmt.Errorf("server did not assign %v to %v again", req.IP, clientID)
+	}
+	return nil
+}
+
+// cniCacheEntry is the result cache written by libcni for each attachment.
+type cniCacheEntry struct {
+	Kind        string      `json:"kind"`
+	ContainerID string      `json:"containerId"`
+	Config      []byte      `json:"config"`
+	IfName      string      `json:"ifName"`
+	NetworkName string      `json:"networkName"`
+	CniArgs     [][2]string `json:"cniArgs,omitempty"`
+	Result      struct {
+		IPs []struct {
+			Address string `json:"address"`
+		} `json:"ips"`
+	} `json:"result"`
+}
+
+// importCommand implements "dhcp import". It finds the attachments using the
+// dhcp IPAM plugin in the runtime's CNI result cache, looks up their network
+// namespace by the configured address, and imports their leases.
+func importCommand(args []string) error {
+	var socketPath, tokenFile, cacheDir, netnsDir string
+	var dryRun bool
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.StringVar(&socketPath, "socketpath", defaultSocketPath, "dhcp daemon socket path")
+	flags.StringVar(&tokenFile, "token-file", "", "file with the token the daemon requires, see -auth-token-file")
+	flags.StringVar(&cacheDir, "cachedir", defaultCNICacheDir, "CNI result cache directory")
+	flags.StringVar(&netnsDir, "netnsdir", defaultNetnsDir, "directory of the container network namespaces")
+	flags.BoolVar(&dryRun, "dry-run", false, "only print the leases that would be imported")
+	flags.Parse(args)
+
+	files, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return fmt.Errorf("failed to read CNI cache: %v", err)
+	}
+
+	var client *rpc.Client
+	if !dryRun {
+		token, err := readTokenFlag(tokenFile)
+		if err != nil {
+			return err
+		}
+		if client, err = dialDaemon(socketPath, token); err != nil {
+			return fmt.Errorf("error dialing DHCP daemon: %v", err)
+		}
+		defer client.Close()
+	}
+
+	failed := 0
+	for _, file := range files {
+		req, err := importRequestFromCache(filepath.Join(cacheDir, file.Name()), netnsDir)
+		if err != nil {
+			log.Printf("%s: %v", file.Name(), err)
+			failed++
+			continue
+		}
+		if req == nil {
+			continue
+		}
+
+		if dryRun {
+			fmt.Printf("%s/%s: would import %v in %s\n", req.Args.ContainerID, req.Args.IfName, req.IP, req.Args.Netns)
+			continue
+		}
+		result := &current.Result{}
+		if err := client.Call("DHCP.Import", req, result); err != nil {
+			log.Printf("%s/%s: failed to import %v: %v", req.Args.ContainerID, req.Args.IfName, req.IP, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s/%s: imported %v\n", req.Args.ContainerID, req.Args.IfName, req.IP)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d attachments could not be imported", failed)
+	}
+	return nil
+}
+
+// importRequestFromCache builds the import request for a cache entry. It
+// returns nil for attachments not using the dhcp IPAM plugin.
+func importRequestFromCache(path, netnsDir string) (*ImportRequest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entry cniCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse cache entry: %v", err)
+	}
+
+	conf, err := dhcpPluginConfig(entry.Config)
+	if err != nil || conf == nil {
+		return nil, err
+	}
+
+	var ip net.IP
+	for _, ipc := range entry.Result.IPs {
+		if addr, _, err := net.ParseCIDR(ipc.Address); err == nil && addr.To4() != nil {
+			ip = addr.To4()
+			break
+		}
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("cached result has no IPv4 address")
+	}
+
+	netns, err := findNetnsWithAddress(netnsDir, entry.IfName, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	cniArgs := make([]string, 0, len(entry.CniArgs))
+	for _, arg := range entry.CniArgs {
+		cniArgs = append(cniArgs, arg[0]+"="+arg[1])
+	}
+
+	return &ImportRequest{
+		Args: skel.CmdArgs{
+			ContainerID: entry.ContainerID,
+			Netns:       netns,
+			IfName:      entry.IfName,
+			Args:        strings.Join(cniArgs, ";"),
+			StdinData:   conf,
+		},
+		IP: ip,
+	}, nil
+}
+
+// dhcpPluginConfig returns the network config the dhcp IPAM plugin is called
+// with for the cached network config or config list, or nil if the network
+// doesn't use it.
+func dhcpPluginConfig(config []byte) ([]byte, error) {
+	var list struct {
+		CNIVersion string                   `json:"cniVersion"`
+		Name       string                   `json:"name"`
+		Plugins    []map[string]interface{} `json:"plugins"`
+		IPAM       struct {
+			Type string `json:"type"`
+		} `json:"ipam"`
+	}
+	if err := json.Unmarshal(config, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse cached network config: %v", err)
+	}
+
+	if list.Plugins == nil {
+		if list.IPAM.Type != "dhcp" {
+			return nil, nil
+		}
+		return config, nil
+	}
+
+	for _, plugin := range list.Plugins {
+		ipam, _ := plugin["ipam"].(map[string]interface{})
+		if ipam == nil || ipam["type"] != "dhcp" {
+			continue
+		}
+		// libcni passes the list's name and version to each plugin
+		plugin["name"] = list.Name
+		plugin["cniVersion"] = list.CNIVersion
+		return json.Marshal(plugin)
+	}
+	return nil, nil
+}
+
+// findNetnsWithAddress returns the path of the network namespace in dir in
+// which ifName has ip configured.
+func findNetnsWithAddress(dir, ifName string, ip net.IP) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		found := false
+		err := ns.WithNetNSPath(path, func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(ifName)
+			if err != nil {
+				return nil
+			}
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			if err != nil {
+				return err
+			}
+			for _, addr := range addrs {
+				if addr.IP.Equal(ip) {
+					found = true
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("skipping network namespace %s: %v", path, err)
+			continue
+		}
+		if found {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no network namespace in %s has %v on %s", dir, ip, ifName)
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDHCPPluginConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name:   "single config",
+			config: `{"cniVersion":"0.4.0","name":"net","type":"macvlan","ipam":{"type":"dhcp"}}`,
+			want: map[string]interface{}{
+				"cniVersion": "0.4.0", "name": "net", "type": "macvlan",
+				"ipam": map[string]interface{}{"type": "dhcp"},
+			},
+		},
+		{
+			name: "config list",
+			config: `{"cniVersion":"0.4.0","name":"net","plugins":[
+				{"type":"bridge","ipam":{"type":"dhcp","daemonSocketPath":"/run/dhcp.sock"}},
+				{"type":"portmap"}]}`,
+			want: map[string]interface{}{
+				"cniVersion": "0.4.0", "name": "net", "type": "bridge",
+				"ipam": map[string]interface{}{"type": "dhcp", "daemonSocketPath": "/run/dhcp.sock"},
+			},
+		},
+		{
+			name:   "other ipam",
+			config: `{"cniVersion":"0.4.0","name":"net","plugins":[{"type":"bridge","ipam":{"type":"host-local"}}]}`,
+		},
+		{
+			name:    "invalid",
+			config:  `{`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dhcpPluginConfig([]byte(tt.config))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dhcpPluginConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("dhcpPluginConfig() = %s, want nil", got)
+				}
+				return
+			}
+			var gotMap map[string]interface{}
+			if err := json.Unmarshal(got, &gotMap); err != nil {
+				t.Fatalf("dhcpPluginConfig() returned invalid JSON: %v", err)
+			}
+			if !reflect.DeepEqual(gotMap, tt.want) {
+				t.Errorf("dhcpPluginConfig() = %v, want %v", gotMap, tt.want)
+			}
+		})
+	}
+}
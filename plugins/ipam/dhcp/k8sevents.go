@@ -0,0 +1,96 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+
+	kapiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	eventReasonAllocateFailed = "DHCPAllocateFailed"
+	eventReasonRenewFailed    = "DHCPRenewFailed"
+	eventReasonFallback       = "DHCPFallback"
+	eventReasonRogueServer    = "DHCPRogueServer"
+	eventReasonServerChanged  = "DHCPServerChanged"
+	eventReasonAddressChanged = "DHCPAddressChanged"
+	eventReasonLeaseExpired   = "DHCPLeaseExpired"
+)
+
+// podEventRecorder posts Kubernetes Events on the pods whose leases fail.
+type podEventRecorder struct {
+	pods     typedcorev1.PodsGetter
+	recorder record.EventRecorder
+}
+
+func newPodEventRecorder(clientset kubernetes.Interface, nodeName string) *podEventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return &podEventRecorder{
+		pods: clientset.CoreV1(),
+		recorder: broadcaster.NewRecorder(scheme.Scheme, kapiv1.EventSource{
+			Component: "dhcp-daemon",
+			Host:      nodeName,
+		}),
+	}
+}
+
+// warn posts a Warning Event on the pod in the background. Events need the
+// pod's UID to show up in "kubectl describe", so the pod is looked up first.
+func (r *podEventRecorder) warn(namespace, name, reason, message string) {
+	if r == nil || name == "" {
+		return
+	}
+	go func() {
+		pod, err := r.pods.Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			log.Printf("failed to look up pod %s/%s for %s event: %v", namespace, name, reason, err)
+			return
+		}
+		r.recorder.Event(pod, kapiv1.EventTypeWarning, reason, message)
+	}()
+}
+
+// deletePod posts a Warning Event on the pod and deletes it in the
+// background, so that its controller replaces it. The UID precondition
+// spares a pod recreated with the same name. It returns false when there is
+// no client or pod to delete.
+func (r *podEventRecorder) deletePod(namespace, name, reason, message string) bool {
+	if r == nil || name == "" {
+		return false
+	}
+	go func() {
+		pod, err := r.pods.Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			log.Printf("failed to look up pod %s/%s for deletion: %v", namespace, name, err)
+			return
+		}
+		r.recorder.Event(pod, kapiv1.EventTypeWarning, reason, message)
+		err = r.pods.Pods(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &pod.UID},
+		})
+		if err != nil {
+			log.Printf("failed to delete pod %s/%s: %v", namespace, name, err)
+		}
+	}()
+	return true
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	kapiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestPodEventRecorderWarn(t *testing.T) {
+	client := fake.NewSimpleClientset(&kapiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+	})
+	recorder := record.NewFakeRecorder(10)
+	r := &podEventRecorder{pods: client.CoreV1(), recorder: recorder}
+
+	r.warn("default", "web", eventReasonAllocateFailed, "no offer received")
+	select {
+	case event := <-recorder.Events:
+		if want := "Warning DHCPAllocateFailed no offer received"; event != want {
+			t.Errorf("got event %q, want %q", event, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event posted")
+	}
+
+	// unknown pods and leases without a pod don't get events
+	r.warn("default", "gone", eventReasonRenewFailed, "NAK")
+	r.warn("", "", eventReasonRenewFailed, "NAK")
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("got unexpected event %q", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// without a Kubernetes client there is no recorder
+	var none *podEventRecorder
+	none.warn("default", "web", eventReasonRenewFailed, "NAK")
+}
+
+func TestPodEventRecorderDeletePod(t *testing.T) {
+	client := fake.NewSimpleClientset(&kapiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "uid-a"},
+	})
+	recorder := record.NewFakeRecorder(10)
+	r := &podEventRecorder{pods: client.CoreV1(), recorder: recorder}
+
+	if !r.deletePod("default", "web", eventReasonLeaseExpired, "lease expired") {
+		t.Fatal("deletePod() = false")
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, "Warning DHCPLeaseExpired") {
+			t.Errorf("got event %q", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event posted")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pods, err := client.CoreV1().Pods("default").List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pods.Items) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("pod not deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var none *podEventRecorder
+	if none.deletePod("default", "web", eventReasonLeaseExpired, "lease expired") {
+		t.Error("deletePod() without a client = true")
+	}
+}
@@ -24,9 +24,10 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/d2g/dhcp4"
-	"github.com/d2g/dhcp4client"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/time/rate"
 
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/plugins/pkg/ns"
@@ -46,44 +47,116 @@ const (
 	leaseStateBound = iota
 	leaseStateRenewing
 	leaseStateRebinding
+	leaseStateFallback
+	leaseStateExpired
 )
 
 // This implementation uses 1 OS thread per lease. This is because
 // all the network operations have to be done in network namespace
 // of the interface. This can be improved by switching to the proper
 // namespace for network ops and using fewer threads. However, this
-// needs to be done carefully as dhcp4client ops are blocking.
+// needs to be done carefully as the DHCP exchanges are blocking.
 
 type DHCPLease struct {
 	clientID      string
-	ack           *dhcp4.Packet
-	opts          dhcp4.Options
+	ack           *dhcpv4.DHCPv4
 	link          netlink.Link
 	renewalTime   time.Time
 	rebindingTime time.Time
 	expireTime    time.Time
 	timeout       time.Duration
-	resendMax     time.Duration
+	retry         RetryPolicy
 	broadcast     bool
-	stopping      uint32
-	stop          chan struct{}
-	wg            sync.WaitGroup
+	rapidCommit   bool
+	arpProbe      bool
+	// the settings above that the network config sets, see networkOverrides
+	overrides networkOverrides
+	// bounds applied to the timers from the ACK, zero if unset
+	minRenewalTime time.Duration
+	maxLeaseTime   time.Duration
+	stopping       uint32
+	detached       uint32
+	// set when the server NAKs the lease, cleared by the next ACK
+	nakd uint32
+	// the address is remembered for the pod, see stableAddresses
+	stableIP bool
+	// set when the server leased the address forever. The timers are then
+	// zero and the lease is only renewed on request.
+	infinite bool
+	// set while the lease is based on an address of the fallback pool
+	synthetic uint32
+	stop      chan struct{}
+	renewNow  chan struct{}
+	wg        sync.WaitGroup
 	// list of requesting and providing options and if they are necessary / their value
-	optsRequesting map[dhcp4.OptionCode]bool
-	optsProviding  map[dhcp4.OptionCode][]byte
+	optsRequesting map[uint8]bool
+	optsProviding  dhcpv4.Options
 	k8sNamespace   string
 	k8sPodName     string
+	k8sPodUID      string
+	hostname       string
+	fqdn           []byte
 	netNs          string
 	interfaceName  string
+	// client identifier option value including the type octet, derived from clientID when nil
+	clientIdentifier []byte
+	// sent as chaddr instead of the link's hardware address, unless nil
+	hwAddr net.HardwareAddr
+	// relay agent settings, nil when broadcasting on the link
+	relay *relayAgent
+	// replies from other servers are ignored, unless empty
+	allowedServers []net.IP
+	// offered addresses in these ranges are declined
+	excludeRanges []*net.IPNet
+	// address asked for in the first DISCOVER, nil if none
+	requestedIP net.IP
+	// offers of other addresses are released, unless nil
+	requiredIP net.IP
+	// name of the network, used to track the servers answering on it
+	network string
+	// how replies from unknown servers are handled, one of the rogueServer* values
+	rogueServers string
+	// the lease's link is a VLAN subinterface created for it
+	vlanCreated bool
+	// what happens when another server than the one that granted the lease
+	// answers, see checkServerChange
+	serverChange string
+	// what happens when the lease expires, one of the expiryPolicy* values
+	expiryPolicy string
+	// how routers and static routes are combined
+	routePolicy RoutePolicy
+	// don't set the server's Interface MTU option on the link
+	ignoreMTU bool
+	// one of the clientSocket* values, empty for the default
+	clientSocket string
+	// QoS marking of the messages
+	marking packetMarking
+	// handle of netNs kept open while the lease is maintained
+	netNSMux   sync.Mutex
+	netNSCache ns.NetNS
+	// shared with the daemon's other leases
+	env leaseEnv
 }
 
-var requestOptionsDefault = map[dhcp4.OptionCode]bool{
-	dhcp4.OptionRouter:     true,
-	dhcp4.OptionSubnetMask: true,
+var requestOptionsDefault = map[uint8]bool{
+	dhcpv4.OptionRouter.Code():     true,
+	dhcpv4.OptionSubnetMask.Code(): true,
+	// optional, but some servers only send the DNS options when asked for them
+	dhcpv4.OptionDomainNameServer.Code(): false,
+	dhcpv4.OptionDomainName.Code():       false,
+}
+
+// options always asked for in a DHCPINFORM, since fetching them is its only purpose
+var informOptionsDefault = map[uint8]bool{
+	dhcpv4.OptionDomainNameServer.Code():     false,
+	dhcpv4.OptionDomainName.Code():           false,
+	dhcpv4.OptionNTPServers.Code():           false,
+	dhcpv4.OptionStaticRoutingTable.Code():   false,
+	dhcpv4.OptionClasslessStaticRoute.Code(): false,
 }
 
 func prepareOptions(cniArgs string, ProvideOptions []ProvideOption, RequestOptions []RequestOption) (
-	optsRequesting map[dhcp4.OptionCode]bool, optsProviding map[dhcp4.OptionCode][]byte, err error) {
+	optsRequesting map[uint8]bool, optsProviding dhcpv4.Options, err error) {
 
 	// parse CNI args
 	cniArgsParsed := map[string]string{}
@@ -95,8 +168,8 @@ func prepareOptions(cniArgs string, ProvideOptions []ProvideOption, RequestOptio
 	}
 
 	// parse providing options map
-	var optParsed dhcp4.OptionCode
-	optsProviding = make(map[dhcp4.OptionCode][]byte)
+	var optParsed uint8
+	optsProviding = make(dhcpv4.Options)
 	for _, opt := range ProvideOptions {
 		optParsed, err = parseOptionName(string(opt.Option))
 		if err != nil {
@@ -104,11 +177,12 @@ func prepareOptions(cniArgs string, ProvideOptions []ProvideOption, RequestOptio
 			return
 		}
 		if len(opt.Value) > 0 {
-			if len(opt.Value) > 255 {
-				err = fmt.Errorf("value too long for option %q: %q", opt.Option, opt.Value)
+			value := podTemplateReplacer(cniArgsParsed["K8S_POD_NAMESPACE"], cniArgsParsed["K8S_POD_NAME"]).Replace(opt.Value)
+			if len(value) > 255 {
+				err = fmt.Errorf("value too long for option %q: %q", opt.Option, value)
 				return
 			}
-			optsProviding[optParsed] = []byte(opt.Value)
+			optsProviding[optParsed] = []byte(value)
 		}
 		if value, ok := cniArgsParsed[opt.ValueFromCNIArg]; ok {
 			if len(value) > 255 {
@@ -117,10 +191,15 @@ func prepareOptions(cniArgs string, ProvideOptions []ProvideOption, RequestOptio
 			}
 			optsProviding[optParsed] = []byte(value)
 		}
+		if value, ok := optsProviding[optParsed]; ok && optParsed == dhcpv4.OptionUserClassInformation.Code() {
+			if optsProviding[optParsed], err = encodeUserClass(string(value)); err != nil {
+				return
+			}
+		}
 	}
 
 	// parse necessary options map
-	optsRequesting = make(map[dhcp4.OptionCode]bool)
+	optsRequesting = make(map[uint8]bool)
 	skipRequireDefault := false
 	for _, opt := range RequestOptions {
 		if opt.SkipDefault {
@@ -142,31 +221,118 @@ func prepareOptions(cniArgs string, ProvideOptions []ProvideOption, RequestOptio
 	return
 }
 
+// leaseEnv is what the daemon shares with all its leases: the settings that
+// aren't per network and where the leases report to. The zero value, e.g.
+// outside of the daemon, disables all of them.
+type leaseEnv struct {
+	// fraction of their remaining time renewal and rebinding times are moved
+	// by at random, so that leases acquired or reloaded together don't renew
+	// at the same instant
+	renewalJitter float64
+	// leases aren't maintained in the background, but renewed by
+	// "dhcp renew-all"
+	oneShot bool
+	// called once an expired lease was replaced, so that the daemon writes
+	// the new lease to the store
+	reacquired func()
+	// retains the most recent DHCP transactions for the "transactions" admin
+	// command, nothing unless -trace-transactions is set
+	trace *transactionLog
+	// bounds the rate of DHCP exchanges (DISCOVER/REQUEST and their retries)
+	// across all leases, unlimited if nil
+	limiter *rate.Limiter
+	// Kubernetes Events, webhook and pod annotations the lease lifecycle is
+	// reported to, each disabled when nil
+	events      *podEventRecorder
+	webhook     *eventWebhook
+	annotations *podAnnotator
+}
+
+// leaseConfig holds the settings AcquireLease acquires and maintains a lease
+// with.
+type leaseConfig struct {
+	clientID         string
+	clientIdentifier []byte
+	netns            string
+	ifName           string
+	hostname         string
+	fqdn             []byte
+	optsRequesting   map[uint8]bool
+	optsProviding    dhcpv4.Options
+	args             IPAMArgs
+	timeout          time.Duration
+	retry            RetryPolicy
+	broadcast        bool
+	rapidCommit      bool
+	arpProbe         bool
+	minRenewalTime   time.Duration
+	maxLeaseTime     time.Duration
+	relay            *relayAgent
+	allowedServers   []net.IP
+	excludeRanges    []*net.IPNet
+	requestedIP      net.IP
+	fallback         *fallbackPool
+	network          string
+	rogueServers     string
+	serverChange     string
+	hwAddr           net.HardwareAddr
+	expiryPolicy     string
+	routePolicy      RoutePolicy
+	ignoreMTU        bool
+	clientSocket     string
+	marking          packetMarking
+	stableIP         bool
+	vlanCreated      bool
+	overrides        networkOverrides
+	env              leaseEnv
+}
+
 // AcquireLease gets an DHCP lease and then maintains it in the background
 // by periodically renewing it. The acquired lease can be released by
 // calling DHCPLease.Stop()
-func AcquireLease(
-	clientID, netns, ifName string,
-	optsRequesting map[dhcp4.OptionCode]bool, optsProviding map[dhcp4.OptionCode][]byte, args IPAMArgs,
-	timeout, resendMax time.Duration, broadcast bool,
-) (*DHCPLease, error) {
+func AcquireLease(c leaseConfig) (*DHCPLease, error) {
 	l := &DHCPLease{
-		clientID:       clientID,
-		stop:           make(chan struct{}),
-		timeout:        timeout,
-		resendMax:      resendMax,
-		broadcast:      broadcast,
-		optsRequesting: optsRequesting,
-		optsProviding:  optsProviding,
-		netNs:          netns,
-		k8sNamespace:   string(args.K8S_POD_NAMESPACE),
-		k8sPodName:     string(args.K8S_POD_NAME),
-	}
-
-	log.Printf("%v: acquiring lease (%s/%s)", clientID, l.k8sNamespace, l.k8sPodName)
-
-	err := ns.WithNetNSPath(l.netNs, func(_ ns.NetNS) error {
-		link, err := netlink.LinkByName(ifName)
+		clientID:         c.clientID,
+		stop:             make(chan struct{}),
+		renewNow:         make(chan struct{}, 1),
+		timeout:          c.timeout,
+		retry:            c.retry,
+		overrides:        c.overrides,
+		marking:          c.marking,
+		broadcast:        c.broadcast,
+		rapidCommit:      c.rapidCommit,
+		arpProbe:         c.arpProbe,
+		minRenewalTime:   c.minRenewalTime,
+		maxLeaseTime:     c.maxLeaseTime,
+		relay:            c.relay,
+		allowedServers:   c.allowedServers,
+		excludeRanges:    c.excludeRanges,
+		requestedIP:      c.requestedIP,
+		network:          c.network,
+		rogueServers:     c.rogueServers,
+		serverChange:     c.serverChange,
+		vlanCreated:      c.vlanCreated,
+		optsRequesting:   c.optsRequesting,
+		optsProviding:    c.optsProviding,
+		netNs:            c.netns,
+		k8sNamespace:     string(c.args.K8S_POD_NAMESPACE),
+		k8sPodName:       string(c.args.K8S_POD_NAME),
+		k8sPodUID:        string(c.args.K8S_POD_UID),
+		hostname:         c.hostname,
+		fqdn:             c.fqdn,
+		clientIdentifier: c.clientIdentifier,
+		hwAddr:           c.hwAddr,
+		expiryPolicy:     c.expiryPolicy,
+		routePolicy:      c.routePolicy,
+		ignoreMTU:        c.ignoreMTU,
+		clientSocket:     c.clientSocket,
+		env:              c.env,
+	}
+
+	log.Printf("%v: acquiring lease (%s/%s)", c.clientID, l.k8sNamespace, l.k8sPodName)
+
+	err := withLeaseNetNS(l.netNs, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(c.ifName)
 		if err != nil {
 			return fmt.Errorf("error looking up %q: %v", l.interfaceName, err)
 		}
@@ -174,15 +340,30 @@ func AcquireLease(
 		l.link = link
 
 		if err = l.acquire(); err != nil {
-			return err
+			if err != errNoMoreTries {
+				return err
+			}
+			if c.fallback == nil {
+				return l.exchangeError()
+			}
+			if err = l.useFallback(c.fallback); err != nil {
+				return types.NewError(errCodeNoOffer, "no DHCP server answered and no fallback address is available", err.Error())
+			}
+			log.Printf("%v: no DHCP server answered, using fallback address %v", l.clientID, l.ack.YourIPAddr)
+			l.env.events.warn(l.k8sNamespace, l.k8sPodName, eventReasonFallback,
+				fmt.Sprintf("no DHCP server answered, using fallback address %v", l.ack.YourIPAddr))
+		} else {
+			log.Printf("%v: lease acquired, expiration is %v", l.clientID, l.expiration())
 		}
-		log.Printf("%v: lease acquired, expiration is %v", l.clientID, l.expireTime)
+		l.notify(leaseEventAcquired)
 
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	// addresses of the fallback pool aren't the server's to remember
+	l.stableIP = c.stableIP && !l.isSynthetic()
 	err = l.StartMaintaining()
 
 	if err != nil {
@@ -192,24 +373,71 @@ func AcquireLease(
 	return l, nil
 }
 
-func (l *DHCPLease) StartMaintaining() error {
-	errCh := make(chan error, 1)
-	l.wg.Add(1)
+// InformLease fetches configuration parameters for an address that was
+// assigned outside of DHCP by sending a DHCPINFORM. The returned lease
+// only carries the server's options and is never maintained. Of c, only the
+// settings of the exchange are used.
+func InformLease(c leaseConfig, addr net.IP) (*DHCPLease, error) {
+	for k, v := range informOptionsDefault {
+		if _, ok := c.optsRequesting[k]; !ok {
+			c.optsRequesting[k] = v
+		}
+	}
 
-	go func() {
-		errCh <- ns.WithNetNSPath(l.netNs, func(_ ns.NetNS) error {
-			defer l.wg.Done()
+	l := &DHCPLease{
+		clientID:         c.clientID,
+		clientIdentifier: c.clientIdentifier,
+		timeout:          c.timeout,
+		retry:            c.retry,
+		marking:          c.marking,
+		broadcast:        true,
+		optsRequesting:   c.optsRequesting,
+		optsProviding:    c.optsProviding,
+		netNs:            c.netns,
+		hostname:         c.hostname,
+		allowedServers:   c.allowedServers,
+		routePolicy:      c.routePolicy,
+		env:              c.env,
+	}
 
-			errCh <- nil
+	log.Printf("%v: sending DHCPINFORM for %v", c.clientID, addr)
 
-			l.maintain()
-			return nil
-		})
-	}()
+	err := withLeaseNetNS(l.netNs, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(c.ifName)
+		if err != nil {
+			return fmt.Errorf("error looking up %q: %v", c.ifName, err)
+		}
+
+		l.link = link
+
+		if err := l.inform(addr); err != errNoMoreTries {
+			return err
+		}
+		return l.exchangeError()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
 
-	if err := <-errCh; err != nil {
+func (l *DHCPLease) StartMaintaining() error {
+	if l.env.oneShot {
+		// renewed by "dhcp renew-all"
+		return nil
+	}
+	if _, err := l.netNSHandle(); err != nil {
 		return err
 	}
+	l.wg.Add(1)
+
+	go func() {
+		defer l.wg.Done()
+		defer l.closeNetNS()
+
+		l.maintain()
+	}()
 
 	return nil
 }
@@ -219,37 +447,83 @@ func (l *DHCPLease) StartMaintaining() error {
 func (l *DHCPLease) Stop() {
 	if atomic.CompareAndSwapUint32(&l.stopping, 0, 1) {
 		close(l.stop)
+		if l.env.oneShot {
+			l.releaseOneShot()
+		}
 	}
 	l.wg.Wait()
 }
 
-func (l *DHCPLease) getOptionsWithClientId() dhcp4.Options {
-	opts := make(dhcp4.Options)
-	opts[dhcp4.OptionClientIdentifier] = []byte(l.clientID)
-	// client identifier's first byte is "type"
-	newClientID := []byte{0}
-	newClientID = append(newClientID, opts[dhcp4.OptionClientIdentifier]...)
-	opts[dhcp4.OptionClientIdentifier] = newClientID
-	opts[dhcp4.OptionHostName] = []byte(l.k8sPodName)
+// releaseOneShot releases a lease that is not maintained in the
+// background, which the maintain loop does otherwise.
+func (l *DHCPLease) releaseOneShot() {
+	err := withLeaseNetNS(l.netNs, func(_ ns.NetNS) error {
+		return l.release()
+	})
+	if err != nil {
+		log.Printf("%v: failed to release DHCP lease: %v", l.clientID, err)
+	}
+	l.notify(leaseEventReleased)
+}
+
+// Detach terminates the background task that maintains the lease without
+// releasing it, so that another daemon can take it over.
+func (l *DHCPLease) Detach() {
+	atomic.StoreUint32(&l.detached, 1)
+	l.Stop()
+}
+
+// Renew makes the lease renew immediately instead of waiting for T1.
+func (l *DHCPLease) Renew() {
+	select {
+	case l.renewNow <- struct{}{}:
+	default:
+	}
+}
+
+func (l *DHCPLease) getOptionsWithClientId() dhcpv4.Options {
+	opts := make(dhcpv4.Options)
+	if l.clientIdentifier != nil {
+		opts[dhcpv4.OptionClientIdentifier.Code()] = l.clientIdentifier
+	} else {
+		opts[dhcpv4.OptionClientIdentifier.Code()] = []byte(l.clientID)
+		// client identifier's first byte is "type"
+		newClientID := []byte{0}
+		newClientID = append(newClientID, opts[dhcpv4.OptionClientIdentifier.Code()]...)
+		opts[dhcpv4.OptionClientIdentifier.Code()] = newClientID
+	}
+	if l.hostname != "" {
+		opts[dhcpv4.OptionHostName.Code()] = []byte(l.hostname)
+	}
+	if l.fqdn != nil {
+		opts[dhcpv4.OptionFQDN.Code()] = l.fqdn
+	}
 	return opts
 }
 
-func (l *DHCPLease) getAllOptions() dhcp4.Options {
+// getProvidedOptions returns the options identifying the client along with
+// the ones configured to be provided to the server.
+func (l *DHCPLease) getProvidedOptions() dhcpv4.Options {
 	opts := l.getOptionsWithClientId()
 
 	for k, v := range l.optsProviding {
 		opts[k] = v
 	}
+	return opts
+}
 
-	opts[dhcp4.OptionParameterRequestList] = []byte{}
+func (l *DHCPLease) getAllOptions() dhcpv4.Options {
+	opts := l.getProvidedOptions()
+
+	opts[dhcpv4.OptionParameterRequestList.Code()] = []byte{}
 	for k := range l.optsRequesting {
-		opts[dhcp4.OptionParameterRequestList] = append(opts[dhcp4.OptionParameterRequestList], byte(k))
+		opts[dhcpv4.OptionParameterRequestList.Code()] = append(opts[dhcpv4.OptionParameterRequestList.Code()], byte(k))
 	}
 	return opts
 }
 
 func (l *DHCPLease) acquire() error {
-	c, err := newDHCPClient(l.link, l.clientID, l.timeout, l.broadcast)
+	c, err := l.newClient()
 	if err != nil {
 		return err
 	}
@@ -262,18 +536,53 @@ func (l *DHCPLease) acquire() error {
 		}
 	}
 
-	opts := l.getOptionsWithClientId()
+	opts := l.getProvidedOptions()
+	if ip := l.requestedIP.To4(); ip != nil {
+		opts[dhcpv4.OptionRequestedIPAddress.Code()] = ip
+	}
 
-	pkt, err := backoffRetry(l.resendMax, func() (*dhcp4.Packet, error) {
-		ok, ack, err := DhcpRequest(c, opts)
+	pkt, err := l.backoffRetry(func() (*dhcpv4.DHCPv4, error) {
+		var ok bool
+		var ack *dhcpv4.DHCPv4
+		var err error
+		if l.rapidCommit {
+			ok, ack, err = DhcpRapidCommitRequest(c, l.timeout, opts)
+		} else {
+			ok, ack, err = DhcpRequest(c, opts)
+		}
 		switch {
 		case err != nil:
 			return nil, err
 		case !ok:
+			l.recordNak(ack)
 			return nil, fmt.Errorf("DHCP server NACK'd own offer")
-		default:
-			return &ack, nil
+		case l.requiredIP != nil && !ack.YourIPAddr.Equal(l.requiredIP):
+			if err := DhcpRelease(c, ack, opts); err != nil {
+				log.Printf("%v: failed to release %v: %v", l.clientID, ack.YourIPAddr, err)
+			}
+			return nil, fmt.Errorf("DHCP server assigned %v instead of %v", ack.YourIPAddr, l.requiredIP)
 		}
+
+		if r := excludedRange(l.excludeRanges, ack.YourIPAddr); r != nil {
+			log.Printf("%v: address %v is in excluded range %v, declining", l.clientID, ack.YourIPAddr, r)
+			if _, err := DhcpSendDecline(c, ack, opts); err != nil {
+				log.Printf("%v: failed to send DHCPDECLINE: %v", l.clientID, err)
+			}
+			// asking for it again would get the same offer
+			delete(opts, dhcpv4.OptionRequestedIPAddress.Code())
+			return nil, fmt.Errorf("DHCP server offered %v in excluded range %v", ack.YourIPAddr, r)
+		}
+
+		if err := l.checkServerChange(ack); err != nil {
+			return nil, err
+		}
+
+		if l.arpProbe {
+			if err := l.checkAddressUnused(c, ack, opts); err != nil {
+				return nil, err
+			}
+		}
+		return ack, nil
 	})
 	if err != nil {
 		return err
@@ -282,8 +591,68 @@ func (l *DHCPLease) acquire() error {
 	return l.commit(pkt)
 }
 
-func (l *DHCPLease) commit(ack *dhcp4.Packet) error {
-	opts := ack.ParseOptions()
+// checkAddressUnused probes the acknowledged address with ARP. If another
+// host answers, the address is declined so the server marks it as in use.
+func (l *DHCPLease) checkAddressUnused(c *dhcpClient, ack *dhcpv4.DHCPv4, opts dhcpv4.Options) error {
+	ip := ack.YourIPAddr
+	inUse, err := arpProbe(l.link, ip)
+	if err != nil {
+		// don't fail the allocation because probing isn't possible
+		log.Printf("%v: ARP probe for %v failed: %v", l.clientID, ip, err)
+		return nil
+	}
+	if !inUse {
+		return nil
+	}
+
+	log.Printf("%v: address %v is already in use, declining", l.clientID, ip)
+	if _, err := DhcpSendDecline(c, ack, opts); err != nil {
+		log.Printf("%v: failed to send DHCPDECLINE: %v", l.clientID, err)
+	}
+	return fmt.Errorf("address %v offered by DHCP server is already in use", ip)
+}
+
+// announceAddress sends gratuitous ARP for ip on links that use ARP. It
+// must be called in the link's namespace.
+func (l *DHCPLease) announceAddress(ip net.IP) {
+	if l.link == nil || !usesARP(l.link) {
+		return
+	}
+	if err := arpAnnounce(l.link, ip); err != nil {
+		log.Printf("%v: %v", l.clientID, err)
+	}
+}
+
+func (l *DHCPLease) inform(addr net.IP) error {
+	c, err := l.newClient()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if (l.link.Attrs().Flags & net.FlagUp) != net.FlagUp {
+		log.Printf("Link %q down. Attempting to set up", l.link.Attrs().Name)
+		if err = netlink.LinkSetUp(l.link); err != nil {
+			return err
+		}
+	}
+
+	opts := l.getAllOptions()
+
+	pkt, err := l.backoffRetry(func() (*dhcpv4.DHCPv4, error) {
+		return DhcpInform(c, l.hardwareAddr(), addr, opts)
+	})
+	if err != nil {
+		return err
+	}
+
+	// there is no lease time in an ACK to DHCPINFORM, so only keep the options
+	l.ack = pkt
+	return nil
+}
+
+func (l *DHCPLease) commit(ack *dhcpv4.DHCPv4) error {
+	opts := ack.Options
 
 	leaseTime, err := parseLeaseTime(opts)
 	if err != nil {
@@ -302,24 +671,89 @@ func (l *DHCPLease) commit(ack *dhcp4.Packet) error {
 		renewalTime = leaseTime / 2
 	}
 
-	now := time.Now()
-	l.expireTime = now.Add(leaseTime)
-	l.renewalTime = now.Add(renewalTime)
-	l.rebindingTime = now.Add(rebindingTime)
+	leaseTime, rebindingTime, renewalTime = clampLeaseTimes(leaseTime, rebindingTime, renewalTime, l.minRenewalTime, l.maxLeaseTime)
+
+	// maxLeaseTime still has infinite leases renewed
+	l.infinite = isInfiniteLease(opts) && l.maxLeaseTime == 0
+	if l.infinite {
+		l.expireTime, l.renewalTime, l.rebindingTime = time.Time{}, time.Time{}, time.Time{}
+	} else {
+		now := time.Now()
+		l.expireTime = now.Add(leaseTime)
+		l.renewalTime = now.Add(renewalTime)
+		l.rebindingTime = now.Add(rebindingTime)
+		l.applyRenewalJitter(now)
+	}
+	if l.ack == nil || !l.ack.YourIPAddr.Equal(ack.YourIPAddr) {
+		l.announceAddress(ack.YourIPAddr)
+	}
 	l.ack = ack
-	l.opts = opts
+	atomic.StoreUint32(&l.nakd, 0)
+	l.requestedIP = nil
+	recordExchange()
+	l.applyMTU()
 
 	return nil
 }
 
+// expiration describes when the lease expires, for logs.
+func (l *DHCPLease) expiration() string {
+	if l.infinite {
+		return "never"
+	}
+	return l.expireTime.String()
+}
+
+// recordNak marks the lease as rejected if pkt is a DHCPNAK.
+func (l *DHCPLease) recordNak(pkt *dhcpv4.DHCPv4) {
+	if isNak(pkt) {
+		atomic.StoreUint32(&l.nakd, 1)
+	}
+}
+
+func isNak(pkt *dhcpv4.DHCPv4) bool {
+	return pkt != nil && pkt.MessageType() == dhcpv4.MessageTypeNak
+}
+
+// clampLeaseTimes enforces a lower bound on the renewal time and an upper
+// bound on the lease time, independent of what the server handed out. Only
+// the renewal time is raised, and never past the rebinding time, so the
+// lease is not used longer than the server granted. A zero bound is ignored.
+func clampLeaseTimes(leaseTime, rebindingTime, renewalTime, minRenewal, maxLease time.Duration) (time.Duration, time.Duration, time.Duration) {
+	if maxLease > 0 && leaseTime > maxLease {
+		leaseTime = maxLease
+		if rebindingTime > leaseTime*85/100 {
+			rebindingTime = leaseTime * 85 / 100
+		}
+		if renewalTime > leaseTime/2 {
+			renewalTime = leaseTime / 2
+		}
+	}
+
+	if minRenewal > 0 && renewalTime < minRenewal {
+		renewalTime = minRenewal
+		if renewalTime > rebindingTime {
+			renewalTime = rebindingTime
+		}
+	}
+
+	return leaseTime, rebindingTime, renewalTime
+}
+
 func (l *DHCPLease) maintain() {
 	state := leaseStateBound
+	// set while rebinding an expired lease whose address is kept
+	expired := false
 
 	for {
 		var sleepDur time.Duration
 
 		switch state {
 		case leaseStateBound:
+			if l.infinite {
+				// only a renewal request or Stop wakes the lease up
+				break
+			}
 			sleepDur = l.renewalTime.Sub(time.Now())
 			if sleepDur <= 0 {
 				log.Printf("%v: renewing lease", l.clientID)
@@ -328,40 +762,119 @@ func (l *DHCPLease) maintain() {
 			}
 
 		case leaseStateRenewing:
-			if err := l.renew(); err != nil {
+			if l.isSynthetic() {
+				state = leaseStateFallback
+				continue
+			}
+			if err := l.inNetNS(l.renew); err != nil {
 				log.Printf("%v: %v", l.clientID, err)
+				l.env.events.warn(l.k8sNamespace, l.k8sPodName, eventReasonRenewFailed, err.Error())
 
-				if time.Now().After(l.rebindingTime) {
+				if l.infinite {
+					// the address is still leased, the renewal was only requested
+					state = leaseStateBound
+				} else if time.Now().After(l.rebindingTime) {
 					log.Printf("%v: renewal time expired, rebinding", l.clientID)
+					l.notify(leaseEventRebinding)
 					state = leaseStateRebinding
 				}
 			} else {
-				log.Printf("%v: lease renewed, expiration is %v", l.clientID, l.expireTime)
+				log.Printf("%v: lease renewed, expiration is %v", l.clientID, l.expiration())
+				l.notify(leaseEventRenewed)
 				state = leaseStateBound
 			}
 
 		case leaseStateRebinding:
-			if err := l.acquire(); err != nil {
+			if err := l.inNetNS(l.acquire); err != nil {
 				log.Printf("%v: %v", l.clientID, err)
+				l.env.events.warn(l.k8sNamespace, l.k8sPodName, eventReasonRenewFailed, err.Error())
 
 				if time.Now().After(l.expireTime) {
-					log.Printf("%v: lease expired, bringing interface DOWN", l.clientID)
-					l.downIface()
-					return
+					first := !expired
+					if first {
+						expired = true
+						l.notify(leaseEventExpired)
+					}
+					switch l.expiryPolicy {
+					case expiryPolicyReacquire:
+						log.Printf("%v: lease expired, removing the address and acquiring a new lease", l.clientID)
+						l.inNetNS(func() error {
+							l.removeAddress()
+							return nil
+						})
+						state = leaseStateExpired
+						continue
+					case expiryPolicyKeep:
+						if first {
+							log.Printf("%v: lease expired, keeping the address and rebinding", l.clientID)
+							l.expiryEvent("the address is kept until a server answers")
+						}
+						sleepDur = reacquireRetryInterval
+					default:
+						l.inNetNS(func() error {
+							l.expire()
+							return nil
+						})
+						return
+					}
 				}
 			} else {
-				log.Printf("%v: lease rebound, expiration is %v", l.clientID, l.expireTime)
+				expired = false
+				log.Printf("%v: lease rebound, expiration is %v", l.clientID, l.expiration())
+				l.notify(leaseEventRenewed)
 				state = leaseStateBound
 			}
+
+		case leaseStateExpired:
+			if err := l.inNetNS(l.reacquire); err != nil {
+				log.Printf("%v: %v", l.clientID, err)
+				l.env.events.warn(l.k8sNamespace, l.k8sPodName, eventReasonRenewFailed, err.Error())
+				sleepDur = reacquireRetryInterval
+			} else {
+				log.Printf("%v: lease acquired after expiry, expiration is %v", l.clientID, l.expiration())
+				l.notify(leaseEventAcquired)
+				if l.env.reacquired != nil {
+					l.env.reacquired()
+				}
+				state = leaseStateBound
+				continue
+			}
+
+		case leaseStateFallback:
+			if err := l.inNetNS(l.replaceFallback); err != nil {
+				log.Printf("%v: still using fallback address: %v", l.clientID, err)
+				l.extendFallback(time.Now())
+			} else {
+				log.Printf("%v: lease acquired for fallback address, expiration is %v", l.clientID, l.expiration())
+				l.notify(leaseEventAcquired)
+			}
+			state = leaseStateBound
+			continue
+		}
+
+		var wake <-chan time.Time
+		if state != leaseStateBound || !l.infinite {
+			wake = time.After(sleepDur)
 		}
 
 		select {
-		case <-time.After(sleepDur):
+		case <-wake:
+
+		case <-l.renewNow:
+			if state == leaseStateBound {
+				log.Printf("%v: renewal requested", l.clientID)
+				state = leaseStateRenewing
+			}
 
 		case <-l.stop:
-			if err := l.release(); err != nil {
+			if atomic.LoadUint32(&l.detached) == 1 {
+				log.Printf("%v: lease detached, no longer maintaining it", l.clientID)
+				return
+			}
+			if err := l.inNetNS(l.release); err != nil {
 				log.Printf("%v: failed to release DHCP lease: %v", l.clientID, err)
 			}
+			l.notify(leaseEventReleased)
 			return
 		}
 	}
@@ -374,23 +887,30 @@ func (l *DHCPLease) downIface() {
 }
 
 func (l *DHCPLease) renew() error {
-	c, err := newDHCPClient(l.link, l.clientID, l.timeout, l.broadcast)
+	// RFC 2131 section 4.4.5: in RENEWING state the request is unicast to
+	// the server that granted the lease. Broadcasting is left to REBINDING.
+	c, err := l.newRenewClient()
 	if err != nil {
 		return err
 	}
 	defer c.Close()
 
-	opts := l.getOptionsWithClientId()
-	pkt, err := backoffRetry(l.resendMax, func() (*dhcp4.Packet, error) {
-		ok, ack, err := DhcpRenew(c, *l.ack, opts)
+	opts := l.getProvidedOptions()
+	pkt, err := l.backoffRetry(func() (*dhcpv4.DHCPv4, error) {
+		ok, ack, err := DhcpRenew(c, l.ack, opts)
+		if !ok {
+			l.recordNak(ack)
+		}
 		switch {
 		case err != nil:
 			return nil, err
 		case !ok:
 			return nil, fmt.Errorf("DHCP server did not renew lease: %v", err)
-		default:
-			return &ack, nil
 		}
+		if err := l.checkServerChange(ack); err != nil {
+			return nil, err
+		}
+		return ack, nil
 	})
 	if err != nil {
 		return err
@@ -400,61 +920,178 @@ func (l *DHCPLease) renew() error {
 	return nil
 }
 
+// newRenewClient returns a client sending unicast from the leased address to
+// the server identifier. If that is not possible, e.g. because the address
+// is not configured on the interface, it falls back to broadcasting.
+func (l *DHCPLease) newRenewClient() (*dhcpClient, error) {
+	if l.ack == nil || l.relay != nil {
+		return l.newClient()
+	}
+
+	if serverID := l.ack.ServerIdentifier(); serverID != nil {
+		c, err := newUnicastDHCPClient(l.hardwareAddr(), l.ack.YourIPAddr, serverID, l.timeout, l.marking)
+		if err == nil {
+			if l.env.trace != nil {
+				c.conn = &traceConn{dhcpConn: c.conn, lease: l}
+			}
+			return c, nil
+		}
+		log.Printf("%v: unicast renewal to %v not possible, broadcasting: %v", l.clientID, serverID, err)
+	}
+	return l.newClient()
+}
+
+// linkName returns the name of the lease's interface, which is known before
+// the link is looked up.
+func (l *DHCPLease) linkName() string {
+	if l.link != nil {
+		return l.link.Attrs().Name
+	}
+	return l.interfaceName
+}
+
+// hardwareAddr returns the address sent as chaddr.
+func (l *DHCPLease) hardwareAddr() net.HardwareAddr {
+	if l.hwAddr != nil {
+		return l.hwAddr
+	}
+	return l.link.Attrs().HardwareAddr
+}
+
+// newClient returns a client for the lease's link, relaying to the
+// configured server if any.
+func (l *DHCPLease) newClient() (*dhcpClient, error) {
+	var c *dhcpClient
+	var err error
+	if l.relay != nil {
+		c, err = newRelayDHCPClient(l.hardwareAddr(), l.relay, l.timeout, l.marking)
+	} else {
+		c, err = newDHCPClient(l.link, l.hardwareAddr(), l.timeout, l.broadcast, l.clientSocket, l.marking)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if l.env.trace != nil {
+		// innermost, so that replies are recorded before being filtered
+		c.conn = &traceConn{dhcpConn: c.conn, lease: l}
+	}
+	switch {
+	case len(l.allowedServers) > 0:
+		c.conn = &serverFilterConn{dhcpConn: c.conn, allowed: l.allowedServers, clientID: l.clientID}
+	case l.network != "" && l.rogueServers != rogueServerNone:
+		c.conn = &rogueServerConn{dhcpConn: c.conn, lease: l}
+	}
+	return c, nil
+}
+
 func (l *DHCPLease) release() error {
+	if l.isSynthetic() {
+		freeFallbackAddress(l.ack.YourIPAddr)
+		return nil
+	}
+
 	log.Printf("%v: releasing lease", l.clientID)
 
-	c, err := newDHCPClient(l.link, l.clientID, l.timeout, l.broadcast)
+	c, err := l.newClient()
 	if err != nil {
-		return err
+		// the pod's link may be gone, e.g. after a runtime crash
+		log.Printf("%v: cannot release on the pod's link, releasing from the host: %v", l.clientID, err)
+		return l.releaseFromHost()
 	}
 	defer c.Close()
 
 	opts := l.getOptionsWithClientId()
 
-	if err = DhcpRelease(c, *l.ack, opts); err != nil {
+	if err = DhcpRelease(c, l.ack, opts); err != nil {
 		return fmt.Errorf("failed to send DHCPRELEASE")
 	}
 
 	return nil
 }
 
+// releaseFromHost unicasts the release to the server identifier from the
+// daemon's network namespace. The server identifies the lease by ciaddr and
+// client identifier, so the pod's link is not needed.
+func (l *DHCPLease) releaseFromHost() error {
+	serverID := l.ack.ServerIdentifier()
+	if serverID == nil {
+		return fmt.Errorf("lease has no server identifier")
+	}
+	if hostNetNS == nil {
+		return fmt.Errorf("daemon network namespace unknown")
+	}
+
+	return hostNetNS.Do(func(_ ns.NetNS) error {
+		conn, err := newUDPConn(net.UDPAddr{IP: net.IPv4zero, Port: 0}, serverID, l.marking)
+		if err != nil {
+			return err
+		}
+		c := &dhcpClient{conn: conn, timeout: l.timeout}
+		defer c.Close()
+
+		if err := DhcpRelease(c, l.ack, l.getOptionsWithClientId()); err != nil {
+			return fmt.Errorf("failed to send DHCPRELEASE to %v: %v", serverID, err)
+		}
+		return nil
+	})
+}
+
 func (l *DHCPLease) IPNet() (*net.IPNet, error) {
-	mask := parseSubnetMask(l.opts)
+	mask := parseSubnetMask(l.ack.Options)
 	if mask == nil {
 		return nil, fmt.Errorf("DHCP option Subnet Mask not found in DHCPACK")
 	}
 
 	return &net.IPNet{
-		IP:   l.ack.YIAddr(),
+		IP:   l.ack.YourIPAddr,
 		Mask: mask,
 	}, nil
 }
 
 func (l *DHCPLease) Gateway() net.IP {
-	return parseRouter(l.opts)
+	return parseRouter(l.ack.Options)
 }
 
 func (l *DHCPLease) Routes() []*types.Route {
-	routes := []*types.Route{}
+	return buildRoutes(l.ack.Options, l.routePolicy)
+}
 
-	// RFC 3442 states that if Classless Static Routes (option 121)
-	// exist, we ignore Static Routes (option 33) and the Router/Gateway.
-	opt121_routes := parseCIDRRoutes(l.opts)
-	if len(opt121_routes) > 0 {
-		return append(routes, opt121_routes...)
+func (l *DHCPLease) DNS() types.DNS {
+	return types.DNS{
+		Nameservers: parseNameServers(l.ack.Options),
+		Domain:      parseDomainName(l.ack.Options),
+		Search:      parseSearchDomains(l.ack.Options),
 	}
+}
 
-	// Append Static Routes
-	routes = append(routes, parseRoutes(l.opts)...)
-
-	// The CNI spec says even if there is a gateway specified, we must
-	// add a default route in the routes section.
-	if gw := l.Gateway(); gw != nil {
-		_, defaultRoute, _ := net.ParseCIDR("0.0.0.0/0")
-		routes = append(routes, &types.Route{Dst: *defaultRoute, GW: gw})
+// applyRenewalJitter moves the renewal and rebinding times at random, see
+// leaseEnv.renewalJitter.
+func (l *DHCPLease) applyRenewalJitter(now time.Time) {
+	fraction := l.env.renewalJitter
+	if fraction <= 0 {
+		return
+	}
+	l.renewalTime = jitterTime(now, l.renewalTime, l.expireTime, fraction)
+	l.rebindingTime = jitterTime(now, l.rebindingTime, l.expireTime, fraction)
+	if l.rebindingTime.Before(l.renewalTime) {
+		l.rebindingTime = l.renewalTime
 	}
+}
 
-	return routes
+// jitterTime moves t by up to fraction of the time remaining until it, but
+// not past limit. Times already due, e.g. for leases reloaded after the
+// daemon was down, are spread over fraction of the time left until limit.
+func jitterTime(now, t, limit time.Time, fraction float64) time.Time {
+	if remaining := t.Sub(now); remaining > 0 {
+		t = t.Add(jitter(time.Duration(float64(remaining) * fraction)))
+	} else if left := limit.Sub(now); left > 0 {
+		t = now.Add(time.Duration(float64(left) * fraction * rand.Float64()))
+	}
+	if t.After(limit) {
+		t = limit
+	}
+	return t
 }
 
 // jitter returns a random value within [-span, span) range
@@ -462,54 +1099,57 @@ func jitter(span time.Duration) time.Duration {
 	return time.Duration(float64(span) * (2.0*rand.Float64() - 1.0))
 }
 
-func backoffRetry(resendMax time.Duration, f func() (*dhcp4.Packet, error)) (*dhcp4.Packet, error) {
-	var baseDelay time.Duration = resendDelay0
-	var sleepTime time.Duration
-	var fastRetryLimit = resendFastMax
-	for {
+// backoffRetry calls f until it succeeds, pausing for the delays of the
+// lease's retry policy. A last attempt follows the last delay, which the loop
+// used to sleep before giving up without one.
+func (l *DHCPLease) backoffRetry(f func() (*dhcpv4.DHCPv4, error)) (*dhcpv4.DHCPv4, error) {
+	delays := l.retry.delays()
+	for attempt := 0; ; attempt++ {
+		l.waitForExchange()
 		pkt, err := f()
 		if err == nil {
 			return pkt, nil
 		}
 
 		log.Print(err)
+		recordExchangeFailure()
 
-		if fastRetryLimit == 0 {
-			sleepTime = baseDelay + jitter(time.Second)
-		} else {
-			sleepTime = resendFastDelay + jitter(time.Second)
-			fastRetryLimit--
+		if attempt == len(delays) {
+			break
 		}
+		sleepTime := delays[attempt] + jitter(time.Second)
 
 		log.Printf("retrying in %f seconds", sleepTime.Seconds())
 
 		time.Sleep(sleepTime)
-
-		// only adjust delay time if we are in normal backoff stage
-		if baseDelay < resendMax && fastRetryLimit == 0 {
-			baseDelay *= 2
-		} else if fastRetryLimit == 0 { // only break if we are at normal delay
-			break
-		}
 	}
 
 	return nil, errNoMoreTries
 }
 
+// newDHCPClient returns a client broadcasting on the link.
 func newDHCPClient(
-	link netlink.Link, clientID string,
+	link netlink.Link,
+	hwAddr net.HardwareAddr,
 	timeout time.Duration,
 	broadcast bool,
-) (*dhcp4client.Client, error) {
-	pktsock, err := dhcp4client.NewPacketSock(link.Attrs().Index)
+	socket string,
+	marking packetMarking,
+) (*dhcpClient, error) {
+	conn, err := newLinkConn(link, socket, marking)
 	if err != nil {
 		return nil, err
 	}
+	return &dhcpClient{conn: conn, hwAddr: hwAddr, timeout: timeout, broadcast: broadcast}, nil
+}
 
-	return dhcp4client.New(
-		dhcp4client.HardwareAddr(link.Attrs().HardwareAddr),
-		dhcp4client.Timeout(timeout),
-		dhcp4client.Broadcast(broadcast),
-		dhcp4client.Connection(pktsock),
-	)
+func newUnicastDHCPClient(
+	hwAddr net.HardwareAddr, ciaddr, server net.IP,
+	timeout time.Duration, marking packetMarking,
+) (*dhcpClient, error) {
+	conn, err := newUDPConn(net.UDPAddr{IP: ciaddr, Port: nclient4.ClientPort}, server, marking)
+	if err != nil {
+		return nil, err
+	}
+	return &dhcpClient{conn: conn, hwAddr: hwAddr, timeout: timeout}, nil
 }
@@ -0,0 +1,193 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestClampLeaseTimes(t *testing.T) {
+	tests := []struct {
+		name                               string
+		lease, rebinding, renewal          time.Duration
+		minRenewal, maxLease               time.Duration
+		wantLease, wantRebind, wantRenewal time.Duration
+	}{
+		{
+			"unbounded", 30 * time.Second, 25 * time.Second, 15 * time.Second, 0, 0,
+			30 * time.Second, 25 * time.Second, 15 * time.Second,
+		},
+		{
+			"renewal raised", 30 * time.Minute, 25 * time.Minute, 15 * time.Second, time.Minute, 0,
+			30 * time.Minute, 25 * time.Minute, time.Minute,
+		},
+		{
+			"renewal raised up to rebinding", 30 * time.Second, 25 * time.Second, 15 * time.Second, time.Minute, 0,
+			30 * time.Second, 25 * time.Second, 25 * time.Second,
+		},
+		{
+			"long lease capped", 24 * time.Hour, 21 * time.Hour, 12 * time.Hour, 0, time.Hour,
+			time.Hour, 51 * time.Minute, 30 * time.Minute,
+		},
+		{
+			"minimum doesn't extend the capped lease", 24 * time.Hour, 21 * time.Hour, 12 * time.Hour, 2 * time.Hour, time.Hour,
+			time.Hour, 51 * time.Minute, 51 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lease, rebinding, renewal := clampLeaseTimes(tt.lease, tt.rebinding, tt.renewal, tt.minRenewal, tt.maxLease)
+			if lease != tt.wantLease || rebinding != tt.wantRebind || renewal != tt.wantRenewal {
+				t.Errorf("clampLeaseTimes() = %v, %v, %v, want %v, %v, %v",
+					lease, rebinding, renewal, tt.wantLease, tt.wantRebind, tt.wantRenewal)
+			}
+		})
+	}
+}
+
+func TestPrepareOptionsTemplates(t *testing.T) {
+	provide := []ProvideOption{
+		{Option: "user-class", Value: "ns-{{namespace}}"},
+		{Option: "host-name", Value: "{{podName}}.{{namespace}}"},
+	}
+	_, optsProviding, err := prepareOptions("K8S_POD_NAMESPACE=team-a;K8S_POD_NAME=web-0", provide, nil)
+	if err != nil {
+		t.Fatalf("prepareOptions() error = %v", err)
+	}
+
+	want := dhcpv4.Options{
+		dhcpv4.OptionUserClassInformation.Code(): append([]byte{9}, "ns-team-a"...),
+		dhcpv4.OptionHostName.Code():             []byte("web-0.team-a"),
+	}
+	if !reflect.DeepEqual(optsProviding, want) {
+		t.Errorf("prepareOptions() = %q, want %q", optsProviding, want)
+	}
+}
+
+func TestJitterTime(t *testing.T) {
+	now := time.Now()
+	limit := now.Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		t        time.Time
+		min, max time.Time
+	}{
+		{
+			name: "future",
+			t:    now.Add(30 * time.Minute),
+			min:  now.Add(27 * time.Minute),
+			max:  now.Add(33 * time.Minute),
+		},
+		{
+			name: "due",
+			t:    now.Add(-time.Minute),
+			min:  now,
+			max:  now.Add(6 * time.Minute),
+		},
+		{
+			name: "capped at limit",
+			t:    limit,
+			min:  now.Add(54 * time.Minute),
+			max:  limit,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				got := jitterTime(now, tt.t, limit, 0.1)
+				if got.Before(tt.min) || got.After(tt.max) {
+					t.Fatalf("jitterTime() = %v, want within [%v, %v]", got.Sub(now), tt.min.Sub(now), tt.max.Sub(now))
+				}
+			}
+		})
+	}
+}
+
+func TestIsNak(t *testing.T) {
+	nak := testPacket(dhcpv4.OpcodeBootReply, nil, dhcpv4.MessageTypeNak)
+	ack := testPacket(dhcpv4.OpcodeBootReply, nil, dhcpv4.MessageTypeAck)
+
+	tests := []struct {
+		name string
+		pkt  *dhcpv4.DHCPv4
+		want bool
+	}{
+		{name: "nak", pkt: nak, want: true},
+		{name: "ack", pkt: ack, want: false},
+		{name: "empty", pkt: nil, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isNak(tt.pkt); got != tt.want {
+				t.Errorf("isNak() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommitInfiniteLease(t *testing.T) {
+	ack := func(leaseTime []byte) *dhcpv4.DHCPv4 {
+		pkt := testPacket(dhcpv4.OpcodeBootReply, nil, dhcpv4.MessageTypeAck)
+		pkt.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionIPAddressLeaseTime, leaseTime))
+		return pkt
+	}
+	infinite := []byte{0xff, 0xff, 0xff, 0xff}
+
+	tests := []struct {
+		name         string
+		leaseTime    []byte
+		maxLeaseTime time.Duration
+		want         bool
+	}{
+		{name: "infinite", leaseTime: infinite, want: true},
+		{name: "capped by maxLeaseTime", leaseTime: infinite, maxLeaseTime: time.Hour, want: false},
+		{name: "finite", leaseTime: []byte{0, 0, 0x0e, 0x10}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &DHCPLease{maxLeaseTime: tt.maxLeaseTime, ignoreMTU: true}
+			if err := l.commit(ack(tt.leaseTime)); err != nil {
+				t.Fatal(err)
+			}
+			if l.infinite != tt.want {
+				t.Errorf("infinite = %v, want %v", l.infinite, tt.want)
+			}
+			if zero := l.renewalTime.IsZero() && l.rebindingTime.IsZero() && l.expireTime.IsZero(); zero != tt.want {
+				t.Errorf("timers are %v, %v, %v", l.renewalTime, l.rebindingTime, l.expireTime)
+			}
+		})
+	}
+}
+
+func TestOptionsWithClientIdHostname(t *testing.T) {
+	l := &DHCPLease{clientID: "c/net/eth0", hostname: "web-0"}
+	opts := l.getOptionsWithClientId()
+	if got := string(opts[dhcpv4.OptionHostName.Code()]); got != "web-0" {
+		t.Errorf("host-name = %q, want %q", got, "web-0")
+	}
+	if got := string(opts[dhcpv4.OptionClientIdentifier.Code()]); got != "\x00c/net/eth0" {
+		t.Errorf("client identifier = %q", got)
+	}
+
+	l.hostname = ""
+	if _, ok := l.getOptionsWithClientId()[dhcpv4.OptionHostName.Code()]; ok {
+		t.Errorf("host-name sent without a hostname")
+	}
+}
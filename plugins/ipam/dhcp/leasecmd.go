@@ -0,0 +1,338 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// LeaseInfo describes an active lease for the "leases" subcommand.
+type LeaseInfo struct {
+	ClientID      string
+	Namespace     string
+	Pod           string
+	Interface     string
+	IP            string
+	Server        string
+	RenewalTime   time.Time
+	RebindingTime time.Time
+	ExpireTime    time.Time
+	// the address is leased forever, the times are then zero
+	Infinite bool
+	// the address is from the fallback pool
+	Synthetic bool
+}
+
+func (l *DHCPLease) info() LeaseInfo {
+	info := LeaseInfo{
+		ClientID:      l.clientID,
+		Namespace:     l.k8sNamespace,
+		Pod:           l.k8sPodName,
+		RenewalTime:   l.renewalTime,
+		RebindingTime: l.rebindingTime,
+		ExpireTime:    l.expireTime,
+		Infinite:      l.infinite,
+		Synthetic:     l.isSynthetic(),
+	}
+	if l.link != nil {
+		info.Interface = l.link.Attrs().Name
+	}
+	if l.ack != nil {
+		info.IP = l.ack.YourIPAddr.String()
+		if serverID := l.serverID(); serverID != nil {
+			info.Server = serverID.String()
+		} else if info.Synthetic {
+			info.Server = "fallback"
+		}
+	}
+	return info
+}
+
+// times returns the server and timers of the lease, with the lease time
+// counted from now. Only the server is set for informed addresses.
+func (l *DHCPLease) times(now time.Time) *LeaseTimes {
+	t := &LeaseTimes{
+		RenewalTime:   l.renewalTime,
+		RebindingTime: l.rebindingTime,
+		ExpireTime:    l.expireTime,
+	}
+	switch {
+	case l.infinite:
+		t.LeaseTime = infiniteLeaseTime
+	case !l.expireTime.IsZero():
+		t.LeaseTime = int64(l.expireTime.Sub(now).Round(time.Second) / time.Second)
+	}
+	if serverID := l.serverID(); serverID != nil {
+		t.Server = serverID.String()
+	}
+	return t
+}
+
+// ListLeases returns all leases maintained by the daemon.
+func (d *DHCP) ListLeases(_ struct{}, reply *[]LeaseInfo) error {
+	all := d.leases.all()
+	leases := make([]LeaseInfo, 0, len(all))
+	for _, l := range all {
+		leases = append(leases, l.info())
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		if leases[i].Namespace != leases[j].Namespace {
+			return leases[i].Namespace < leases[j].Namespace
+		}
+		if leases[i].Pod != leases[j].Pod {
+			return leases[i].Pod < leases[j].Pod
+		}
+		return leases[i].ClientID < leases[j].ClientID
+	})
+	*reply = leases
+	return nil
+}
+
+// RenewLease makes the leases matching target renew immediately and returns
+// their client IDs. The target is a client ID or a pod, see leaseMatches.
+func (d *DHCP) RenewLease(target string, reply *[]string) error {
+	renewed := []string{}
+	for clientID, l := range d.leases.all() {
+		if leaseMatches(l.info(), target) {
+			l.Renew()
+			renewed = append(renewed, clientID)
+		}
+	}
+	if len(renewed) == 0 {
+		return fmt.Errorf("no lease found for %q", target)
+	}
+	sort.Strings(renewed)
+	*reply = renewed
+	return nil
+}
+
+// ReleaseLease stops maintaining the leases matching target, releases them
+// and returns their client IDs. Unlike Release, it doesn't need the network
+// config, and also works when the pod's network namespace is gone.
+func (d *DHCP) ReleaseLease(target string, reply *[]string) error {
+	matching := map[string]*DHCPLease{}
+	for clientID, l := range d.leases.all() {
+		if leaseMatches(l.info(), target) {
+			matching[clientID] = l
+		}
+	}
+
+	if len(matching) == 0 {
+		return fmt.Errorf("no lease found for %q", target)
+	}
+
+	released := []string{}
+	for clientID := range matching {
+		d.removeLease(clientID)
+		released = append(released, clientID)
+	}
+	sort.Strings(released)
+	*reply = released
+	return nil
+}
+
+// leasesCommand implements "dhcp leases list", "dhcp leases show <pod>",
+// "dhcp leases options <pod|clientID>", "dhcp leases renew <pod|clientID>"
+// and "dhcp leases release <pod|clientID>".
+// The pod is given as "namespace/name" or just "name".
+func leasesCommand(args []string) error {
+	var socketPath, tokenFile string
+	flags := flag.NewFlagSet("leases", flag.ExitOnError)
+	flags.StringVar(&socketPath, "socketpath", defaultSocketPath, "dhcp daemon socket path")
+	flags.StringVar(&tokenFile, "token-file", "", "file with the token the daemon requires for renew and release, see -auth-token-file")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s leases [-socketpath path] [-token-file path] list | show <[namespace/]pod> | options <[namespace/]pod|clientID> | renew <[namespace/]pod|clientID> | release <[namespace/]pod|clientID>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	switch {
+	case flags.NArg() == 1 && flags.Arg(0) == "list":
+		leases, err := fetchLeases(socketPath)
+		if err != nil {
+			return err
+		}
+		return printLeaseTable(os.Stdout, leases)
+
+	case flags.NArg() == 2 && flags.Arg(0) == "show":
+		leases, err := fetchLeases(socketPath)
+		if err != nil {
+			return err
+		}
+		matching := filterLeases(leases, flags.Arg(1))
+		if len(matching) == 0 {
+			return fmt.Errorf("no lease found for pod %q", flags.Arg(1))
+		}
+		for i, l := range matching {
+			if i > 0 {
+				fmt.Println()
+			}
+			printLeaseDetails(os.Stdout, l)
+		}
+		return nil
+
+	case flags.NArg() == 2 && flags.Arg(0) == "options":
+		client, err := rpc.DialHTTP("unix", socketPath)
+		if err != nil {
+			return fmt.Errorf("error dialing DHCP daemon: %v", err)
+		}
+		defer client.Close()
+
+		var leases []LeaseOptions
+		if err := client.Call("DHCP.LeaseOptions", flags.Arg(1), &leases); err != nil {
+			return fmt.Errorf("error calling DHCP.LeaseOptions: %v", err)
+		}
+		for i, l := range leases {
+			if i > 0 {
+				fmt.Println()
+			}
+			if err := printLeaseOptions(os.Stdout, l); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case flags.NArg() == 2 && flags.Arg(0) == "renew":
+		renewed, err := callDaemon(socketPath, tokenFile, "DHCP.RenewLease", flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		for _, clientID := range renewed {
+			fmt.Printf("%s: renewal triggered\n", clientID)
+		}
+		return nil
+
+	case flags.NArg() == 2 && flags.Arg(0) == "release":
+		released, err := callDaemon(socketPath, tokenFile, "DHCP.ReleaseLease", flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		for _, clientID := range released {
+			fmt.Printf("%s: released\n", clientID)
+		}
+		return nil
+
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	return nil
+}
+
+func fetchLeases(socketPath string) ([]LeaseInfo, error) {
+	client, err := rpc.DialHTTP("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing DHCP daemon: %v", err)
+	}
+	defer client.Close()
+
+	var leases []LeaseInfo
+	if err := client.Call("DHCP.ListLeases", struct{}{}, &leases); err != nil {
+		return nil, fmt.Errorf("error calling DHCP.ListLeases: %v", err)
+	}
+	return leases, nil
+}
+
+// callDaemon calls an admin method taking a lease target and returning the
+// affected client IDs. The token in tokenFile, if any, is sent along.
+func callDaemon(socketPath, tokenFile, method, target string) ([]string, error) {
+	token, err := readTokenFlag(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dialDaemon(socketPath, token)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing DHCP daemon: %v", err)
+	}
+	defer client.Close()
+
+	var clientIDs []string
+	if err := client.Call(method, target, &clientIDs); err != nil {
+		return nil, fmt.Errorf("error calling %v: %v", method, err)
+	}
+	return clientIDs, nil
+}
+
+// leaseMatches reports whether the lease is identified by target, which is
+// either its client ID, "namespace/pod" or just the pod name.
+func leaseMatches(l LeaseInfo, target string) bool {
+	if l.ClientID == target {
+		return true
+	}
+	namespace, pod := "", target
+	if i := strings.Index(target, "/"); i >= 0 {
+		namespace, pod = target[:i], target[i+1:]
+	}
+	return l.Pod == pod && (namespace == "" || l.Namespace == namespace)
+}
+
+func filterLeases(leases []LeaseInfo, target string) []LeaseInfo {
+	matching := []LeaseInfo{}
+	for _, l := range leases {
+		if leaseMatches(l, target) {
+			matching = append(matching, l)
+		}
+	}
+	return matching
+}
+
+func printLeaseTable(out io.Writer, leases []LeaseInfo) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tPOD\tINTERFACE\tIP\tSERVER\tT1\tT2\tEXPIRES")
+	for _, l := range leases {
+		expires := formatLeaseTime(l.ExpireTime)
+		if l.Infinite {
+			expires = "never"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", l.Namespace, l.Pod, l.Interface, l.IP, l.Server,
+			formatLeaseTime(l.RenewalTime), formatLeaseTime(l.RebindingTime), expires)
+	}
+	return w.Flush()
+}
+
+func printLeaseDetails(out io.Writer, l LeaseInfo) {
+	fmt.Fprintf(out, "Pod:        %s/%s\n", l.Namespace, l.Pod)
+	fmt.Fprintf(out, "Client ID:  %s\n", l.ClientID)
+	fmt.Fprintf(out, "Interface:  %s\n", l.Interface)
+	fmt.Fprintf(out, "IP:         %s\n", l.IP)
+	fmt.Fprintf(out, "Server:     %s\n", l.Server)
+	if l.Infinite {
+		fmt.Fprintf(out, "Expires:    never\n")
+		return
+	}
+	fmt.Fprintf(out, "Renewal:    %s (%s)\n", l.RenewalTime.Format(time.RFC3339), formatLeaseTime(l.RenewalTime))
+	fmt.Fprintf(out, "Rebinding:  %s (%s)\n", l.RebindingTime.Format(time.RFC3339), formatLeaseTime(l.RebindingTime))
+	fmt.Fprintf(out, "Expires:    %s (%s)\n", l.ExpireTime.Format(time.RFC3339), formatLeaseTime(l.ExpireTime))
+}
+
+// formatLeaseTime formats t relative to now, e.g. "in 5m0s" or "2m0s ago".
+func formatLeaseTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	d := time.Until(t).Round(time.Second)
+	if d < 0 {
+		return fmt.Sprintf("%v ago", -d)
+	}
+	return fmt.Sprintf("in %v", d)
+}
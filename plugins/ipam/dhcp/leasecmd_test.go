@@ -0,0 +1,123 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestFilterLeases(t *testing.T) {
+	leases := []LeaseInfo{
+		{ClientID: "a", Namespace: "default", Pod: "web"},
+		{ClientID: "b", Namespace: "team", Pod: "web"},
+		{ClientID: "c", Namespace: "team", Pod: "db"},
+	}
+
+	tests := []struct {
+		name string
+		pod  string
+		want []string
+	}{
+		{name: "name only", pod: "web", want: []string{"a", "b"}},
+		{name: "namespaced", pod: "team/web", want: []string{"b"}},
+		{name: "no match", pod: "default/db", want: []string{}},
+		{name: "client ID", pod: "c", want: []string{"c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, l := range filterLeases(leases, tt.pod) {
+				got = append(got, l.ClientID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterLeases() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeaseTimes(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	ack := testPacket(dhcpv4.OpcodeBootReply, nil, dhcpv4.MessageTypeAck)
+	ack.UpdateOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 1)))
+	l := &DHCPLease{
+		ack:           ack,
+		renewalTime:   now.Add(30 * time.Minute),
+		rebindingTime: now.Add(52*time.Minute + 30*time.Second),
+		expireTime:    now.Add(time.Hour),
+	}
+	want := &LeaseTimes{
+		Server:        "10.0.0.1",
+		LeaseTime:     3600,
+		RenewalTime:   l.renewalTime,
+		RebindingTime: l.rebindingTime,
+		ExpireTime:    l.expireTime,
+	}
+	if got := l.times(now); !reflect.DeepEqual(got, want) {
+		t.Errorf("times() = %+v, want %+v", got, want)
+	}
+
+	// fallback addresses have no server
+	l.synthetic = 1
+	if got := l.times(now); got.Server != "" {
+		t.Errorf("times() of a fallback address has server %q", got.Server)
+	}
+
+	infinite := &DHCPLease{infinite: true}
+	if got := infinite.times(now); got.LeaseTime != infiniteLeaseTime {
+		t.Errorf("times() of an infinite lease has lease time %d", got.LeaseTime)
+	}
+}
+
+func TestReleaseLease(t *testing.T) {
+	lease := func(namespace, pod string) *DHCPLease {
+		return &DHCPLease{k8sNamespace: namespace, k8sPodName: pod, stop: make(chan struct{})}
+	}
+	d := &DHCP{
+		persistPending: make(chan struct{}, 1),
+		leases: newLeaseMap(map[string]*DHCPLease{
+			"a": lease("default", "web"),
+			"b": lease("team", "web"),
+			"c": lease("team", "db"),
+		}),
+	}
+
+	var released []string
+	if err := d.ReleaseLease("team/web", &released); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b"}; !reflect.DeepEqual(released, want) {
+		t.Errorf("ReleaseLease() = %v, want %v", released, want)
+	}
+
+	remaining := []string{}
+	for clientID := range d.leases.all() {
+		remaining = append(remaining, clientID)
+	}
+	sort.Strings(remaining)
+	if want := []string{"a", "c"}; !reflect.DeepEqual(remaining, want) {
+		t.Errorf("remaining leases = %v, want %v", remaining, want)
+	}
+
+	if err := d.ReleaseLease("team/web", &released); err == nil {
+		t.Errorf("released a lease twice")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Number of independently locked parts of the lease table
+const leaseMapShards = 32
+
+// leaseMap is the lease table of the daemon by client ID. It's sharded by a
+// hash of the client ID, so requests for different clients don't contend on
+// a single lock.
+type leaseMap struct {
+	shards [leaseMapShards]leaseShard
+}
+
+type leaseShard struct {
+	sync.RWMutex
+	leases map[string]*DHCPLease
+}
+
+// newLeaseMap returns a table holding the given leases.
+func newLeaseMap(leases map[string]*DHCPLease) *leaseMap {
+	m := &leaseMap{}
+	for i := range m.shards {
+		m.shards[i].leases = map[string]*DHCPLease{}
+	}
+	for clientID, l := range leases {
+		m.set(clientID, l)
+	}
+	return m
+}
+
+func (m *leaseMap) shard(clientID string) *leaseShard {
+	h := fnv.New32a()
+	h.Write([]byte(clientID))
+	return &m.shards[h.Sum32()%leaseMapShards]
+}
+
+func (m *leaseMap) get(clientID string) *DHCPLease {
+	s := m.shard(clientID)
+	s.RLock()
+	defer s.RUnlock()
+	return s.leases[clientID]
+}
+
+func (m *leaseMap) set(clientID string, l *DHCPLease) {
+	s := m.shard(clientID)
+	s.Lock()
+	defer s.Unlock()
+	s.leases[clientID] = l
+}
+
+func (m *leaseMap) delete(clientID string) {
+	s := m.shard(clientID)
+	s.Lock()
+	defer s.Unlock()
+	delete(s.leases, clientID)
+}
+
+// len returns the number of leases. Shards are counted one at a time, so
+// it's not exact while leases are added or removed.
+func (m *leaseMap) len() int {
+	n := 0
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		n += len(s.leases)
+		s.RUnlock()
+	}
+	return n
+}
+
+// all returns a copy of the table, taken one shard at a time.
+func (m *leaseMap) all() map[string]*DHCPLease {
+	leases := map[string]*DHCPLease{}
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		for clientID, l := range s.leases {
+			leases[clientID] = l
+		}
+		s.RUnlock()
+	}
+	return leases
+}
+
+// takeAll empties the table and returns the leases it held.
+func (m *leaseMap) takeAll() map[string]*DHCPLease {
+	leases := map[string]*DHCPLease{}
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.Lock()
+		for clientID, l := range s.leases {
+			leases[clientID] = l
+		}
+		s.leases = map[string]*DHCPLease{}
+		s.Unlock()
+	}
+	return leases
+}
+
+// lockAll locks every shard, so the table doesn't change until unlockAll is
+// called, and returns the leases.
+func (m *leaseMap) lockAll() map[string]*DHCPLease {
+	leases := map[string]*DHCPLease{}
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.Lock()
+		for clientID, l := range s.leases {
+			leases[clientID] = l
+		}
+	}
+	return leases
+}
+
+func (m *leaseMap) unlockAll() {
+	for i := range m.shards {
+		m.shards[i].Unlock()
+	}
+}
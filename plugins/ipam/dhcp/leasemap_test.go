@@ -0,0 +1,55 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestLeaseMap(t *testing.T) {
+	m := newLeaseMap(map[string]*DHCPLease{"a": {clientID: "a"}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clientID := fmt.Sprintf("c%d/net/eth0", i)
+			m.set(clientID, &DHCPLease{clientID: clientID})
+		}(i)
+	}
+	wg.Wait()
+
+	if n := m.len(); n != 101 {
+		t.Fatalf("len() = %d, want 101", n)
+	}
+	if l := m.get("c42/net/eth0"); l == nil || l.clientID != "c42/net/eth0" {
+		t.Errorf("get() = %v, want the lease of c42", l)
+	}
+
+	m.delete("a")
+	if l := m.get("a"); l != nil {
+		t.Errorf("get() after delete() = %v, want nil", l)
+	}
+	if all := m.all(); len(all) != 100 {
+		t.Errorf("all() returned %d leases, want 100", len(all))
+	}
+
+	if taken := m.takeAll(); len(taken) != 100 || m.len() != 0 {
+		t.Errorf("takeAll() returned %d leases and left %d, want 100 and 0", len(taken), m.len())
+	}
+}
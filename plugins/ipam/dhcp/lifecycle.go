@@ -4,15 +4,24 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"os"
+	"sync/atomic"
 	"time"
 
 	kapiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 )
 
+const (
+	nodeReasonUp              = "DHCPIsUp"
+	nodeReasonDown            = "DHCPIsDown"
+	nodeReasonExchangesFailed = "DHCPExchangesFailing"
+)
+
 func SetNodeIsOfflineState(clientset *kubernetes.Clientset, value bool) error {
 	nodename := os.Getenv("NODENAME")
 
@@ -22,7 +31,7 @@ func SetNodeIsOfflineState(clientset *kubernetes.Clientset, value bool) error {
 		condition = kapiv1.NodeCondition{
 			Type:               kapiv1.NodeNetworkUnavailable,
 			Status:             kapiv1.ConditionTrue,
-			Reason:             "DHCPIsDown",
+			Reason:             nodeReasonDown,
 			Message:            "DHCP Daemon is shutting down on this node",
 			LastTransitionTime: metav1.Now(),
 			LastHeartbeatTime:  metav1.Now(),
@@ -31,25 +40,92 @@ func SetNodeIsOfflineState(clientset *kubernetes.Clientset, value bool) error {
 		condition = kapiv1.NodeCondition{
 			Type:               kapiv1.NodeNetworkUnavailable,
 			Status:             kapiv1.ConditionFalse,
-			Reason:             "DHCPIsUp",
+			Reason:             nodeReasonUp,
 			Message:            "DHCP Daemon is running on this node",
 			LastTransitionTime: metav1.Now(),
 			LastHeartbeatTime:  metav1.Now(),
 		}
 	}
+	return patchNodeCondition(clientset.CoreV1().Nodes(), nodename, condition)
+}
+
+func patchNodeCondition(nodes typedcorev1.NodeInterface, nodename string, condition kapiv1.NodeCondition) error {
 	raw, err := json.Marshal(&[]kapiv1.NodeCondition{condition})
 	if err != nil {
 		return err
 	}
 	patch := []byte(fmt.Sprintf(`{"status":{"conditions":%s}}`, raw))
 
-	_, err = clientset.CoreV1().Nodes().PatchStatus(context.Background(), nodename, patch)
+	_, err = nodes.PatchStatus(context.Background(), nodename, patch)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// nodeHeartbeat refreshes the NodeNetworkUnavailable condition of the node,
+// so that it reflects whether DHCP works rather than only that the daemon
+// started. The network is reported unavailable once failureThreshold DHCP
+// attempts in a row failed, e.g. because the uplink is broken, and
+// available again after the next successful exchange.
+type nodeHeartbeat struct {
+	nodes            typedcorev1.NodeInterface
+	nodeName         string
+	interval         time.Duration
+	failureThreshold int64
+}
+
+// run beats until the condition is set by "dhcp shutdown", which must not
+// be overwritten while the daemon is terminating.
+func (h *nodeHeartbeat) run() {
+	for range time.Tick(h.interval) {
+		done, err := h.beat()
+		if err != nil {
+			log.Printf("failed to update the network condition of node %s: %v", h.nodeName, err)
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// beat updates the condition once. It returns true when the daemon is
+// shutting down.
+func (h *nodeHeartbeat) beat() (bool, error) {
+	node, err := h.nodes.Get(context.Background(), h.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	var current *kapiv1.NodeCondition
+	for i, c := range node.Status.Conditions {
+		if c.Type == kapiv1.NodeNetworkUnavailable {
+			current = &node.Status.Conditions[i]
+		}
+	}
+	if current != nil && current.Reason == nodeReasonDown {
+		return true, nil
+	}
+
+	now := metav1.Now()
+	condition := kapiv1.NodeCondition{
+		Type:               kapiv1.NodeNetworkUnavailable,
+		Status:             kapiv1.ConditionFalse,
+		Reason:             nodeReasonUp,
+		Message:            "DHCP Daemon is running on this node",
+		LastTransitionTime: now,
+		LastHeartbeatTime:  now,
+	}
+	if failures := atomic.LoadInt64(&failedExchanges); h.failureThreshold > 0 && failures >= h.failureThreshold {
+		condition.Status = kapiv1.ConditionTrue
+		condition.Reason = nodeReasonExchangesFailed
+		condition.Message = fmt.Sprintf("The last %d DHCP attempts on this node failed", failures)
+	}
+	if current != nil && current.Status == condition.Status {
+		condition.LastTransitionTime = current.LastTransitionTime
+	}
+	return false, patchNodeCondition(h.nodes, h.nodeName, condition)
+}
+
 func shutdown() {
 	if config, err := rest.InClusterConfig(); err == nil {
 		config.Timeout = 2 * time.Second
@@ -0,0 +1,94 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kapiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNodeHeartbeat(t *testing.T) {
+	started := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	client := fake.NewSimpleClientset(&kapiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Status: kapiv1.NodeStatus{Conditions: []kapiv1.NodeCondition{{
+			Type:               kapiv1.NodeNetworkUnavailable,
+			Status:             kapiv1.ConditionFalse,
+			Reason:             nodeReasonUp,
+			LastTransitionTime: started,
+		}}},
+	})
+	h := &nodeHeartbeat{nodes: client.CoreV1().Nodes(), nodeName: "node1", failureThreshold: 3}
+	defer atomic.StoreInt64(&failedExchanges, 0)
+
+	condition := func() kapiv1.NodeCondition {
+		node, err := client.CoreV1().Nodes().Get(context.TODO(), "node1", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range node.Status.Conditions {
+			if c.Type == kapiv1.NodeNetworkUnavailable {
+				return c
+			}
+		}
+		t.Fatalf("node has no NetworkUnavailable condition")
+		return kapiv1.NodeCondition{}
+	}
+	beat := func() {
+		if done, err := h.beat(); err != nil || done {
+			t.Fatalf("beat() = %v, %v", done, err)
+		}
+	}
+
+	atomic.StoreInt64(&failedExchanges, 2)
+	beat()
+	if c := condition(); c.Status != kapiv1.ConditionFalse || !c.LastTransitionTime.Equal(&started) {
+		t.Errorf("below the threshold, got %s since %v", c.Status, c.LastTransitionTime)
+	}
+
+	atomic.StoreInt64(&failedExchanges, 3)
+	beat()
+	if c := condition(); c.Status != kapiv1.ConditionTrue || c.Reason != nodeReasonExchangesFailed {
+		t.Errorf("at the threshold, got %s with reason %s", c.Status, c.Reason)
+	}
+
+	recordExchange()
+	beat()
+	if c := condition(); c.Status != kapiv1.ConditionFalse || c.Reason != nodeReasonUp {
+		t.Errorf("after a successful exchange, got %s with reason %s", c.Status, c.Reason)
+	}
+
+	// "dhcp shutdown" marked the node while the daemon is terminating
+	err := patchNodeCondition(client.CoreV1().Nodes(), "node1", kapiv1.NodeCondition{
+		Type:   kapiv1.NodeNetworkUnavailable,
+		Status: kapiv1.ConditionTrue,
+		Reason: nodeReasonDown,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done, err := h.beat(); err != nil || !done {
+		t.Errorf("beat() after shutdown = %v, %v, want done", done, err)
+	}
+	if c := condition(); c.Reason != nodeReasonDown {
+		t.Errorf("shutdown condition was overwritten with %s", c.Reason)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	var k keyedMutex
+
+	unlockA := k.lock("a")
+
+	// other keys are not blocked
+	done := make(chan struct{})
+	go func() {
+		k.lock("b")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock on another key blocked")
+	}
+
+	// the same key is
+	acquired := make(chan struct{})
+	go func() {
+		unlock := k.lock("a")
+		close(acquired)
+		unlock()
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("lock on the same key did not block")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlockA()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock was not handed over after unlock")
+	}
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if len(k.locks) != 0 {
+		t.Errorf("unused locks were not removed: %v", k.locks)
+	}
+}
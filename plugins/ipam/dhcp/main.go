@@ -16,10 +16,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net/rpc"
 	"os"
 	"path/filepath"
 	"time"
@@ -38,11 +38,25 @@ const defaultSocketPath = "/run/cni/dhcp.sock"
 type NetConf struct {
 	types.NetConf
 	IPAM *IPAMConfig `json:"ipam"`
+	// Set by runtimes supporting the "hostname" capability.
+	RuntimeConfig struct {
+		// Sent as host-name instead of the pod name, e.g. the guest name of a VM. Takes
+		// precedence over HOSTNAME in CNI_ARGS.
+		Hostname string `json:"hostname"`
+	} `json:"runtimeConfig"`
 }
 
 type IPAMConfig struct {
 	types.IPAM
 	DaemonSocketPath string `json:"daemonSocketPath"`
+	// Do the DHCP exchange in the plugin instead of the daemon and record the lease in
+	// leaseFile (default /var/lib/cni/dhcp/leases.json). Leases are renewed by running
+	// "dhcp renew-all" periodically, e.g. with the cni-dhcp-renew systemd timer, which
+	// renews the *.json files in /var/lib/cni/dhcp; other lease files must be passed to it.
+	Daemonless bool   `json:"daemonless"`
+	LeaseFile  string `json:"leaseFile"`
+	// File holding the token the daemon requires with -auth-token-file.
+	DaemonTokenFile string `json:"daemonTokenFile"`
 	// When requesting IP from DHCP server, carry these options for management purpose.
 	// Some fields have default values, and can be override by setting a new option with the same name at here.
 	ProvideOptions []ProvideOption `json:"provide"`
@@ -51,6 +65,144 @@ type IPAMConfig struct {
 	// To override default requesting fields, set `skipDefault` to `false`.
 	// If an field is not optional, but the server failed to provide it, error will be raised.
 	RequestOptions []RequestOption `json:"request"`
+	// Controls the value sent as DHCP option 12 (host-name). Defaults to the pod name,
+	// "podName.namespace" appends the pod namespace and "none" omits the option. A hostname
+	// in runtimeConfig or CNI_ARGS (HOSTNAME) is sent instead of the pod name.
+	SendHostname string `json:"sendHostname"`
+	// When set, send the Client FQDN option (81) so the server can register the pod in DNS.
+	FQDN *FQDNConfig `json:"fqdn"`
+	// How the client identifier (option 61) is derived: "containerID" (default) uses the
+	// container ID, network and interface names, "mac" uses the configured hardware address,
+	// or else the one of the container's interface, and "podHash" uses a hash of the pod
+	// namespace and name, which is stable across pod restarts.
+	ClientIDType string `json:"clientIDType"`
+	// Ask for the address the pod had before, so that it's kept when the pod is recreated on
+	// the node. The client identifier defaults to "podHash", "containerID" can't be used.
+	StableIP bool `json:"stableIP"`
+	// Don't allocate an address, but send a DHCPINFORM for the address found in prevResult
+	// and merge the returned routes and DNS servers into it.
+	Inform bool `json:"inform"`
+	// Ask for the two message exchange of RFC 4039 (Rapid Commit). Servers without support
+	// answer with an offer and the regular exchange is used.
+	RapidCommit bool `json:"rapidCommit"`
+	// Lower bound for the renewal time and upper bound for the lease time, as Go durations
+	// (e.g. "5m"). They override the daemon's -minrenewal and -maxlease flags.
+	MinRenewalTime string `json:"minRenewalTime"`
+	MaxLeaseTime   string `json:"maxLeaseTime"`
+	// Override the daemon's -timeout and -resendmax flags for this network, as Go durations.
+	Timeout   string `json:"timeout"`
+	ResendMax string `json:"resendMax"`
+	// Shape of the resend curve of the DHCP exchange, e.g. for slow servers. The cap
+	// defaults to resendMax.
+	Retry *RetryConfig `json:"retry"`
+	// Override the daemon's -broadcast flag, i.e. whether the server is asked to broadcast
+	// its replies, for this network.
+	Broadcast *bool `json:"broadcast"`
+	// Relay messages to a DHCP server instead of broadcasting them on the pod's link,
+	// for routed pod networks without a local DHCP server.
+	Relay *RelayConfig `json:"relay"`
+	// Probe the acquired address with ARP before using it, and decline it if another host answers.
+	ArpProbe bool `json:"arpProbe"`
+	// Only accept offers and acknowledgements from these server identifiers. All servers are
+	// accepted when empty.
+	AllowedServers []string `json:"allowedServers"`
+	// Addresses in these CIDRs are declined and the server is asked for another one, e.g. to
+	// keep pods out of a range reserved for devices the server's pool can't leave out.
+	ExcludeRanges []string `json:"excludeRanges"`
+	// Sent as Vendor Class Identifier (option 60), so the server can assign pods to a dedicated
+	// pool. A "vendor-class-identifier" entry in "provide" takes precedence.
+	VendorClassIdentifier string `json:"vendorClassIdentifier"`
+	// Options returned by the server that are added to the result under "dhcpOptions",
+	// keyed by option code, e.g. NTP servers (42) or the TFTP server and boot file (66, 67).
+	ExposeOptions []DHCPOption `json:"exposeOptions"`
+	// Number of addresses to acquire on the interface, each with its own lease. The first
+	// one is the primary address. Defaults to 1.
+	Addresses int `json:"addresses"`
+	// Static pool used when no DHCP server answers before the retries are exhausted, so pods
+	// can start during an outage. DHCP is retried in the background for the same address.
+	Fallback *FallbackConfig `json:"fallback"`
+	// Handling of replies from a DHCP server other than the first one seen on the network:
+	// "none" (default) disables the detection, "warn" logs and posts a Kubernetes event once
+	// and "refuse" also ignores the replies. Not used with allowedServers.
+	RogueServers string `json:"rogueServers"`
+	// Handling of a renewal or rebinding answered by another server than the one that granted
+	// the lease: "warn" (default) logs and posts a Kubernetes event, "refuse" also ignores the
+	// new binding and "none" disables the check.
+	ServerChange string `json:"serverChange"`
+	// Add the Relay Agent Information option (82) to the messages, so the server can choose
+	// the pool by node or namespace and its lease table shows the pod. A
+	// "relay-agent-information" entry in "provide" takes precedence.
+	AgentInfo *AgentInfoConfig `json:"agentInfo"`
+	// Add the server identifier, lease time and renewal, rebinding and expiry times of the
+	// primary address to the result under "dhcpLease", so chained plugins know when it
+	// might change.
+	ExposeLease bool `json:"exposeLease"`
+	// What happens when a lease can't be renewed until it expires: "down" (default) brings
+	// the interface down, "reacquire" removes the address and starts over with a DISCOVER,
+	// configuring the new address and routes and posting an event if the address changed,
+	// "keep" leaves the address in place and keeps rebinding, "remove" removes the address
+	// and "evict" deletes the pod, so that its controller replaces it. A DHCPLeaseExpired
+	// event is posted on the pod.
+	ExpiryPolicy string `json:"expiryPolicy"`
+	// Hardware address sent as chaddr instead of the interface's, so reservations keyed on
+	// the MAC keep working when the pod is recreated. A MAC in CNI_ARGS takes precedence.
+	// The server is asked to broadcast its replies, which aren't addressed to the interface.
+	MAC string `json:"mac"`
+	// How the routers (option 3) are combined with the static routes (options 33 and 121)
+	// when a server sends both. RFC 3442 behavior by default.
+	RoutePolicy *RoutePolicy `json:"routePolicy"`
+	// Don't set the Interface MTU option (26) sent by the server on the container interface,
+	// e.g. when the main plugin configures the MTU.
+	IgnoreMTU bool `json:"ignoreMTU"`
+	// Socket the messages are exchanged on: "packet" (default) receives every IPv4 packet
+	// of the link, "filtered" attaches a BPF filter to that AF_PACKET datagram socket passing only
+	// DHCP replies, for macvlan or ipvlan links without an address where offers are otherwise
+	// lost.
+	ClientSocket string `json:"clientSocket"`
+	// QoS marking of the DHCP messages, so that renewals aren't dropped on a congested
+	// uplink: the DSCP (0-63) written into their IPv4 header and the SO_PRIORITY of the
+	// sockets sending them. Unmarked by default.
+	DSCP           int `json:"dscp"`
+	SocketPriority int `json:"socketPriority"`
+	// VLAN ID (1-4094) of an 802.1Q subinterface of the container interface, named
+	// "<ifname>.<vlan>", to run DHCP on, e.g. for pods with a trunk. The daemon creates the
+	// subinterface unless it exists, configures the leased address and routes on it and
+	// deletes it on DEL if it created it. The result lists the subinterface and its
+	// addresses refer to it, so that main plugins like bridge and macvlan leave them alone.
+	VLAN int `json:"vlan"`
+}
+
+// RetryConfig configures the resends after the four fast retries every 2s.
+type RetryConfig struct {
+	// Delay before the first backed off resend, as a Go duration. Defaults to "4s".
+	InitialDelay string `json:"initialDelay"`
+	// Factor applied to the delay after each resend, 1 for a constant delay. Defaults to 2.
+	Multiplier float64 `json:"multiplier"`
+	// Upper bound of the delay, as a Go duration. Defaults to the first doubling of 4s
+	// reaching the daemon's resendmax, 64s unless it is set.
+	MaxDelay string `json:"maxDelay"`
+	// Total number of attempts, including the first one. The exchange keeps resending at
+	// maxDelay until they're used up. By default it gives up once maxDelay is reached.
+	Attempts int `json:"attempts"`
+}
+
+// AllocateReply is the reply of DHCP.AllocateWithOptions.
+type AllocateReply struct {
+	Result  *current.Result
+	Options map[string][]string
+	Lease   *LeaseTimes
+}
+
+// LeaseTimes describes the lease of the primary address. It's added to the
+// result under "dhcpLease" with exposeLease.
+type LeaseTimes struct {
+	// server identifier, empty for fallback addresses
+	Server string `json:"server,omitempty"`
+	// lease duration in seconds
+	LeaseTime     int64     `json:"leaseTime"`
+	RenewalTime   time.Time `json:"renewalTime"`
+	RebindingTime time.Time `json:"rebindingTime"`
+	ExpireTime    time.Time `json:"expireTime"`
 }
 
 // DHCPOption represents a DHCP option. It can be a number, or a string defined in manual dhcp-options(5).
@@ -60,6 +212,8 @@ type DHCPOption string
 type ProvideOption struct {
 	Option DHCPOption `json:"option"`
 
+	// "{{podName}}" and "{{namespace}}" are substituted with the pod identity.
+	// The user-class option is sent as a single RFC 3004 user class.
 	Value           string `json:"value"`
 	ValueFromCNIArg string `json:"fromArg"`
 }
@@ -70,34 +224,148 @@ type RequestOption struct {
 	Option DHCPOption `json:"option"`
 }
 
+// FallbackConfig is the static pool used when DHCP is unreachable.
+type FallbackConfig struct {
+	// Subnet of the network, e.g. "192.168.1.0/24"
+	Subnet string `json:"subnet"`
+	// First and last address handed out, the whole subnet by default
+	RangeStart string `json:"rangeStart"`
+	RangeEnd   string `json:"rangeEnd"`
+	Gateway    string `json:"gateway"`
+}
+
+// AgentInfoConfig configures the Relay Agent Information option, see RFC 3046.
+// "{{nodeName}}", "{{podName}}" and "{{namespace}}" are substituted in the values.
+type AgentInfoConfig struct {
+	// Agent Circuit ID, "{{nodeName}}" by default
+	CircuitID string `json:"circuitID"`
+	// Agent Remote ID, "{{namespace}}/{{podName}}" by default
+	RemoteID string `json:"remoteID"`
+}
+
+// FQDNConfig configures the Client FQDN option, see RFC 4702.
+type FQDNConfig struct {
+	// Domain name template. "{{podName}}" and "{{namespace}}" are substituted with the pod identity.
+	Template string `json:"template"`
+	// Sets the S bit, asking the server to perform the A RR update.
+	ServerUpdate bool `json:"serverUpdate"`
+	// Sets the N bit, asking the server not to perform any DNS update.
+	NoServerUpdate bool `json:"noServerUpdate"`
+	// Sets the E bit and sends the domain name in canonical wire format instead of ASCII.
+	Encoded bool `json:"encoded"`
+}
+
+// RoutePolicy controls the routes built from the routers and static route options.
+type RoutePolicy struct {
+	// Keep the routers' default route when classless static routes (option 121) are sent,
+	// which RFC 3442 says to ignore. Static routes (option 33) are still ignored.
+	KeepRoutersWithClassless bool `json:"keepRoutersWithClassless"`
+	// Add a default route for every router instead of for the first one only.
+	AllRouters bool `json:"allRouters"`
+	// Which routes are kept when the routers and the static routes have the same
+	// destination: "both" (default), "static" or "routers".
+	PreferOnConflict string `json:"preferOnConflict"`
+}
+
+// RelayConfig makes the daemon act as a relay agent, see RFC 2131 section 4.1.
+type RelayConfig struct {
+	// Address of the DHCP server messages are unicast to.
+	Server string `json:"server"`
+	// Address of the node or bridge on the pod network, used as giaddr. The server
+	// selects the address pool and sends its replies based on it.
+	AgentAddress string `json:"agentAddress"`
+}
+
 func main() {
 	if len(os.Args) > 1 {
 		if os.Args[1] == "daemon" {
-			var pidfilePath string
-			var hostPrefix string
-			var socketPath string
-			var broadcast bool
-			var timeout time.Duration
-			var resendMax time.Duration
+			var conf daemonConfig
+			var socketMode, socketOwner, socketGroup, socketAllowedUIDs string
+			var hostInterfaces string
+			var authTokenFile, cniAllowedUIDs, auditLog string
 			daemonFlags := flag.NewFlagSet("daemon", flag.ExitOnError)
-			daemonFlags.StringVar(&pidfilePath, "pidfile", "", "optional path to write daemon PID to")
-			daemonFlags.StringVar(&hostPrefix, "hostprefix", "", "optional prefix to host root")
-			daemonFlags.StringVar(&socketPath, "socketpath", "", "optional dhcp server socketpath")
-			daemonFlags.BoolVar(&broadcast, "broadcast", false, "broadcast DHCP leases")
-			daemonFlags.DurationVar(&timeout, "timeout", 10*time.Second, "optional dhcp client timeout duration")
-			daemonFlags.DurationVar(&resendMax, "resendmax", resendDelayMax, "optional dhcp client resend max duration")
+			daemonFlags.StringVar(&conf.pidfilePath, "pidfile", "", "optional path to write daemon PID to")
+			daemonFlags.StringVar(&conf.hostPrefix, "hostprefix", "", "optional prefix to host root")
+			daemonFlags.StringVar(&conf.leaseFile, "lease-file", defaultLeaseFile, "file the leases are persisted in, under -hostprefix")
+			daemonFlags.StringVar(&conf.socketPath, "socketpath", "", "optional dhcp server socketpath")
+			daemonFlags.StringVar(&socketMode, "socket-mode", "0600", "permissions of the socket, unless passed by systemd")
+			daemonFlags.StringVar(&socketOwner, "socket-owner", "", "optional user name or ID owning the socket, unless passed by systemd")
+			daemonFlags.StringVar(&socketGroup, "socket-group", "", "optional group name or ID of the socket, unless passed by systemd")
+			daemonFlags.StringVar(&socketAllowedUIDs, "socket-allowed-uids", "", "comma-separated UIDs allowed to connect besides root")
+			daemonFlags.StringVar(&authTokenFile, "auth-token-file", "", "optional file with a token required for all calls but listing leases and transactions, configured for the plugin as daemonTokenFile")
+			daemonFlags.StringVar(&cniAllowedUIDs, "cni-allowed-uids", "", "optional comma-separated UIDs allowed to make the calls requiring the token besides root, by default all that can connect")
+			daemonFlags.StringVar(&auditLog, "audit-log", "", `optional file every call is logged to with the caller's UID and PID, "-" for stderr`)
+			daemonFlags.BoolVar(&conf.broadcast, "broadcast", false, "broadcast DHCP leases")
+			daemonFlags.DurationVar(&conf.timeout, "timeout", 10*time.Second, "optional dhcp client timeout duration")
+			daemonFlags.DurationVar(&conf.resendMax, "resendmax", resendDelayMax, "optional dhcp client resend max duration")
+			daemonFlags.DurationVar(&conf.minRenewal, "minrenewal", 0, "optional lower bound for lease renewal time, up to the rebinding time")
+			daemonFlags.DurationVar(&conf.maxLease, "maxlease", 0, "optional upper bound for lease time")
+			daemonFlags.BoolVar(&conf.releaseOnExit, "release-on-exit", false, "release all leases when terminated by SIGTERM or SIGINT")
+			daemonFlags.BoolVar(&conf.standby, "standby", false, "wait for the active daemon to exit and take over its leases")
+			daemonFlags.BoolVar(&conf.takeover, "takeover", false, "ask the active daemon to hand over its sockets and leases and exit")
+			daemonFlags.StringVar(&conf.eventWebhookURL, "event-webhook", "", "optional URL lease events are POSTed to as JSON")
+			daemonFlags.StringVar(&conf.healthAddress, "health-address", "", "optional address to serve /healthz and /readyz on, e.g. :8080")
+			daemonFlags.DurationVar(&conf.healthMaxExchangeAge, "health-max-exchange-age", 0, "optional age of the last successful DHCP exchange after which /readyz fails")
+			daemonFlags.DurationVar(&conf.gcInterval, "gc-interval", 5*time.Minute, "interval for releasing leases of deleted pods, 0 disables it")
+			daemonFlags.BoolVar(&conf.watchPods, "watch-pods", true, "release leases as soon as their pod is deleted")
+			daemonFlags.Float64Var(&conf.rateLimit, "rate-limit", 0, "optional limit of DHCP exchanges per second across all leases")
+			daemonFlags.IntVar(&conf.rateBurst, "rate-burst", 10, "number of DHCP exchanges allowed in a burst above -rate-limit")
+			daemonFlags.DurationVar(&conf.backoffBase, "allocate-backoff", 0, "optional delay before retrying a failed allocation for the same client, doubled on each failure")
+			daemonFlags.DurationVar(&conf.backoffMax, "allocate-backoff-max", 5*time.Minute, "upper bound for -allocate-backoff")
+			daemonFlags.BoolVar(&conf.annotatePods, "annotate-pods", false, "write the lease address, expiry and server to pod annotations")
+			daemonFlags.StringVar(&conf.leaseStoreType, "lease-store", leaseStoreFile, `where leases are persisted: "file" or "kubernetes" for DHCPLease objects`)
+			daemonFlags.DurationVar(&conf.pendingGrace, "pending-lease-grace", 5*time.Minute, "how long saved leases whose netns is missing at startup are kept, waiting for the netns to be restored")
+			daemonFlags.StringVar(&hostInterfaces, "host-interfaces", "", "comma-separated host interfaces, such as the bridge uplink, to acquire and maintain leases for")
+			daemonFlags.Float64Var(&conf.renewalJitter, "renewal-jitter", 0, "fraction of the remaining time renewal and rebinding times are randomly moved by, e.g. 0.1 (disabled by default)")
+			daemonFlags.IntVar(&conf.traceTransactions, "trace-transactions", 0, "log every DHCP message and keep the last N transactions for \"dhcp transactions\", 0 disables it")
+			daemonFlags.StringVar(&conf.configFile, "config", "", "optional JSON file overriding timeout, resendmax, broadcast, minrenewal, maxlease, socket-allowed-uids, cni-allowed-uids and trace-transactions, reloaded on SIGHUP")
+			daemonFlags.DurationVar(&conf.heartbeatInterval, "node-heartbeat-interval", time.Minute, "interval for refreshing the NetworkUnavailable condition of the node, 0 only sets it at startup")
+			daemonFlags.IntVar(&conf.unavailableAfter, "node-unavailable-after", 0, "optional number of consecutive failed DHCP attempts after which the node's network is reported unavailable")
+			daemonFlags.DurationVar(&conf.stableIPRetention, "stable-ip-retention", defaultStableIPRetention, "how long the addresses of released stableIP leases are asked for again")
 			daemonFlags.Parse(os.Args[2:])
 
-			if socketPath == "" {
-				socketPath = defaultSocketPath
+			if conf.socketPath == "" {
+				conf.socketPath = defaultSocketPath
 			}
+			var err error
+			conf.socketAccess, err = parseSocketAccess(socketMode, socketOwner, socketGroup, socketAllowedUIDs)
+			if err != nil {
+				log.Print(err.Error())
+				os.Exit(1)
+			}
+			conf.auth, err = parseRPCAuth(authTokenFile, cniAllowedUIDs, auditLog)
+			if err != nil {
+				log.Print(err.Error())
+				os.Exit(1)
+			}
+			conf.hostInterfaces = parseHostInterfaces(hostInterfaces)
 
-			if err := runDaemon(pidfilePath, hostPrefix, socketPath, timeout, resendMax, broadcast); err != nil {
+			if err := runDaemon(conf); err != nil {
 				log.Print(err.Error())
 				os.Exit(1)
 			}
 		} else if os.Args[1] == "shutdown" {
 			shutdown()
+		} else if os.Args[1] == "import" {
+			if err := importCommand(os.Args[2:]); err != nil {
+				log.Print(err.Error())
+				os.Exit(1)
+			}
+		} else if os.Args[1] == "leases" {
+			if err := leasesCommand(os.Args[2:]); err != nil {
+				log.Print(err.Error())
+				os.Exit(1)
+			}
+		} else if os.Args[1] == "renew-all" {
+			if err := renewAllCommand(os.Args[2:]); err != nil {
+				log.Print(err.Error())
+				os.Exit(1)
+			}
+		} else if os.Args[1] == "transactions" {
+			if err := transactionsCommand(os.Args[2:]); err != nil {
+				log.Print(err.Error())
+				os.Exit(1)
+			}
 		} else {
 			log.Print("Unrecognized command")
 			os.Exit(1)
@@ -115,6 +383,25 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
+	conf := NetConf{}
+	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
+		return fmt.Errorf("error parsing netconf: %v", err)
+	}
+	if conf.IPAM != nil && (len(conf.IPAM.ExposeOptions) > 0 || conf.IPAM.ExposeLease) {
+		reply := &AllocateReply{}
+		if err := rpcCall("DHCP.AllocateWithOptions", args, reply); err != nil {
+			return err
+		}
+		fields := map[string]interface{}{}
+		if len(conf.IPAM.ExposeOptions) > 0 {
+			fields["dhcpOptions"] = reply.Options
+		}
+		if conf.IPAM.ExposeLease {
+			fields["dhcpLease"] = reply.Lease
+		}
+		return printResultWithFields(reply.Result, confVersion, fields)
+	}
+
 	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
 	if err := rpcCall("DHCP.Allocate", args, result); err != nil {
 		return err
@@ -123,12 +410,45 @@ func cmdAdd(args *skel.CmdArgs) error {
 	return types.PrintResult(result, confVersion)
 }
 
+// printResultWithFields prints the result in the requested version with the
+// given fields added, such as the exposed DHCP options under "dhcpOptions".
+func printResultWithFields(result *current.Result, version string, extra map[string]interface{}) error {
+	converted, err := result.GetAsVersion(version)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(converted)
+	if err != nil {
+		return err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for name, value := range extra {
+		fields[name] = value
+	}
+
+	data, err = json.MarshalIndent(fields, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
 func cmdDel(args *skel.CmdArgs) error {
 	result := struct{}{}
-	if err := rpcCall("DHCP.Release", args, &result); err != nil {
-		return err
+	err := rpcCall("DHCP.Release", args, &result)
+	var cniErr *types.Error
+	if errors.As(err, &cniErr) && cniErr.Code == errCodeDaemonUnreachable {
+		// the daemon releases the lease when it's back
+		socketPath, pathErr := getSocketPath(args.StdinData)
+		if pathErr == nil && journalRelease(releaseJournalPath(socketPath), args) == nil {
+			return nil
+		}
 	}
-	return nil
+	return err
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
@@ -140,8 +460,8 @@ func cmdCheck(args *skel.CmdArgs) error {
 		return err
 	}
 
-	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
-	if err := rpcCall("DHCP.Allocate", args, result); err != nil {
+	result := struct{}{}
+	if err := rpcCall("DHCP.Check", args, &result); err != nil {
 		return err
 	}
 
@@ -159,15 +479,41 @@ func getSocketPath(stdinData []byte) (string, error) {
 	return conf.IPAM.DaemonSocketPath, nil
 }
 
+// getDaemonToken returns the token in the daemonTokenFile, empty if none is
+// configured.
+func getDaemonToken(stdinData []byte) (string, error) {
+	conf := NetConf{}
+	if err := json.Unmarshal(stdinData, &conf); err != nil {
+		return "", fmt.Errorf("error parsing daemon token conf: %v", err)
+	}
+	if conf.IPAM.DaemonTokenFile == "" {
+		return "", nil
+	}
+	return readToken(conf.IPAM.DaemonTokenFile)
+}
+
 func rpcCall(method string, args *skel.CmdArgs, result interface{}) error {
+	leaseFile, err := daemonlessLeaseFile(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if leaseFile != "" {
+		return oneShotCall(method, args, result, leaseFile)
+	}
+
 	socketPath, err := getSocketPath(args.StdinData)
 	if err != nil {
 		return fmt.Errorf("error obtaining socketPath: %v", err)
 	}
 
-	client, err := rpc.DialHTTP("unix", socketPath)
+	token, err := getDaemonToken(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	client, err := dialDaemon(socketPath, token)
 	if err != nil {
-		return fmt.Errorf("error dialing DHCP daemon: %v", err)
+		return types.NewError(errCodeDaemonUnreachable, "error dialing DHCP daemon", err.Error())
 	}
 
 	// The daemon may be running under a different working dir
@@ -180,7 +526,7 @@ func rpcCall(method string, args *skel.CmdArgs, result interface{}) error {
 
 	err = client.Call(method, args, result)
 	if err != nil {
-		return fmt.Errorf("error calling %v: %v", method, err)
+		return callError(method, err)
 	}
 
 	return nil
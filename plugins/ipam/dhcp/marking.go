@@ -0,0 +1,104 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// packetMarking is the QoS marking of the messages sent for a lease, so
+// that renewals aren't dropped on a congested uplink.
+type packetMarking struct {
+	// differentiated services code point, the upper six bits of the TOS
+	dscp uint8
+	// SO_PRIORITY of the sockets, which selects the egress queue
+	priority int
+}
+
+func parsePacketMarking(dscp, priority int) (packetMarking, error) {
+	if dscp < 0 || dscp > 63 {
+		return packetMarking{}, fmt.Errorf("dscp must be between 0 and 63, got %d", dscp)
+	}
+	if priority < 0 {
+		return packetMarking{}, fmt.Errorf("socketPriority must not be negative, got %d", priority)
+	}
+	return packetMarking{dscp: uint8(dscp), priority: priority}, nil
+}
+
+func (m packetMarking) tos() uint8 {
+	return m.dscp << 2
+}
+
+// applyTo sets the marking on a UDP socket, such as the ones of newUDPConn.
+func (m packetMarking) applyTo(conn interface{}) error {
+	if m == (packetMarking{}) {
+		return nil
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("can't mark the packets of %T", conn)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if m.dscp != 0 {
+			if sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, int(m.tos())); sockErr != nil {
+				return
+			}
+		}
+		sockErr = m.setPriority(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// setPriority sets SO_PRIORITY, which setting IP_TOS also changes.
+func (m packetMarking) setPriority(fd int) error {
+	if m.priority == 0 {
+		return nil
+	}
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_PRIORITY, m.priority)
+}
+
+// setTOS writes the marking into the IPv4 header of packet and updates its
+// checksum, for packet sockets sending headers built by the client.
+func (m packetMarking) setTOS(packet []byte) {
+	if m.dscp == 0 || len(packet) < 20 {
+		return
+	}
+	hdrLen := int(packet[0]&0x0f) * 4
+	if hdrLen < 20 || len(packet) < hdrLen {
+		return
+	}
+	packet[1] = m.tos()
+	packet[10], packet[11] = 0, 0
+	var sum uint32
+	for i := 0; i < hdrLen; i += 2 {
+		sum += uint32(packet[i])<<8 | uint32(packet[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	csum := ^uint16(sum)
+	packet[10], packet[11] = byte(csum>>8), byte(csum)
+}
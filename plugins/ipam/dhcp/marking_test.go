@@ -0,0 +1,91 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSetTOS(t *testing.T) {
+	// IPv4 header of a DISCOVER as built by nclient4, with a valid checksum
+	hdr := []byte{
+		0x45, 0x00, 0x01, 0x48, 0x00, 0x00, 0x00, 0x00, 0x40, 0x11, 0x79, 0xa6,
+		0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff,
+	}
+	packetMarking{dscp: 46}.setTOS(hdr)
+
+	if hdr[1] != 46<<2 {
+		t.Errorf("TOS is %#x, want %#x", hdr[1], 46<<2)
+	}
+	var sum uint32
+	for i := 0; i < len(hdr); i += 2 {
+		sum += uint32(hdr[i])<<8 | uint32(hdr[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	if sum != 0xffff {
+		t.Errorf("header checksum is invalid, sum %#x", sum)
+	}
+}
+
+func TestPacketMarkingApplyTo(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := (packetMarking{dscp: 10, priority: 5}).applyTo(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tos, priority int
+	var tosErr, priorityErr error
+	err = rc.Control(func(fd uintptr) {
+		tos, tosErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+		priority, priorityErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_PRIORITY)
+	})
+	for _, e := range []error{err, tosErr, priorityErr} {
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	if tos != 10<<2 || priority != 5 {
+		t.Errorf("got TOS %#x and priority %d, want %#x and 5", tos, priority, 10<<2)
+	}
+
+	if err := (packetMarking{dscp: 10}).applyTo(struct{}{}); err == nil {
+		t.Errorf("applyTo() accepted a connection without socket")
+	}
+}
+
+func TestParsePacketMarking(t *testing.T) {
+	if m, err := parsePacketMarking(46, 6); err != nil || m != (packetMarking{dscp: 46, priority: 6}) {
+		t.Errorf("parsePacketMarking(46, 6) = %+v, %v", m, err)
+	}
+	for _, tc := range [][2]int{{64, 0}, {-1, 0}, {0, -1}} {
+		if _, err := parsePacketMarking(tc[0], tc[1]); err == nil {
+			t.Errorf("parsePacketMarking(%d, %d) accepted invalid values", tc[0], tc[1])
+		}
+	}
+}
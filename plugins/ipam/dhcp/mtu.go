@@ -0,0 +1,58 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"log"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/vishvananda/netlink"
+)
+
+// minimum MTU of IPv4 links, see RFC 2132 section 5.1
+const minInterfaceMTU = 68
+
+// parseInterfaceMTU returns the Interface MTU option, 0 if it is missing or
+// invalid.
+func parseInterfaceMTU(opts dhcpv4.Options) int {
+	opt := opts[dhcpv4.OptionInterfaceMTU.Code()]
+	if len(opt) != 2 {
+		return 0
+	}
+	mtu := int(binary.BigEndian.Uint16(opt))
+	if mtu < minInterfaceMTU {
+		return 0
+	}
+	return mtu
+}
+
+// applyMTU sets the MTU sent by the server on the link. It must be called in
+// the lease's network namespace.
+func (l *DHCPLease) applyMTU() {
+	if l.ignoreMTU || l.link == nil {
+		return
+	}
+	mtu := parseInterfaceMTU(l.ack.Options)
+	if mtu == 0 || mtu == l.link.Attrs().MTU {
+		return
+	}
+	if err := netlink.LinkSetMTU(l.link, mtu); err != nil {
+		log.Printf("%v: failed to set the MTU of %v to %d: %v", l.clientID, l.link.Attrs().Name, mtu, err)
+		return
+	}
+	log.Printf("%v: set the MTU of %v to %d", l.clientID, l.link.Attrs().Name, mtu)
+	l.link.Attrs().MTU = mtu
+}
@@ -0,0 +1,41 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestParseInterfaceMTU(t *testing.T) {
+	for _, tc := range []struct {
+		opt  []byte
+		want int
+	}{
+		{nil, 0},
+		{[]byte{0x05, 0x78}, 1400},
+		{[]byte{0x00, 0x40}, 0},
+		{[]byte{0x05}, 0},
+	} {
+		opts := dhcpv4.Options{}
+		if tc.opt != nil {
+			opts[dhcpv4.OptionInterfaceMTU.Code()] = tc.opt
+		}
+		if got := parseInterfaceMTU(opts); got != tc.want {
+			t.Errorf("parseInterfaceMTU(%v) = %d, want %d", tc.opt, got, tc.want)
+		}
+	}
+}
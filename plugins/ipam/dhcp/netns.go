@@ -0,0 +1,110 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// inNetNS runs f in the lease's network namespace. The namespace handle is
+// opened once and reused across renewals, so maintaining a lease doesn't
+// hold an OS thread while it sleeps or reopen the path on every exchange.
+func (l *DHCPLease) inNetNS(f func() error) error {
+	netns, err := l.netNSHandle()
+	if err != nil {
+		return err
+	}
+	return netns.Do(func(ns.NetNS) error {
+		return f()
+	})
+}
+
+// netNSHandle returns the cached handle of the lease's namespace. When the
+// path refers to another namespace than the handle, e.g. because the
+// sandbox was recreated, the handle is reopened and the link looked up again.
+func (l *DHCPLease) netNSHandle() (ns.NetNS, error) {
+	if l.netNs == "" {
+		if hostNetNS == nil {
+			return nil, fmt.Errorf("host leases require the daemon network namespace")
+		}
+		return hostNetNS, nil
+	}
+
+	l.netNSMux.Lock()
+	defer l.netNSMux.Unlock()
+
+	old := l.netNSCache
+	if old != nil && sameNetNS(l.netNs, old) {
+		return old, nil
+	}
+
+	// the old handle is kept until the new namespace is usable
+	netns, err := ns.GetNS(l.netNs)
+	if err != nil {
+		return nil, err
+	}
+	if old == nil && l.link != nil {
+		l.netNSCache = netns
+		return netns, nil
+	}
+	// the link index may differ in a recreated namespace
+	err = netns.Do(func(ns.NetNS) error {
+		link, err := netlink.LinkByName(l.linkName())
+		if err != nil {
+			return fmt.Errorf("error looking up %q: %v", l.linkName(), err)
+		}
+		l.link = link
+		return nil
+	})
+	if err != nil {
+		netns.Close()
+		return nil, err
+	}
+	if old != nil {
+		log.Printf("%v: netns %s was recreated, reopened it", l.clientID, l.netNs)
+		old.Close()
+	}
+	l.netNSCache = netns
+	return netns, nil
+}
+
+// closeNetNS releases the cached namespace handle.
+func (l *DHCPLease) closeNetNS() {
+	l.netNSMux.Lock()
+	defer l.netNSMux.Unlock()
+
+	if l.netNSCache != nil {
+		l.netNSCache.Close()
+		l.netNSCache = nil
+	}
+}
+
+// sameNetNS reports whether path still refers to the namespace of netns.
+// A path that can't be inspected is treated as changed.
+func sameNetNS(path string, netns ns.NetNS) bool {
+	var pathStat, nsStat unix.Stat_t
+	if err := unix.Stat(path, &pathStat); err != nil {
+		return false
+	}
+	if err := unix.Fstat(int(netns.Fd()), &nsStat); err != nil {
+		return false
+	}
+	return pathStat.Dev == nsStat.Dev && pathStat.Ino == nsStat.Ino
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// fileNetNS stands in for a namespace handle, only its Fd is used.
+type fileNetNS struct {
+	ns.NetNS
+	f *os.File
+}
+
+func (n fileNetNS) Fd() uintptr {
+	return n.f.Fd()
+}
+
+func TestSameNetNS(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "netns")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	handle := fileNetNS{f: f}
+
+	if !sameNetNS(path, handle) {
+		t.Fatalf("expected %s to refer to the open handle", path)
+	}
+
+	// a recreated sandbox bind mounts a new namespace at the same path
+	recreated := filepath.Join(dir, "recreated")
+	if err := os.WriteFile(recreated, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(recreated, path); err != nil {
+		t.Fatal(err)
+	}
+	if sameNetNS(path, handle) {
+		t.Fatalf("expected the replaced %s to be detected", path)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if sameNetNS(path, handle) {
+		t.Fatalf("expected the removed %s to be detected", path)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"golang.org/x/sys/unix"
+)
+
+// Networks configured with daemonless don't need a running daemon, e.g. on
+// single-container edge devices: the plugin does the DHCP exchange itself
+// and records the lease in a file. "dhcp renew-all", run by a systemd timer,
+// renews the leases that are due in the files it is given, by default those
+// in the directory of defaultOneShotLeaseFile.
+const defaultOneShotLeaseFile = "/var/lib/cni/dhcp/leases.json"
+
+// daemonlessLeaseFile returns the lease file of a network configured with
+// daemonless, empty for networks using the daemon.
+func daemonlessLeaseFile(stdinData []byte) (string, error) {
+	conf := NetConf{}
+	if err := json.Unmarshal(stdinData, &conf); err != nil {
+		return "", fmt.Errorf("error parsing netconf: %v", err)
+	}
+	if conf.IPAM == nil || !conf.IPAM.Daemonless {
+		return "", nil
+	}
+	if conf.IPAM.LeaseFile == "" {
+		return defaultOneShotLeaseFile, nil
+	}
+	return conf.IPAM.LeaseFile, nil
+}
+
+// openOneShot loads the leases in leaseFile without maintaining them. The
+// file stays locked against other plugin calls and renewals until the
+// returned function is called.
+func openOneShot(leaseFile string) (*DHCP, func(), error) {
+	var err error
+	if hostNetNS, err = ns.GetCurrentNS(); err != nil {
+		return nil, nil, fmt.Errorf("failed to get the current network namespace: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(leaseFile), 0755); err != nil {
+		return nil, nil, leaseStoreError(err)
+	}
+	lock, err := os.OpenFile(leaseFile+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, nil, leaseStoreError(err)
+	}
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, nil, leaseStoreError(fmt.Errorf("failed to lock %s: %v", lock.Name(), err))
+	}
+	// closing the file releases the lock
+	unlock := func() { lock.Close() }
+
+	store := &fileLeaseStore{path: leaseFile}
+	// the defaults of the daemon's flags
+	defaults := leaseDefaults{timeout: 10 * time.Second, resendMax: resendDelayMax}
+	leases, pending, err := LoadSavedLeases(store, defaults)
+	if err != nil && !os.IsNotExist(err) {
+		unlock()
+		return nil, nil, leaseStoreError(err)
+	}
+
+	d := &DHCP{
+		leases:   newLeaseMap(nil),
+		pending:  newLeaseMap(nil),
+		store:    store,
+		defaults: defaults,
+		env:      leaseEnv{oneShot: true},
+	}
+	d.stableAddresses = loadStableAddresses(stableAddressesPath(leaseFile), defaultStableIPRetention)
+	for _, l := range leases {
+		l.env = d.env
+		d.setLease(l.clientID, l)
+	}
+	for _, l := range pending {
+		l.env = d.env
+		d.pending.set(l.clientID, l)
+	}
+	return d, unlock, nil
+}
+
+// oneShotCall handles a CNI call in the plugin process, the way the daemon
+// would.
+func oneShotCall(method string, args *skel.CmdArgs, result interface{}, leaseFile string) error {
+	d, unlock, err := openOneShot(leaseFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	switch method {
+	case "DHCP.Allocate":
+		err = d.Allocate(args, result.(*current.Result))
+	case "DHCP.AllocateWithOptions":
+		err = d.AllocateWithOptions(args, result.(*AllocateReply))
+	case "DHCP.Release":
+		err = d.Release(args, result.(*struct{}))
+	case "DHCP.Check":
+		if err := d.Check(args, result.(*struct{})); err != nil {
+			return callError(method, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%s is not supported without the daemon", method)
+	}
+	if err != nil {
+		return callError(method, err)
+	}
+	// the lease must be recorded for "dhcp renew-all" and DEL to find it
+	if err := d.persistLeases(); err != nil {
+		return leaseStoreError(err)
+	}
+	return nil
+}
+
+// renewAllCommand implements "dhcp renew-all [-lease-dir dir] [lease-file...]",
+// which renews the leases of daemonless networks that are due. Without lease
+// files, it renews those in the lease directory.
+func renewAllCommand(args []string) error {
+	var leaseDir string
+	flags := flag.NewFlagSet("renew-all", flag.ExitOnError)
+	flags.StringVar(&leaseDir, "lease-dir", filepath.Dir(defaultOneShotLeaseFile), "directory whose *.json lease files are renewed if none are given")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s renew-all [-lease-dir dir] [lease-file...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	leaseFiles := flags.Args()
+	if len(leaseFiles) == 0 {
+		var err error
+		if leaseFiles, err = findLeaseFiles(leaseDir); err != nil {
+			return err
+		}
+	}
+	failed := 0
+	for _, leaseFile := range leaseFiles {
+		if err := renewLeaseFile(leaseFile); err != nil {
+			log.Printf("%s: %v", leaseFile, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to renew the leases of %d of %d lease files", failed, len(leaseFiles))
+	}
+	return nil
+}
+
+// findLeaseFiles returns the lease files in dir, none if it doesn't exist.
+// Networks whose leaseFile is elsewhere must be given to renew-all.
+func findLeaseFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var leaseFiles []string
+	for _, file := range files {
+		// skip the files written in place of a lease file
+		if !strings.HasPrefix(filepath.Base(file), ".") {
+			leaseFiles = append(leaseFiles, file)
+		}
+	}
+	return leaseFiles, nil
+}
+
+// renewLeaseFile renews the leases in leaseFile that are due.
+func renewLeaseFile(leaseFile string) error {
+	d, unlock, err := openOneShot(leaseFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	now := time.Now()
+	for clientID, l := range d.leases.all() {
+		ended := false
+		err := withLeaseNetNS(l.netNs, func(ns.NetNS) error {
+			ended = !l.renewDue(now)
+			return nil
+		})
+		if err != nil {
+			log.Printf("%v: %v", clientID, err)
+			continue
+		}
+		if ended {
+			d.leases.delete(clientID)
+		}
+	}
+	// the container of a lease whose netns is gone won't come back
+	for clientID, l := range d.pending.all() {
+		if !l.infinite && now.After(l.expireTime) {
+			d.pending.delete(clientID)
+		}
+	}
+	return d.persistLeases()
+}
+
+// renewDue does what the maintain loop would do for the lease at now. It
+// must be called in the link's namespace and returns false once the lease
+// ended and is no longer to be renewed.
+func (l *DHCPLease) renewDue(now time.Time) bool {
+	if l.infinite || now.Before(l.renewalTime) {
+		return true
+	}
+
+	if l.isSynthetic() {
+		if err := l.replaceFallback(); err != nil {
+			log.Printf("%v: still using fallback address: %v", l.clientID, err)
+			l.extendFallback(now)
+		} else {
+			log.Printf("%v: lease acquired for fallback address, expiration is %v", l.clientID, l.expiration())
+			l.notify(leaseEventAcquired)
+		}
+		return true
+	}
+
+	var err error
+	if now.Before(l.rebindingTime) {
+		err = l.renew()
+	} else {
+		err = l.acquire()
+	}
+	if err == nil {
+		log.Printf("%v: lease renewed, expiration is %v", l.clientID, l.expiration())
+		l.notify(leaseEventRenewed)
+		return true
+	}
+	log.Printf("%v: %v", l.clientID, err)
+	if !time.Now().After(l.expireTime) {
+		return true
+	}
+
+	l.notify(leaseEventExpired)
+	switch l.expiryPolicy {
+	case expiryPolicyKeep:
+		log.Printf("%v: lease expired, keeping the address", l.clientID)
+	case expiryPolicyReacquire:
+		l.removeAddress()
+		if err := l.reacquire(); err != nil {
+			log.Printf("%v: %v", l.clientID, err)
+		} else {
+			log.Printf("%v: lease acquired after expiry, expiration is %v", l.clientID, l.expiration())
+			l.notify(leaseEventAcquired)
+		}
+	default:
+		l.expire()
+		return false
+	}
+	return true
+}
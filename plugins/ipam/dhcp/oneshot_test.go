@@ -0,0 +1,134 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestDaemonlessLeaseFile(t *testing.T) {
+	tests := []struct {
+		conf string
+		want string
+	}{
+		{`{"ipam": {"type": "dhcp"}}`, ""},
+		{`{"ipam": {"type": "dhcp", "daemonless": true}}`, defaultOneShotLeaseFile},
+		{`{"ipam": {"type": "dhcp", "daemonless": true, "leaseFile": "/data/leases.json"}}`, "/data/leases.json"},
+	}
+	for _, tt := range tests {
+		got, err := daemonlessLeaseFile([]byte(tt.conf))
+		if err != nil || got != tt.want {
+			t.Errorf("daemonlessLeaseFile(%s) = %q, %v, want %q", tt.conf, got, err, tt.want)
+		}
+	}
+}
+
+func TestOpenOneShot(t *testing.T) {
+	defer func(saved ns.NetNS) { hostNetNS = saved }(hostNetNS)
+
+	leaseFile := filepath.Join(t.TempDir(), "dhcp", "leases.json")
+	d, unlock, err := openOneShot(leaseFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.env.oneShot {
+		t.Errorf("leases would be maintained in the background")
+	}
+
+	// another call waits for the lease file
+	opened := make(chan func())
+	go func() {
+		_, unlock, err := openOneShot(leaseFile)
+		if err != nil {
+			t.Error(err)
+			close(opened)
+			return
+		}
+		opened <- unlock
+	}()
+	select {
+	case <-opened:
+		t.Fatalf("lease file opened twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a lease that is not due isn't renewed, so no link is needed
+	ack := testPacket(dhcpv4.OpcodeBootReply, nil, dhcpv4.MessageTypeAck)
+	ack.YourIPAddr = []byte{10, 0, 0, 2}
+	l := &DHCPLease{
+		clientID:      "container1",
+		ack:           ack,
+		interfaceName: "lo",
+		renewalTime:   time.Now().Add(time.Hour),
+		rebindingTime: time.Now().Add(2 * time.Hour),
+		expireTime:    time.Now().Add(3 * time.Hour),
+		stop:          make(chan struct{}),
+	}
+	if !l.renewDue(time.Now()) {
+		t.Errorf("lease ended before it was due")
+	}
+	d.setLease(l.clientID, l)
+	if err := d.persistLeases(); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+
+	var unlockSecond func()
+	select {
+	case unlockSecond = <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("lease file still locked")
+	}
+	if unlockSecond == nil {
+		return
+	}
+	defer unlockSecond()
+
+	saved, err := (&fileLeaseStore{path: leaseFile}).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].ClientID != "container1" {
+		t.Errorf("unexpected saved leases %+v", saved)
+	}
+}
+
+func TestFindLeaseFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"leases.json", "leases.json.lock", "leases.json.addresses", "storage.json", ".leases.json"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := findLeaseFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "leases.json"), filepath.Join(dir, "storage.json")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got lease files %v, want %v", got, want)
+	}
+
+	if got, err := findLeaseFiles(filepath.Join(dir, "missing")); err != nil || len(got) != 0 {
+		t.Errorf("got %v, %v for a missing directory", got, err)
+	}
+}
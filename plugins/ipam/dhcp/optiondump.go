@@ -0,0 +1,203 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Names of the options commonly sent by servers, as used by ISC dhcpd
+var optionNames = map[uint8]string{
+	dhcpv4.OptionSubnetMask.Code():                 "subnet-mask",
+	dhcpv4.OptionTimeOffset.Code():                 "time-offset",
+	dhcpv4.OptionRouter.Code():                     "routers",
+	dhcpv4.OptionTimeServer.Code():                 "time-servers",
+	dhcpv4.OptionNameServer.Code():                 "ien116-name-servers",
+	dhcpv4.OptionDomainNameServer.Code():           "domain-name-servers",
+	dhcpv4.OptionLogServer.Code():                  "log-servers",
+	dhcpv4.OptionHostName.Code():                   "host-name",
+	dhcpv4.OptionDomainName.Code():                 "domain-name",
+	dhcpv4.OptionRootPath.Code():                   "root-path",
+	dhcpv4.OptionInterfaceMTU.Code():               "interface-mtu",
+	dhcpv4.OptionBroadcastAddress.Code():           "broadcast-address",
+	dhcpv4.OptionStaticRoutingTable.Code():         "static-routes",
+	dhcpv4.OptionNetworkInformationServers.Code():  "nis-servers",
+	dhcpv4.OptionNTPServers.Code():                 "ntp-servers",
+	dhcpv4.OptionVendorSpecificInformation.Code():  "vendor-encapsulated-options",
+	dhcpv4.OptionNetBIOSOverTCPIPNameServer.Code(): "netbios-name-servers",
+	dhcpv4.OptionIPAddressLeaseTime.Code():         "dhcp-lease-time",
+	dhcpv4.OptionDHCPMessageType.Code():            "dhcp-message-type",
+	dhcpv4.OptionServerIdentifier.Code():           "dhcp-server-identifier",
+	dhcpv4.OptionMessage.Code():                    "dhcp-message",
+	dhcpv4.OptionRenewTimeValue.Code():             "dhcp-renewal-time",
+	dhcpv4.OptionRebindingTimeValue.Code():         "dhcp-rebinding-time",
+	dhcpv4.OptionClassIdentifier.Code():            "vendor-class-identifier",
+	dhcpv4.OptionClientIdentifier.Code():           "dhcp-client-identifier",
+	dhcpv4.OptionTFTPServerName.Code():             "tftp-server-name",
+	dhcpv4.OptionBootfileName.Code():               "bootfile-name",
+	dhcpv4.OptionUserClassInformation.Code():       "user-class",
+	dhcpv4.OptionIEEE10031TZString.Code():          "pcode",
+	dhcpv4.OptionReferenceToTZDatabase.Code():      "tcode",
+	dhcpv4.OptionClasslessStaticRoute.Code():       "classless-static-routes",
+	dhcpv4.OptionFQDN.Code():                       "fqdn",
+	dhcpv4.OptionRelayAgentInformation.Code():      "relay-agent-information",
+	dhcpv4.OptionDNSDomainSearchList.Code():        "domain-search",
+}
+
+// OptionValue is an option of a lease's acknowledgement. Decoded is empty
+// for options whose format isn't known.
+type OptionValue struct {
+	Code    int
+	Name    string
+	Raw     string
+	Decoded []string
+}
+
+// LeaseOptions lists the options the server sent for a lease, for the
+// "leases options" subcommand.
+type LeaseOptions struct {
+	LeaseInfo
+	Options []OptionValue
+}
+
+// dumpOptions returns all options of ack, ordered by code.
+func dumpOptions(ack *dhcpv4.DHCPv4) []OptionValue {
+	if ack == nil {
+		return nil
+	}
+	values := []OptionValue{}
+	for code, value := range ack.Options {
+		values = append(values, OptionValue{
+			Code:    int(code),
+			Name:    optionNames[code],
+			Raw:     hex.EncodeToString(value),
+			Decoded: decodeOption(code, value),
+		})
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Code < values[j].Code })
+	return values
+}
+
+// decodeOption returns the value of the option in readable form, nil if its
+// format isn't known or the value doesn't match it.
+func decodeOption(code uint8, value []byte) []string {
+	opts := dhcpv4.Options{code: value}
+	decoded := []string{}
+	switch {
+	case ipListOptions[code], code == dhcpv4.OptionBroadcastAddress.Code():
+		if len(value) == 0 || len(value)%4 != 0 {
+			return nil
+		}
+		for ; len(value) >= 4; value = value[4:] {
+			decoded = append(decoded, net.IP(value[0:4]).String())
+		}
+	case textOptions[code], code == dhcpv4.OptionClassIdentifier.Code(),
+		code == dhcpv4.OptionIEEE10031TZString.Code(), code == dhcpv4.OptionReferenceToTZDatabase.Code():
+		decoded = append(decoded, string(trimNul(value)))
+	case code == dhcpv4.OptionSubnetMask.Code():
+		if len(value) != 4 {
+			return nil
+		}
+		decoded = append(decoded, net.IP(value).String())
+	case code == dhcpv4.OptionInterfaceMTU.Code():
+		if len(value) != 2 {
+			return nil
+		}
+		decoded = append(decoded, strconv.Itoa(int(binary.BigEndian.Uint16(value))))
+	case code == dhcpv4.OptionIPAddressLeaseTime.Code(), code == dhcpv4.OptionRenewTimeValue.Code(), code == dhcpv4.OptionRebindingTimeValue.Code():
+		if len(value) != 4 {
+			return nil
+		}
+		secs := binary.BigEndian.Uint32(value)
+		if secs == infiniteLeaseTime {
+			decoded = append(decoded, "infinite")
+		} else {
+			decoded = append(decoded, fmt.Sprintf("%ds", secs))
+		}
+	case code == dhcpv4.OptionDHCPMessageType.Code():
+		if len(value) != 1 {
+			return nil
+		}
+		decoded = append(decoded, messageTypeName(opts))
+	case code == dhcpv4.OptionStaticRoutingTable.Code():
+		for _, r := range parseRoutes(opts) {
+			decoded = append(decoded, fmt.Sprintf("%v via %v", &r.Dst, r.GW))
+		}
+	case code == dhcpv4.OptionClasslessStaticRoute.Code():
+		for _, r := range parseCIDRRoutes(opts) {
+			decoded = append(decoded, fmt.Sprintf("%v via %v", &r.Dst, r.GW))
+		}
+	case code == dhcpv4.OptionDNSDomainSearchList.Code():
+		decoded = parseDomainSearch(opts)
+	default:
+		return nil
+	}
+	if len(decoded) == 0 {
+		return nil
+	}
+	return decoded
+}
+
+func trimNul(value []byte) []byte {
+	for len(value) > 0 && value[len(value)-1] == 0 {
+		value = value[:len(value)-1]
+	}
+	return value
+}
+
+// LeaseOptions returns the options of the leases matching target, see
+// leaseMatches, as sent by the server in the last acknowledgement.
+func (d *DHCP) LeaseOptions(target string, reply *[]LeaseOptions) error {
+	matching := []LeaseOptions{}
+	for _, l := range d.leases.all() {
+		if info := l.info(); leaseMatches(info, target) {
+			matching = append(matching, LeaseOptions{LeaseInfo: info, Options: dumpOptions(l.ack)})
+		}
+	}
+	if len(matching) == 0 {
+		return fmt.Errorf("no lease found for %q", target)
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].ClientID < matching[j].ClientID })
+	*reply = matching
+	return nil
+}
+
+func printLeaseOptions(out io.Writer, l LeaseOptions) error {
+	fmt.Fprintf(out, "%s/%s %s %s (%s)\n", l.Namespace, l.Pod, l.Interface, l.IP, l.ClientID)
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CODE\tNAME\tDECODED\tRAW")
+	for _, o := range l.Options {
+		decoded := "-"
+		if len(o.Decoded) > 0 {
+			decoded = strings.Join(o.Decoded, ", ")
+		}
+		name := o.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", o.Code, name, decoded, o.Raw)
+	}
+	return w.Flush()
+}
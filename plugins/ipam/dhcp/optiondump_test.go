@@ -0,0 +1,72 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestDumpOptions(t *testing.T) {
+	ack := testPacket(dhcpv4.OpcodeBootReply, []byte{0, 0, 0, 1}, dhcpv4.MessageTypeAck)
+	ack.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionSubnetMask, []byte{255, 255, 255, 0}))
+	ack.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionRouter, net.ParseIP("10.0.0.1").To4()))
+	ack.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionNTPServers, []byte{10, 0, 0, 2, 10, 0, 0, 3}))
+	ack.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionDomainName, []byte("example.com\x00")))
+	ack.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionInterfaceMTU, []byte{0x05, 0xdc}))
+	ack.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionIPAddressLeaseTime, []byte{0, 0, 0x0e, 0x10}))
+	ack.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionClasslessStaticRoute, []byte{24, 192, 168, 1, 10, 0, 0, 1}))
+	ack.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionDNSDomainSearchList, []byte{3, 'e', 'n', 'g', 0}))
+	ack.UpdateOption(dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(224), []byte{0xca, 0xfe}))
+	ack.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionRenewTimeValue, []byte{0, 1}))
+
+	got := map[int]OptionValue{}
+	var codes []int
+	for _, o := range dumpOptions(ack) {
+		got[o.Code] = o
+		codes = append(codes, o.Code)
+	}
+	wantCodes := []int{1, 3, 15, 26, 42, 51, 53, 58, 119, 121, 224}
+	if !reflect.DeepEqual(codes, wantCodes) {
+		t.Errorf("codes = %v, want %v", codes, wantCodes)
+	}
+
+	for code, want := range map[int][]string{
+		1:   {"255.255.255.0"},
+		3:   {"10.0.0.1"},
+		15:  {"example.com"},
+		26:  {"1500"},
+		42:  {"10.0.0.2", "10.0.0.3"},
+		51:  {"3600s"},
+		53:  {"ACK"},
+		58:  nil, // too short for a time
+		119: {"eng"},
+		121: {"192.168.1.0/24 via 10.0.0.1"},
+		224: nil,
+	} {
+		if !reflect.DeepEqual(got[code].Decoded, want) {
+			t.Errorf("option %d decoded as %q, want %q", code, got[code].Decoded, want)
+		}
+	}
+	if o := got[224]; o.Raw != "cafe" || o.Name != "" {
+		t.Errorf("unknown option = %+v", o)
+	}
+	if o := got[3]; o.Name != "routers" || o.Raw != "0a000001" {
+		t.Errorf("routers option = %+v", o)
+	}
+}
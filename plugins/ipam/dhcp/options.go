@@ -16,44 +16,67 @@ package main
 
 import (
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/d2g/dhcp4"
+	"github.com/insomniacslk/dhcp/dhcpv4"
 )
 
-var optionNameToID = map[string]dhcp4.OptionCode{
-	"dhcp-client-identifier":  dhcp4.OptionClientIdentifier,
-	"subnet-mask":             dhcp4.OptionSubnetMask,
-	"routers":                 dhcp4.OptionRouter,
-	"host-name":               dhcp4.OptionHostName,
-	"user-class":              dhcp4.OptionUserClass,
-	"vendor-class-identifier": dhcp4.OptionVendorClassIdentifier,
+// Relay Agent Information sub-options, see RFC 3046 section 2.0
+const (
+	agentCircuitID byte = 1
+	agentRemoteID  byte = 2
+)
+
+// Client FQDN flag bits, see RFC 4702 section 2.1
+const (
+	fqdnFlagServerUpdate   byte = 0x01
+	fqdnFlagEncoded        byte = 0x04
+	fqdnFlagNoServerUpdate byte = 0x08
+)
+
+var optionNameToID = map[string]dhcpv4.OptionCode{
+	"dhcp-client-identifier":  dhcpv4.OptionClientIdentifier,
+	"subnet-mask":             dhcpv4.OptionSubnetMask,
+	"routers":                 dhcpv4.OptionRouter,
+	"host-name":               dhcpv4.OptionHostName,
+	"user-class":              dhcpv4.OptionUserClassInformation,
+	"vendor-class-identifier": dhcpv4.OptionClassIdentifier,
+	"fqdn":                    dhcpv4.OptionFQDN,
+	"relay-agent-information": dhcpv4.OptionRelayAgentInformation,
 }
 
-func parseOptionName(option string) (dhcp4.OptionCode, error) {
+// parseOptionName returns the code of an option given by name or number.
+// Codes are kept as the keys of dhcpv4.Options, since option codes of
+// different types don't compare equal.
+func parseOptionName(option string) (uint8, error) {
 	if val, ok := optionNameToID[option]; ok {
-		return val, nil
+		return val.Code(), nil
 	}
 	i, err := strconv.ParseUint(option, 10, 8)
 	if err != nil {
 		return 0, fmt.Errorf("Can not parse option: %w", err)
 	}
-	return dhcp4.OptionCode(i), nil
+	return uint8(i), nil
 }
 
-func parseRouter(opts dhcp4.Options) net.IP {
-	if opts, ok := opts[dhcp4.OptionRouter]; ok {
-		if len(opts) == 4 {
-			return net.IP(opts)
-		}
+// parseRouter returns the first router, which is the preferred one.
+func parseRouter(opts dhcpv4.Options) net.IP {
+	if routers := parseRouters(opts); len(routers) > 0 {
+		return routers[0]
 	}
 	return nil
 }
 
+func parseRouters(opts dhcpv4.Options) []net.IP {
+	return dhcpv4.GetIPs(dhcpv4.OptionRouter, opts)
+}
+
 func classfulSubnet(sn net.IP) net.IPNet {
 	return net.IPNet{
 		IP:   sn,
@@ -61,13 +84,14 @@ func classfulSubnet(sn net.IP) net.IPNet {
 	}
 }
 
-func parseRoutes(opts dhcp4.Options) []*types.Route {
+func parseRoutes(opts dhcpv4.Options) []*types.Route {
 	// StaticRoutes format: pairs of:
 	// Dest = 4 bytes; Classful IP subnet
 	// Router = 4 bytes; IP address of router
+	// dhcpv4 has no type for the option
 
 	routes := []*types.Route{}
-	if opt, ok := opts[dhcp4.OptionStaticRoute]; ok {
+	if opt := opts.Get(dhcpv4.OptionStaticRoutingTable); opt != nil {
 		for len(opt) >= 8 {
 			sn := opt[0:4]
 			r := opt[4:8]
@@ -83,78 +107,288 @@ func parseRoutes(opts dhcp4.Options) []*types.Route {
 	return routes
 }
 
-func parseCIDRRoutes(opts dhcp4.Options) []*types.Route {
+func parseCIDRRoutes(opts dhcpv4.Options) []*types.Route {
 	// See RFC4332 for format (http://tools.ietf.org/html/rfc3442)
 
 	routes := []*types.Route{}
-	if opt, ok := opts[dhcp4.OptionClasslessRouteFormat]; ok {
-		for len(opt) >= 5 {
-			width := int(opt[0])
-			if width > 32 {
-				// error: can't have more than /32
-				return nil
-			}
-			// network bits are compacted to avoid zeros
-			octets := 0
-			if width > 0 {
-				octets = (width-1)/8 + 1
-			}
+	opt := opts.Get(dhcpv4.OptionClasslessStaticRoute)
+	if opt == nil {
+		return routes
+	}
+	var parsed dhcpv4.Routes
+	if err := parsed.FromBytes(opt); err != nil {
+		return nil
+	}
+	for _, r := range parsed {
+		routes = append(routes, &types.Route{Dst: *r.Dest, GW: r.Router})
+	}
+	return routes
+}
 
-			if len(opt) < 1+octets+4 {
-				// error: too short
-				return nil
-			}
+func parseSubnetMask(opts dhcpv4.Options) net.IPMask {
+	mask := opts.Get(dhcpv4.OptionSubnetMask)
+	if mask == nil {
+		return nil
+	}
+
+	return net.IPMask(mask)
+}
 
-			sn := make([]byte, 4)
-			copy(sn, opt[1:octets+1])
+func parseDuration(opts dhcpv4.Options, code dhcpv4.OptionCode, optName string) (time.Duration, error) {
+	val := opts.Get(code)
+	if val == nil {
+		return 0, fmt.Errorf("option %v not found", optName)
+	}
+	var d dhcpv4.Duration
+	if err := d.FromBytes(val); err != nil {
+		return 0, fmt.Errorf("option %v is not 4 bytes", optName)
+	}
+	return time.Duration(d), nil
+}
 
-			gw := net.IP(opt[octets+1 : octets+5])
+// A lease time of all ones means the address is leased forever, RFC 2131
+// section 3.3.
+const infiniteLeaseTime = 0xffffffff
 
-			rt := &types.Route{
-				Dst: net.IPNet{
-					IP:   net.IP(sn),
-					Mask: net.CIDRMask(width, 32),
-				},
-				GW: gw,
-			}
-			routes = append(routes, rt)
+func isInfiniteLease(opts dhcpv4.Options) bool {
+	secs := opts.Get(dhcpv4.OptionIPAddressLeaseTime)
+	return len(secs) == 4 && binary.BigEndian.Uint32(secs) == infiniteLeaseTime
+}
+
+func parseLeaseTime(opts dhcpv4.Options) (time.Duration, error) {
+	return parseDuration(opts, dhcpv4.OptionIPAddressLeaseTime, "LeaseTime")
+}
 
-			opt = opt[octets+5:]
+func parseRenewalTime(opts dhcpv4.Options) (time.Duration, error) {
+	return parseDuration(opts, dhcpv4.OptionRenewTimeValue, "RenewalTime")
+}
+
+func parseRebindingTime(opts dhcpv4.Options) (time.Duration, error) {
+	return parseDuration(opts, dhcpv4.OptionRebindingTimeValue, "RebindingTime")
+}
+
+// encodeAgentInfo builds the payload of the Relay Agent Information option
+// from the Agent Circuit ID and Agent Remote ID. Empty sub-options are left
+// out.
+func encodeAgentInfo(circuitID, remoteID string) ([]byte, error) {
+	var opt []byte
+	for _, sub := range []struct {
+		code  byte
+		value string
+	}{{agentCircuitID, circuitID}, {agentRemoteID, remoteID}} {
+		if sub.value == "" {
+			continue
+		}
+		if len(sub.value) > 255 {
+			return nil, fmt.Errorf("relay agent sub-option %d too long: %q", sub.code, sub.value)
 		}
+		opt = append(opt, sub.code, byte(len(sub.value)))
+		opt = append(opt, sub.value...)
 	}
-	return routes
+
+	if len(opt) > 255 {
+		return nil, fmt.Errorf("relay agent information too long")
+	}
+	return opt, nil
 }
 
-func parseSubnetMask(opts dhcp4.Options) net.IPMask {
-	mask, ok := opts[dhcp4.OptionSubnetMask]
-	if !ok {
-		return nil
+// encodeClientFQDN builds the payload of the Client FQDN option: the flags,
+// two deprecated RCODE octets and the domain name. When the E flag is set,
+// the name is encoded in canonical wire format, otherwise as plain ASCII.
+func encodeClientFQDN(name string, flags byte) ([]byte, error) {
+	if flags&fqdnFlagServerUpdate != 0 && flags&fqdnFlagNoServerUpdate != 0 {
+		return nil, fmt.Errorf("FQDN flags S and N can not both be set")
 	}
 
-	return net.IPMask(mask)
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil, fmt.Errorf("FQDN is empty")
+	}
+
+	opt := []byte{flags, 0, 0}
+	if flags&fqdnFlagEncoded == 0 {
+		opt = append(opt, name...)
+	} else {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid label %q in FQDN %q", label, name)
+			}
+			opt = append(opt, byte(len(label)))
+			opt = append(opt, label...)
+		}
+		opt = append(opt, 0)
+	}
+
+	if len(opt) > 255 {
+		return nil, fmt.Errorf("FQDN %q is too long", name)
+	}
+	return opt, nil
 }
 
-func parseDuration(opts dhcp4.Options, code dhcp4.OptionCode, optName string) (time.Duration, error) {
-	val, ok := opts[code]
-	if !ok {
-		return 0, fmt.Errorf("option %v not found", optName)
+func parseNameServers(opts dhcpv4.Options) []string {
+	servers := []string{}
+	for _, ip := range dhcpv4.GetIPs(dhcpv4.OptionDomainNameServer, opts) {
+		servers = append(servers, ip.String())
 	}
-	if len(val) != 4 {
-		return 0, fmt.Errorf("option %v is not 4 bytes", optName)
+	return servers
+}
+
+// parseDomainNames returns the domains in the Domain Name option. It holds a
+// single name, but some servers send a space-separated list.
+func parseDomainNames(opts dhcpv4.Options) []string {
+	return strings.Fields(strings.TrimRight(dhcpv4.GetString(dhcpv4.OptionDomainName, opts), "\x00"))
+}
+
+// parseDomainName returns the first domain of the Domain Name option.
+func parseDomainName(opts dhcpv4.Options) string {
+	if names := parseDomainNames(opts); len(names) > 0 {
+		return names[0]
+	}
+	return ""
+}
+
+// parseSearchDomains returns the Domain Search option, or the domains of the
+// Domain Name option if there are several and the former is missing.
+func parseSearchDomains(opts dhcpv4.Options) []string {
+	if search := parseDomainSearch(opts); len(search) > 0 {
+		return search
+	}
+	if names := parseDomainNames(opts); len(names) > 1 {
+		return names
+	}
+	return []string{}
+}
+
+// parseDomainSearch decodes the Domain Search option, see RFC 3397. The names
+// use DNS wire format and may contain compression pointers into the option data.
+func parseDomainSearch(opts dhcpv4.Options) []string {
+	opt := opts.Get(dhcpv4.OptionDNSDomainSearchList)
+	domains := []string{}
+	for pos := 0; pos < len(opt); {
+		name, next, err := readDomainName(opt, pos)
+		if err != nil {
+			return nil
+		}
+		if name != "" {
+			domains = append(domains, name)
+		}
+		pos = next
 	}
+	return domains
+}
 
-	secs := binary.BigEndian.Uint32(val)
-	return time.Duration(secs) * time.Second, nil
+// readDomainName reads the name starting at pos and returns it together with
+// the position following it.
+func readDomainName(data []byte, pos int) (string, int, error) {
+	labels := []string{}
+	next := -1
+	// every pointer must go backwards, which guarantees termination
+	limit := len(data)
+	for {
+		if pos >= len(data) {
+			return "", 0, fmt.Errorf("domain name truncated")
+		}
+		length := int(data[pos])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = pos + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if pos+1 >= len(data) {
+				return "", 0, fmt.Errorf("domain name pointer truncated")
+			}
+			target := (length&0x3f)<<8 | int(data[pos+1])
+			if target >= limit {
+				return "", 0, fmt.Errorf("invalid domain name pointer %d", target)
+			}
+			if next < 0 {
+				next = pos + 2
+			}
+			limit = target
+			pos = target
+		case length&0xc0 != 0:
+			return "", 0, fmt.Errorf("invalid domain name label length %d", length)
+		default:
+			if pos+1+length > len(data) {
+				return "", 0, fmt.Errorf("domain name label truncated")
+			}
+			labels = append(labels, string(data[pos+1:pos+1+length]))
+			pos += 1 + length
+		}
+	}
 }
 
-func parseLeaseTime(opts dhcp4.Options) (time.Duration, error) {
-	return parseDuration(opts, dhcp4.OptionIPAddressLeaseTime, "LeaseTime")
+// Options whose value is a list of IPv4 addresses
+var ipListOptions = map[uint8]bool{
+	dhcpv4.OptionRouter.Code():                                     true,
+	dhcpv4.OptionTimeServer.Code():                                 true,
+	dhcpv4.OptionNameServer.Code():                                 true,
+	dhcpv4.OptionDomainNameServer.Code():                           true,
+	dhcpv4.OptionLogServer.Code():                                  true,
+	dhcpv4.OptionNetworkInformationServers.Code():                  true,
+	dhcpv4.OptionNTPServers.Code():                                 true,
+	dhcpv4.OptionNetBIOSOverTCPIPNameServer.Code():                 true,
+	dhcpv4.OptionNetBIOSOverTCPIPDatagramDistributionServer.Code(): true,
+	dhcpv4.OptionServerIdentifier.Code():                           true,
 }
 
-func parseRenewalTime(opts dhcp4.Options) (time.Duration, error) {
-	return parseDuration(opts, dhcp4.OptionRenewalTimeValue, "RenewalTime")
+// Options whose value is text
+var textOptions = map[uint8]bool{
+	dhcpv4.OptionHostName.Code():                        true,
+	dhcpv4.OptionDomainName.Code():                      true,
+	dhcpv4.OptionRootPath.Code():                        true,
+	dhcpv4.OptionNetworkInformationServiceDomain.Code(): true,
+	dhcpv4.OptionTFTPServerName.Code():                  true,
+	dhcpv4.OptionBootfileName.Code():                    true,
+	dhcpv4.OptionMessage.Code():                         true,
 }
 
-func parseRebindingTime(opts dhcp4.Options) (time.Duration, error) {
-	return parseDuration(opts, dhcp4.OptionRebindingTimeValue, "RebindingTime")
+// exposeOptions returns the values of the listed options keyed by option
+// code. IP lists and text are decoded, other values are hex encoded.
+func exposeOptions(opts dhcpv4.Options, options []DHCPOption) (map[string][]string, error) {
+	exposed := map[string][]string{}
+	for _, option := range options {
+		code, err := parseOptionName(string(option))
+		if err != nil {
+			return nil, err
+		}
+		value, ok := opts[code]
+		if !ok {
+			continue
+		}
+
+		key := strconv.Itoa(int(code))
+		switch {
+		case ipListOptions[code]:
+			values := []string{}
+			for ; len(value) >= 4; value = value[4:] {
+				values = append(values, net.IP(value[0:4]).String())
+			}
+			exposed[key] = values
+		case textOptions[code]:
+			exposed[key] = []string{strings.TrimSuffix(string(value), "\x00")}
+		default:
+			exposed[key] = []string{hex.EncodeToString(value)}
+		}
+	}
+	return exposed, nil
+}
+
+// podTemplateReplacer substitutes the pod identity in configured values.
+func podTemplateReplacer(namespace, podName string) *strings.Replacer {
+	return strings.NewReplacer(
+		"{{podName}}", podName,
+		"{{namespace}}", namespace,
+	)
+}
+
+// encodeUserClass encodes a single user class as described in RFC 3004:
+// the data is preceded by its length.
+func encodeUserClass(class string) ([]byte, error) {
+	if len(class) == 0 || len(class) > 254 {
+		return nil, fmt.Errorf("invalid user class length %d", len(class))
+	}
+	return append([]byte{byte(len(class))}, class...), nil
 }
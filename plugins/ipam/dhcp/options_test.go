@@ -20,7 +20,7 @@ import (
 	"testing"
 
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/d2g/dhcp4"
+	"github.com/insomniacslk/dhcp/dhcpv4"
 )
 
 func validateRoutes(t *testing.T, routes []*types.Route) {
@@ -60,16 +60,16 @@ func validateRoutes(t *testing.T, routes []*types.Route) {
 }
 
 func TestParseRoutes(t *testing.T) {
-	opts := make(dhcp4.Options)
-	opts[dhcp4.OptionStaticRoute] = []byte{10, 0, 0, 0, 10, 1, 2, 3, 192, 168, 1, 0, 192, 168, 2, 3}
+	opts := make(dhcpv4.Options)
+	opts[dhcpv4.OptionStaticRoutingTable.Code()] = []byte{10, 0, 0, 0, 10, 1, 2, 3, 192, 168, 1, 0, 192, 168, 2, 3}
 	routes := parseRoutes(opts)
 
 	validateRoutes(t, routes)
 }
 
 func TestParseCIDRRoutes(t *testing.T) {
-	opts := make(dhcp4.Options)
-	opts[dhcp4.OptionClasslessRouteFormat] = []byte{8, 10, 10, 1, 2, 3, 24, 192, 168, 1, 192, 168, 2, 3}
+	opts := make(dhcpv4.Options)
+	opts[dhcpv4.OptionClasslessStaticRoute.Code()] = []byte{8, 10, 10, 1, 2, 3, 24, 192, 168, 1, 192, 168, 2, 3}
 	routes := parseCIDRRoutes(opts)
 
 	validateRoutes(t, routes)
@@ -79,14 +79,14 @@ func TestParseOptionName(t *testing.T) {
 	tests := []struct {
 		name    string
 		option  string
-		want    dhcp4.OptionCode
+		want    uint8
 		wantErr bool
 	}{
 		{
-			"hostname", "host-name", dhcp4.OptionHostName, false,
+			"hostname", "host-name", dhcpv4.OptionHostName.Code(), false,
 		},
 		{
-			"hostname in number", "12", dhcp4.OptionHostName, false,
+			"hostname in number", "12", dhcpv4.OptionHostName.Code(), false,
 		},
 		{
 			"random string", "doNotparseMe", 0, true,
@@ -105,3 +105,191 @@ func TestParseOptionName(t *testing.T) {
 		})
 	}
 }
+
+func TestEncodeClientFQDN(t *testing.T) {
+	tests := []struct {
+		name    string
+		fqdn    string
+		flags   byte
+		want    []byte
+		wantErr bool
+	}{
+		{
+			"ascii", "web.default.", fqdnFlagServerUpdate,
+			append([]byte{fqdnFlagServerUpdate, 0, 0}, "web.default"...), false,
+		},
+		{
+			"wire format", "web.default", fqdnFlagEncoded,
+			[]byte{fqdnFlagEncoded, 0, 0, 3, 'w', 'e', 'b', 7, 'd', 'e', 'f', 'a', 'u', 'l', 't', 0}, false,
+		},
+		{
+			"empty label", "web..default", fqdnFlagEncoded, nil, true,
+		},
+		{
+			"conflicting flags", "web.default", fqdnFlagServerUpdate | fqdnFlagNoServerUpdate, nil, true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encodeClientFQDN(tt.fqdn, tt.flags)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("encodeClientFQDN() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("encodeClientFQDN() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateAgentInfo(t *testing.T) {
+	pod := IPAMArgs{K8S_POD_NAME: "web", K8S_POD_NAMESPACE: "default"}
+	tests := []struct {
+		name    string
+		conf    *AgentInfoConfig
+		args    IPAMArgs
+		want    []byte
+		wantErr bool
+	}{
+		{"disabled", nil, pod, nil, false},
+		{
+			"defaults", &AgentInfoConfig{}, pod,
+			append(append([]byte{agentCircuitID, 5}, "node1"...), append([]byte{agentRemoteID, 11}, "default/web"...)...), false,
+		},
+		{
+			"no pod", &AgentInfoConfig{}, IPAMArgs{},
+			append([]byte{agentCircuitID, 5}, "node1"...), false,
+		},
+		{
+			"templates", &AgentInfoConfig{CircuitID: "{{nodeName}}:eth0", RemoteID: "{{podName}}"}, pod,
+			append(append([]byte{agentCircuitID, 10}, "node1:eth0"...), append([]byte{agentRemoteID, 3}, "web"...)...), false,
+		},
+		{"unknown placeholder", &AgentInfoConfig{RemoteID: "{{pod}}"}, pod, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := generateAgentInfo(tt.conf, "node1", tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("generateAgentInfo() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("generateAgentInfo() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDomainSearch(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{
+			name: "none",
+			data: nil,
+			want: []string{},
+		},
+		{
+			// example from RFC 3397 section 2
+			name: "compressed",
+			data: []byte{
+				3, 'e', 'n', 'g', 5, 'a', 'p', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+				9, 'm', 'a', 'r', 'k', 'e', 't', 'i', 'n', 'g', 0xc0, 0x04,
+			},
+			want: []string{"eng.apple.com", "marketing.apple.com"},
+		},
+		{
+			name: "pointer loop",
+			data: []byte{3, 'f', 'o', 'o', 0xc0, 0x00},
+			want: nil,
+		},
+		{
+			name: "truncated",
+			data: []byte{3, 'f', 'o'},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := make(dhcpv4.Options)
+			if tt.data != nil {
+				opts[dhcpv4.OptionDNSDomainSearchList.Code()] = tt.data
+			}
+			if got := parseDomainSearch(opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDomainSearch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDomainName(t *testing.T) {
+	tests := []struct {
+		data       string
+		wantDomain string
+		wantSearch []string
+	}{
+		{"", "", []string{}},
+		{"example.com\x00", "example.com", []string{}},
+		{"a.example.com b.example.com", "a.example.com", []string{"a.example.com", "b.example.com"}},
+	}
+	for _, tt := range tests {
+		opts := dhcpv4.Options{dhcpv4.OptionDomainName.Code(): []byte(tt.data)}
+		if got := parseDomainName(opts); got != tt.wantDomain {
+			t.Errorf("parseDomainName(%q) = %q, want %q", tt.data, got, tt.wantDomain)
+		}
+		if got := parseSearchDomains(opts); !reflect.DeepEqual(got, tt.wantSearch) {
+			t.Errorf("parseSearchDomains(%q) = %v, want %v", tt.data, got, tt.wantSearch)
+		}
+	}
+}
+
+func TestExposeOptions(t *testing.T) {
+	opts := dhcpv4.Options{
+		dhcpv4.OptionNTPServers.Code():                []byte{10, 0, 0, 1, 10, 0, 0, 2},
+		dhcpv4.OptionTFTPServerName.Code():            []byte("tftp.example.com"),
+		dhcpv4.OptionBootfileName.Code():              []byte("pxelinux.0\x00"),
+		dhcpv4.OptionVendorSpecificInformation.Code(): []byte{1, 2, 0xff},
+	}
+
+	tests := []struct {
+		name    string
+		options []DHCPOption
+		want    map[string][]string
+		wantErr bool
+	}{
+		{
+			name:    "decoded",
+			options: []DHCPOption{"42", "66", "67", "43"},
+			want: map[string][]string{
+				"42": {"10.0.0.1", "10.0.0.2"},
+				"66": {"tftp.example.com"},
+				"67": {"pxelinux.0"},
+				"43": {"0102ff"},
+			},
+		},
+		{
+			name:    "missing option",
+			options: []DHCPOption{"routers"},
+			want:    map[string][]string{},
+		},
+		{
+			name:    "invalid option",
+			options: []DHCPOption{"no-such-option"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := exposeOptions(opts, tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("exposeOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("exposeOptions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
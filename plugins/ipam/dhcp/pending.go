@@ -0,0 +1,89 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// how often the links of pending leases are looked up again
+const pendingRetryInterval = 10 * time.Second
+
+// resolvePendingLeases starts maintaining the pending leases once their
+// netns and link show up, e.g. after the kubelet restored the pod sandboxes
+// following a reboot. Leases still pending after grace are dropped.
+func (d *DHCP) resolvePendingLeases(grace time.Duration) {
+	deadline := time.Now().Add(grace)
+	for {
+		for clientID, l := range d.pending.all() {
+			d.resolvePendingLease(clientID, l)
+		}
+		if d.pending.len() == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			for clientID, l := range d.pending.takeAll() {
+				log.Printf("%v: netns %s of %s/%s still missing, dropping its lease", clientID, l.netNs, l.k8sNamespace, l.k8sPodName)
+			}
+			d.requestPersist()
+			return
+		}
+		time.Sleep(pendingRetryInterval)
+	}
+}
+
+func (d *DHCP) resolvePendingLease(clientID string, l *DHCPLease) {
+	unlock := d.clientLocks.lock(clientID)
+	defer unlock()
+
+	if d.pending.get(clientID) != l {
+		// released meanwhile
+		return
+	}
+	if d.getLease(clientID) != nil {
+		// allocated again meanwhile
+		d.pending.delete(clientID)
+		return
+	}
+
+	err := withLeaseNetNS(l.netNs, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(l.interfaceName)
+		if err != nil {
+			return fmt.Errorf("error looking up %q: %v", l.interfaceName, err)
+		}
+		l.link = link
+		return nil
+	})
+	if err != nil {
+		if _, ok := err.(ns.NSPathNotExistErr); !ok {
+			log.Printf("%v: pending lease not resolved: %v", clientID, err)
+		}
+		return
+	}
+
+	log.Printf("%v: netns of %s/%s found, maintaining its lease", clientID, l.k8sNamespace, l.k8sPodName)
+	d.setLease(clientID, l)
+	d.pending.delete(clientID)
+	if err := l.StartMaintaining(); err != nil {
+		log.Printf("%v: failed to start maintaining lease: %v", clientID, err)
+		d.leases.delete(clientID)
+	}
+	d.requestPersist()
+}
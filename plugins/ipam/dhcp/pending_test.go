@@ -0,0 +1,58 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePendingLeases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dhcp-pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &fileLeaseStore{path: filepath.Join(dir, "leases.json")}
+
+	missing := &DHCPLease{clientID: "a/net/eth0", netNs: filepath.Join(dir, "missing"), interfaceName: "eth0"}
+	d := &DHCP{
+		leases:  newLeaseMap(nil),
+		pending: newLeaseMap(map[string]*DHCPLease{"a/net/eth0": missing}),
+		store:   store,
+	}
+
+	if err := d.persistLeases(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].LinkName != "eth0" {
+		t.Fatalf("saved %+v, want the pending lease", saved)
+	}
+
+	// the netns never shows up
+	d.resolvePendingLeases(0)
+	if n := d.pending.len(); n != 0 {
+		t.Errorf("%d leases still pending after the grace period", n)
+	}
+	if saved, err := store.load(); err != nil || len(saved) != 0 {
+		t.Errorf("saved %+v, %v after the grace period, want no leases", saved, err)
+	}
+}
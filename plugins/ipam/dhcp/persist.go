@@ -1,57 +1,141 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"time"
 
 	"github.com/containernetworking/plugins/pkg/ns"
-	"github.com/d2g/dhcp4"
+	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/vishvananda/netlink"
 )
 
 type PersistedLeased struct {
-	ClientID      string
-	Ack           *dhcp4.Packet
-	LinkName      string
-	RenewalTime   time.Time
-	RebindingTime time.Time
-	ExpireTime    time.Time
-	K8sNamespace  string
-	K8sPodName    string
-	NetNs         string
+	ClientID string
+	// the acknowledgement in wire format
+	Ack              []byte
+	LinkName         string
+	RenewalTime      time.Time
+	RebindingTime    time.Time
+	ExpireTime       time.Time
+	K8sNamespace     string
+	K8sPodName       string
+	K8sPodUID        string
+	Hostname         string
+	FQDN             []byte
+	RapidCommit      bool
+	ArpProbe         bool
+	MinRenewalTime   time.Duration
+	MaxLeaseTime     time.Duration
+	Timeout          time.Duration
+	ResendMax        time.Duration
+	Retry            *RetryConfig
+	Broadcast        *bool
+	RelayServer      net.IP
+	RelayAgent       net.IP
+	AllowedServers   []net.IP
+	ExcludeRanges    []*net.IPNet
+	Synthetic        bool
+	Network          string
+	RogueServers     string
+	ServerChange     string
+	VLANCreated      bool
+	ProvideOptions   dhcpv4.Options
+	NetNs            string
+	ClientIdentifier []byte
+	HardwareAddr     net.HardwareAddr
+	ExpiryPolicy     string
+	RoutePolicy      RoutePolicy
+	IgnoreMTU        bool
+	ClientSocket     string
+	DSCP             uint8
+	SocketPriority   int
+	// the address is leased forever and the times are zero
+	Infinite bool
+	StableIP bool
 }
 
-func LoadSavedLeases(leaseFile string, timeout time.Duration, resendMax time.Duration, broadcast bool) ([]*DHCPLease, error) {
-	file, err := ioutil.ReadFile(leaseFile)
+// LoadSavedLeases returns the leases in the store. Leases whose network
+// namespace doesn't exist (yet) are returned separately, without a link.
+func LoadSavedLeases(store leaseStore, defaults leaseDefaults) ([]*DHCPLease, []*DHCPLease, error) {
+	saved, err := store.load()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	leases, malformed, duplicates := validLeases(saved)
+	if malformed > 0 || duplicates > 0 {
+		log.Printf("Recovered %d leases from the store, discarded %d malformed and %d duplicate entries",
+			len(leases), malformed, duplicates)
+		if err := store.save(leases); err != nil {
+			log.Printf("Failed to rewrite the lease store: %v", err)
+		}
 	}
 
-	var leases []PersistedLeased
-
-	err = json.Unmarshal(file, &leases)
-
-	var reloadedLeases []*DHCPLease
+	var reloadedLeases, pendingLeases []*DHCPLease
 
 	for _, lease := range leases {
+		ack, err := dhcpv4.FromBytes(lease.Ack)
+		if err != nil {
+			// checked by validLeases
+			return nil, nil, err
+		}
 		myLease := &DHCPLease{
-			clientID:      lease.ClientID,
-			ack:           lease.Ack,
-			renewalTime:   lease.RenewalTime,
-			rebindingTime: lease.RebindingTime,
-			expireTime:    lease.ExpireTime,
-			timeout:       timeout,
-			resendMax:     resendMax,
-			broadcast:     broadcast,
-			stop:          make(chan struct{}),
-			k8sNamespace:  lease.K8sNamespace,
-			k8sPodName:    lease.K8sPodName,
-			netNs:         lease.NetNs,
-		}
-		err := ns.WithNetNSPath(myLease.netNs, func(_ ns.NetNS) error {
+			clientID:         lease.ClientID,
+			ack:              ack,
+			renewalTime:      lease.RenewalTime,
+			rebindingTime:    lease.RebindingTime,
+			expireTime:       lease.ExpireTime,
+			stop:             make(chan struct{}),
+			renewNow:         make(chan struct{}, 1),
+			k8sNamespace:     lease.K8sNamespace,
+			k8sPodName:       lease.K8sPodName,
+			k8sPodUID:        lease.K8sPodUID,
+			hostname:         lease.Hostname,
+			fqdn:             lease.FQDN,
+			rapidCommit:      lease.RapidCommit,
+			arpProbe:         lease.ArpProbe,
+			allowedServers:   lease.AllowedServers,
+			excludeRanges:    lease.ExcludeRanges,
+			optsProviding:    lease.ProvideOptions,
+			netNs:            lease.NetNs,
+			interfaceName:    lease.LinkName,
+			clientIdentifier: lease.ClientIdentifier,
+			hwAddr:           lease.HardwareAddr,
+			expiryPolicy:     lease.ExpiryPolicy,
+			routePolicy:      lease.RoutePolicy,
+			ignoreMTU:        lease.IgnoreMTU,
+			clientSocket:     lease.ClientSocket,
+			marking:          packetMarking{dscp: lease.DSCP, priority: lease.SocketPriority},
+			infinite:         lease.Infinite,
+			stableIP:         lease.StableIP,
+			network:          lease.Network,
+			rogueServers:     lease.RogueServers,
+			serverChange:     lease.ServerChange,
+			vlanCreated:      lease.VLANCreated,
+			overrides: networkOverrides{
+				timeout:        lease.Timeout,
+				resendMax:      lease.ResendMax,
+				retry:          lease.Retry,
+				broadcast:      lease.Broadcast,
+				minRenewalTime: lease.MinRenewalTime,
+				maxLeaseTime:   lease.MaxLeaseTime,
+			},
+		}
+		if lease.RelayServer != nil && lease.RelayAgent != nil {
+			myLease.relay = &relayAgent{server: lease.RelayServer, giaddr: lease.RelayAgent}
+		}
+		if myLease.timeout, myLease.retry, myLease.broadcast, err = myLease.overrides.resolve(defaults); err != nil {
+			// e.g. a retry config that's only valid with a former resendmax
+			log.Printf("%v: %v, using the default retry policy", lease.ClientID, err)
+			myLease.retry = defaultRetryPolicy(defaults.resendMax)
+		}
+		myLease.minRenewalTime, myLease.maxLeaseTime = myLease.overrides.leaseTimeBounds(defaults)
+		if myLease.hwAddr != nil {
+			// unicast replies would be addressed to hwAddr
+			myLease.broadcast = true
+		}
+		err = withLeaseNetNS(myLease.netNs, func(_ ns.NetNS) error {
 			link, err := netlink.LinkByName(lease.LinkName)
 			if err != nil {
 				return fmt.Errorf("error looking up %q: %v", lease.LinkName, err)
@@ -61,46 +145,136 @@ func LoadSavedLeases(leaseFile string, timeout time.Duration, resendMax time.Dur
 
 			return nil
 		})
+		pending := false
 		if err != nil {
 			if _, ok := err.(ns.NSPathNotExistErr); ok {
-				fmt.Printf("Container %s/%s does not seem to have a working netns. Skipping", lease.K8sNamespace, lease.K8sPodName)
-				continue
+				log.Printf("Container %s/%s does not seem to have a working netns yet. Keeping its lease pending", lease.K8sNamespace, lease.K8sPodName)
+				pending = true
 			} else {
-				return nil, fmt.Errorf("couldn't look up link '%s' in container netns '%s': %v", lease.LinkName, lease.NetNs, err)
+				return nil, nil, fmt.Errorf("couldn't look up link '%s' in container netns '%s': %v", lease.LinkName, lease.NetNs, err)
 			}
 		}
-		reloadedLeases = append(reloadedLeases, myLease)
+		if lease.Synthetic {
+			myLease.synthetic = 1
+			claimFallbackAddress(myLease.ack.YourIPAddr)
+		} else if serverID := myLease.ack.ServerIdentifier(); serverID != nil && myLease.network != "" {
+			rememberServer(myLease.network, serverID)
+		}
+		myLease.applyRenewalJitter(time.Now())
+		if pending {
+			pendingLeases = append(pendingLeases, myLease)
+		} else {
+			reloadedLeases = append(reloadedLeases, myLease)
+		}
 	}
 
-	return reloadedLeases, nil
+	return reloadedLeases, pendingLeases, nil
 }
 
-func PersistActiveLeases(fileName string, leases map[string]*DHCPLease) error {
-	var leasesToSave []PersistedLeased
-
-	for _, v := range leases {
-		value := PersistedLeased{
-			ClientID:      v.clientID,
-			Ack:           v.ack,
-			LinkName:      v.link.Attrs().Name,
-			RenewalTime:   v.renewalTime,
-			RebindingTime: v.rebindingTime,
-			ExpireTime:    v.expireTime,
-			K8sNamespace:  v.k8sNamespace,
-			K8sPodName:    v.k8sPodName,
-			NetNs:         v.netNs,
+// validLeases drops the entries that can't be taken over, and keeps the
+// lease that expires last of the entries of a client ID.
+func validLeases(saved []PersistedLeased) (leases []PersistedLeased, malformed, duplicates int) {
+	index := map[string]int{}
+	for _, lease := range saved {
+		if lease.ClientID == "" || lease.LinkName == "" {
+			malformed++
+			continue
+		}
+		if _, err := dhcpv4.FromBytes(lease.Ack); err != nil {
+			malformed++
+			continue
+		}
+		i, ok := index[lease.ClientID]
+		if !ok {
+			index[lease.ClientID] = len(leases)
+			leases = append(leases, lease)
+			continue
+		}
+		duplicates++
+		if kept := leases[i]; !kept.Infinite && (lease.Infinite || lease.ExpireTime.After(kept.ExpireTime)) {
+			leases[i] = lease
 		}
-		leasesToSave = append(leasesToSave, value)
 	}
+	return leases, malformed, duplicates
+}
 
-	b, err := json.Marshal(leasesToSave)
-	if err != nil {
-		return err
+// durationOrDefault returns def for durations missing in leases saved by
+// older versions.
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
 	}
+	return d
+}
 
-	err = ioutil.WriteFile(fileName, b, 0644)
+// boolOrDefault is the same for flags.
+func boolOrDefault(b *bool, def bool) bool {
+	if b == nil {
+		return def
+	}
+	return *b
+}
+
+func PersistActiveLeases(store leaseStore, leases map[string]*DHCPLease) error {
+	err := store.save(persistedLeases(leases))
 	if err != nil {
 		log.Printf("Error while saving: %v", err)
 	}
 	return nil
 }
+
+// persistedLeases returns the leases in the form they are persisted in.
+func persistedLeases(leases map[string]*DHCPLease) []PersistedLeased {
+	var leasesToSave []PersistedLeased
+
+	for _, v := range leases {
+		value := PersistedLeased{
+			ClientID:         v.clientID,
+			LinkName:         v.linkName(),
+			RenewalTime:      v.renewalTime,
+			RebindingTime:    v.rebindingTime,
+			ExpireTime:       v.expireTime,
+			K8sNamespace:     v.k8sNamespace,
+			K8sPodName:       v.k8sPodName,
+			K8sPodUID:        v.k8sPodUID,
+			Hostname:         v.hostname,
+			FQDN:             v.fqdn,
+			RapidCommit:      v.rapidCommit,
+			ArpProbe:         v.arpProbe,
+			MinRenewalTime:   v.overrides.minRenewalTime,
+			MaxLeaseTime:     v.overrides.maxLeaseTime,
+			Timeout:          v.overrides.timeout,
+			ResendMax:        v.overrides.resendMax,
+			Retry:            v.overrides.retry,
+			Broadcast:        v.overrides.broadcast,
+			AllowedServers:   v.allowedServers,
+			ExcludeRanges:    v.excludeRanges,
+			Synthetic:        v.isSynthetic(),
+			Network:          v.network,
+			RogueServers:     v.rogueServers,
+			ServerChange:     v.serverChange,
+			VLANCreated:      v.vlanCreated,
+			ProvideOptions:   v.optsProviding,
+			NetNs:            v.netNs,
+			ClientIdentifier: v.clientIdentifier,
+			HardwareAddr:     v.hwAddr,
+			ExpiryPolicy:     v.expiryPolicy,
+			RoutePolicy:      v.routePolicy,
+			IgnoreMTU:        v.ignoreMTU,
+			ClientSocket:     v.clientSocket,
+			DSCP:             v.marking.dscp,
+			SocketPriority:   v.marking.priority,
+			Infinite:         v.infinite,
+			StableIP:         v.stableIP,
+		}
+		if v.ack != nil {
+			value.Ack = v.ack.ToBytes()
+		}
+		if v.relay != nil {
+			value.RelayServer = v.relay.server
+			value.RelayAgent = v.relay.giaddr
+		}
+		leasesToSave = append(leasesToSave, value)
+	}
+	return leasesToSave
+}
@@ -0,0 +1,219 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestValidLeases(t *testing.T) {
+	ack := testPacket(dhcpv4.OpcodeBootReply, nil, dhcpv4.MessageTypeAck)
+	now := time.Now()
+	lease := func(clientID string, expires time.Time) PersistedLeased {
+		return PersistedLeased{ClientID: clientID, LinkName: "eth0", Ack: ack.ToBytes(), ExpireTime: expires}
+	}
+	short := make([]byte, 20)
+
+	saved := []PersistedLeased{
+		lease("a", now),
+		{},
+		{ClientID: "b", LinkName: "eth0"},
+		{ClientID: "c", LinkName: "eth0", Ack: short},
+		lease("d", now),
+		lease("a", now.Add(time.Hour)),
+		lease("d", now.Add(-time.Hour)),
+	}
+	leases, malformed, duplicates := validLeases(saved)
+	if malformed != 3 || duplicates != 2 {
+		t.Errorf("got %d malformed and %d duplicates, want 3 and 2", malformed, duplicates)
+	}
+	if len(leases) != 2 || leases[0].ClientID != "a" || leases[1].ClientID != "d" {
+		t.Fatalf("got %+v", leases)
+	}
+	// the lease expiring last is kept
+	if !leases[0].ExpireTime.Equal(now.Add(time.Hour)) || !leases[1].ExpireTime.Equal(now) {
+		t.Errorf("kept leases expiring %v and %v", leases[0].ExpireTime, leases[1].ExpireTime)
+	}
+
+	infinite := lease("a", time.Time{})
+	infinite.Infinite = true
+	if leases, _, _ := validLeases([]PersistedLeased{infinite, lease("a", now)}); !leases[0].Infinite {
+		t.Error("an infinite lease was replaced")
+	}
+}
+
+// memLeaseStore keeps the leases in memory.
+type memLeaseStore struct {
+	leases []PersistedLeased
+}
+
+func (s *memLeaseStore) load() ([]PersistedLeased, error) { return s.leases, nil }
+
+func (s *memLeaseStore) save(leases []PersistedLeased) error {
+	s.leases = leases
+	return nil
+}
+
+func (s *memLeaseStore) check() error { return nil }
+
+func TestPersistRelay(t *testing.T) {
+	ack := testPacket(dhcpv4.OpcodeBootReply, nil, dhcpv4.MessageTypeAck)
+	relay := &relayAgent{server: net.IPv4(10, 0, 0, 1).To4(), giaddr: net.IPv4(10, 1, 0, 1).To4()}
+	store := &memLeaseStore{}
+	store.save(persistedLeases(map[string]*DHCPLease{
+		"relayed": {clientID: "relayed", ack: ack, interfaceName: "lo", netNs: "/proc/self/ns/net", relay: relay},
+		"local":   {clientID: "local", ack: ack, interfaceName: "lo", netNs: "/proc/self/ns/net"},
+	}))
+
+	leases, _, err := LoadSavedLeases(store, leaseDefaults{timeout: time.Second, resendMax: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 2 {
+		t.Fatalf("got %d leases, want 2", len(leases))
+	}
+	for _, l := range leases {
+		switch l.clientID {
+		case "relayed":
+			if l.relay == nil || !l.relay.server.Equal(relay.server) || !l.relay.giaddr.Equal(relay.giaddr) {
+				t.Errorf("relay = %+v, want %+v", l.relay, relay)
+			}
+		case "local":
+			if l.relay != nil {
+				t.Errorf("relay = %+v, want none", l.relay)
+			}
+		}
+	}
+}
+
+func TestPersistOverrides(t *testing.T) {
+	ack := testPacket(dhcpv4.OpcodeBootReply, nil, dhcpv4.MessageTypeAck)
+	store := &memLeaseStore{}
+	store.save(persistedLeases(map[string]*DHCPLease{
+		"default": {
+			clientID: "default", ack: ack, interfaceName: "lo", netNs: "/proc/self/ns/net",
+			timeout: 10 * time.Second, retry: defaultRetryPolicy(62 * time.Second),
+		},
+		"override": {
+			clientID: "override", ack: ack, interfaceName: "lo", netNs: "/proc/self/ns/net",
+			timeout: time.Minute, retry: defaultRetryPolicy(2 * time.Minute),
+			overrides: networkOverrides{timeout: time.Minute, resendMax: 2 * time.Minute},
+		},
+	}))
+	for _, l := range store.leases {
+		if l.ClientID == "default" && (l.Timeout != 0 || l.ResendMax != 0 || l.Retry != nil) {
+			t.Errorf("saved the daemon defaults: %+v", l)
+		}
+	}
+
+	// the daemon restarted with other defaults
+	leases, _, err := LoadSavedLeases(store, leaseDefaults{timeout: 20 * time.Second, resendMax: 30 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range leases {
+		switch l.clientID {
+		case "default":
+			if l.timeout != 20*time.Second || l.retry != defaultRetryPolicy(30*time.Second) {
+				t.Errorf("default lease got timeout %v and retry %+v", l.timeout, l.retry)
+			}
+		case "override":
+			if l.timeout != time.Minute || l.retry != defaultRetryPolicy(2*time.Minute) {
+				t.Errorf("overriding lease got timeout %v and retry %+v", l.timeout, l.retry)
+			}
+		}
+	}
+}
+
+func TestPersistBroadcastOverride(t *testing.T) {
+	ack := testPacket(dhcpv4.OpcodeBootReply, nil, dhcpv4.MessageTypeAck)
+	yes, no := true, false
+	store := &memLeaseStore{}
+	store.save(persistedLeases(map[string]*DHCPLease{
+		"default":   {clientID: "default", ack: ack, interfaceName: "lo", netNs: "/proc/self/ns/net"},
+		"unicast":   {clientID: "unicast", ack: ack, interfaceName: "lo", netNs: "/proc/self/ns/net", overrides: networkOverrides{broadcast: &no}},
+		"broadcast": {clientID: "broadcast", ack: ack, interfaceName: "lo", netNs: "/proc/self/ns/net", overrides: networkOverrides{broadcast: &yes}},
+		"mac": {
+			clientID: "mac", ack: ack, interfaceName: "lo", netNs: "/proc/self/ns/net",
+			hwAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}, overrides: networkOverrides{broadcast: &no},
+		},
+	}))
+
+	for _, defaultBroadcast := range []bool{false, true} {
+		leases, _, err := LoadSavedLeases(store, leaseDefaults{timeout: time.Second, resendMax: time.Second, broadcast: defaultBroadcast})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]bool{"default": defaultBroadcast, "unicast": false, "broadcast": true, "mac": true}
+		for _, l := range leases {
+			if l.broadcast != want[l.clientID] {
+				t.Errorf("lease %s with default %v: broadcast = %v, want %v", l.clientID, defaultBroadcast, l.broadcast, want[l.clientID])
+			}
+		}
+	}
+}
+
+func TestPersistLeaseTimeBounds(t *testing.T) {
+	ack := testPacket(dhcpv4.OpcodeBootReply, nil, dhcpv4.MessageTypeAck)
+	store := &memLeaseStore{}
+	store.save(persistedLeases(map[string]*DHCPLease{
+		"default": {
+			clientID: "default", ack: ack, interfaceName: "lo", netNs: "/proc/self/ns/net",
+			minRenewalTime: time.Minute, maxLeaseTime: time.Hour,
+		},
+		"override": {
+			clientID: "override", ack: ack, interfaceName: "lo", netNs: "/proc/self/ns/net",
+			minRenewalTime: 5 * time.Minute, maxLeaseTime: time.Hour,
+			overrides: networkOverrides{minRenewalTime: 5 * time.Minute},
+		},
+	}))
+
+	// the defaults were reloaded from -config before the restart
+	leases, _, err := LoadSavedLeases(store, leaseDefaults{minRenewalTime: 2 * time.Minute, maxLeaseTime: 2 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][2]time.Duration{
+		"default":  {2 * time.Minute, 2 * time.Hour},
+		"override": {5 * time.Minute, 2 * time.Hour},
+	}
+	for _, l := range leases {
+		if got := [2]time.Duration{l.minRenewalTime, l.maxLeaseTime}; got != want[l.clientID] {
+			t.Errorf("lease %s: bounds = %v, want %v", l.clientID, got, want[l.clientID])
+		}
+	}
+}
+
+func TestFlushPersist(t *testing.T) {
+	store := &memLeaseStore{}
+	l := &DHCPLease{clientID: "a", stop: make(chan struct{})}
+	d := &DHCP{leases: newLeaseMap(map[string]*DHCPLease{"a": l}), store: store, persistPending: make(chan struct{}, 1)}
+
+	// runPersister isn't running, so the write stays pending
+	d.requestPersist()
+	d.flushPersist()
+	if len(store.leases) != 1 {
+		t.Fatalf("flushPersist() wrote %v, want the pending lease", store.leases)
+	}
+
+	store.leases = nil
+	if err := d.persistLeases(); err != nil || store.leases != nil {
+		t.Errorf("persisted %v, %v after flushing on shutdown", store.leases, err)
+	}
+}
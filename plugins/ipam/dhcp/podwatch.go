@@ -0,0 +1,80 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+
+	kapiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchPodDeletions releases the leases of pods as soon as they are deleted,
+// without waiting for CNI DEL, which is not always called. Only pods on
+// nodeName are watched, unless it is empty.
+func (d *DHCP) watchPodDeletions(clientset kubernetes.Interface, nodeName string, stop <-chan struct{}) {
+	var opts []informers.SharedInformerOption
+	if nodeName != "" {
+		opts = append(opts, informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+		}))
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, opts...)
+
+	factory.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			pod, ok := obj.(*kapiv1.Pod)
+			if !ok {
+				return
+			}
+			// releasing may take a while, don't block the informer
+			go d.releasePodLeases(pod)
+		},
+	})
+	factory.Start(stop)
+}
+
+func (d *DHCP) releasePodLeases(pod *kapiv1.Pod) {
+	for clientID := range d.podLeases(pod.UID) {
+		log.Printf("%v: pod %s/%s was deleted, releasing lease", clientID, pod.Namespace, pod.Name)
+		d.removeLease(clientID)
+	}
+}
+
+// podLeases returns the leases acquired for the pod with the given UID. A pod
+// recreated with the same name, e.g. by a StatefulSet, has another UID, so
+// its leases are kept when the former pod's deletion is seen late. Leases
+// acquired without K8S_POD_UID in CNI_ARGS are left to CNI DEL and the
+// garbage collection.
+func (d *DHCP) podLeases(uid types.UID) map[string]*DHCPLease {
+	leases := map[string]*DHCPLease{}
+	if uid == "" {
+		return leases
+	}
+	for clientID, l := range d.leases.all() {
+		if l.k8sPodUID == string(uid) {
+			leases[clientID] = l
+		}
+	}
+	return leases
+}
@@ -0,0 +1,49 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPodLeases(t *testing.T) {
+	d := &DHCP{
+		leases: newLeaseMap(map[string]*DHCPLease{
+			"a/net/eth0": {k8sNamespace: "default", k8sPodName: "web", k8sPodUID: "uid-a"},
+			"a/net/net1": {k8sNamespace: "default", k8sPodName: "web", k8sPodUID: "uid-a"},
+			// the pod recreated with the same name
+			"b/net/eth0": {k8sNamespace: "default", k8sPodName: "web", k8sPodUID: "uid-b"},
+			"c/net/eth0": {k8sNamespace: "default", k8sPodName: "db", k8sPodUID: "uid-c"},
+			// acquired without K8S_POD_UID
+			"d/net/eth0": {k8sNamespace: "default", k8sPodName: "web"},
+		}),
+	}
+
+	got := []string{}
+	for clientID := range d.podLeases("uid-a") {
+		got = append(got, clientID)
+	}
+	sort.Strings(got)
+
+	if want := []string{"a/net/eth0", "a/net/net1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("podLeases() = %v, want %v", got, want)
+	}
+
+	if got := d.podLeases(""); len(got) != 0 {
+		t.Errorf("podLeases() without UID = %v, want none", got)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// waitForExchange waits until the daemon's rate limit allows another DHCP
+// exchange, see leaseEnv.limiter.
+func (l *DHCPLease) waitForExchange() {
+	if l.env.limiter != nil {
+		// cannot fail: the context is never canceled and the burst is at least 1
+		_ = l.env.limiter.Wait(context.Background())
+	}
+}
+
+// allocationBackoff rejects allocations for a client that failed recently,
+// with a delay doubling on each consecutive failure. This keeps crashlooping
+// pods from hammering the DHCP server.
+type allocationBackoff struct {
+	mux     sync.Mutex
+	base    time.Duration
+	max     time.Duration
+	clients map[string]*backoffState
+}
+
+type backoffState struct {
+	failures int
+	until    time.Time
+}
+
+func newAllocationBackoff(base, max time.Duration) *allocationBackoff {
+	return &allocationBackoff{
+		base:    base,
+		max:     max,
+		clients: make(map[string]*backoffState),
+	}
+}
+
+// check returns an error if the client is backing off. A nil backoff never
+// rejects.
+func (b *allocationBackoff) check(clientID string) error {
+	if b == nil {
+		return nil
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if s, ok := b.clients[clientID]; ok {
+		if wait := time.Until(s.until); wait > 0 {
+			return fmt.Errorf("backing off for %v after %d failed allocations", wait.Round(time.Second), s.failures)
+		}
+	}
+	return nil
+}
+
+func (b *allocationBackoff) failed(clientID string) {
+	if b == nil {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	now := time.Now()
+	// forget clients that stopped retrying
+	for id, s := range b.clients {
+		if now.Sub(s.until) > b.max {
+			delete(b.clients, id)
+		}
+	}
+
+	s, ok := b.clients[clientID]
+	if !ok {
+		s = &backoffState{}
+		b.clients[clientID] = s
+	}
+	s.failures++
+
+	delay := b.base
+	for i := 1; i < s.failures && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	s.until = now.Add(delay)
+}
+
+func (b *allocationBackoff) succeeded(clientID string) {
+	if b == nil {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	delete(b.clients, clientID)
+}
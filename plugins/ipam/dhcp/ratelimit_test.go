@@ -0,0 +1,54 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllocationBackoff(t *testing.T) {
+	b := newAllocationBackoff(time.Second, 4*time.Second)
+
+	if err := b.check("a"); err != nil {
+		t.Fatalf("check() before any failure error = %v", err)
+	}
+
+	wantDelays := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+	for i, want := range wantDelays {
+		b.failed("a")
+		got := time.Until(b.clients["a"].until)
+		if got > want || got < want-100*time.Millisecond {
+			t.Errorf("delay after %d failures = %v, want %v", i+1, got, want)
+		}
+	}
+	if err := b.check("a"); err == nil {
+		t.Errorf("check() after failures succeeded, want error")
+	}
+	if err := b.check("b"); err != nil {
+		t.Errorf("check() for other client error = %v", err)
+	}
+
+	b.succeeded("a")
+	if err := b.check("a"); err != nil {
+		t.Errorf("check() after success error = %v", err)
+	}
+
+	var disabled *allocationBackoff
+	disabled.failed("a")
+	if err := disabled.check("a"); err != nil {
+		t.Errorf("check() on disabled backoff error = %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// DHCP servers answer relayed messages on the server port of the giaddr,
+// see RFC 2131 section 4.1.
+const relayPort = 67
+
+// Offset of the giaddr field in a DHCP message, see RFC 2131 section 2
+const giaddrOffset = 24
+
+// hostNetNS is the network namespace of the daemon. Relayed messages are
+// sent from there instead of from the container.
+var hostNetNS ns.NetNS
+
+// Only one relay socket can be bound to the agent address and port at a
+// time, so the attempts of relayed exchanges are serialized.
+var relayMux sync.Mutex
+
+type relayAgent struct {
+	server net.IP
+	giaddr net.IP
+}
+
+func parseRelayConfig(conf *RelayConfig) (*relayAgent, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	server := net.ParseIP(conf.Server).To4()
+	if server == nil {
+		return nil, fmt.Errorf("invalid relay server address %q", conf.Server)
+	}
+	giaddr := net.ParseIP(conf.AgentAddress).To4()
+	if giaddr == nil {
+		return nil, fmt.Errorf("invalid relay agent address %q", conf.AgentAddress)
+	}
+
+	return &relayAgent{server: server, giaddr: giaddr}, nil
+}
+
+// relayConn sets the relay agent address on every message before sending it
+// to the server. The socket is bound on the first message of an attempt and
+// released once it fails, so that retries of one exchange don't block the
+// relayed exchanges of other leases while they wait.
+type relayConn struct {
+	relay   *relayAgent
+	marking packetMarking
+
+	sock        dhcpConn
+	readTimeout time.Duration
+	closeOnce   sync.Once
+}
+
+// open binds the relay socket in the daemon's network namespace.
+func (c *relayConn) open() error {
+	if c.sock != nil {
+		return nil
+	}
+
+	relayMux.Lock()
+	err := hostNetNS.Do(func(_ ns.NetNS) error {
+		sock, err := newUDPConn(net.UDPAddr{IP: c.relay.giaddr, Port: relayPort}, c.relay.server, c.marking)
+		if err != nil {
+			return err
+		}
+		if c.readTimeout > 0 {
+			sock.SetReadTimeout(c.readTimeout)
+		}
+		c.sock = sock
+		return nil
+	})
+	if err != nil {
+		relayMux.Unlock()
+		return fmt.Errorf("failed to open relay socket on %v: %v", c.relay.giaddr, err)
+	}
+	return nil
+}
+
+// release closes the relay socket, if bound, and allows the next relayed
+// exchange to start.
+func (c *relayConn) release() error {
+	if c.sock == nil {
+		return nil
+	}
+	err := c.sock.Close()
+	c.sock = nil
+	relayMux.Unlock()
+	return err
+}
+
+func (c *relayConn) Write(packet []byte) error {
+	if err := c.open(); err != nil {
+		return err
+	}
+	copy(packet[giaddrOffset:giaddrOffset+4], c.relay.giaddr.To4())
+	return c.sock.Write(packet)
+}
+
+// ReadFrom releases the socket when reading fails, e.g. on a timeout, which
+// ends the attempt.
+func (c *relayConn) ReadFrom() ([]byte, net.IP, error) {
+	if c.sock == nil {
+		return nil, nil, fmt.Errorf("relay socket on %v is not open", c.relay.giaddr)
+	}
+	pkt, source, err := c.sock.ReadFrom()
+	if err != nil {
+		c.release()
+	}
+	return pkt, source, err
+}
+
+func (c *relayConn) SetReadTimeout(t time.Duration) error {
+	c.readTimeout = t
+	if c.sock == nil {
+		return nil
+	}
+	return c.sock.SetReadTimeout(t)
+}
+
+// Close releases the socket. It can be called more than once.
+func (c *relayConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.release()
+	})
+	return err
+}
+
+// newRelayDHCPClient returns a client relaying messages for hwAddr to the
+// configured server. The socket is created in the daemon's network namespace,
+// so it can be used from within the container's namespace as well.
+func newRelayDHCPClient(
+	hwAddr net.HardwareAddr, relay *relayAgent,
+	timeout time.Duration, marking packetMarking,
+) (*dhcpClient, error) {
+	if hostNetNS == nil {
+		return nil, fmt.Errorf("relaying requires the daemon network namespace")
+	}
+
+	conn := &relayConn{relay: relay, marking: marking}
+	return &dhcpClient{conn: conn, hwAddr: hwAddr, timeout: timeout}, nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// stubConn fails every read and counts how often it's closed.
+type stubConn struct {
+	closed int
+}
+
+func (c *stubConn) Close() error                         { c.closed++; return nil }
+func (c *stubConn) Write(packet []byte) error            { return nil }
+func (c *stubConn) ReadFrom() ([]byte, net.IP, error)    { return nil, nil, errors.New("timeout") }
+func (c *stubConn) SetReadTimeout(t time.Duration) error { return nil }
+
+func TestRelayConnRelease(t *testing.T) {
+	relay := &relayAgent{server: net.IPv4(10, 0, 0, 1).To4(), giaddr: net.IPv4(10, 1, 0, 1).To4()}
+
+	// a failed read ends the attempt and releases the socket
+	sock := &stubConn{}
+	relayMux.Lock()
+	c := &relayConn{relay: relay, sock: sock}
+	if _, _, err := c.ReadFrom(); err == nil {
+		t.Fatal("ReadFrom() succeeded")
+	}
+	if sock.closed != 1 || c.sock != nil {
+		t.Errorf("socket closed %d times, want once", sock.closed)
+	}
+	relayMux.Lock()
+	relayMux.Unlock()
+
+	// closing twice unlocks once
+	sock = &stubConn{}
+	relayMux.Lock()
+	c = &relayConn{relay: relay, sock: sock}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sock.closed != 1 {
+		t.Errorf("socket closed %d times, want once", sock.closed)
+	}
+	relayMux.Lock()
+	relayMux.Unlock()
+}
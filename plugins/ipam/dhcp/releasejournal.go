@@ -0,0 +1,96 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"golang.org/x/sys/unix"
+)
+
+// DELs that can't reach the daemon, e.g. while it's upgraded, are queued in
+// a journal next to its socket instead of failing, so that pod teardown
+// isn't blocked. The daemon replays them once it's back.
+
+// releaseJournalPath returns the path of the journal of the daemon listening
+// on socketPath.
+func releaseJournalPath(socketPath string) string {
+	return socketPath + ".releases"
+}
+
+// openReleaseJournal opens the journal locked against concurrent plugin
+// calls and the daemon.
+func openReleaseJournal(path string, flag int) (*os.File, error) {
+	f, err := os.OpenFile(path, flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// journalRelease appends the arguments of a DEL to the journal.
+func journalRelease(path string, args *skel.CmdArgs) error {
+	f, err := openReleaseJournal(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(args)
+}
+
+// replayReleaseJournal releases the leases of the DELs in the journal and
+// empties it.
+func (d *DHCP) replayReleaseJournal(path string) {
+	f, err := openReleaseJournal(path, os.O_RDWR)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to open the release journal: %v", err)
+		}
+		return
+	}
+	defer f.Close()
+
+	replayed := 0
+	dec := json.NewDecoder(f)
+	for {
+		args := &skel.CmdArgs{}
+		if err := dec.Decode(args); err == io.EOF {
+			break
+		} else if err != nil {
+			// e.g. cut short by a crash while it was written
+			log.Printf("Discarding the rest of the release journal: %v", err)
+			break
+		}
+		if err := d.Release(args, &struct{}{}); err != nil {
+			log.Printf("Failed to replay the release of %s/%s: %v", args.ContainerID, args.IfName, err)
+			continue
+		}
+		replayed++
+	}
+	if replayed > 0 {
+		log.Printf("Released %d leases of pods deleted while the daemon was unreachable", replayed)
+	}
+	if err := f.Truncate(0); err != nil {
+		log.Printf("Failed to empty the release journal: %v", err)
+	}
+}
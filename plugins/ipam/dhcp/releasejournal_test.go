@@ -0,0 +1,70 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+func TestReplayReleaseJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dhcp-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := releaseJournalPath(filepath.Join(dir, "dhcp.sock"))
+
+	d := &DHCP{
+		leases: newLeaseMap(nil),
+		pending: newLeaseMap(map[string]*DHCPLease{
+			"a/net/eth0": {clientID: "a/net/eth0", interfaceName: "eth0"},
+			"b/net/eth0": {clientID: "b/net/eth0", interfaceName: "eth0"},
+		}),
+		store: &fileLeaseStore{path: filepath.Join(dir, "leases.json")},
+	}
+
+	// nothing to replay yet
+	d.replayReleaseJournal(path)
+
+	conf := []byte(`{"cniVersion": "1.0.0", "name": "net", "ipam": {"type": "dhcp"}}`)
+	for _, id := range []string{"a", "gone"} {
+		if err := journalRelease(path, &skel.CmdArgs{ContainerID: id, IfName: "eth0", StdinData: conf}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an entry cut short by a crash
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"ContainerID": "b", "IfN`)
+	f.Close()
+
+	d.replayReleaseJournal(path)
+	if d.pending.get("a/net/eth0") != nil {
+		t.Errorf("the journaled lease wasn't released")
+	}
+	if d.pending.get("b/net/eth0") == nil {
+		t.Errorf("the lease of the truncated entry was released")
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || len(data) != 0 {
+		t.Errorf("journal is %q, %v after the replay, want it empty", data, err)
+	}
+}
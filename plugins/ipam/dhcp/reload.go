@@ -0,0 +1,221 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// leaseDefaults are the daemon-wide settings for networks that don't
+// override them.
+type leaseDefaults struct {
+	timeout        time.Duration
+	resendMax      time.Duration
+	broadcast      bool
+	minRenewalTime time.Duration
+	maxLeaseTime   time.Duration
+}
+
+func (d *DHCP) leaseDefaults() leaseDefaults {
+	d.defaultsMux.RLock()
+	defer d.defaultsMux.RUnlock()
+	return d.defaults
+}
+
+func (d *DHCP) setLeaseDefaults(defaults leaseDefaults) {
+	d.defaultsMux.Lock()
+	defer d.defaultsMux.Unlock()
+	d.defaults = defaults
+}
+
+// networkOverrides are the settings of a network config that take precedence
+// over the daemon-wide defaults, zero if unset. Leases persist them instead
+// of the effective settings, so that they pick up the current defaults when
+// they're reloaded.
+type networkOverrides struct {
+	timeout   time.Duration
+	resendMax time.Duration
+	retry     *RetryConfig
+	broadcast *bool
+	// bounds of the lease timers, see leaseTimeBounds
+	minRenewalTime time.Duration
+	maxLeaseTime   time.Duration
+}
+
+func parseNetworkOverrides(conf *IPAMConfig) (networkOverrides, error) {
+	var o networkOverrides
+	var err error
+	if o.timeout, err = parseDurationOverride(conf.Timeout, 0); err != nil {
+		return o, fmt.Errorf("invalid timeout: %v", err)
+	}
+	if o.resendMax, err = parseDurationOverride(conf.ResendMax, 0); err != nil {
+		return o, fmt.Errorf("invalid resendMax: %v", err)
+	}
+	o.retry = conf.Retry
+	o.broadcast = conf.Broadcast
+	if o.minRenewalTime, err = parseDurationOverride(conf.MinRenewalTime, 0); err != nil {
+		return o, fmt.Errorf("invalid minRenewalTime: %v", err)
+	}
+	if o.maxLeaseTime, err = parseDurationOverride(conf.MaxLeaseTime, 0); err != nil {
+		return o, fmt.Errorf("invalid maxLeaseTime: %v", err)
+	}
+	return o, nil
+}
+
+// resolve returns the timeout, retry policy and broadcast flag of a lease.
+func (o networkOverrides) resolve(defaults leaseDefaults) (time.Duration, RetryPolicy, bool, error) {
+	timeout := durationOrDefault(o.timeout, defaults.timeout)
+	broadcast := boolOrDefault(o.broadcast, defaults.broadcast)
+	retry, err := parseRetryConfig(o.retry, durationOrDefault(o.resendMax, defaults.resendMax))
+	return timeout, retry, broadcast, err
+}
+
+// leaseTimeBounds returns the minimum renewal time and maximum lease time of
+// a lease.
+func (o networkOverrides) leaseTimeBounds(defaults leaseDefaults) (time.Duration, time.Duration) {
+	return durationOrDefault(o.minRenewalTime, defaults.minRenewalTime), durationOrDefault(o.maxLeaseTime, defaults.maxLeaseTime)
+}
+
+// daemonConfigFile is the -config file. Its settings take precedence over the
+// flags of the same name and are reloaded on SIGHUP. Maintained leases keep
+// the settings they were acquired with, leases loaded from the store use the
+// current ones unless their network overrides them.
+type daemonConfigFile struct {
+	Timeout           string  `json:"timeout"`
+	ResendMax         string  `json:"resendmax"`
+	Broadcast         *bool   `json:"broadcast"`
+	MinRenewal        string  `json:"minrenewal"`
+	MaxLease          string  `json:"maxlease"`
+	SocketAllowedUIDs *string `json:"socket-allowed-uids"`
+	CNIAllowedUIDs    *string `json:"cni-allowed-uids"`
+	TraceTransactions *int    `json:"trace-transactions"`
+}
+
+// daemonSettings are the settings that can be reloaded.
+type daemonSettings struct {
+	defaults          leaseDefaults
+	socketAllowedUIDs map[uint32]bool
+	// nil if every UID may make CNI calls
+	cniAllowedUIDs    map[uint32]bool
+	traceTransactions int
+}
+
+// settingsReloader applies the -config file on top of the flags.
+type settingsReloader struct {
+	path string
+	// the settings given by flags, used for those missing from the file
+	flags  daemonSettings
+	dhcp   *DHCP
+	socket *socketAccess
+	auth   *rpcAuth
+}
+
+// read returns the settings of the config file, falling back to the flags.
+func (r *settingsReloader) read() (daemonSettings, error) {
+	settings := r.flags
+	if r.path == "" {
+		return settings, nil
+	}
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return settings, fmt.Errorf("failed to read config: %v", err)
+	}
+	var conf daemonConfigFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&conf); err != nil {
+		return settings, fmt.Errorf("failed to parse config %q: %v", r.path, err)
+	}
+
+	for _, d := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"timeout", conf.Timeout, &settings.defaults.timeout},
+		{"resendmax", conf.ResendMax, &settings.defaults.resendMax},
+		{"minrenewal", conf.MinRenewal, &settings.defaults.minRenewalTime},
+		{"maxlease", conf.MaxLease, &settings.defaults.maxLeaseTime},
+	} {
+		if *d.dest, err = parseDurationOverride(d.value, *d.dest); err != nil {
+			return settings, fmt.Errorf("invalid %s in config: %v", d.name, err)
+		}
+	}
+	if conf.Broadcast != nil {
+		settings.defaults.broadcast = *conf.Broadcast
+	}
+	if conf.SocketAllowedUIDs != nil {
+		if settings.socketAllowedUIDs, err = parseUIDs(*conf.SocketAllowedUIDs); err != nil {
+			return settings, fmt.Errorf("invalid socket-allowed-uids in config: %v", err)
+		}
+	}
+	if conf.CNIAllowedUIDs != nil {
+		settings.cniAllowedUIDs = nil
+		if *conf.CNIAllowedUIDs != "" {
+			if settings.cniAllowedUIDs, err = parseUIDs(*conf.CNIAllowedUIDs); err != nil {
+				return settings, fmt.Errorf("invalid cni-allowed-uids in config: %v", err)
+			}
+		}
+	}
+	if conf.TraceTransactions != nil {
+		if *conf.TraceTransactions < 0 {
+			return settings, fmt.Errorf("invalid trace-transactions in config: %d", *conf.TraceTransactions)
+		}
+		settings.traceTransactions = *conf.TraceTransactions
+	}
+	return settings, nil
+}
+
+func (r *settingsReloader) apply(settings daemonSettings) {
+	r.dhcp.setLeaseDefaults(settings.defaults)
+	r.socket.setAllowedUIDs(settings.socketAllowedUIDs)
+	r.auth.setAllowedUIDs(settings.cniAllowedUIDs)
+	r.dhcp.env.trace.resize(settings.traceTransactions)
+}
+
+// reload reads and applies the config file. The current settings are kept
+// if it is invalid.
+func (r *settingsReloader) reload() error {
+	settings, err := r.read()
+	if err != nil {
+		return err
+	}
+	r.apply(settings)
+	log.Printf("Settings reloaded: timeout %v, resendmax %v, broadcast %v, minrenewal %v, maxlease %v, trace-transactions %d",
+		settings.defaults.timeout, settings.defaults.resendMax, settings.defaults.broadcast,
+		settings.defaults.minRenewalTime, settings.defaults.maxLeaseTime, settings.traceTransactions)
+	return nil
+}
+
+// reloadOnSIGHUP reloads the settings whenever the daemon receives SIGHUP.
+func (r *settingsReloader) reloadOnSIGHUP() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	go func() {
+		for range sigCh {
+			if err := r.reload(); err != nil {
+				log.Printf("Failed to reload settings, keeping the current ones: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSettingsReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dhcp-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+
+	r := &settingsReloader{
+		path: path,
+		flags: daemonSettings{
+			defaults:          leaseDefaults{timeout: 10 * time.Second, resendMax: 62 * time.Second},
+			socketAllowedUIDs: map[uint32]bool{},
+			cniAllowedUIDs:    map[uint32]bool{1000: true},
+		},
+		dhcp:   &DHCP{env: leaseEnv{trace: newTransactionLog(0)}},
+		socket: &socketAccess{},
+		auth:   &rpcAuth{},
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"timeout": "3s", "broadcast": true, "socket-allowed-uids": "1001", "cni-allowed-uids": "", "trace-transactions": 10}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	want := leaseDefaults{timeout: 3 * time.Second, resendMax: 62 * time.Second, broadcast: true}
+	if got := r.dhcp.leaseDefaults(); got != want {
+		t.Errorf("got lease defaults %+v, want %+v", got, want)
+	}
+	if !r.socket.allowed(1001) {
+		t.Errorf("UID 1001 not allowed on the socket")
+	}
+	if r.auth.allowedUIDs != nil {
+		t.Errorf("CNI calls still restricted to %v", r.auth.allowedUIDs)
+	}
+	if !r.dhcp.env.trace.enabled() {
+		t.Errorf("transaction tracing not enabled")
+	}
+
+	// an invalid config keeps the current settings
+	if err := ioutil.WriteFile(path, []byte(`{"timeout": "soon"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err == nil {
+		t.Errorf("invalid config accepted")
+	}
+	if got := r.dhcp.leaseDefaults(); got != want {
+		t.Errorf("got lease defaults %+v after an invalid config, want %+v", got, want)
+	}
+
+	// settings removed from the config revert to the flags
+	if err := ioutil.WriteFile(path, []byte(`{}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.dhcp.leaseDefaults(); got != r.flags.defaults {
+		t.Errorf("got lease defaults %+v, want the flags' %+v", got, r.flags.defaults)
+	}
+	if r.socket.allowed(1001) || !r.auth.allowedUIDs[1000] || r.dhcp.env.trace.enabled() {
+		t.Errorf("allow-lists or tracing not reverted to the flags")
+	}
+}
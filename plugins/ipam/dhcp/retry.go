@@ -0,0 +1,107 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// RetryPolicy is the resend curve of a DHCP exchange. After the fast
+// retries, the delay starts at InitialDelay and is multiplied by Multiplier
+// after each resend, up to MaxDelay.
+type RetryPolicy struct {
+	InitialDelay time.Duration
+	Multiplier   float64
+	MaxDelay     time.Duration
+	// attempts including the first one; zero gives up once MaxDelay is reached
+	Attempts int
+}
+
+// defaultRetryPolicy is the RFC 2131 backoff, doubling the delay until it
+// reaches resendMax. Like the backoff always did, the last delay is the first
+// doubling reaching resendMax rather than resendMax itself, 64s by default.
+func defaultRetryPolicy(resendMax time.Duration) RetryPolicy {
+	maxDelay := resendDelay0
+	for maxDelay < resendMax {
+		maxDelay *= 2
+	}
+	return RetryPolicy{
+		InitialDelay: resendDelay0,
+		Multiplier:   2,
+		MaxDelay:     maxDelay,
+	}
+}
+
+// parseRetryConfig applies the network's retry settings to the default
+// policy, whose cap is the resendMax in effect for the network.
+func parseRetryConfig(conf *RetryConfig, resendMax time.Duration) (RetryPolicy, error) {
+	policy := defaultRetryPolicy(resendMax)
+	if conf == nil {
+		return policy, nil
+	}
+
+	var err error
+	if policy.InitialDelay, err = parseDurationOverride(conf.InitialDelay, policy.InitialDelay); err != nil {
+		return RetryPolicy{}, fmt.Errorf("invalid retry initialDelay: %v", err)
+	}
+	if policy.MaxDelay, err = parseDurationOverride(conf.MaxDelay, policy.MaxDelay); err != nil {
+		return RetryPolicy{}, fmt.Errorf("invalid retry maxDelay: %v", err)
+	}
+	if conf.Multiplier != 0 {
+		policy.Multiplier = conf.Multiplier
+	}
+	policy.Attempts = conf.Attempts
+
+	switch {
+	case policy.InitialDelay <= 0 || policy.MaxDelay <= 0:
+		return RetryPolicy{}, fmt.Errorf("retry delays must be positive")
+	case policy.Multiplier < 1:
+		return RetryPolicy{}, fmt.Errorf("retry multiplier must be at least 1, got %v", policy.Multiplier)
+	case policy.Attempts < 0:
+		return RetryPolicy{}, fmt.Errorf("retry attempts must not be negative, got %d", policy.Attempts)
+	case policy.Multiplier == 1 && policy.Attempts == 0 && policy.InitialDelay < policy.MaxDelay:
+		// the delay would never reach maxDelay
+		return RetryPolicy{}, fmt.Errorf("a constant retry delay requires attempts")
+	}
+	return policy, nil
+}
+
+// delays returns the pauses between the attempts of an exchange, without
+// jitter.
+func (p RetryPolicy) delays() []time.Duration {
+	var delays []time.Duration
+	for i := 0; i < resendFastMax; i++ {
+		delays = append(delays, resendFastDelay)
+	}
+
+	delay := p.InitialDelay
+	for p.Attempts == 0 || len(delays) < p.Attempts-1 {
+		if delay >= p.MaxDelay {
+			delays = append(delays, p.MaxDelay)
+			if p.Attempts == 0 {
+				break
+			}
+			continue
+		}
+		delays = append(delays, delay)
+		delay = time.Duration(float64(delay) * p.Multiplier)
+	}
+
+	if p.Attempts > 0 && len(delays) > p.Attempts-1 {
+		delays = delays[:p.Attempts-1]
+	}
+	return delays
+}
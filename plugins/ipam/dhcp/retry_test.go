@@ -0,0 +1,86 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelays(t *testing.T) {
+	fast := []time.Duration{resendFastDelay, resendFastDelay, resendFastDelay, resendFastDelay}
+	s := time.Second
+
+	tests := []struct {
+		name string
+		conf *RetryConfig
+		want []time.Duration
+	}{
+		{
+			name: "default",
+			want: append(fast, 4*s, 8*s, 16*s, 32*s, 64*s),
+		},
+		{
+			name: "resendMax at a doubling",
+			conf: &RetryConfig{MaxDelay: "32s"},
+			want: append(fast, 4*s, 8*s, 16*s, 32*s),
+		},
+		{
+			name: "slow server",
+			conf: &RetryConfig{InitialDelay: "10s", Multiplier: 3, MaxDelay: "2m"},
+			want: append(fast, 10*s, 30*s, 90*s, 120*s),
+		},
+		{
+			name: "constant delay",
+			conf: &RetryConfig{InitialDelay: "5s", Multiplier: 1, Attempts: 8},
+			want: append(fast, 5*s, 5*s, 5*s),
+		},
+		{
+			name: "attempts beyond the cap",
+			conf: &RetryConfig{MaxDelay: "10s", Attempts: 9},
+			want: append(fast, 4*s, 8*s, 10*s, 10*s),
+		},
+		{
+			name: "fewer attempts than fast retries",
+			conf: &RetryConfig{Attempts: 2},
+			want: fast[:1],
+		},
+	}
+
+	for _, tt := range tests {
+		policy, err := parseRetryConfig(tt.conf, resendDelayMax)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if got := policy.delays(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got delays %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryConfigErrors(t *testing.T) {
+	for _, conf := range []*RetryConfig{
+		{InitialDelay: "soon"},
+		{MaxDelay: "-1s"},
+		{Multiplier: 0.5},
+		{Attempts: -1},
+		{Multiplier: 1},
+	} {
+		if _, err := parseRetryConfig(conf, resendDelayMax); err == nil {
+			t.Errorf("expected an error for %+v", *conf)
+		}
+	}
+}
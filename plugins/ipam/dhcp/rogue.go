@@ -0,0 +1,112 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	rogueServerWarn   = "warn"
+	rogueServerRefuse = "refuse"
+	rogueServerNone   = "none"
+)
+
+func parseRogueServerAction(action string) (string, error) {
+	switch action {
+	case "":
+		return rogueServerNone, nil
+	case rogueServerWarn, rogueServerRefuse, rogueServerNone:
+		return action, nil
+	default:
+		return "", fmt.Errorf("unknown rogueServers action %q", action)
+	}
+}
+
+// knownServers holds the server identifiers seen on each network. The first
+// server answering on a network is trusted.
+var knownServers = struct {
+	sync.Mutex
+	servers map[string][]net.IP
+}{servers: map[string][]net.IP{}}
+
+// observeServer reports whether serverID is unexpected on the network, i.e.
+// another server answered on it before. Unexpected servers are remembered,
+// so they are reported only once, unless they are refused.
+func observeServer(network string, serverID net.IP, refuse bool) bool {
+	knownServers.Lock()
+	defer knownServers.Unlock()
+
+	known := knownServers.servers[network]
+	if serverAllowed(known, serverID) {
+		return false
+	}
+	if len(known) > 0 && refuse {
+		return true
+	}
+	knownServers.servers[network] = append(known, serverID)
+	return len(known) > 0
+}
+
+// rememberServer marks serverID as known on the network, e.g. for leases
+// reloaded from the store.
+func rememberServer(network string, serverID net.IP) {
+	knownServers.Lock()
+	defer knownServers.Unlock()
+
+	if known := knownServers.servers[network]; !serverAllowed(known, serverID) {
+		knownServers.servers[network] = append(known, serverID)
+	}
+}
+
+// rogueServerConn reports DHCP replies from servers other than the ones
+// known on the lease's network, and hides them if they are refused.
+type rogueServerConn struct {
+	dhcpConn
+	lease *DHCPLease
+}
+
+func (c *rogueServerConn) ReadFrom() ([]byte, net.IP, error) {
+	pkt, source, err := c.dhcpConn.ReadFrom()
+	if err != nil {
+		return pkt, source, err
+	}
+	reply, parseErr := dhcpv4.FromBytes(pkt)
+	if parseErr != nil || reply.OpCode != dhcpv4.OpcodeBootReply {
+		return pkt, source, nil
+	}
+
+	l := c.lease
+	refuse := l.rogueServers == rogueServerRefuse
+	serverID := reply.ServerIdentifier()
+	if len(serverID) != 4 || !observeServer(l.network, serverID, refuse) {
+		return pkt, source, nil
+	}
+
+	msg := fmt.Sprintf("unexpected DHCP server %v (sent by %v) answering on network %q", serverID, source, l.network)
+	log.Printf("%v: WARNING: %s", l.clientID, msg)
+	l.env.events.warn(l.k8sNamespace, l.k8sPodName, eventReasonRogueServer, msg)
+	if refuse {
+		log.Printf("%v: ignoring DHCP reply from server %v", l.clientID, serverID)
+		// see serverFilterConn
+		copy(pkt[xidOffset:xidOffset+4], []byte{0, 0, 0, 0})
+	}
+	return pkt, source, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestObserveServer(t *testing.T) {
+	first := net.ParseIP("192.168.1.1").To4()
+	rogue := net.ParseIP("192.168.1.66").To4()
+	other := net.ParseIP("192.168.1.77").To4()
+
+	// the first server is trusted
+	if observeServer("test-warn", first, false) {
+		t.Errorf("first server reported as unexpected")
+	}
+	if observeServer("test-warn", first, false) {
+		t.Errorf("known server reported as unexpected")
+	}
+	// another one is reported once when warning
+	if !observeServer("test-warn", rogue, false) {
+		t.Errorf("new server not reported")
+	}
+	if observeServer("test-warn", rogue, false) {
+		t.Errorf("new server reported twice")
+	}
+	// networks are tracked separately
+	if observeServer("test-other", rogue, false) {
+		t.Errorf("first server on another network reported as unexpected")
+	}
+
+	// refused servers are reported every time
+	rememberServer("test-refuse", first)
+	for i := 0; i < 2; i++ {
+		if !observeServer("test-refuse", other, true) {
+			t.Errorf("refused server not reported")
+		}
+	}
+	if observeServer("test-refuse", first, true) {
+		t.Errorf("remembered server reported as unexpected")
+	}
+}
+
+func TestParseRogueServerAction(t *testing.T) {
+	for action, want := range map[string]string{
+		"":       rogueServerNone,
+		"warn":   rogueServerWarn,
+		"refuse": rogueServerRefuse,
+		"none":   rogueServerNone,
+	} {
+		if got, err := parseRogueServerAction(action); err != nil || got != want {
+			t.Errorf("parseRogueServerAction(%q) = %q, %v, want %q", action, got, err, want)
+		}
+	}
+	if _, err := parseRogueServerAction("block"); err == nil {
+		t.Errorf("parseRogueServerAction() accepted an unknown action")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	// routes with the same destination are all kept
+	routeConflictBoth = "both"
+	// static routes replace the routers' default routes
+	routeConflictStatic = "static"
+	// the routers' default routes replace static routes to 0.0.0.0/0
+	routeConflictRouters = "routers"
+)
+
+// parseRoutePolicy validates the routePolicy of the ipam config. The zero
+// value is returned when it is not set.
+func parseRoutePolicy(conf *RoutePolicy) (RoutePolicy, error) {
+	if conf == nil {
+		return RoutePolicy{}, nil
+	}
+	policy := *conf
+	switch policy.PreferOnConflict {
+	case "":
+		policy.PreferOnConflict = routeConflictBoth
+	case routeConflictBoth, routeConflictStatic, routeConflictRouters:
+	default:
+		return RoutePolicy{}, fmt.Errorf("unknown routePolicy preferOnConflict %q", policy.PreferOnConflict)
+	}
+	return policy, nil
+}
+
+// buildRoutes returns the routes given by the options. The routers add
+// default routes, as the CNI spec says a default route must be added even if
+// there is a gateway.
+func buildRoutes(opts dhcpv4.Options, policy RoutePolicy) []*types.Route {
+	useRouters := true
+	// RFC 3442 states that if Classless Static Routes (option 121)
+	// exist, we ignore Static Routes (option 33) and the Router/Gateway.
+	static := parseCIDRRoutes(opts)
+	if len(static) > 0 {
+		useRouters = policy.KeepRoutersWithClassless
+	} else {
+		static = parseRoutes(opts)
+	}
+
+	var defaults []*types.Route
+	if useRouters {
+		routers := parseRouters(opts)
+		if !policy.AllRouters && len(routers) > 1 {
+			routers = routers[:1]
+		}
+		_, defaultRoute, _ := net.ParseCIDR("0.0.0.0/0")
+		for _, gw := range routers {
+			defaults = append(defaults, &types.Route{Dst: *defaultRoute, GW: gw})
+		}
+	}
+
+	switch policy.PreferOnConflict {
+	case routeConflictStatic:
+		defaults = withoutDestinations(defaults, static)
+	case routeConflictRouters:
+		static = withoutDestinations(static, defaults)
+	}
+
+	routes := []*types.Route{}
+	routes = append(routes, static...)
+	return append(routes, defaults...)
+}
+
+// withoutDestinations returns the routes whose destination isn't routed by
+// any of the preferred routes.
+func withoutDestinations(routes, preferred []*types.Route) []*types.Route {
+	kept := []*types.Route{}
+	for _, r := range routes {
+		conflict := false
+		for _, p := range preferred {
+			if r.Dst.String() == p.Dst.String() {
+				conflict = true
+				break
+			}
+		}
+		if !conflict {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func routeStrings(routes []*types.Route) string {
+	s := ""
+	for _, r := range routes {
+		s += fmt.Sprintf("%v via %v;", r.Dst.String(), r.GW)
+	}
+	return s
+}
+
+func TestBuildRoutes(t *testing.T) {
+	routers := []byte{10, 0, 0, 1, 10, 0, 0, 2}
+	classless := []byte{8, 10, 10, 1, 2, 3, 0, 10, 0, 0, 254}
+	static := []byte{192, 168, 1, 0, 10, 0, 0, 253}
+
+	for _, tc := range []struct {
+		name   string
+		opts   dhcpv4.Options
+		policy RoutePolicy
+		want   string
+	}{
+		{
+			name: "first router by default",
+			opts: dhcpv4.Options{dhcpv4.OptionRouter.Code(): routers},
+			want: "0.0.0.0/0 via 10.0.0.1;",
+		},
+		{
+			name:   "all routers",
+			opts:   dhcpv4.Options{dhcpv4.OptionRouter.Code(): routers},
+			policy: RoutePolicy{AllRouters: true},
+			want:   "0.0.0.0/0 via 10.0.0.1;0.0.0.0/0 via 10.0.0.2;",
+		},
+		{
+			name: "classless routes suppress the routers",
+			opts: dhcpv4.Options{dhcpv4.OptionRouter.Code(): routers, dhcpv4.OptionClasslessStaticRoute.Code(): classless},
+			want: "10.0.0.0/8 via 10.1.2.3;0.0.0.0/0 via 10.0.0.254;",
+		},
+		{
+			name:   "routers kept with classless routes",
+			opts:   dhcpv4.Options{dhcpv4.OptionRouter.Code(): routers, dhcpv4.OptionClasslessStaticRoute.Code(): classless},
+			policy: RoutePolicy{KeepRoutersWithClassless: true, PreferOnConflict: routeConflictBoth},
+			want:   "10.0.0.0/8 via 10.1.2.3;0.0.0.0/0 via 10.0.0.254;0.0.0.0/0 via 10.0.0.1;",
+		},
+		{
+			name:   "routers win over classless routes",
+			opts:   dhcpv4.Options{dhcpv4.OptionRouter.Code(): routers, dhcpv4.OptionClasslessStaticRoute.Code(): classless},
+			policy: RoutePolicy{KeepRoutersWithClassless: true, PreferOnConflict: routeConflictRouters},
+			want:   "10.0.0.0/8 via 10.1.2.3;0.0.0.0/0 via 10.0.0.1;",
+		},
+		{
+			name:   "classless routes win over routers",
+			opts:   dhcpv4.Options{dhcpv4.OptionRouter.Code(): routers, dhcpv4.OptionClasslessStaticRoute.Code(): classless},
+			policy: RoutePolicy{KeepRoutersWithClassless: true, AllRouters: true, PreferOnConflict: routeConflictStatic},
+			want:   "10.0.0.0/8 via 10.1.2.3;0.0.0.0/0 via 10.0.0.254;",
+		},
+		{
+			name: "static routes are kept along with the routers",
+			opts: dhcpv4.Options{dhcpv4.OptionRouter.Code(): routers, dhcpv4.OptionStaticRoutingTable.Code(): static},
+			want: "192.168.1.0/24 via 10.0.0.253;0.0.0.0/0 via 10.0.0.1;",
+		},
+	} {
+		if got := routeStrings(buildRoutes(tc.opts, tc.policy)); got != tc.want {
+			t.Errorf("%s: got routes %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseRoutePolicy(t *testing.T) {
+	if p, err := parseRoutePolicy(&RoutePolicy{}); err != nil || p.PreferOnConflict != routeConflictBoth {
+		t.Errorf("parseRoutePolicy() = %+v, %v, want preferOnConflict %q", p, err, routeConflictBoth)
+	}
+	if _, err := parseRoutePolicy(&RoutePolicy{PreferOnConflict: "server"}); err == nil {
+		t.Errorf("parseRoutePolicy() accepted an unknown preferOnConflict")
+	}
+}
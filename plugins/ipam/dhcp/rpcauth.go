@@ -0,0 +1,340 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"golang.org/x/sys/unix"
+)
+
+// read-only calls left to the socket permissions, every other call requires
+// the token and an allowed UID
+var openMethods = map[string]bool{
+	"DHCP.ListLeases":       true,
+	"DHCP.LeaseOptions":     true,
+	"DHCP.ListTransactions": true,
+}
+
+// rpcAuth authorizes the calls beyond the socket's permissions, for nodes
+// where not every local user can be trusted, and records every call in the
+// audit log.
+type rpcAuth struct {
+	// the plugin must send, empty if none is required
+	token string
+	// besides root, nil if every UID that can connect is allowed. Replaced
+	// when the settings are reloaded.
+	allowedUIDsMux sync.RWMutex
+	allowedUIDs    map[uint32]bool
+	// nil disables auditing
+	audit *log.Logger
+}
+
+// parseRPCAuth reads the token from tokenFile, parses the comma-separated
+// allowedUIDs and opens the audit log, "-" meaning stderr. Empty values
+// disable each of them.
+func parseRPCAuth(tokenFile, allowedUIDs, auditLog string) (*rpcAuth, error) {
+	a := &rpcAuth{}
+	if tokenFile != "" {
+		token, err := readToken(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		a.token = token
+	}
+	if allowedUIDs != "" {
+		uids, err := parseUIDs(allowedUIDs)
+		if err != nil {
+			return nil, err
+		}
+		a.allowedUIDs = uids
+	}
+	switch auditLog {
+	case "":
+	case "-":
+		a.audit = log.New(os.Stderr, "audit: ", log.LstdFlags)
+	default:
+		f, err := os.OpenFile(auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %v", err)
+		}
+		a.audit = log.New(f, "", log.LstdFlags)
+	}
+	return a, nil
+}
+
+// readTokenFlag reads the token given to an admin command, empty if path is.
+func readTokenFlag(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	return readToken(path)
+}
+
+func readToken(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %q is empty", path)
+	}
+	return token, nil
+}
+
+// authorize returns an error if the caller may not make the call.
+func (a *rpcAuth) authorize(method string, cred *unix.Ucred, authenticated bool) error {
+	if openMethods[method] {
+		return nil
+	}
+	if !authenticated {
+		return fmt.Errorf("permission denied: %s requires the daemon token", method)
+	}
+	a.allowedUIDsMux.RLock()
+	defer a.allowedUIDsMux.RUnlock()
+	if a.allowedUIDs != nil {
+		if cred == nil {
+			return fmt.Errorf("permission denied: the caller of %s is unknown", method)
+		}
+		if cred.Uid != 0 && !a.allowedUIDs[cred.Uid] {
+			return fmt.Errorf("permission denied: UID %d may not call %s", cred.Uid, method)
+		}
+	}
+	return nil
+}
+
+func (a *rpcAuth) setAllowedUIDs(uids map[uint32]bool) {
+	a.allowedUIDsMux.Lock()
+	defer a.allowedUIDsMux.Unlock()
+	a.allowedUIDs = uids
+}
+
+// record writes the call to the audit log. The arguments are nil for denied
+// calls, whose bodies are not decoded.
+func (a *rpcAuth) record(method string, cred *unix.Ucred, args interface{}, denied error) {
+	if a.audit == nil {
+		return
+	}
+	caller := "caller unknown"
+	if cred != nil {
+		caller = fmt.Sprintf("uid=%d pid=%d comm=%q", cred.Uid, cred.Pid, processName(cred.Pid))
+	}
+	var target string
+	switch v := args.(type) {
+	case *skel.CmdArgs:
+		target = fmt.Sprintf(" container=%s netns=%s ifname=%s", v.ContainerID, v.Netns, v.IfName)
+	case *string:
+		target = fmt.Sprintf(" target=%q", *v)
+	}
+	outcome := "allowed"
+	if denied != nil {
+		outcome = denied.Error()
+	}
+	a.audit.Printf("%s %s%s: %s", method, caller, target, outcome)
+}
+
+// processName returns the command name of pid, empty if it is not visible in
+// the daemon's PID namespace.
+func processName(pid int32) string {
+	comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// rpcHandler serves net/rpc over HTTP CONNECT like rpc.HandleHTTP, checking
+// each call with auth. The token is sent as a bearer token in the CONNECT
+// request.
+type rpcHandler struct {
+	server *rpc.Server
+	auth   *rpcAuth
+	// nil if the connections aren't counted
+	conns *rpcConns
+}
+
+// the reply to CONNECT expected by rpc.DialHTTP
+const rpcConnected = "200 Connected to Go RPC"
+
+func (h *rpcHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	authenticated := h.auth.token == ""
+	if token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "); !authenticated && token != "" {
+		authenticated = subtle.ConstantTimeCompare([]byte(token), []byte(h.auth.token)) == 1
+	}
+
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Printf("rpc hijacking %v: %v", req.RemoteAddr, err)
+		return
+	}
+	defer h.conns.hijackedDone()
+	// nil if unknown, calls are then only allowed without a UID allow-list
+	cred, _ := peerCred(conn)
+	io.WriteString(conn, "HTTP/1.0 "+rpcConnected+"\n\n")
+	h.server.ServeCodec(&authCodec{
+		gobServerCodec: newGobServerCodec(conn),
+		auth:           h.auth,
+		cred:           cred,
+		authenticated:  authenticated,
+	})
+}
+
+// authCodec answers unauthorized calls itself, so that they never reach the
+// server.
+type authCodec struct {
+	*gobServerCodec
+	auth          *rpcAuth
+	cred          *unix.Ucred
+	authenticated bool
+	// of the request whose body is read next
+	method string
+}
+
+func (c *authCodec) ReadRequestHeader(r *rpc.Request) error {
+	for {
+		if err := c.gobServerCodec.ReadRequestHeader(r); err != nil {
+			return err
+		}
+		denied := c.auth.authorize(r.ServiceMethod, c.cred, c.authenticated)
+		if denied == nil {
+			c.method = r.ServiceMethod
+			return nil
+		}
+		c.auth.record(r.ServiceMethod, c.cred, nil, denied)
+		if err := c.gobServerCodec.ReadRequestBody(nil); err != nil {
+			return err
+		}
+		resp := &rpc.Response{ServiceMethod: r.ServiceMethod, Seq: r.Seq, Error: denied.Error()}
+		if err := c.WriteResponse(resp, struct{}{}); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *authCodec) ReadRequestBody(body interface{}) error {
+	err := c.gobServerCodec.ReadRequestBody(body)
+	if err == nil && body != nil {
+		c.auth.record(c.method, c.cred, body, nil)
+	}
+	return err
+}
+
+// gobServerCodec is net/rpc's unexported default codec, with writes
+// serialized since denials are written outside of the server's lock.
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	mux    sync.Mutex
+	closed bool
+}
+
+func newGobServerCodec(conn io.ReadWriteCloser) *gobServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// gob couldn't encode the header, which shouldn't happen
+			c.closeLocked()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// the body couldn't be encoded, e.g. a type wasn't registered
+			c.closeLocked()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.closeLocked()
+}
+
+func (c *gobServerCodec) closeLocked() error {
+	if c.closed {
+		// only call c.rwc.Close once, the server may close the codec twice
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+// dialDaemon connects to the daemon like rpc.DialHTTP, sending token, if
+// set, for the calls that require it.
+func dialDaemon(socketPath, token string) (*rpc.Client, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	request := "CONNECT " + rpc.DefaultRPCPath + " HTTP/1.0\n"
+	if token != "" {
+		request += "Authorization: Bearer " + token + "\n"
+	}
+	io.WriteString(conn, request+"\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != rpcConnected {
+		err = fmt.Errorf("unexpected HTTP response: %s", resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
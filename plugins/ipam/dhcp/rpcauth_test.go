@@ -0,0 +1,142 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"golang.org/x/sys/unix"
+)
+
+type testRPCService struct{}
+
+func (testRPCService) Release(args *skel.CmdArgs, reply *struct{}) error {
+	return nil
+}
+
+func (testRPCService) RenewLease(target string, reply *[]string) error {
+	return nil
+}
+
+func (testRPCService) ListLeases(_ struct{}, reply *[]LeaseInfo) error {
+	return nil
+}
+
+func TestRPCAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dhcp-rpcauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dhcp.sock")
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("DHCP", testRPCService{}); err != nil {
+		t.Fatal(err)
+	}
+	audit := &bytes.Buffer{}
+	auth := &rpcAuth{token: "secret", audit: log.New(audit, "", 0)}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, &rpcHandler{server: server, auth: auth})
+	go http.Serve(l, mux)
+
+	args := &skel.CmdArgs{ContainerID: "c1", Netns: "/var/run/netns/a", IfName: "eth0"}
+	for _, tc := range []struct {
+		token   string
+		wantErr bool
+	}{
+		{"", true},
+		{"wrong", true},
+		{"secret", false},
+	} {
+		client, err := dialDaemon(path, tc.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.Call("DHCP.Release", args, &struct{}{})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Release with token %q: error = %v, wantErr %v", tc.token, err, tc.wantErr)
+		}
+		// so are the admin calls changing leases
+		err = client.Call("DHCP.RenewLease", "c1", &[]string{})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("RenewLease with token %q: error = %v, wantErr %v", tc.token, err, tc.wantErr)
+		}
+		// listing is left to the socket permissions
+		if err := client.Call("DHCP.ListLeases", struct{}{}, &[]LeaseInfo{}); err != nil {
+			t.Errorf("ListLeases with token %q: %v", tc.token, err)
+		}
+		client.Close()
+	}
+
+	// clients listing leases don't send a token
+	client, err := rpc.DialHTTP("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("DHCP.ListLeases", struct{}{}, &[]LeaseInfo{}); err != nil {
+		t.Errorf("ListLeases over rpc.DialHTTP: %v", err)
+	}
+	client.Close()
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(lines) != 10 {
+		t.Fatalf("got audit log %q, want 10 lines", audit.String())
+	}
+	if !strings.Contains(lines[0], "DHCP.Release uid=") || !strings.Contains(lines[0], "permission denied") {
+		t.Errorf("unexpected audit entry for a denied call %q", lines[0])
+	}
+	if !strings.Contains(lines[6], "container=c1 netns=/var/run/netns/a ifname=eth0: allowed") {
+		t.Errorf("unexpected audit entry for an allowed call %q", lines[4])
+	}
+}
+
+func TestRPCAuthAllowedUIDs(t *testing.T) {
+	auth := &rpcAuth{allowedUIDs: map[uint32]bool{1000: true}}
+	if err := auth.authorize("DHCP.Allocate", nil, true); err == nil {
+		t.Errorf("unknown caller allowed")
+	}
+	if err := auth.authorize("DHCP.Allocate", &unix.Ucred{Uid: 1001}, true); err == nil {
+		t.Errorf("UID 1001 allowed")
+	}
+	for _, uid := range []uint32{0, 1000} {
+		if err := auth.authorize("DHCP.Allocate", &unix.Ucred{Uid: uid}, true); err != nil {
+			t.Errorf("UID %d not allowed: %v", uid, err)
+		}
+	}
+	if err := auth.authorize("DHCP.ListLeases", &unix.Ucred{Uid: 1001}, true); err != nil {
+		t.Errorf("listing denied: %v", err)
+	}
+	for _, method := range []string{"DHCP.Import", "DHCP.RenewLease", "DHCP.ReleaseLease", "DHCP.Handover", "DHCP.Unknown"} {
+		if err := auth.authorize(method, &unix.Ucred{Uid: 1001}, true); err == nil {
+			t.Errorf("UID 1001 allowed to call %s", method)
+		}
+	}
+}
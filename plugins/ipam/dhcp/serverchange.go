@@ -0,0 +1,78 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	serverChangeWarn   = "warn"
+	serverChangeRefuse = "refuse"
+	serverChangeNone   = "none"
+)
+
+func parseServerChangePolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return serverChangeWarn, nil
+	case serverChangeWarn, serverChangeRefuse, serverChangeNone:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown serverChange policy %q", policy)
+	}
+}
+
+// packetServerID returns the server identifier of pkt, nil if it has none.
+func packetServerID(pkt *dhcpv4.DHCPv4) net.IP {
+	if pkt == nil {
+		return nil
+	}
+	return pkt.ServerIdentifier()
+}
+
+// serverID returns the identifier of the server that granted the lease, nil
+// for leases without one, e.g. fallback addresses.
+func (l *DHCPLease) serverID() net.IP {
+	if l.isSynthetic() {
+		return nil
+	}
+	return packetServerID(l.ack)
+}
+
+// checkServerChange compares the server that sent ack to the one that
+// granted the lease. A change, e.g. after a second router was plugged into
+// the network, is reported, and an error is returned if it is refused.
+func (l *DHCPLease) checkServerChange(ack *dhcpv4.DHCPv4) error {
+	if l.serverChange == serverChangeNone {
+		return nil
+	}
+	previous, current := l.serverID(), packetServerID(ack)
+	if previous == nil || current == nil || previous.Equal(current) {
+		return nil
+	}
+
+	msg := fmt.Sprintf("lease granted by DHCP server %v is now answered by %v", previous, current)
+	log.Printf("%v: WARNING: %s", l.clientID, msg)
+	l.env.events.warn(l.k8sNamespace, l.k8sPodName, eventReasonServerChanged, msg)
+	if l.serverChange == serverChangeRefuse {
+		return fmt.Errorf("refusing binding from DHCP server %v, the lease was granted by %v", current, previous)
+	}
+	return nil
+}
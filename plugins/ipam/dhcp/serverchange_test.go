@@ -0,0 +1,76 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestCheckServerChange(t *testing.T) {
+	ack := func(server string) *dhcpv4.DHCPv4 {
+		pkt := testPacket(dhcpv4.OpcodeBootReply, []byte{0, 0, 0, 1}, dhcpv4.MessageTypeAck)
+		if server != "" {
+			pkt.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionServerIdentifier, net.ParseIP(server).To4()))
+		}
+		return pkt
+	}
+
+	tests := []struct {
+		name      string
+		policy    string
+		synthetic bool
+		granted   string
+		answered  string
+		wantErr   bool
+	}{
+		{name: "same server", policy: serverChangeRefuse, granted: "10.0.0.1", answered: "10.0.0.1"},
+		{name: "warn", policy: serverChangeWarn, granted: "10.0.0.1", answered: "10.0.0.2"},
+		{name: "saved by older version", policy: "", granted: "10.0.0.1", answered: "10.0.0.2"},
+		{name: "refuse", policy: serverChangeRefuse, granted: "10.0.0.1", answered: "10.0.0.2", wantErr: true},
+		{name: "none", policy: serverChangeNone, granted: "10.0.0.1", answered: "10.0.0.2"},
+		{name: "no server identifier", policy: serverChangeRefuse, granted: "", answered: "10.0.0.2"},
+		{name: "fallback address", policy: serverChangeRefuse, synthetic: true, granted: "10.0.0.1", answered: "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &DHCPLease{clientID: "c1", ack: ack(tt.granted), serverChange: tt.policy}
+			if tt.synthetic {
+				l.synthetic = 1
+			}
+			if err := l.checkServerChange(ack(tt.answered)); (err != nil) != tt.wantErr {
+				t.Errorf("checkServerChange() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseServerChangePolicy(t *testing.T) {
+	for policy, want := range map[string]string{
+		"":       serverChangeWarn,
+		"warn":   serverChangeWarn,
+		"refuse": serverChangeRefuse,
+		"none":   serverChangeNone,
+	} {
+		if got, err := parseServerChangePolicy(policy); err != nil || got != want {
+			t.Errorf("parseServerChangePolicy(%q) = %q, %v, want %q", policy, got, err, want)
+		}
+	}
+	if _, err := parseServerChangePolicy("block"); err == nil {
+		t.Errorf("parseServerChangePolicy() accepted an unknown policy")
+	}
+}
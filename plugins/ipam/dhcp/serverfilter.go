@@ -0,0 +1,78 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Offset of the xid field in a DHCP message, see RFC 2131 section 2
+const xidOffset = 4
+
+func parseAllowedServers(servers []string) ([]net.IP, error) {
+	var allowed []net.IP
+	for _, s := range servers {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid allowed server address %q", s)
+		}
+		allowed = append(allowed, ip)
+	}
+	return allowed, nil
+}
+
+// serverFilterConn hides DHCP replies from servers that are not allowed.
+// Filtering is done on the connection, so that the exchange keeps waiting
+// for a reply from an allowed server.
+type serverFilterConn struct {
+	dhcpConn
+	allowed  []net.IP
+	clientID string
+}
+
+func (c *serverFilterConn) ReadFrom() ([]byte, net.IP, error) {
+	pkt, source, err := c.dhcpConn.ReadFrom()
+	if err != nil {
+		return pkt, source, err
+	}
+	reply, parseErr := dhcpv4.FromBytes(pkt)
+	if parseErr != nil || reply.OpCode != dhcpv4.OpcodeBootReply {
+		return pkt, source, nil
+	}
+
+	serverID := reply.ServerIdentifier()
+	if serverAllowed(c.allowed, serverID) {
+		return pkt, source, nil
+	}
+
+	log.Printf("%v: ignoring DHCP reply from server %v (sent by %v), it is not allowed", c.clientID, serverID, source)
+	// Clearing the xid makes the client discard the reply while still
+	// accounting for the time spent waiting.
+	copy(pkt[xidOffset:xidOffset+4], []byte{0, 0, 0, 0})
+	return pkt, source, nil
+}
+
+func serverAllowed(allowed []net.IP, serverID net.IP) bool {
+	for _, ip := range allowed {
+		if ip.Equal(serverID) {
+			return true
+		}
+	}
+	return false
+}
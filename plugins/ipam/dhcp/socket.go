@@ -0,0 +1,179 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketAccess controls who can use the daemon's socket. The API can
+// disrupt every pod on the node, so by default only root may connect.
+type socketAccess struct {
+	// applied to a socket created by the daemon, unlike one passed by systemd
+	mode os.FileMode
+	// owner and group of a socket created by the daemon, -1 to keep them
+	uid, gid int
+	// besides root, replaced when the settings are reloaded
+	allowedUIDsMux sync.RWMutex
+	allowedUIDs    map[uint32]bool
+}
+
+// parseSocketAccess parses the socket flags. The mode is octal, owner and
+// group are names or IDs and allowedUIDs is a comma-separated list of IDs.
+func parseSocketAccess(mode, owner, group, allowedUIDs string) (*socketAccess, error) {
+	a := &socketAccess{uid: -1, gid: -1}
+
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return nil, fmt.Errorf("invalid socket mode %q", mode)
+	}
+	a.mode = os.FileMode(m)
+
+	if owner != "" {
+		if a.uid, err = lookupID(owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		}); err != nil {
+			return nil, fmt.Errorf("invalid socket owner %q: %v", owner, err)
+		}
+	}
+	if group != "" {
+		if a.gid, err = lookupID(group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		}); err != nil {
+			return nil, fmt.Errorf("invalid socket group %q: %v", group, err)
+		}
+	}
+
+	if a.allowedUIDs, err = parseUIDs(allowedUIDs); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// parseUIDs parses a comma-separated list of numeric UIDs.
+func parseUIDs(list string) (map[uint32]bool, error) {
+	uids := map[uint32]bool{}
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		uid, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed UID %q", field)
+		}
+		uids[uint32(uid)] = true
+	}
+	return uids, nil
+}
+
+// lookupID returns the numeric ID, looking up names with lookup.
+func lookupID(nameOrID string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+	id, err := lookup(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// apply sets the mode and ownership of the socket at path.
+func (a *socketAccess) apply(path string) error {
+	if err := os.Chmod(path, a.mode); err != nil {
+		return err
+	}
+	if a.uid != -1 || a.gid != -1 {
+		return os.Chown(path, a.uid, a.gid)
+	}
+	return nil
+}
+
+func (a *socketAccess) allowed(uid uint32) bool {
+	a.allowedUIDsMux.RLock()
+	defer a.allowedUIDsMux.RUnlock()
+	return uid == 0 || a.allowedUIDs[uid]
+}
+
+func (a *socketAccess) setAllowedUIDs(uids map[uint32]bool) {
+	a.allowedUIDsMux.Lock()
+	defer a.allowedUIDsMux.Unlock()
+	a.allowedUIDs = uids
+}
+
+// peerCredListener only accepts connections from processes whose UID is
+// allowed, according to SO_PEERCRED.
+type peerCredListener struct {
+	net.Listener
+	access *socketAccess
+}
+
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		cred, err := peerCred(conn)
+		if err != nil {
+			log.Printf("Rejecting connection: failed to get peer credentials: %v", err)
+			conn.Close()
+			continue
+		}
+		if !l.access.allowed(cred.Uid) {
+			log.Printf("Rejecting connection from UID %d (PID %d)", cred.Uid, cred.Pid)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+func peerCred(conn net.Conn) (*unix.Ucred, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("not a unix socket connection")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSocketAccess(t *testing.T) {
+	tests := []struct {
+		name                        string
+		mode, owner, group, allowed string
+		wantMode                    os.FileMode
+		wantUID, wantGID            int
+		wantAllowed, wantNotAllowed uint32
+		wantErr                     bool
+	}{
+		{name: "defaults", mode: "0600", wantMode: 0600, wantUID: -1, wantGID: -1, wantNotAllowed: 1000},
+		{name: "numeric", mode: "660", owner: "0", group: "1000", allowed: "1000, 1001", wantMode: 0660, wantUID: 0, wantGID: 1000, wantAllowed: 1001, wantNotAllowed: 1002},
+		{name: "names", mode: "0600", owner: "root", group: "root", wantMode: 0600, wantUID: 0, wantGID: 0},
+		{name: "invalid mode", mode: "0800", wantErr: true},
+		{name: "unknown owner", mode: "0600", owner: "no-such-user", wantErr: true},
+		{name: "invalid UID", mode: "0600", allowed: "nobody", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parseSocketAccess(tt.mode, tt.owner, tt.group, tt.allowed)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSocketAccess() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if a.mode != tt.wantMode || a.uid != tt.wantUID || a.gid != tt.wantGID {
+				t.Errorf("parseSocketAccess() = mode %o, uid %d, gid %d, want %o, %d, %d", a.mode, a.uid, a.gid, tt.wantMode, tt.wantUID, tt.wantGID)
+			}
+			if !a.allowed(0) || !a.allowed(tt.wantAllowed) {
+				t.Errorf("root or UID %d not allowed", tt.wantAllowed)
+			}
+			if tt.wantNotAllowed != 0 && a.allowed(tt.wantNotAllowed) {
+				t.Errorf("UID %d allowed", tt.wantNotAllowed)
+			}
+		})
+	}
+}
+
+func TestPeerCredListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dhcp-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dhcp.sock")
+
+	access := &socketAccess{mode: 0600, uid: -1, gid: -1, allowedUIDs: map[uint32]bool{uint32(os.Getuid()): true}}
+	listeners, err := getListeners(path, access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &peerCredListener{Listener: listeners.rpc[0], access: access}
+	defer l.Close()
+
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, %v, want 0600", fi.Mode(), err)
+	}
+
+	go func() {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept() = %v, want the connection of an allowed UID", err)
+	}
+	conn.Close()
+}
+
+func TestSortActivationListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dhcp-activation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	unixListener, err := net.Listen("unix", filepath.Join(dir, "dhcp.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixListener.Close()
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+
+	listeners, err := sortActivationListeners(map[string][]net.Listener{
+		"cni-dhcp.socket": {unixListener, tcpListener},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners.rpc) != 1 || listeners.rpc[0] != unixListener || len(listeners.health) != 1 || listeners.health[0] != tcpListener {
+		t.Errorf("unix socket not used for RPC or TCP socket not used for health: %+v", listeners)
+	}
+
+	// a unix socket can be named to serve the health endpoints only
+	if _, err := sortActivationListeners(map[string][]net.Listener{activationNameHealth: {unixListener}}); err == nil {
+		t.Errorf("sockets without one for RPC accepted")
+	}
+	// RPC callers can't be identified on TCP
+	if _, err := sortActivationListeners(map[string][]net.Listener{activationNameRPC: {tcpListener}}); err == nil {
+		t.Errorf("TCP socket accepted for RPC")
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Pods of networks with stableIP ask for the address they had before with
+// the requested-address option, so that a pod recreated on the node keeps
+// its address. The addresses are kept by client identifier, which is
+// derived from the pod's namespace and name rather than the container.
+const defaultStableIPRetention = 24 * time.Hour
+
+// stableAddressesPath returns the path of the addresses next to the lease
+// file.
+func stableAddressesPath(leaseFile string) string {
+	return leaseFile + ".addresses"
+}
+
+type stableAddress struct {
+	IP net.IP `json:"ip"`
+	// zero while the address is leased
+	Released time.Time `json:"released,omitempty"`
+}
+
+// stableAddresses remembers the addresses of stableIP leases for retention
+// after they are released. A nil stableAddresses remembers nothing.
+type stableAddresses struct {
+	mux       sync.Mutex
+	path      string
+	retention time.Duration
+	entries   map[string]stableAddress
+}
+
+func loadStableAddresses(path string, retention time.Duration) *stableAddresses {
+	s := &stableAddresses{path: path, retention: retention, entries: map[string]stableAddress{}}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read stable addresses: %v", err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		log.Printf("Discarding unreadable stable addresses %s: %v", path, err)
+		s.entries = map[string]stableAddress{}
+	}
+	return s
+}
+
+// lookup returns the address last leased to clientIdentifier, nil if none
+// is remembered.
+func (s *stableAddresses) lookup(clientIdentifier []byte) net.IP {
+	if s == nil || clientIdentifier == nil {
+		return nil
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	entry, ok := s.entries[hex.EncodeToString(clientIdentifier)]
+	if !ok || s.expired(entry, time.Now()) {
+		return nil
+	}
+	return entry.IP
+}
+
+// leased records that ip is leased to clientIdentifier.
+func (s *stableAddresses) leased(clientIdentifier []byte, ip net.IP) {
+	s.set(clientIdentifier, stableAddress{IP: ip})
+}
+
+// released starts the retention of the address of clientIdentifier.
+func (s *stableAddresses) released(clientIdentifier []byte, ip net.IP) {
+	s.set(clientIdentifier, stableAddress{IP: ip, Released: time.Now()})
+}
+
+func (s *stableAddresses) set(clientIdentifier []byte, entry stableAddress) {
+	if s == nil || clientIdentifier == nil || entry.IP.To4() == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.entries[hex.EncodeToString(clientIdentifier)] = entry
+
+	now := time.Now()
+	for key, entry := range s.entries {
+		if s.expired(entry, now) {
+			delete(s.entries, key)
+		}
+	}
+	if err := s.save(); err != nil {
+		log.Printf("Failed to save stable addresses: %v", err)
+	}
+}
+
+func (s *stableAddresses) expired(entry stableAddress, now time.Time) bool {
+	return !entry.Released.IsZero() && now.Sub(entry.Released) > s.retention
+}
+
+func (s *stableAddresses) save() error {
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0644)
+}
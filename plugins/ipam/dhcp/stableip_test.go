@@ -0,0 +1,62 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStableAddresses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json.addresses")
+	s := loadStableAddresses(path, time.Hour)
+	pod := []byte("\x00pod")
+	ip := net.IPv4(192, 168, 1, 5).To4()
+
+	if got := s.lookup(pod); got != nil {
+		t.Errorf("got %v before any lease", got)
+	}
+	s.leased(pod, ip)
+	if got := s.lookup(pod); !got.Equal(ip) {
+		t.Errorf("got %v while leased, want %v", got, ip)
+	}
+	s.released(pod, ip)
+
+	// the addresses survive restarts
+	s = loadStableAddresses(path, time.Hour)
+	if got := s.lookup(pod); !got.Equal(ip) {
+		t.Errorf("got %v after reloading, want %v", got, ip)
+	}
+
+	// and are forgotten after the retention
+	s.entries[hex.EncodeToString(pod)] = stableAddress{IP: ip, Released: time.Now().Add(-2 * time.Hour)}
+	if got := s.lookup(pod); got != nil {
+		t.Errorf("got %v after the retention", got)
+	}
+	s.leased([]byte("\x00other"), net.IPv4(192, 168, 1, 6))
+	if len(s.entries) != 1 {
+		t.Errorf("got %d entries, the expired one wasn't dropped", len(s.entries))
+	}
+
+	// a nil stableAddresses remembers nothing
+	var none *stableAddresses
+	none.leased(pod, ip)
+	if got := none.lookup(pod); got != nil {
+		t.Errorf("got %v without stable addresses", got)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	leaseStoreFile       = "file"
+	leaseStoreKubernetes = "kubernetes"
+)
+
+// leaseStore persists the leases maintained by the daemon, so they can be
+// taken over after a restart.
+type leaseStore interface {
+	// load returns entries that can't be decoded zero, so that they are
+	// discarded along with the malformed ones.
+	load() ([]PersistedLeased, error)
+	save(leases []PersistedLeased) error
+	// check verifies that the store is writable
+	check() error
+}
+
+// fileLeaseStore keeps the leases in a node-local JSON file.
+type fileLeaseStore struct {
+	path string
+}
+
+func (s *fileLeaseStore) load() ([]PersistedLeased, error) {
+	file, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeLeases(file), nil
+}
+
+// decodeLeases decodes the entries of a lease file one by one, so that a
+// bad entry doesn't take the others along. A file cut short, e.g. by a
+// crash, loses the entries after the cut only.
+func decodeLeases(file []byte) []PersistedLeased {
+	dec := json.NewDecoder(bytes.NewReader(file))
+	tok, err := dec.Token()
+	switch {
+	case err == io.EOF || err == nil && tok == nil:
+		// empty, or null when saved without leases
+		return nil
+	case err != nil || tok != json.Delim('['):
+		// unreadable as a whole
+		return []PersistedLeased{{}}
+	}
+
+	var leases []PersistedLeased
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			leases = append(leases, PersistedLeased{})
+			break
+		}
+		var lease PersistedLeased
+		if err := json.Unmarshal(raw, &lease); err != nil {
+			lease = PersistedLeased{}
+		}
+		leases = append(leases, lease)
+	}
+	return leases
+}
+
+func (s *fileLeaseStore) save(leases []PersistedLeased) error {
+	b, err := json.Marshal(leases)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b, 0644)
+}
+
+// writeFileAtomic replaces the file at path with data, so that a crash never
+// leaves it truncated. The temporary file is a dotfile in the same directory.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *fileLeaseStore) check() error {
+	f, err := ioutil.TempFile(filepath.Dir(s.path), ".dhcp-health-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecodeLeases(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want []string
+	}{
+		{name: "empty", file: "", want: nil},
+		{name: "null", file: "null", want: nil},
+		{name: "valid", file: `[{"ClientID":"a"},{"ClientID":"b"}]`, want: []string{"a", "b"}},
+		{name: "bad entry", file: `[{"ClientID":"a"},{"ClientID":7},{"ClientID":"c"}]`, want: []string{"a", "", "c"}},
+		{name: "cut short", file: `[{"ClientID":"a"},{"ClientID":"b","Ack":"AAA`, want: []string{"a", ""}},
+		{name: "not a list", file: `{"ClientID":"a"}`, want: []string{""}},
+		{name: "garbage", file: "\x00\x00\x00", want: []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leases := decodeLeases([]byte(tt.file))
+			var got []string
+			for _, l := range leases {
+				got = append(got, l.ClientID)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got entries %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got entries %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "leases.json")
+	if err := ioutil.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil || string(data) != "new" {
+		t.Errorf("got %q, %v, want the new contents", data, err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("unexpected file mode: %v, %v", fi, err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("temporary file left behind: %d files", len(files))
+	}
+}
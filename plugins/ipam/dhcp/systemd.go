@@ -0,0 +1,58 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"time"
+
+	sddaemon "github.com/coreos/go-systemd/v22/daemon"
+)
+
+// notifyReady tells systemd that the daemon is serving requests. It is a
+// no-op when not running under systemd with Type=notify.
+func notifyReady() {
+	if _, err := sddaemon.SdNotify(false, sddaemon.SdNotifyReady); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+}
+
+// startWatchdog pings the systemd watchdog at half the configured interval,
+// as long as check succeeds. A check blocking on a hung daemon stops the
+// pings, so systemd restarts it. It is a no-op when WatchdogSec is not set.
+func startWatchdog(check func() error) {
+	interval, err := sddaemon.SdWatchdogEnabled(false)
+	if err != nil {
+		log.Printf("Failed to read systemd watchdog settings: %v", err)
+		return
+	}
+	if interval == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := check(); err != nil {
+				log.Printf("Skipping watchdog ping: %v", err)
+				continue
+			}
+			if _, err := sddaemon.SdNotify(false, sddaemon.SdNotifyWatchdog); err != nil {
+				log.Printf("Failed to ping systemd watchdog: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,297 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Transaction is a DHCP exchange, i.e. the messages sharing an XID.
+type Transaction struct {
+	XID       uint32
+	ClientID  string
+	Namespace string
+	Pod       string
+	Interface string
+	NetNS     string
+	Start     time.Time
+	Messages  []TransactionMessage
+}
+
+// TransactionMessage is a message sent or received in a transaction.
+type TransactionMessage struct {
+	// time since the start of the transaction
+	Elapsed time.Duration
+	Sent    bool
+	Type    string
+	// the source address of received messages
+	Source      string `json:",omitempty"`
+	ClientIP    string `json:",omitempty"`
+	YourIP      string `json:",omitempty"`
+	ServerID    string `json:",omitempty"`
+	RequestedIP string `json:",omitempty"`
+	LeaseTime   uint32 `json:",omitempty"`
+}
+
+// transactionLog is a ring of the last transactions.
+type transactionLog struct {
+	mux sync.Mutex
+	// 0 disables tracing
+	size int
+	// oldest first
+	transactions []*Transaction
+}
+
+func newTransactionLog(size int) *transactionLog {
+	return &transactionLog{size: size}
+}
+
+// record adds the packet to the transaction of its XID, starting a new one
+// for sent packets. Received packets of unknown transactions, e.g. replies
+// to other clients, are dropped.
+func (t *transactionLog) record(l *DHCPLease, pkt []byte, sent bool, source net.IP) {
+	msg, err := dhcpv4.FromBytes(pkt)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	xid := binary.BigEndian.Uint32(msg.TransactionID[:])
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.size == 0 {
+		return
+	}
+
+	var tx *Transaction
+	for i := len(t.transactions) - 1; i >= 0; i-- {
+		if t.transactions[i].XID == xid && t.transactions[i].ClientID == l.clientID {
+			tx = t.transactions[i]
+			break
+		}
+	}
+	if tx == nil {
+		if !sent {
+			return
+		}
+		tx = &Transaction{
+			XID:       xid,
+			ClientID:  l.clientID,
+			Namespace: l.k8sNamespace,
+			Pod:       l.k8sPodName,
+			Interface: l.linkName(),
+			NetNS:     l.netNs,
+			Start:     now,
+		}
+		if len(t.transactions) >= t.size {
+			t.transactions = t.transactions[len(t.transactions)-t.size+1:]
+		}
+		t.transactions = append(t.transactions, tx)
+	}
+
+	m := describePacket(msg, sent, source)
+	m.Elapsed = now.Sub(tx.Start)
+	tx.Messages = append(tx.Messages, m)
+
+	direction := "received from " + m.Source
+	if sent {
+		direction = "sent"
+	}
+	log.Printf("%v: xid %08x on %v in %v: %s %s (+%v) yiaddr=%s server=%s requested=%s lease=%ds",
+		tx.ClientID, xid, tx.Interface, tx.NetNS, direction, m.Type, m.Elapsed,
+		m.YourIP, m.ServerID, m.RequestedIP, m.LeaseTime)
+}
+
+// resize changes the number of transactions retained, dropping the oldest
+// ones if there are too many.
+func (t *transactionLog) resize(size int) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.size = size
+	if len(t.transactions) > size {
+		t.transactions = t.transactions[len(t.transactions)-size:]
+	}
+}
+
+func (t *transactionLog) enabled() bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.size > 0
+}
+
+// list returns copies of the transactions of leases matching target, or all
+// transactions if target is empty, oldest first.
+func (t *transactionLog) list(target string) []Transaction {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	list := []Transaction{}
+	for _, tx := range t.transactions {
+		info := LeaseInfo{ClientID: tx.ClientID, Namespace: tx.Namespace, Pod: tx.Pod}
+		if target != "" && !leaseMatches(info, target) {
+			continue
+		}
+		c := *tx
+		c.Messages = append([]TransactionMessage(nil), tx.Messages...)
+		list = append(list, c)
+	}
+	return list
+}
+
+func describePacket(pkt *dhcpv4.DHCPv4, sent bool, source net.IP) TransactionMessage {
+	opts := pkt.Options
+	msg := TransactionMessage{Sent: sent, Type: messageTypeName(opts)}
+	if !sent && source != nil {
+		msg.Source = source.String()
+	}
+	if ip := pkt.ClientIPAddr; !ip.IsUnspecified() {
+		msg.ClientIP = ip.String()
+	}
+	if ip := pkt.YourIPAddr; !ip.IsUnspecified() {
+		msg.YourIP = ip.String()
+	}
+	if ip := opts.Get(dhcpv4.OptionServerIdentifier); len(ip) == 4 {
+		msg.ServerID = net.IP(ip).String()
+	}
+	if ip := opts.Get(dhcpv4.OptionRequestedIPAddress); len(ip) == 4 {
+		msg.RequestedIP = net.IP(ip).String()
+	}
+	if t := opts.Get(dhcpv4.OptionIPAddressLeaseTime); len(t) == 4 {
+		msg.LeaseTime = binary.BigEndian.Uint32(t)
+	}
+	return msg
+}
+
+var messageTypeNames = map[dhcpv4.MessageType]string{
+	dhcpv4.MessageTypeDiscover: "DISCOVER",
+	dhcpv4.MessageTypeOffer:    "OFFER",
+	dhcpv4.MessageTypeRequest:  "REQUEST",
+	dhcpv4.MessageTypeDecline:  "DECLINE",
+	dhcpv4.MessageTypeAck:      "ACK",
+	dhcpv4.MessageTypeNak:      "NAK",
+	dhcpv4.MessageTypeRelease:  "RELEASE",
+	dhcpv4.MessageTypeInform:   "INFORM",
+}
+
+func messageTypeName(opts dhcpv4.Options) string {
+	t := opts.Get(dhcpv4.OptionDHCPMessageType)
+	if len(t) != 1 {
+		return "BOOTP"
+	}
+	if name, ok := messageTypeNames[dhcpv4.MessageType(t[0])]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", t[0])
+}
+
+// traceConn records the packets of a lease's connection in its trace.
+type traceConn struct {
+	dhcpConn
+	lease *DHCPLease
+}
+
+func (c *traceConn) Write(pkt []byte) error {
+	c.lease.env.trace.record(c.lease, pkt, true, nil)
+	return c.dhcpConn.Write(pkt)
+}
+
+func (c *traceConn) ReadFrom() ([]byte, net.IP, error) {
+	pkt, source, err := c.dhcpConn.ReadFrom()
+	if err == nil {
+		c.lease.env.trace.record(c.lease, pkt, false, source)
+	}
+	return pkt, source, err
+}
+
+// ListTransactions returns the traced transactions of leases matching
+// target, or all of them if target is empty.
+func (d *DHCP) ListTransactions(target string, reply *[]Transaction) error {
+	trace := d.env.trace
+	if trace == nil || !trace.enabled() {
+		return fmt.Errorf("transaction tracing is disabled, start the daemon with -trace-transactions")
+	}
+	*reply = trace.list(target)
+	return nil
+}
+
+// transactionsCommand implements "dhcp transactions [<[namespace/]pod|clientID>]".
+func transactionsCommand(args []string) error {
+	var socketPath string
+	flags := flag.NewFlagSet("transactions", flag.ExitOnError)
+	flags.StringVar(&socketPath, "socketpath", defaultSocketPath, "dhcp daemon socket path")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s transactions [-socketpath path] [<[namespace/]pod|clientID>]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	client, err := rpc.DialHTTP("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("error dialing DHCP daemon: %v", err)
+	}
+	defer client.Close()
+
+	var transactions []Transaction
+	if err := client.Call("DHCP.ListTransactions", flags.Arg(0), &transactions); err != nil {
+		return fmt.Errorf("error calling DHCP.ListTransactions: %v", err)
+	}
+	for i, tx := range transactions {
+		if i > 0 {
+			fmt.Println()
+		}
+		printTransaction(os.Stdout, tx)
+	}
+	return nil
+}
+
+func printTransaction(out io.Writer, tx Transaction) {
+	fmt.Fprintf(out, "xid %08x  %s  %s on %s in %s\n", tx.XID, tx.Start.Format(time.RFC3339Nano), tx.ClientID, tx.Interface, tx.NetNS)
+	for _, m := range tx.Messages {
+		direction := "<- " + m.Source
+		if m.Sent {
+			direction = "->"
+		}
+		fmt.Fprintf(out, "  %10v  %s %s", m.Elapsed.Round(time.Microsecond), direction, m.Type)
+		for _, f := range []struct{ name, value string }{
+			{"ciaddr", m.ClientIP},
+			{"yiaddr", m.YourIP},
+			{"server", m.ServerID},
+			{"requested", m.RequestedIP},
+		} {
+			if f.value != "" {
+				fmt.Fprintf(out, " %s=%s", f.name, f.value)
+			}
+		}
+		if m.LeaseTime != 0 {
+			fmt.Fprintf(out, " lease=%ds", m.LeaseTime)
+		}
+		fmt.Fprintln(out)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func testPacket(op dhcpv4.OpcodeType, xid []byte, msgType dhcpv4.MessageType) *dhcpv4.DHCPv4 {
+	p, err := dhcpv4.New(dhcpv4.WithMessageType(msgType))
+	if err != nil {
+		panic(err)
+	}
+	p.OpCode = op
+	copy(p.TransactionID[:], xid)
+	return p
+}
+
+func TestTransactionLog(t *testing.T) {
+	trace := newTransactionLog(2)
+	l := &DHCPLease{clientID: "c1", k8sNamespace: "ns", k8sPodName: "pod", interfaceName: "eth0", netNs: "/var/run/netns/a"}
+	server := net.ParseIP("10.0.0.1").To4()
+
+	discover := testPacket(dhcpv4.OpcodeBootRequest, []byte{0, 0, 0, 1}, dhcpv4.MessageTypeDiscover)
+	trace.record(l, discover.ToBytes(), true, nil)
+	offer := testPacket(dhcpv4.OpcodeBootReply, []byte{0, 0, 0, 1}, dhcpv4.MessageTypeOffer)
+	offer.YourIPAddr = net.ParseIP("10.0.0.5").To4()
+	offer.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionServerIdentifier, server))
+	offer.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionIPAddressLeaseTime, []byte{0, 0, 0x0e, 0x10}))
+	trace.record(l, offer.ToBytes(), false, server)
+	// replies to other transactions are not recorded
+	trace.record(l, testPacket(dhcpv4.OpcodeBootReply, []byte{0, 0, 0, 9}, dhcpv4.MessageTypeOffer).ToBytes(), false, server)
+
+	txs := trace.list("ns/pod")
+	if len(txs) != 1 {
+		t.Fatalf("got %d transactions, want 1", len(txs))
+	}
+	tx := txs[0]
+	if tx.XID != 1 || tx.Interface != "eth0" || tx.NetNS != "/var/run/netns/a" || len(tx.Messages) != 2 {
+		t.Fatalf("unexpected transaction %+v", tx)
+	}
+	if m := tx.Messages[0]; !m.Sent || m.Type != "DISCOVER" {
+		t.Errorf("unexpected first message %+v", m)
+	}
+	want := TransactionMessage{Elapsed: tx.Messages[1].Elapsed, Type: "OFFER", Source: "10.0.0.1", YourIP: "10.0.0.5", ServerID: "10.0.0.1", LeaseTime: 3600}
+	if m := tx.Messages[1]; m != want {
+		t.Errorf("got second message %+v, want %+v", m, want)
+	}
+	if txs := trace.list("other"); len(txs) != 0 {
+		t.Errorf("got %d transactions for another pod, want 0", len(txs))
+	}
+
+	// the oldest transaction is dropped when the log is full
+	trace.record(l, testPacket(dhcpv4.OpcodeBootRequest, []byte{0, 0, 0, 2}, dhcpv4.MessageTypeRequest).ToBytes(), true, nil)
+	trace.record(l, testPacket(dhcpv4.OpcodeBootRequest, []byte{0, 0, 0, 3}, dhcpv4.MessageTypeRequest).ToBytes(), true, nil)
+	txs = trace.list("")
+	if len(txs) != 2 || txs[0].XID != 2 || txs[1].XID != 3 {
+		t.Errorf("unexpected transactions after rotation %+v", txs)
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// a packet socket like the one of nclient4, receiving every IPv4 packet
+	// of the link
+	clientSocketPacket = "packet"
+	// the same packet socket with a BPF filter only passing UDP datagrams
+	// to the client port, so replies aren't lost among other traffic
+	clientSocketFiltered = "filtered"
+)
+
+func parseClientSocket(socket string) (string, error) {
+	switch socket {
+	case "", clientSocketPacket:
+		return clientSocketPacket, nil
+	case clientSocketFiltered:
+		return clientSocketFiltered, nil
+	default:
+		return "", fmt.Errorf("unknown clientSocket %q", socket)
+	}
+}
+
+// dhcpReplyFilter passes unfragmented UDP datagrams to the client port. The
+// packets start with the IPv4 header, as the socket is SOCK_DGRAM.
+var dhcpReplyFilter = []bpf.Instruction{
+	// protocol
+	bpf.LoadAbsolute{Off: 9, Size: 1},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_UDP, SkipFalse: 6},
+	// fragment offset
+	bpf.LoadAbsolute{Off: 6, Size: 2},
+	bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
+	// destination port following the header of variable length
+	bpf.LoadMemShift{Off: 0},
+	bpf.LoadIndirect{Off: 2, Size: 2},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: nclient4.ClientPort, SkipFalse: 1},
+	bpf.RetConstant{Val: maxReplyLen},
+	bpf.RetConstant{Val: 0},
+}
+
+// Replies may carry more options than fit in the minimum message size, so
+// read up to a full ethernet frame.
+const maxReplyLen = 1500
+
+// packetConn adapts a net.PacketConn, such as the sockets of nclient4, to
+// dhcpConn. Messages are sent to remote.
+type packetConn struct {
+	net.PacketConn
+	remote *net.UDPAddr
+}
+
+// newUDPConn returns a connection sending from local to the server port of
+// server, for messages that are unicast or relayed.
+func newUDPConn(local net.UDPAddr, server net.IP, marking packetMarking) (*packetConn, error) {
+	sock, err := net.ListenUDP("udp4", &local)
+	if err != nil {
+		return nil, err
+	}
+	if err := marking.applyTo(sock); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return &packetConn{
+		PacketConn: sock,
+		remote:     &net.UDPAddr{IP: server, Port: nclient4.ServerPort},
+	}, nil
+}
+
+// newLinkConn returns a connection broadcasting on the link from the DHCP
+// client port. It only returns UDP datagrams sent to the client port, with
+// any ethernet padding removed.
+func newLinkConn(link netlink.Link, socket string, marking packetMarking) (*packetConn, error) {
+	var filter []bpf.RawInstruction
+	if socket == clientSocketFiltered {
+		var err error
+		if filter, err = bpf.Assemble(dhcpReplyFilter); err != nil {
+			return nil, err
+		}
+	}
+	sock, err := listenLinkSocket(link.Attrs().Index, filter, marking)
+	if err != nil {
+		return nil, err
+	}
+	return &packetConn{
+		PacketConn: nclient4.NewBroadcastUDPConn(sock, &net.UDPAddr{Port: nclient4.ClientPort}),
+		remote:     &net.UDPAddr{IP: net.IPv4bcast, Port: nclient4.ServerPort},
+	}, nil
+}
+
+// linkSocket is the SOCK_DGRAM packet socket for IPv4 of nclient4, opened
+// here so that the filter and marking can be set on it. It sends every
+// packet to the broadcast address of the link.
+type linkSocket struct {
+	f       *os.File
+	rc      syscall.RawConn
+	ifindex int
+	marking packetMarking
+}
+
+// ethPIPBigEndian is ETH_P_IP in network byte order, as used in sockaddr_ll.
+const ethPIPBigEndian = unix.ETH_P_IP>>8 | (unix.ETH_P_IP&0xff)<<8
+
+func listenLinkSocket(ifindex int, filter []bpf.RawInstruction, marking packetMarking) (*linkSocket, error) {
+	// no protocol until bound, so that nothing is queued before the filter
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := setupLinkSocket(fd, ifindex, filter, marking); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	f := os.NewFile(uintptr(fd), "dhcp-link-socket")
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &linkSocket{f: f, rc: rc, ifindex: ifindex, marking: marking}, nil
+}
+
+func setupLinkSocket(fd, ifindex int, filter []bpf.RawInstruction, marking packetMarking) error {
+	if len(filter) > 0 {
+		prog := make([]unix.SockFilter, len(filter))
+		for i, ins := range filter {
+			prog[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+		}
+		err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER,
+			&unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]})
+		if err != nil {
+			return fmt.Errorf("failed to attach the reply filter: %v", err)
+		}
+	}
+	if err := marking.setPriority(fd); err != nil {
+		return fmt.Errorf("failed to set the socket priority: %v", err)
+	}
+	return unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: ethPIPBigEndian, Ifindex: ifindex})
+}
+
+// ReadFrom returns the next IPv4 packet. Its address is not used by
+// nclient4, which takes the source from the IP header.
+func (s *linkSocket) ReadFrom(b []byte) (int, net.Addr, error) {
+	var n int
+	var readErr error
+	err := s.rc.Read(func(fd uintptr) bool {
+		n, _, readErr = unix.Recvfrom(int(fd), b, 0)
+		return readErr != unix.EAGAIN
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, nil, nil
+}
+
+func (s *linkSocket) WriteTo(b []byte, _ net.Addr) (int, error) {
+	s.marking.setTOS(b)
+	to := &unix.SockaddrLinklayer{
+		Protocol: ethPIPBigEndian,
+		Ifindex:  s.ifindex,
+		Halen:    6,
+		Addr:     [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	var writeErr error
+	err := s.rc.Write(func(fd uintptr) bool {
+		writeErr = unix.Sendto(int(fd), b, 0, to)
+		return writeErr != unix.EAGAIN
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (s *linkSocket) Close() error {
+	return s.f.Close()
+}
+
+func (s *linkSocket) LocalAddr() net.Addr {
+	return nil
+}
+
+func (s *linkSocket) SetDeadline(t time.Time) error {
+	return s.f.SetDeadline(t)
+}
+
+func (s *linkSocket) SetReadDeadline(t time.Time) error {
+	return s.f.SetReadDeadline(t)
+}
+
+func (s *linkSocket) SetWriteDeadline(t time.Time) error {
+	return s.f.SetWriteDeadline(t)
+}
+
+func (c *packetConn) Write(packet []byte) error {
+	_, err := c.PacketConn.WriteTo(packet, c.remote)
+	return err
+}
+
+func (c *packetConn) ReadFrom() ([]byte, net.IP, error) {
+	buf := make([]byte, maxReplyLen)
+	n, addr, err := c.PacketConn.ReadFrom(buf)
+	if err != nil {
+		// DhcpReceive recognizes timeouts by EAGAIN
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil, nil, syscall.EAGAIN
+		}
+		return nil, nil, err
+	}
+
+	var source net.IP
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		source = udpAddr.IP
+	}
+	return buf[:n], source, nil
+}
+
+func (c *packetConn) SetReadTimeout(t time.Duration) error {
+	return c.PacketConn.SetReadDeadline(time.Now().Add(t))
+}
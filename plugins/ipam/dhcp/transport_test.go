@@ -0,0 +1,109 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestPacketConn(t *testing.T) {
+	udp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &packetConn{PacketConn: udp, remote: udp.LocalAddr().(*net.UDPAddr)}
+	defer conn.Close()
+
+	msg := []byte("dhcp message")
+	if err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetReadTimeout(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	pkt, source, err := conn.ReadFrom()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pkt, msg) || !source.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("read %q from %v, want %q from 127.0.0.1", pkt, source, msg)
+	}
+
+	// timeouts are reported the way dhcp4client expects them
+	if err := conn.SetReadTimeout(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadFrom(); err != syscall.EAGAIN {
+		t.Errorf("read with timeout returned %v, want EAGAIN", err)
+	}
+}
+
+func TestDHCPReplyFilter(t *testing.T) {
+	vm, err := bpf.NewVM(dhcpReplyFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// IPv4 header of the given length followed by a UDP header
+	packet := func(ihl int, proto byte, fragment uint16, dstPort uint16) []byte {
+		pkt := make([]byte, ihl*4+8+240)
+		pkt[0] = 0x40 | byte(ihl)
+		pkt[6], pkt[7] = byte(fragment>>8), byte(fragment)
+		pkt[9] = proto
+		pkt[ihl*4+2], pkt[ihl*4+3] = byte(dstPort>>8), byte(dstPort)
+		return pkt
+	}
+
+	for _, tc := range []struct {
+		name string
+		pkt  []byte
+		pass bool
+	}{
+		{"reply", packet(5, 17, 0, 68), true},
+		{"reply with IP options", packet(6, 17, 0x4000, 68), true},
+		{"other port", packet(5, 17, 0, 53), false},
+		{"TCP", packet(5, 6, 0, 68), false},
+		{"fragment", packet(5, 17, 0x0010, 68), false},
+	} {
+		n, err := vm.Run(tc.pkt)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if (n > 0) != tc.pass {
+			t.Errorf("%s: filter returned %d, want pass %v", tc.name, n, tc.pass)
+		}
+	}
+}
+
+func TestParseClientSocket(t *testing.T) {
+	for socket, want := range map[string]string{
+		"":         clientSocketPacket,
+		"packet":   clientSocketPacket,
+		"filtered": clientSocketFiltered,
+	} {
+		if got, err := parseClientSocket(socket); err != nil || got != want {
+			t.Errorf("parseClientSocket(%q) = %q, %v, want %q", socket, got, err, want)
+		}
+	}
+	if _, err := parseClientSocket("raw"); err == nil {
+		t.Errorf("parseClientSocket() accepted an unknown socket")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// maximum length of an interface name, IFNAMSIZ without the terminating NUL
+const maxIfNameLen = 15
+
+// vlanLinkName returns the name of the interface the exchange happens on:
+// the 802.1Q subinterface of parent for vlan, or parent without a VLAN.
+func vlanLinkName(parent string, vlan int) string {
+	if vlan == 0 {
+		return parent
+	}
+	return fmt.Sprintf("%s.%d", parent, vlan)
+}
+
+func validateVLAN(parent string, vlan int) error {
+	if vlan < 0 || vlan > 4094 {
+		return fmt.Errorf("invalid vlan %d", vlan)
+	}
+	if name := vlanLinkName(parent, vlan); len(name) > maxIfNameLen {
+		return fmt.Errorf("VLAN interface name %q is too long", name)
+	}
+	return nil
+}
+
+// ensureVLANLink sets up the subinterface of parent for vlan, creating it
+// unless it exists, and returns whether it was created. The parent is set
+// up too, since main plugins usually do that only after IPAM. It must be
+// called in the container's namespace.
+func ensureVLANLink(parent string, vlan int) (bool, error) {
+	p, err := netlink.LinkByName(parent)
+	if err != nil {
+		return false, fmt.Errorf("error looking up %q: %v", parent, err)
+	}
+	if err := netlink.LinkSetUp(p); err != nil {
+		return false, fmt.Errorf("failed to set %q up: %v", parent, err)
+	}
+
+	name := vlanLinkName(parent, vlan)
+	created := false
+	link, err := netlink.LinkByName(name)
+	if err == nil {
+		if v, ok := link.(*netlink.Vlan); !ok || v.VlanId != vlan || v.ParentIndex != p.Attrs().Index {
+			return false, fmt.Errorf("%q exists and is not VLAN %d of %q", name, vlan, parent)
+		}
+	} else {
+		link = &netlink.Vlan{
+			LinkAttrs: netlink.LinkAttrs{Name: name, ParentIndex: p.Attrs().Index, MTU: p.Attrs().MTU},
+			VlanId:    vlan,
+		}
+		if err := netlink.LinkAdd(link); err != nil {
+			return false, fmt.Errorf("failed to create %q: %v", name, err)
+		}
+		created = true
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return created, fmt.Errorf("failed to set %q up: %v", name, err)
+	}
+	return created, nil
+}
+
+// deleteVLANLink deletes the subinterface created for a lease. It must be
+// called in the container's namespace.
+func deleteVLANLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(link)
+}
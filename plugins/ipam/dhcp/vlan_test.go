@@ -0,0 +1,108 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestValidateVLAN(t *testing.T) {
+	tests := []struct {
+		parent  string
+		vlan    int
+		wantErr bool
+	}{
+		{parent: "eth0", vlan: 0},
+		{parent: "eth0", vlan: 100},
+		{parent: "eth0", vlan: 4094},
+		{parent: "eth0", vlan: 4095, wantErr: true},
+		{parent: "eth0", vlan: -1, wantErr: true},
+		{parent: "longname0", vlan: 100},
+		{parent: "longername0", vlan: 1000, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateVLAN(tt.parent, tt.vlan); (err != nil) != tt.wantErr {
+			t.Errorf("validateVLAN(%q, %d) = %v, want error %v", tt.parent, tt.vlan, err, tt.wantErr)
+		}
+	}
+	if name := vlanLinkName("eth0", 0); name != "eth0" {
+		t.Errorf("vlanLinkName() without VLAN = %q", name)
+	}
+}
+
+func TestEnsureVLANLink(t *testing.T) {
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Skipf("can't create a network namespace: %v", err)
+	}
+	defer netns.Close()
+
+	err = netns.Do(func(ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}, PeerName: "peer0"}); err != nil {
+			return err
+		}
+		parent, err := netlink.LinkByName("eth0")
+		if err != nil {
+			return err
+		}
+		probe := &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: "probe", ParentIndex: parent.Attrs().Index}, VlanId: 1}
+		if err := netlink.LinkAdd(probe); err == unix.EOPNOTSUPP {
+			t.Skip("the kernel doesn't support VLANs")
+		} else if err == nil {
+			netlink.LinkDel(probe)
+		}
+
+		created, err := ensureVLANLink("eth0", 100)
+		if err != nil || !created {
+			t.Fatalf("ensureVLANLink() = %v, %v, want the link created", created, err)
+		}
+		link, err := netlink.LinkByName("eth0.100")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, ok := link.(*netlink.Vlan); !ok || v.VlanId != 100 {
+			t.Errorf("eth0.100 is %+v, want VLAN 100", link)
+		}
+
+		// an existing subinterface is used
+		if created, err := ensureVLANLink("eth0", 100); err != nil || created {
+			t.Errorf("ensureVLANLink() again = %v, %v, want the link reused", created, err)
+		}
+
+		// but not another interface with its name
+		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth0.200"}, PeerName: "peer1"}); err != nil {
+			return err
+		}
+		if _, err := ensureVLANLink("eth0", 200); err == nil {
+			t.Errorf("ensureVLANLink() used a veth")
+		}
+
+		if err := deleteVLANLink("eth0.100"); err != nil {
+			t.Errorf("deleteVLANLink() = %v", err)
+		}
+		if err := deleteVLANLink("eth0.100"); err != nil {
+			t.Errorf("deleteVLANLink() of a deleted link = %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
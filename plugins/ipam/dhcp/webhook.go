@@ -0,0 +1,128 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	leaseEventAcquired  = "acquired"
+	leaseEventRenewed   = "renewed"
+	leaseEventRebinding = "rebinding"
+	leaseEventExpired   = "expired"
+	leaseEventReleased  = "released"
+)
+
+const (
+	webhookTimeout   = 10 * time.Second
+	webhookQueueSize = 256
+)
+
+// LeaseEvent is the body POSTed to the event webhook.
+type LeaseEvent struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	ClientID  string    `json:"clientID"`
+	Namespace string    `json:"namespace,omitempty"`
+	Pod       string    `json:"pod,omitempty"`
+	Interface string    `json:"interface,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Server    string    `json:"server,omitempty"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// eventWebhook delivers lease events in the background, so that a slow
+// endpoint never delays lease maintenance.
+type eventWebhook struct {
+	url    string
+	client *http.Client
+	events chan LeaseEvent
+}
+
+func newEventWebhook(url string) *eventWebhook {
+	w := &eventWebhook{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+		events: make(chan LeaseEvent, webhookQueueSize),
+	}
+	go w.run()
+	return w
+}
+
+func (w *eventWebhook) notify(ev LeaseEvent) {
+	if w == nil {
+		return
+	}
+	select {
+	case w.events <- ev:
+	default:
+		log.Printf("%v: event queue full, dropping %s event", ev.ClientID, ev.Event)
+	}
+}
+
+func (w *eventWebhook) run() {
+	for ev := range w.events {
+		if err := w.post(ev); err != nil {
+			log.Printf("%v: failed to deliver %s event: %v", ev.ClientID, ev.Event, err)
+		}
+	}
+}
+
+func (w *eventWebhook) post(ev LeaseEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// notify sends an event about the lease to the webhook, if one is configured.
+// New expiry times are also written to the pod's annotations.
+func (l *DHCPLease) notify(event string) {
+	if event == leaseEventAcquired || event == leaseEventRenewed {
+		l.env.annotations.annotate(l.info())
+	}
+	if l.env.webhook == nil {
+		return
+	}
+
+	info := l.info()
+	ev := LeaseEvent{
+		Event:     event,
+		Time:      time.Now(),
+		ClientID:  info.ClientID,
+		Namespace: info.Namespace,
+		Pod:       info.Pod,
+		Interface: info.Interface,
+		IP:        info.IP,
+		Server:    info.Server,
+		Expiry:    info.ExpireTime,
+	}
+	l.env.webhook.notify(ev)
+}
@@ -0,0 +1,47 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEventWebhook(t *testing.T) {
+	received := make(chan LeaseEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev LeaseEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("failed to decode event: %v", err)
+		}
+		received <- ev
+	}))
+	defer srv.Close()
+
+	w := newEventWebhook(srv.URL)
+	w.notify(LeaseEvent{Event: leaseEventAcquired, ClientID: "client", Namespace: "ns", Pod: "pod", IP: "10.0.0.5"})
+
+	select {
+	case ev := <-received:
+		if ev.Event != leaseEventAcquired || ev.Pod != "pod" || ev.IP != "10.0.0.5" {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+}
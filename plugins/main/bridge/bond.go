@@ -0,0 +1,271 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	defaultBondName = "cnibond0"
+	// link monitoring frequency of the bond, in milliseconds
+	bondMiimon = 100
+)
+
+// bondModes are the modes an uplink bond can be created in. Both work
+// without configuring the switch for balancing, 802.3ad needs LACP on it.
+var bondModes = map[string]netlink.BondMode{
+	"active-backup": netlink.BOND_MODE_ACTIVE_BACKUP,
+	"802.3ad":       netlink.BOND_MODE_802_3AD,
+}
+
+// findMatchingInterfaces returns all the interfaces whose name matches
+// ifaceName, but for the bridge and bond the plugin manages and the ports of
+// the bridge, such as the host side of the container veths.
+func findMatchingInterfaces(ifaceName, brName, bondName string) ([]netlink.Link, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %v", err)
+	}
+	r, err := regexp.Compile(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uplink interface regex: %v", err)
+	}
+
+	brIndex := 0
+	for _, l := range links {
+		if l.Attrs().Name == brName {
+			brIndex = l.Attrs().Index
+		}
+	}
+
+	var matches []netlink.Link
+	for _, l := range links {
+		name := l.Attrs().Name
+		if name == brName || name == bondName || (brIndex != 0 && l.Attrs().MasterIndex == brIndex) {
+			continue
+		}
+		if r.MatchString(name) {
+			matches = append(matches, l)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("couldn't find any interfaces matching '%s'", ifaceName)
+	}
+	return matches, nil
+}
+
+// ensureBond creates the bond named bondName in the given mode if it doesn't
+// exist, and enslaves the members not yet in it. When the bond is created,
+// the addresses and routes of the active member move to it, for ensureBridge
+// to move them on to the bridge. A bond it creates is recorded on undo, with
+// what to give back to the members.
+func ensureBond(bondName, mode string, members []netlink.Link, undo *undoStack) (*netlink.Bond, error) {
+	l, err := netlink.LinkByName(bondName)
+	if err == nil {
+		bond, ok := l.(*netlink.Bond)
+		if !ok {
+			return nil, fmt.Errorf("%q already exists but is not a bond", bondName)
+		}
+		if bond.Mode != bondModes[mode] {
+			return nil, fmt.Errorf("bond %q is in mode %s, not %s", bondName, bond.Mode, mode)
+		}
+		return bond, enslaveBondMembers(bond, members)
+	}
+	if _, ok := err.(netlink.LinkNotFoundError); !ok {
+		return nil, fmt.Errorf("failed to look up %q: %v", bondName, err)
+	}
+
+	for _, m := range members {
+		if m.Attrs().MasterIndex != 0 {
+			return nil, fmt.Errorf("interface %s has already a master set", m.Attrs().Name)
+		}
+	}
+
+	// the first member with an address is the one the host is reachable
+	// through, enslaving it first makes it the active one
+	var addrs []netlink.Addr
+	for i, m := range members {
+		if addrs, err = movableAddrs(m); err != nil {
+			return nil, fmt.Errorf("couldn't get addrs for interface '%s': %v", m.Attrs().Name, err)
+		}
+		if len(addrs) > 0 {
+			members[0], members[i] = members[i], members[0]
+			break
+		}
+	}
+	active := members[0]
+	// taking the member down drops its routes, they are saved first
+	routes, err := listRoutes(active)
+	if err != nil {
+		return nil, err
+	}
+
+	bond := netlink.NewLinkBond(netlink.LinkAttrs{Name: bondName, TxQLen: -1})
+	bond.Mode = bondModes[mode]
+	bond.Miimon = bondMiimon
+	if err := netlink.LinkAdd(bond); err != nil {
+		return nil, fmt.Errorf("could not add bond %q: %v", bondName, err)
+	}
+	undo.push("bond "+bondName, func() error {
+		return releaseBond(bondName, members, addrs)
+	})
+	// re-fetch the bond for its index
+	if l, err = netlink.LinkByName(bondName); err != nil {
+		return nil, fmt.Errorf("failed to look up %q: %v", bondName, err)
+	}
+	bond = l.(*netlink.Bond)
+
+	if err := enslaveBondMembers(bond, members); err != nil {
+		return nil, err
+	}
+	if err := netlink.LinkSetUp(bond); err != nil {
+		return nil, fmt.Errorf("failed to set %q up: %v", bondName, err)
+	}
+
+	for _, addr := range addrs {
+		newAddr := netlink.Addr{
+			IPNet:       addr.IPNet,
+			Scope:       addr.Scope,
+			PreferedLft: addr.PreferedLft,
+			ValidLft:    addr.ValidLft,
+		}
+		if err := netlink.AddrAdd(bond, &newAddr); err != nil && err != syscall.EEXIST {
+			return nil, fmt.Errorf("couldn't add IP address '%s' to bond '%s': %v", addr.IP, bondName, err)
+		}
+		// the IPv6 ones are gone already unless the kernel keeps them on down
+		if err := netlink.AddrDel(active, &addr); err != nil && err != syscall.EADDRNOTAVAIL {
+			return nil, fmt.Errorf("couldn't delete IP address '%s' from interface '%s': %v", addr.IP, active.Attrs().Name, err)
+		}
+	}
+
+	if err := addRoutes(bond, routes); err != nil {
+		return nil, fmt.Errorf("couldn't move route to bond: %v", err)
+	}
+	return bond, nil
+}
+
+// releaseBond deletes a bond created by ensureBond, giving the addresses and
+// routes back to the active member, the first one.
+func releaseBond(bondName string, members []netlink.Link, addrs []netlink.Addr) error {
+	bond, err := netlink.LinkByName(bondName)
+	if err != nil {
+		return fmt.Errorf("failed to look up %q: %v", bondName, err)
+	}
+	// the routes go away with the bond, they are saved first
+	routes, err := listRoutes(bond)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkDel(bond); err != nil {
+		return fmt.Errorf("failed to delete %q: %v", bondName, err)
+	}
+
+	for _, m := range members {
+		if err := netlink.LinkSetUp(m); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", m.Attrs().Name, err)
+		}
+	}
+	active := members[0]
+	for _, addr := range addrs {
+		newAddr := netlink.Addr{
+			IPNet:       addr.IPNet,
+			Scope:       addr.Scope,
+			PreferedLft: addr.PreferedLft,
+			ValidLft:    addr.ValidLft,
+		}
+		if err := netlink.AddrAdd(active, &newAddr); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("couldn't add IP address '%s' to interface '%s': %v", addr.IP, active.Attrs().Name, err)
+		}
+	}
+	if err := addRoutes(active, routes); err != nil {
+		return fmt.Errorf("couldn't move route back to '%s': %v", active.Attrs().Name, err)
+	}
+	return nil
+}
+
+// movableAddrs returns the addresses of the link that move along with it to
+// a bond or bridge: the IPv4 ones and the global IPv6 ones. The IPv6
+// link-local addresses belong to the link itself.
+func movableAddrs(link netlink.Link) ([]netlink.Addr, error) {
+	all, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get addrs for interface '%s': %v", link.Attrs().Name, err)
+	}
+	var addrs []netlink.Addr
+	for _, addr := range all {
+		if addr.IP.To4() != nil || addr.Scope == int(netlink.SCOPE_UNIVERSE) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// listRoutes returns the IPv4 and IPv6 routes of the link.
+func listRoutes(link netlink.Link) ([]netlink.Route, error) {
+	var routes []netlink.Route
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		r, err := netlink.RouteList(link, family)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get routes for interface '%s': %v", link.Attrs().Name, err)
+		}
+		routes = append(routes, r...)
+	}
+	return routes, nil
+}
+
+// addRoutes adds the routes to the link, the subnet routes of its addresses
+// being there already.
+func addRoutes(link netlink.Link, routes []netlink.Route) error {
+	sortRoutes(routes)
+	for _, route := range routes {
+		route.LinkIndex = link.Attrs().Index
+		route.Flags = settableRouteFlags(route.Flags)
+		if err := netlink.RouteAdd(&route); err != nil && err != syscall.EEXIST {
+			return err
+		}
+	}
+	return nil
+}
+
+// enslaveBondMembers adds the members that aren't in the bond yet, e.g. a
+// NIC plugged in since the bond was created.
+func enslaveBondMembers(bond *netlink.Bond, members []netlink.Link) error {
+	for _, m := range members {
+		name := m.Attrs().Name
+		switch m.Attrs().MasterIndex {
+		case bond.Index:
+			continue
+		case 0:
+		default:
+			return fmt.Errorf("interface %s has already a master set", name)
+		}
+		// the bonding driver only enslaves interfaces that are down
+		if err := netlink.LinkSetDown(m); err != nil {
+			return fmt.Errorf("failed to set %q down: %v", name, err)
+		}
+		if err := netlink.LinkSetMaster(m, bond); err != nil {
+			return fmt.Errorf("couldn't add interface '%s' to bond '%s': %v", name, bond.Name, err)
+		}
+		if err := netlink.LinkSetUp(m); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", name, err)
+		}
+	}
+	return nil
+}
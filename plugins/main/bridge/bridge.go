@@ -23,11 +23,13 @@ import (
 	"regexp"
 	"runtime"
 	"sort"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/coreos/go-iptables/iptables"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -47,21 +49,68 @@ var debugPostIPAMError error
 
 const defaultBrName = "cni0"
 
+// In the uplink mode, the default, the bridge takes over a host interface
+// and its addressing, and the containers are routed through it. In the
+// standalone mode it is a plain cni0 like with the upstream bridge plugin.
+const (
+	bridgeModeUplink     = "uplink"
+	bridgeModeStandalone = "standalone"
+)
+
 type NetConf struct {
 	types.NetConf
+	Mode            string `json:"mode"`
 	BrName          string `json:"bridge"`
 	IsGW            bool   `json:"isGateway"`
 	IsDefaultGW     bool   `json:"isDefaultGateway"`
 	ForceAddress    bool   `json:"forceAddress"`
 	IPMasq          bool   `json:"ipMasq"`
 	MTU             int    `json:"mtu"`
+	TxQueueLen      int    `json:"txQueueLen"`
 	HairpinMode     bool   `json:"hairpinMode"`
 	PromiscMode     bool   `json:"promiscMode"`
 	Vlan            int    `json:"vlan"`
 	MacSpoofChk     bool   `json:"macspoofchk,omitempty"`
 	EnableDad       bool   `json:"enabledad,omitempty"`
 	UplinkInterface string `json:"uplinkInterface"`
-	EnableIPv6      bool   `json:"enableIPv6"`
+	// monitor interface the traffic of the network's containers is mirrored to
+	MirrorTo string `json:"mirrorTo"`
+	// set in the container, e.g. "net.ipv4.conf.IFNAME.rp_filter": "2"
+	// with IFNAME replaced by the container interface
+	Sysctls map[string]string `json:"sysctls"`
+	// the node answers ARP for the containers instead of pinning the
+	// gateway's neighbor in them
+	ProxyArp bool `json:"proxyArp"`
+	// tagged VLANs of the container ports, exclusive with vlan
+	VlanTrunk []*VlanTrunk `json:"vlanTrunk,omitempty"`
+	// bond all the interfaces matching uplinkInterface in this mode
+	BondMode       string `json:"bondMode"`
+	BondName       string `json:"bondName"`
+	EnableIPv6     bool   `json:"enableIPv6"`
+	STP            bool   `json:"stp"`
+	ForwardDelay   int    `json:"forwardDelay"`
+	BridgePriority *int   `json:"bridgePriority"`
+	// IGMP/MLD snooping, the kernel default when unset
+	MulticastSnooping *bool `json:"multicastSnooping"`
+	// the bridge queries for memberships, on by default for IPv6 so that
+	// the solicited-node groups NDP relies on are learned
+	MulticastQuerier *bool `json:"multicastQuerier"`
+	MLDVersion       int   `json:"mldVersion"`
+	// the snooped multicast always egresses through the uplink
+	UplinkMulticastRouter bool `json:"uplinkMulticastRouter"`
+	// seconds the bridge keeps learned MACs, the kernel default when unset
+	AgeingTime *int `json:"ageingTime"`
+	// pin the container MACs to their ports with static FDB entries
+	StaticFdb bool `json:"staticFdb"`
+	// times the container addresses are announced after ADD, 0 (the default) disables it
+	AnnounceCount *int `json:"announceCount"`
+	// "iptables" or "nftables", detected when empty. nftables fails if a forward chain of
+	// another table, e.g. firewalld's, drops by default.
+	FirewallBackend string `json:"firewallBackend"`
+	// "error", "info" or "debug", logging is off when unset
+	LogLevel string `json:"logLevel"`
+	// the log entries go to stderr unless a file is set
+	LogFile string `json:"logFile"`
 
 	Args struct {
 		Cni BridgeArgs `json:"cni,omitempty"`
@@ -70,7 +119,15 @@ type NetConf struct {
 		Mac string `json:"mac,omitempty"`
 	} `json:"runtimeConfig,omitempty"`
 
-	mac string
+	mac   string
+	vlans []int
+}
+
+// VlanTrunk is either a single VLAN ID or a range of them
+type VlanTrunk struct {
+	MinID *int `json:"minID,omitempty"`
+	MaxID *int `json:"maxID,omitempty"`
+	ID    *int `json:"id,omitempty"`
 }
 
 type BridgeArgs struct {
@@ -103,9 +160,93 @@ func loadNetConf(bytes []byte, envArgs string) (*NetConf, string, error) {
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
 	}
+	switch n.Mode {
+	case "":
+		n.Mode = bridgeModeUplink
+	case bridgeModeUplink:
+	case bridgeModeStandalone:
+		if n.UplinkInterface != "" || n.BondMode != "" || n.UplinkMulticastRouter || n.ProxyArp {
+			return nil, "", fmt.Errorf("uplinkInterface, bondMode, uplinkMulticastRouter and proxyArp require the uplink mode")
+		}
+	default:
+		return nil, "", fmt.Errorf("invalid mode %q (must be uplink or standalone)", n.Mode)
+	}
+	if n.MirrorTo != "" && n.MirrorTo == n.BrName {
+		return nil, "", fmt.Errorf("mirrorTo can't be the bridge")
+	}
+	if n.TxQueueLen < 0 {
+		return nil, "", fmt.Errorf("invalid txQueueLen %d", n.TxQueueLen)
+	}
 	if n.Vlan < 0 || n.Vlan > 4094 {
 		return nil, "", fmt.Errorf("invalid VLAN ID %d (must be between 0 and 4094)", n.Vlan)
 	}
+	vlans, err := collectVlanTrunk(n.VlanTrunk)
+	if err != nil {
+		return nil, "", err
+	}
+	n.vlans = vlans
+	// a container port is either an access port or a trunk
+	if n.Vlan != 0 && n.vlans != nil {
+		return nil, "", fmt.Errorf("cannot set vlan and vlanTrunk at the same time")
+	}
+	if (n.ForwardDelay != 0 || n.BridgePriority != nil) && !n.STP {
+		return nil, "", fmt.Errorf("forwardDelay and bridgePriority require stp")
+	}
+	if n.ForwardDelay != 0 && (n.ForwardDelay < 2 || n.ForwardDelay > 30) {
+		return nil, "", fmt.Errorf("invalid forwardDelay %d (must be between 2 and 30 seconds)", n.ForwardDelay)
+	}
+	if n.BridgePriority != nil && (*n.BridgePriority < 0 || *n.BridgePriority > 65535) {
+		return nil, "", fmt.Errorf("invalid bridgePriority %d (must be between 0 and 65535)", *n.BridgePriority)
+	}
+	if n.AgeingTime != nil && (*n.AgeingTime < 0 || *n.AgeingTime > 1000000) {
+		return nil, "", fmt.Errorf("invalid ageingTime %d (must be between 0 and 1000000 seconds)", *n.AgeingTime)
+	}
+	snoopingOff := n.MulticastSnooping != nil && !*n.MulticastSnooping
+	if n.MLDVersion != 0 {
+		if n.MLDVersion != 1 && n.MLDVersion != 2 {
+			return nil, "", fmt.Errorf("invalid mldVersion %d (must be 1 or 2)", n.MLDVersion)
+		}
+		if snoopingOff {
+			return nil, "", fmt.Errorf("mldVersion requires multicastSnooping")
+		}
+	}
+	for key := range n.Sysctls {
+		// the keys are turned into paths under /proc/sys
+		if !strings.HasPrefix(key, "net.") || strings.Contains(key, "/") {
+			return nil, "", fmt.Errorf("invalid net sysctl key: %q", key)
+		}
+	}
+	if n.AnnounceCount == nil {
+		announceCount := defaultAnnounceCount
+		n.AnnounceCount = &announceCount
+	} else if *n.AnnounceCount < 0 {
+		return nil, "", fmt.Errorf("invalid announceCount %d", *n.AnnounceCount)
+	}
+	if n.UplinkMulticastRouter && snoopingOff {
+		return nil, "", fmt.Errorf("uplinkMulticastRouter requires multicastSnooping")
+	}
+	if n.MulticastQuerier == nil && n.EnableIPv6 && !snoopingOff {
+		querier := true
+		n.MulticastQuerier = &querier
+	}
+	if n.BondMode != "" {
+		if _, ok := bondModes[n.BondMode]; !ok {
+			return nil, "", fmt.Errorf("invalid bondMode %q (must be active-backup or 802.3ad)", n.BondMode)
+		}
+		if n.BondName == "" {
+			n.BondName = defaultBondName
+		}
+	} else if n.BondName != "" {
+		return nil, "", fmt.Errorf("bondName requires bondMode")
+	}
+	if _, ok := logLevels[n.LogLevel]; n.LogLevel != "" && !ok {
+		return nil, "", fmt.Errorf("invalid logLevel %q (must be error, info or debug)", n.LogLevel)
+	}
+	switch n.FirewallBackend {
+	case "", firewallBackendIptables, firewallBackendNftables:
+	default:
+		return nil, "", fmt.Errorf("invalid firewallBackend %q (must be iptables or nftables)", n.FirewallBackend)
+	}
 
 	if envArgs != "" {
 		e := MacEnvArgs{}
@@ -129,10 +270,60 @@ func loadNetConf(bytes []byte, envArgs string) (*NetConf, string, error) {
 	return n, n.CNIVersion, nil
 }
 
+// collectVlanTrunk returns the sorted IDs of the trunk, each once.
+func collectVlanTrunk(vlanTrunk []*VlanTrunk) ([]int, error) {
+	if vlanTrunk == nil {
+		return nil, nil
+	}
+
+	vlanMap := make(map[int]struct{})
+	for _, item := range vlanTrunk {
+		var minID, maxID int
+		if item.MinID != nil {
+			minID = *item.MinID
+			if minID <= 0 || minID > 4094 {
+				return nil, fmt.Errorf("invalid vlanTrunk minID %d (must be between 1 and 4094)", minID)
+			}
+		}
+		if item.MaxID != nil {
+			maxID = *item.MaxID
+			if maxID <= 0 || maxID > 4094 {
+				return nil, fmt.Errorf("invalid vlanTrunk maxID %d (must be between 1 and 4094)", maxID)
+			}
+		}
+		if (item.MinID == nil) != (item.MaxID == nil) {
+			return nil, fmt.Errorf("vlanTrunk minID and maxID must be set together")
+		}
+		if item.MinID != nil {
+			if minID > maxID {
+				return nil, fmt.Errorf("vlanTrunk minID %d is greater than maxID %d", minID, maxID)
+			}
+			for v := minID; v <= maxID; v++ {
+				vlanMap[v] = struct{}{}
+			}
+		}
+
+		if item.ID != nil {
+			id := *item.ID
+			if id <= 0 || id > 4094 {
+				return nil, fmt.Errorf("invalid vlanTrunk id %d (must be between 1 and 4094)", id)
+			}
+			vlanMap[id] = struct{}{}
+		}
+	}
+
+	vlans := make([]int, 0, len(vlanMap))
+	for v := range vlanMap {
+		vlans = append(vlans, v)
+	}
+	sort.Ints(vlans)
+	return vlans, nil
+}
+
 // calcGateways processes the results from the IPAM plugin and does the
 // following for each IP family:
-//    - Calculates and compiles a list of gateway addresses
-//    - Adds a default route if needed
+//   - Calculates and compiles a list of gateway addresses
+//   - Adds a default route if needed
 func calcGateways(result *current.Result, n *NetConf) (*gwInfo, *gwInfo, error) {
 
 	gwsV4 := &gwInfo{}
@@ -196,7 +387,9 @@ func calcGateways(result *current.Result, n *NetConf) (*gwInfo, *gwInfo, error)
 	return gwsV4, gwsV6, nil
 }
 
-func ensureAddr(br netlink.Link, family int, ipn *net.IPNet, forceAddress bool) error {
+// ensureAddr adds ipn to the link, replacing a conflicting address if
+// forceAddress is set. Both are recorded on undo.
+func ensureAddr(br netlink.Link, family int, ipn *net.IPNet, forceAddress bool, undo *undoStack) error {
 	addrs, err := netlink.AddrList(br, family)
 	if err != nil && err != syscall.ENOENT {
 		return fmt.Errorf("could not get list of IP addresses: %v", err)
@@ -219,15 +412,24 @@ func ensureAddr(br netlink.Link, family int, ipn *net.IPNet, forceAddress bool)
 				if err = deleteAddr(br, a.IPNet); err != nil {
 					return err
 				}
+				old := a
+				undo.push("address "+old.IPNet.String()+" of "+br.Attrs().Name, func() error {
+					return netlink.AddrAdd(br, &netlink.Addr{IPNet: old.IPNet})
+				})
 			} else {
 				return fmt.Errorf("%q already has an IP address different from %v", br.Attrs().Name, ipnStr)
 			}
 		}
 	}
 
-	addr := &netlink.Addr{IPNet: ipn, Label: ""}
+	// ipn may be reused by the caller before the rollback
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: ipn.IP, Mask: ipn.Mask}, Label: ""}
 	if err := netlink.AddrAdd(br, addr); err != nil && err != syscall.EEXIST {
 		return fmt.Errorf("could not add IP address to %q: %v", br.Attrs().Name, err)
+	} else if err == nil {
+		undo.push("address "+ipnStr+" of "+br.Attrs().Name, func() error {
+			return netlink.AddrDel(br, addr)
+		})
 	}
 
 	// Set the bridge's MAC to itself. Otherwise, the bridge will take the
@@ -301,6 +503,37 @@ func copyAddress(from netlink.Link, to netlink.Link, family int) (bool, *netlink
 	return !foundAddr, &newAddr, nil
 }
 
+// copyIPv6Addresses adds the global IPv6 addresses of from to to, each one
+// added recorded on undo. They skip DAD, having been through it on from.
+func copyIPv6Addresses(from, to netlink.Link, undo *undoStack) error {
+	addrs, err := movableAddrs(from)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			continue
+		}
+		newAddr := &netlink.Addr{
+			IPNet:       addr.IPNet,
+			Flags:       unix.IFA_F_NODAD,
+			PreferedLft: addr.PreferedLft,
+			ValidLft:    addr.ValidLft,
+		}
+		err := netlink.AddrAdd(to, newAddr)
+		if err == syscall.EEXIST {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't add IP address '%s' to interface '%s': %v", addr.IP, to.Attrs().Name, err)
+		}
+		undo.push("address "+addr.IPNet.String()+" of "+to.Attrs().Name, func() error {
+			return netlink.AddrDel(to, newAddr)
+		})
+	}
+	return nil
+}
+
 func findMatchingInterface(ifaceName string) (netlink.Link, error) {
 	links, err := netlink.LinkList()
 	if err != nil {
@@ -323,11 +556,28 @@ func findMatchingInterface(ifaceName string) (netlink.Link, error) {
 	return nil, fmt.Errorf("couldn't find any matching interfaces '%s' (%s) in set: %s", ifaceName, r, set)
 }
 
-func ensureBridge(brName string, mtu int, promiscMode, vlanFiltering bool, uplinkLink netlink.Link, enableIPv6 bool) (*netlink.Bridge, error) {
+// bridgeConf holds the settings ensureBridge applies to the bridge, the
+// uplink being optional.
+type bridgeConf struct {
+	name          string
+	mtu           int
+	txQueueLen    int
+	promiscMode   bool
+	vlanFiltering bool
+	uplink        netlink.Link
+	enableIPv6    bool
+	stp           bool
+	forwardDelay  int
+	priority      *int
+	ageingTime    *int
+	mcast         multicastConf
+}
+
+func ensureBridge(c bridgeConf, undo *undoStack) (*netlink.Bridge, error) {
 	br := &netlink.Bridge{
 		LinkAttrs: netlink.LinkAttrs{
-			Name: brName,
-			MTU:  mtu,
+			Name: c.name,
+			MTU:  c.mtu,
 			// Let kernel use default txqueuelen; leaving it unset
 			// means 0, and a zero-length TX queue messes up FIFO
 			// traffic shapers which use TX queue length as the
@@ -335,35 +585,72 @@ func ensureBridge(brName string, mtu int, promiscMode, vlanFiltering bool, uplin
 			TxQLen: -1,
 		},
 	}
-	if vlanFiltering {
-		br.VlanFiltering = &vlanFiltering
+	if c.txQueueLen != 0 {
+		br.TxQLen = c.txQueueLen
+	}
+	if c.vlanFiltering {
+		br.VlanFiltering = &c.vlanFiltering
 	}
 
 	err := netlink.LinkAdd(br)
 	if err != nil && err != syscall.EEXIST {
-		return nil, fmt.Errorf("could not add %q: %v", brName, err)
+		return nil, fmt.Errorf("could not add %q: %v", c.name, err)
+	}
+	if err == nil {
+		undo.push("bridge "+c.name, func() error {
+			return ip.DelLinkByName(c.name)
+		})
 	}
 
-	if promiscMode {
+	if c.promiscMode {
 		if err := netlink.SetPromiscOn(br); err != nil {
-			return nil, fmt.Errorf("could not set promiscuous mode on %q: %v", brName, err)
+			return nil, fmt.Errorf("could not set promiscuous mode on %q: %v", c.name, err)
 		}
 	}
 
 	// Re-fetch link to read all attributes and if it already existed,
 	// ensure it's really a bridge with similar configuration
-	br, err = bridgeByName(brName)
+	br, err = bridgeByName(c.name)
 	if err != nil {
 		return nil, err
 	}
 
+	if c.txQueueLen != 0 && br.TxQLen != c.txQueueLen {
+		if err := netlink.LinkSetTxQLen(br, c.txQueueLen); err != nil {
+			return nil, fmt.Errorf("could not set txqueuelen of %q: %v", c.name, err)
+		}
+		oldQLen := br.TxQLen
+		undo.push("txqueuelen of "+c.name, func() error {
+			return netlink.LinkSetTxQLen(br, oldQLen)
+		})
+	}
+
+	// before the uplink is added, so a loop through another NIC is blocked
+	if c.stp {
+		if err := enableSTP(br, c.forwardDelay, c.priority); err != nil {
+			return nil, fmt.Errorf("could not enable STP on %q: %v", c.name, err)
+		}
+	}
+
+	if !c.mcast.isDefault() {
+		if err := setMulticast(br, c.mcast); err != nil {
+			return nil, fmt.Errorf("could not set multicast settings on %q: %v", c.name, err)
+		}
+	}
+
+	if c.ageingTime != nil {
+		if err := setAgeingTime(br, *c.ageingTime); err != nil {
+			return nil, fmt.Errorf("could not set ageing time on %q: %v", c.name, err)
+		}
+	}
+
 	// we want to own the routes for this interface
-	if enableIPv6 {
-		_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_ra", brName), "1")
+	if c.enableIPv6 {
+		_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_ra", c.name), "1")
 
-		_, err = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/forwarding", brName), "1")
+		_, err = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/forwarding", c.name), "1")
 		if err != nil {
-			return nil, fmt.Errorf("could not enable IPv6 routing on '%s': %v", brName, err)
+			return nil, fmt.Errorf("could not enable IPv6 routing on '%s': %v", c.name, err)
 		}
 	}
 
@@ -371,82 +658,158 @@ func ensureBridge(brName string, mtu int, promiscMode, vlanFiltering bool, uplin
 		return nil, err
 	}
 
-	uplinkName := uplinkLink.Attrs().Name
+	if c.uplink == nil {
+		return br, nil
+	}
+
+	uplinkName := c.uplink.Attrs().Name
 
-	var failed bool
-	applied, gwIp, err := copyAddress(uplinkLink, br, netlink.FAMILY_V4)
+	applied, gwIp, err := copyAddress(c.uplink, br, netlink.FAMILY_V4)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't copy IPv4 address to bridge: %v", err)
 	}
 	if applied {
-		defer func() {
-			if failed {
-				netlink.AddrDel(br, gwIp)
-			}
-		}()
+		undo.push("address "+gwIp.IPNet.String()+" of "+c.name, func() error {
+			return netlink.AddrDel(br, gwIp)
+		})
+	}
+	if err := copyIPv6Addresses(c.uplink, br, undo); err != nil {
+		return nil, fmt.Errorf("couldn't copy IPv6 addresses to bridge: %v", err)
 	}
 
 	// Add the uplink interface to the bridge if it isn't already there
-	if uplinkLink.Attrs().MasterIndex != br.Attrs().Index && uplinkLink.Attrs().MasterIndex != 0 {
-		master, err := netlink.LinkByIndex(uplinkLink.Attrs().MasterIndex)
+	if c.uplink.Attrs().MasterIndex != br.Attrs().Index && c.uplink.Attrs().MasterIndex != 0 {
+		master, err := netlink.LinkByIndex(c.uplink.Attrs().MasterIndex)
 		if err != nil {
-			failed = true
-			return nil, fmt.Errorf("interface %s has already a master set (actual=%d, desired=%d), could not retrieve the name: %v", uplinkName, uplinkLink.Attrs().MasterIndex, br.Attrs().Index, err)
+			return nil, fmt.Errorf("interface %s has already a master set (actual=%d, desired=%d), could not retrieve the name: %v", uplinkName, c.uplink.Attrs().MasterIndex, br.Attrs().Index, err)
 		}
 		return nil, fmt.Errorf("interface %s has already a master set: %s", uplinkName, master.Attrs().Name)
 	}
 
 	// https://backreference.org/2010/07/28/linux-bridge-mac-addresses-and-dynamic-ports/
-	err = netlink.LinkSetHardwareAddr(br, uplinkLink.Attrs().HardwareAddr)
-	if err != nil {
-		failed = true
-		return nil, fmt.Errorf("couldn't assign bridge MAC address to the same as the uplink interface: %v", err)
+	if oldMac := br.Attrs().HardwareAddr; oldMac.String() != c.uplink.Attrs().HardwareAddr.String() {
+		err = netlink.LinkSetHardwareAddr(br, c.uplink.Attrs().HardwareAddr)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't assign bridge MAC address to the same as the uplink interface: %v", err)
+		}
+		undo.push("MAC address of "+c.name, func() error {
+			return netlink.LinkSetHardwareAddr(br, oldMac)
+		})
 	}
 
-	err = netlink.LinkSetMaster(uplinkLink, br)
-	if err != nil {
-		failed = true
-		return nil, fmt.Errorf("couldn't add interface '%s' to bridge '%s': %v", uplinkName, brName, err)
+	if c.uplink.Attrs().MasterIndex == 0 {
+		err = netlink.LinkSetMaster(c.uplink, br)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't add interface '%s' to bridge '%s': %v", uplinkName, c.name, err)
+		}
+		// the routes move back once the uplink is out of the bridge
+		undo.push("routes of "+uplinkName, func() error {
+			for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+				if err := moveRoutes(br, c.uplink, family); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		undo.push("port "+uplinkName+" of "+c.name, func() error {
+			return netlink.LinkSetNoMaster(c.uplink)
+		})
+	}
+	if c.mcast.uplinkRouter {
+		if err := setPortMulticastRouter(c.uplink, mcastRouterPermanent); err != nil {
+			return nil, fmt.Errorf("couldn't make '%s' a multicast router port: %v", uplinkName, err)
+		}
 	}
 	// Routes on the uplink (e.g. eth0) interface need to be moved to the bridge so the kernel correctly routes packets
-	routes, err := netlink.RouteList(uplinkLink, netlink.FAMILY_V4)
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		if err := moveRoutes(c.uplink, br, family); err != nil {
+			return nil, err
+		}
+	}
+
+	return br, nil
+}
+
+// moveRoutes moves the routes of the given family from the uplink to the
+// bridge, or back on rollback. The link-local IPv6 route is added to the
+// bridge even if the kernel didn't move it, as the default route learned
+// from RAs goes through a link-local gateway.
+func moveRoutes(from, to netlink.Link, family int) error {
+	routes, err := netlink.RouteList(from, family)
 	if err != nil {
-		failed = true
-		return nil, fmt.Errorf("couldn't get routes for uplink interface to move to bridge: %v", err)
+		return fmt.Errorf("couldn't get routes of '%s' to move to '%s': %v", from.Attrs().Name, to.Attrs().Name, err)
 	}
-	if len(routes) > 0 {
-		// Sort routes so that most specific routes appear first. This is to avoid an issue where we can't create a
-		// default route until the subnet route is available
-		sort.Slice(routes, func(i, j int) bool {
-			l, _ := routes[i].Dst.Mask.Size()
-			if routes[j].Dst == nil {
-				return true
-			}
-			if routes[j].Dst.Mask == nil {
-				return true
-			}
-			r, _ := routes[j].Dst.Mask.Size()
-			return l >= r
-		})
-		for _, route := range routes {
-			err = netlink.RouteDel(&route)
-			if err != nil {
-				failed = true
-				return nil, fmt.Errorf("couldn't delete route from uplink: %v", err)
-			}
-			route.LinkIndex = br.Index
-			err = netlink.RouteAdd(&route)
-			if err != nil {
-				failed = true
-				return nil, fmt.Errorf("couldn't move route to bridge: %v", err)
-			}
+	if len(routes) == 0 {
+		return nil
+	}
+
+	sortRoutes(routes)
+	for _, route := range routes {
+		err = netlink.RouteDel(&route)
+		if err != nil {
+			return fmt.Errorf("couldn't delete route from '%s': %v", from.Attrs().Name, err)
+		}
+		route.LinkIndex = to.Attrs().Index
+		route.Flags = settableRouteFlags(route.Flags)
+		// the bridge may have the route of its own address already
+		err = netlink.RouteAdd(&route)
+		if err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("couldn't move route to '%s': %v", to.Attrs().Name, err)
 		}
 	}
 
-	return br, nil
+	if family == netlink.FAMILY_V6 {
+		return ensureLinkLocalRoute(to)
+	}
+	return nil
+}
+
+func ensureLinkLocalRoute(link netlink.Link) error {
+	_, linkLocal, _ := net.ParseCIDR("fe80::/64")
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       linkLocal,
+	}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_DST)
+	if err != nil {
+		return fmt.Errorf("couldn't get link-local route of bridge: %v", err)
+	}
+	if len(routes) > 0 {
+		return nil
+	}
+	err = netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: linkLocal})
+	if err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("couldn't add link-local route to bridge: %v", err)
+	}
+	return nil
 }
 
-func ensureVlanInterface(br *netlink.Bridge, vlanId int) (netlink.Link, error) {
+// settableRouteFlags drops the flags the kernel reports on routes, e.g.
+// linkdown for an uplink without carrier, which it refuses when they're
+// added.
+func settableRouteFlags(flags int) int {
+	return flags & (unix.RTNH_F_ONLINK | unix.RTNH_F_PERVASIVE)
+}
+
+// sortRoutes sorts routes so that most specific routes appear first. This is
+// to avoid an issue where we can't create a default route until the subnet
+// route is available.
+func sortRoutes(routes []netlink.Route) {
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Dst == nil {
+			return false
+		}
+		if routes[j].Dst == nil {
+			return true
+		}
+		l, _ := routes[i].Dst.Mask.Size()
+		r, _ := routes[j].Dst.Mask.Size()
+		return l > r
+	})
+}
+
+// ensureVlanInterface returns the gateway veth of the VLAN on the bridge,
+// creating it if needed. A veth it creates is recorded on undo.
+func ensureVlanInterface(br *netlink.Bridge, vlanId int, undo *undoStack) (netlink.Link, error) {
 	name := fmt.Sprintf("%s.%d", br.Name, vlanId)
 
 	brGatewayVeth, err := netlink.LinkByName(name)
@@ -460,7 +823,7 @@ func ensureVlanInterface(br *netlink.Bridge, vlanId int) (netlink.Link, error) {
 			return nil, fmt.Errorf("faild to find host namespace: %v", err)
 		}
 
-		_, brGatewayIface, err := setupVeth(hostNS, br, name, br.MTU, false, vlanId, "")
+		_, brGatewayIface, _, err := setupVeth(hostNS, br, name, br.MTU, 0, false, vlanId, nil, "", undo)
 		if err != nil {
 			return nil, fmt.Errorf("faild to create vlan gateway %q: %v", name, err)
 		}
@@ -479,129 +842,367 @@ func ensureVlanInterface(br *netlink.Bridge, vlanId int) (netlink.Link, error) {
 	return brGatewayVeth, nil
 }
 
-func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairpinMode bool, vlanID int, mac string) (*current.Interface, *current.Interface, error) {
+// setupVeth connects the container to the bridge, and reports whether it
+// took over the veth of a former ADD rather than creating one.
+func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu, txQueueLen int, hairpinMode bool, vlanID int, vlans []int, mac string, undo *undoStack) (*current.Interface, *current.Interface, bool, error) {
 	contIface := &current.Interface{}
 	hostIface := &current.Interface{}
+	var reused bool
 
 	err := netns.Do(func(hostNS ns.NetNS) error {
-		// create the veth pair in the container and move host end into host netns
-		hostVeth, containerVeth, err := ip.SetupVeth(ifName, mtu, mac, hostNS)
+		existing, hostVethName, err := existingVeth(ifName, hostNS, br)
 		if err != nil {
 			return err
 		}
+		if existing != nil {
+			// a retried ADD converges the veth of the former one
+			if err := resetContainerVeth(existing, mtu, mac); err != nil {
+				return err
+			}
+			reused = true
+			hostIface.Name = hostVethName
+		} else {
+			// create the veth pair in the container and move host end into host netns
+			hostVeth, _, err := ip.SetupVeth(ifName, mtu, mac, hostNS)
+			if err != nil {
+				return err
+			}
+			// deleting the container end deletes the host one too
+			undo.push("veth "+ifName, func() error {
+				return netns.Do(func(_ ns.NetNS) error {
+					return ip.DelLinkByName(ifName)
+				})
+			})
+			hostIface.Name = hostVeth.Name
+		}
+		if txQueueLen != 0 {
+			if err := setTxQLenByName(ifName, txQueueLen); err != nil {
+				return err
+			}
+		}
+		containerVeth, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
 		contIface.Name = containerVeth.Name
 		contIface.Mac = containerVeth.HardwareAddr.String()
 		contIface.Sandbox = netns.Path()
-		hostIface.Name = hostVeth.Name
 		return nil
 	})
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, false, err
 	}
 
 	// need to lookup hostVeth again as its index has changed during ns move
 	hostVeth, err := netlink.LinkByName(hostIface.Name)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to lookup %q: %v", hostIface.Name, err)
+		return nil, nil, false, fmt.Errorf("failed to lookup %q: %v", hostIface.Name, err)
 	}
 	hostIface.Mac = hostVeth.Attrs().HardwareAddr.String()
+	if txQueueLen != 0 {
+		if err := netlink.LinkSetTxQLen(hostVeth, txQueueLen); err != nil {
+			return nil, nil, false, fmt.Errorf("failed to set txqueuelen of %q: %v", hostIface.Name, err)
+		}
+	}
+	if reused {
+		if err := resetHostVeth(hostVeth, mtu); err != nil {
+			return nil, nil, false, err
+		}
+	}
 
 	// connect host veth end to the bridge
 	if err := netlink.LinkSetMaster(hostVeth, br); err != nil {
-		return nil, nil, fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
+		return nil, nil, false, fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
 	}
 
 	// set hairpin mode
 	if err = netlink.LinkSetHairpin(hostVeth, hairpinMode); err != nil {
-		return nil, nil, fmt.Errorf("failed to setup hairpin mode for %v: %v", hostVeth.Attrs().Name, err)
+		return nil, nil, false, fmt.Errorf("failed to setup hairpin mode for %v: %v", hostVeth.Attrs().Name, err)
 	}
 
 	if vlanID != 0 {
 		err = netlink.BridgeVlanAdd(hostVeth, uint16(vlanID), true, true, false, true)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to setup vlan tag on interface %q: %v", hostIface.Name, err)
+			return nil, nil, false, fmt.Errorf("failed to setup vlan tag on interface %q: %v", hostIface.Name, err)
 		}
 	}
 
-	return hostIface, contIface, nil
-}
+	for _, v := range vlans {
+		err = netlink.BridgeVlanAdd(hostVeth, uint16(v), false, false, false, true)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("failed to setup vlan tag %d on interface %q: %v", v, hostIface.Name, err)
+		}
+	}
 
-func calcGatewayIP(ipn *net.IPNet) net.IP {
-	nid := ipn.IP.Mask(ipn.Mask)
-	return ip.NextIP(nid)
+	return hostIface, contIface, reused, nil
 }
 
-func setupBridge(n *NetConf) (*netlink.Bridge, *current.Interface, error) {
-	vlanFiltering := false
-	if n.Vlan != 0 {
-		vlanFiltering = true
+// addStaticFdb adds bridge FDB entries for mac on the port, one per VLAN,
+// which unlike the learned ones don't age out. The entries go away with the
+// port.
+func addStaticFdb(portName, mac string, vlanIDs []int) error {
+	port, err := netlink.LinkByName(portName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", portName, err)
 	}
-
-	uplinkIface, err := findMatchingInterface(n.UplinkInterface)
+	hwAddr, err := net.ParseMAC(mac)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to find uplink interface matching regex %q: %v", n.UplinkInterface, err)
+		return fmt.Errorf("invalid MAC address %q: %v", mac, err)
+	}
+	for _, vlanID := range vlanIDs {
+		err = netlink.NeighSet(&netlink.Neigh{
+			LinkIndex:    port.Attrs().Index,
+			Family:       syscall.AF_BRIDGE,
+			Flags:        netlink.NTF_MASTER,
+			State:        netlink.NUD_NOARP,
+			HardwareAddr: hwAddr,
+			Vlan:         vlanID,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add static FDB entry %s on %q: %v", mac, portName, err)
+		}
 	}
+	return nil
+}
 
-	// create bridge if necessary
-	br, err := ensureBridge(n.BrName, n.MTU, n.PromiscMode, vlanFiltering, uplinkIface, n.EnableIPv6)
+// portVlans returns the VLANs of a bridge port, for a trunk port its PVID
+// as well as the tagged ones.
+func portVlans(portName string) ([]int, error) {
+	port, err := netlink.LinkByName(portName)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create bridge %q: %v", n.BrName, err)
+		return nil, fmt.Errorf("failed to lookup %q: %v", portName, err)
+	}
+	vlanMap, err := netlink.BridgeVlanList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the VLANs of %q: %v", portName, err)
+	}
+	var vlans []int
+	for _, info := range vlanMap[int32(port.Attrs().Index)] {
+		vlans = append(vlans, int(info.Vid))
 	}
+	return vlans, nil
+}
 
-	return br, &current.Interface{
-		Name: br.Attrs().Name,
-		Mac:  br.Attrs().HardwareAddr.String(),
-	}, nil
+// containerSysctls returns the configured sysctls of the container, with
+// IFNAME replaced by its interface.
+func containerSysctls(sysctls map[string]string, ifName string) map[string]string {
+	res := make(map[string]string, len(sysctls))
+	for key, value := range sysctls {
+		res[strings.Replace(key, "IFNAME", ifName, 1)] = value
+	}
+	return res
 }
 
-func enableIPForward(family int) error {
-	if family == netlink.FAMILY_V4 {
-		return ip.EnableIP4Forward()
+// setSysctls writes the sysctls, keyed like net.ipv4.ip_forward. It must be
+// called in the container's namespace.
+func setSysctls(sysctls map[string]string) error {
+	for key, value := range sysctls {
+		if _, err := sysctl.Sysctl(strings.Replace(key, ".", "/", -1), value); err != nil {
+			return fmt.Errorf("failed to set sysctl %s: %v", key, err)
+		}
 	}
-	return ip.EnableIP6Forward()
+	return nil
+}
+
+// setDefaultSysctl sets the sysctl at path unless it is configured.
+func setDefaultSysctl(sysctls map[string]string, path, value string) (string, error) {
+	if _, ok := sysctls[strings.Replace(path, "/", ".", -1)]; ok {
+		return "", nil
+	}
+	return sysctl.Sysctl(path, value)
+}
+
+func setTxQLenByName(name string, qlen int) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+	if err := netlink.LinkSetTxQLen(link, qlen); err != nil {
+		return fmt.Errorf("failed to set txqueuelen of %q: %v", name, err)
+	}
+	return nil
+}
+
+func calcGatewayIP(ipn *net.IPNet) net.IP {
+	nid := ipn.IP.Mask(ipn.Mask)
+	return ip.NextIP(nid)
 }
 
-func createBaselineRules(brName string) [][]string {
-	rules := make([][]string, 0)
+// enableSTP turns on the kernel's spanning tree protocol on the bridge, with
+// the forward delay in seconds and the bridge priority unless they're zero
+// and nil, which the netlink package has no attributes for.
+func enableSTP(br *netlink.Bridge, forwardDelay int, priority *int) error {
+	return setBridgeAttrs(br, func(data *nl.RtAttr) {
+		data.AddRtAttr(nl.IFLA_BR_STP_STATE, nl.Uint32Attr(1))
+		if forwardDelay != 0 {
+			// in USER_HZ, i.e. hundredths of a second
+			data.AddRtAttr(nl.IFLA_BR_FORWARD_DELAY, nl.Uint32Attr(uint32(forwardDelay*100)))
+		}
+		if priority != nil {
+			data.AddRtAttr(nl.IFLA_BR_PRIORITY, nl.Uint16Attr(uint16(*priority)))
+		}
+	})
+}
 
-	// TODO: Use marking to track exactly which interface
+// multicastConf holds the multicast settings of the bridge, the kernel
+// defaults are kept for the unset ones.
+type multicastConf struct {
+	snooping   *bool
+	querier    *bool
+	mldVersion int
+	// set on the uplink port rather than the bridge
+	uplinkRouter bool
+}
 
-	rules = append(rules, []string{"-i", "cni0", "-j", "ACCEPT"})
+func (c multicastConf) isDefault() bool {
+	return c.snooping == nil && c.querier == nil && c.mldVersion == 0
+}
 
-	return rules
+func setAgeingTime(br *netlink.Bridge, ageingTime int) error {
+	return setBridgeAttrs(br, func(data *nl.RtAttr) {
+		// in USER_HZ, like the forward delay
+		data.AddRtAttr(nl.IFLA_BR_AGEING_TIME, nl.Uint32Attr(uint32(ageingTime*100)))
+	})
 }
 
-func setupFirewallRules(ipt *iptables.IPTables, vethName string) error {
-	rules := make([][]string, 0)
-	err := utils.EnsureChain(ipt, "filter", "CNI-FORWARD")
-	if err != nil {
-		return fmt.Errorf("failed to create chain: %v", err)
+func setMulticast(br *netlink.Bridge, c multicastConf) error {
+	return setBridgeAttrs(br, func(data *nl.RtAttr) {
+		if c.snooping != nil {
+			data.AddRtAttr(nl.IFLA_BR_MCAST_SNOOPING, boolAttr(*c.snooping))
+		}
+		if c.querier != nil {
+			data.AddRtAttr(nl.IFLA_BR_MCAST_QUERIER, boolAttr(*c.querier))
+		}
+		if c.mldVersion != 0 {
+			data.AddRtAttr(nl.IFLA_BR_MCAST_MLD_VERSION, nl.Uint8Attr(uint8(c.mldVersion)))
+		}
+	})
+}
+
+// multicast_router of a bridge port, a router is always behind it
+const mcastRouterPermanent = 2
+
+// setPortMulticastRouter sets the multicast_router of a bridge port, which
+// netlink.Link* has no setter for.
+func setPortMulticastRouter(port netlink.Link, mode uint8) error {
+	req := nl.NewNetlinkRequest(unix.RTM_SETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_BRIDGE)
+	msg.Index = int32(port.Attrs().Index)
+	req.AddData(msg)
+
+	protinfo := nl.NewRtAttr(unix.IFLA_PROTINFO|unix.NLA_F_NESTED, nil)
+	protinfo.AddRtAttr(unix.IFLA_BRPORT_MULTICAST_ROUTER, nl.Uint8Attr(mode))
+	req.AddData(protinfo)
+
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+func boolAttr(b bool) []byte {
+	if b {
+		return nl.Uint8Attr(1)
 	}
+	return nl.Uint8Attr(0)
+}
 
-	err = utils.EnsureFirstChainRule(ipt, "FORWARD", utils.GenerateFilterRule("CNI-FORWARD"))
-	if err != nil {
-		return err
+// setBridgeAttrs changes the bridge attributes added by addAttrs. Unlike
+// netlink.LinkModify, the request doesn't carry the link attributes, some of
+// which can't be changed on an existing bridge.
+func setBridgeAttrs(br *netlink.Bridge, addAttrs func(data *nl.RtAttr)) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(br.Attrs().Index)
+	req.AddData(msg)
+
+	linkInfo := nl.NewRtAttr(unix.IFLA_LINKINFO, nil)
+	linkInfo.AddRtAttr(nl.IFLA_INFO_KIND, nl.NonZeroTerminated("bridge"))
+	addAttrs(linkInfo.AddRtAttr(nl.IFLA_INFO_DATA, nil))
+	req.AddData(linkInfo)
+
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+func setupBridge(n *NetConf, undo *undoStack) (*netlink.Bridge, *current.Interface, error) {
+	vlanFiltering := n.Vlan != 0 || n.vlans != nil
+
+	// the bridge has no uplink in the standalone mode
+	var uplinkIface netlink.Link
+	switch {
+	case n.Mode == bridgeModeStandalone:
+	case n.BondMode != "":
+		members, err := findMatchingInterfaces(n.UplinkInterface, n.BrName, n.BondName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find uplink interfaces matching regex %q: %v", n.UplinkInterface, err)
+		}
+		if uplinkIface, err = ensureBond(n.BondName, n.BondMode, members, undo); err != nil {
+			return nil, nil, fmt.Errorf("failed to set up uplink bond %q: %v", n.BondName, err)
+		}
+	default:
+		var err error
+		uplinkIface, err = findMatchingInterface(n.UplinkInterface)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find uplink interface matching regex %q: %v", n.UplinkInterface, err)
+		}
 	}
 
-	rules = append(rules, createBaselineRules(vethName)...)
+	// create bridge if necessary
+	br, err := ensureBridge(bridgeConf{
+		name:          n.BrName,
+		mtu:           n.MTU,
+		txQueueLen:    n.TxQueueLen,
+		promiscMode:   n.PromiscMode,
+		vlanFiltering: vlanFiltering,
+		uplink:        uplinkIface,
+		enableIPv6:    n.EnableIPv6,
+		stp:           n.STP,
+		forwardDelay:  n.ForwardDelay,
+		priority:      n.BridgePriority,
+		ageingTime:    n.AgeingTime,
+		mcast: multicastConf{
+			snooping:     n.MulticastSnooping,
+			querier:      n.MulticastQuerier,
+			mldVersion:   n.MLDVersion,
+			uplinkRouter: n.UplinkMulticastRouter,
+		},
+	}, undo)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create bridge %q: %v", n.BrName, err)
+	}
 
-	for _, rule := range rules {
-		err = ipt.AppendUnique("filter", "CNI-FORWARD", rule...)
+	if n.ProxyArp {
+		// the node answers on the LAN for the container addresses, which
+		// are routed to the host veths
+		proxyArp := fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", n.BrName)
+		old, err := sysctl.Sysctl(proxyArp)
 		if err != nil {
-			return err
+			return nil, nil, fmt.Errorf("couldn't read proxy_arp of %s: %v", n.BrName, err)
+		}
+		if _, err := sysctl.Sysctl(proxyArp, "1"); err != nil {
+			return nil, nil, fmt.Errorf("failed to enable proxy_arp on %q: %v", n.BrName, err)
+		}
+		if old != "1" {
+			undo.push("proxy_arp of "+n.BrName, func() error {
+				_, err := sysctl.Sysctl(proxyArp, old)
+				return err
+			})
 		}
 	}
 
-	return nil
+	return br, &current.Interface{
+		Name: br.Attrs().Name,
+		Mac:  br.Attrs().HardwareAddr.String(),
+	}, nil
 }
 
-func cleanupRules(ipt *iptables.IPTables, rules [][]string) {
-	for _, rule := range rules {
-		ipt.Delete("filter", "CNI-FORWARD", rule...)
+func enableIPForward(family int) error {
+	if family == netlink.FAMILY_V4 {
+		return ip.EnableIP4Forward()
 	}
+	return ip.EnableIP6Forward()
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
+func cmdAdd(args *skel.CmdArgs) (err error) {
 	var success bool = false
 
 	n, cniVersion, err := loadNetConf(args.StdinData, args.Args)
@@ -609,6 +1210,25 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
+	logger, closeLog, err := newLogger(n, "ADD", args)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	defer func() {
+		if err != nil {
+			logger.errorf("add", "%v", err)
+		}
+	}()
+
+	// a failed ADD reverts what it changed on the node
+	undo := &undoStack{}
+	defer func() {
+		if !success {
+			undo.rollback(logger)
+		}
+	}()
+
 	isLayer3 := n.IPAM.Type != ""
 
 	if n.IsDefaultGW {
@@ -619,20 +1239,51 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return fmt.Errorf("cannot set hairpin mode and promiscuous mode at the same time.")
 	}
 
-	br, brInterface, err := setupBridge(n)
+	br, brInterface, err := setupBridge(n, undo)
 	if err != nil {
 		return err
 	}
+	logger.infof("bridge", "bridge %s is set up", br.Name)
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
 		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
 	}
-	defer netns.Close()
+	defer netns.Close()
+
+	hostInterface, containerInterface, reused, err := setupVeth(netns, br, args.IfName, n.MTU, n.TxQueueLen, n.HairpinMode, n.Vlan, n.vlans, n.mac, undo)
+	if err != nil {
+		return err
+	}
+	if reused {
+		logger.infof("veth", "veth %s of a former ADD is taken over", hostInterface.Name)
+	}
+	logger.infof("veth", "veth %s connects %s to the bridge", hostInterface.Name, containerInterface.Name)
+
+	// before the defaults of the plugin, which leave these alone
+	sysctls := containerSysctls(n.Sysctls, args.IfName)
+	if len(sysctls) > 0 {
+		if err := netns.Do(func(_ ns.NetNS) error {
+			return setSysctls(sysctls)
+		}); err != nil {
+			return err
+		}
+		logger.debugf("sysctl", "%d sysctl(s) set in the container", len(sysctls))
+	}
 
-	hostInterface, containerInterface, err := setupVeth(netns, br, args.IfName, n.MTU, n.HairpinMode, n.Vlan, n.mac)
-	if err != nil {
-		return err
+	if n.StaticFdb {
+		fdbVlans := []int{n.Vlan}
+		// the container's untagged frames go to the PVID of a trunk port
+		if n.vlans != nil {
+			fdbVlans, err = portVlans(hostInterface.Name)
+			if err != nil {
+				return err
+			}
+		}
+		if err := addStaticFdb(hostInterface.Name, containerInterface.Mac, fdbVlans); err != nil {
+			return err
+		}
+		logger.infof("fdb", "%s is pinned to %s", containerInterface.Mac, hostInterface.Name)
 	}
 
 	// Assume L2 interface only
@@ -644,51 +1295,42 @@ func cmdAdd(args *skel.CmdArgs) error {
 			containerInterface,
 		},
 	}
-	file, err := os.OpenFile("/tmp/cni.log", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
 	if n.MacSpoofChk {
 		sc := link.NewSpoofChecker(hostInterface.Name, containerInterface.Mac, uniqueID(args.ContainerID, args.IfName))
 		if err := sc.Setup(); err != nil {
 			return err
 		}
-		defer func() {
-			if !success {
-				if err := sc.Teardown(); err != nil {
-					fmt.Fprintf(os.Stderr, "%v", err)
-				}
-			}
-		}()
+		logger.infof("macspoofchk", "spoof check rules set up for %s", containerInterface.Mac)
+		undo.push("spoof check of "+hostInterface.Name, sc.Teardown)
 	}
 
-	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
-	if err != nil {
-		return fmt.Errorf("failed to open IPTables: %v", err)
+	if n.MirrorTo != "" {
+		if err := setupMirroring(hostInterface.Name, n.MirrorTo); err != nil {
+			return err
+		}
+		logger.infof("mirror", "traffic of %s is mirrored to %s", hostInterface.Name, n.MirrorTo)
 	}
 
-	fmt.Fprintf(file, "Is Layer3: %s\n", isLayer3)
+	logger.debugf("ipam", "layer 3: %t", isLayer3)
 	if isLayer3 {
-		err = setupFirewallRules(ipt, hostInterface.Name)
-		if err != nil {
-			return fmt.Errorf("couldn't setup firewall rules: %v", err)
+		// the allocation of a former ADD is released, as IPAM plugins like
+		// host-local refuse a second one for the same container
+		if reused {
+			if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+				return fmt.Errorf("failed to release the former IPAM allocation: %v", err)
+			}
 		}
 
 		// run the IPAM plugin and get back the config to apply
 		r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
 		if err != nil {
-			success = false
 			return err
 		}
 
 		// release IP in case of failure
-		defer func() {
-			if !success {
-				ipam.ExecDel(n.IPAM.Type, args.StdinData)
-			}
-		}()
+		undo.push("IPAM allocation", func() error {
+			return ipam.ExecDel(n.IPAM.Type, args.StdinData)
+		})
 
 		// Convert whatever the IPAM result was into the current Result type
 		ipamResult, err := current.NewResultFromResult(r)
@@ -696,13 +1338,41 @@ func cmdAdd(args *skel.CmdArgs) error {
 			return err
 		}
 
+		if len(ipamResult.IPs) == 0 {
+			return errors.New("IPAM plugin returned missing IP config")
+		}
+		// addresses the IPAM plugin configured on interfaces of its own,
+		// e.g. VLAN subinterfaces, are only reported
+		foreignIPs := ipam.SplitForeignIPs(ipamResult, args.IfName)
+		if len(foreignIPs) > 0 && n.Mode == bridgeModeUplink {
+			return fmt.Errorf("IPAM addresses of other interfaces than %q aren't supported in uplink mode", args.IfName)
+		}
+
 		result.IPs = ipamResult.IPs
 		result.Routes = ipamResult.Routes
 		result.DNS = ipamResult.DNS
+		for _, ipc := range result.IPs {
+			logger.infof("ipam", "%s allocated %s", n.IPAM.Type, ipc.Address.String())
+		}
 
-		if len(result.IPs) == 0 {
-			return errors.New("IPAM plugin returned missing IP config")
+		fw, err := newFirewallBackend(n.FirewallBackend)
+		if err != nil {
+			return err
+		}
+		fwc := newContainerFirewall(n, args.ContainerID, args.IfName)
+		var fwIPs []net.IP
+		for _, ipc := range result.IPs {
+			if ipc.Address.IP.To4() != nil {
+				fwIPs = append(fwIPs, ipc.Address.IP)
+			}
+		}
+		if err := fw.setupContainerRules(fwc, containerInterface.Mac, fwIPs); err != nil {
+			return fmt.Errorf("couldn't setup firewall rules: %v", err)
 		}
+		logger.infof("firewall", "forward rules set up in %s", fwc.chain)
+		undo.push("firewall rules in "+fwc.chain, func() error {
+			return fw.teardownContainerRules(fwc)
+		})
 
 		// Gather gateway information for each IP family
 		gwsV4, gwsV6, err := calcGateways(result, n)
@@ -713,28 +1383,31 @@ func cmdAdd(args *skel.CmdArgs) error {
 		// Configure the container hardware address and IP address(es)
 		if err := netns.Do(func(_ ns.NetNS) error {
 			if n.EnableDad {
-				_, _ = sysctl.Sysctl(fmt.Sprintf("/net/ipv6/conf/%s/enhanced_dad", args.IfName), "1")
-				_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_dad", args.IfName), "1")
+				_, _ = setDefaultSysctl(sysctls, fmt.Sprintf("net/ipv6/conf/%s/enhanced_dad", args.IfName), "1")
+				_, _ = setDefaultSysctl(sysctls, fmt.Sprintf("net/ipv6/conf/%s/accept_dad", args.IfName), "1")
 			} else {
-				_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_dad", args.IfName), "0")
+				_, _ = setDefaultSysctl(sysctls, fmt.Sprintf("net/ipv6/conf/%s/accept_dad", args.IfName), "0")
 			}
-			_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/arp_notify", args.IfName), "1")
+			_, _ = setDefaultSysctl(sysctls, fmt.Sprintf("net/ipv4/conf/%s/arp_notify", args.IfName), "1")
 
-			// Add the IP to the interface
-			if err := ipam.ConfigureIface(args.IfName, result); err != nil {
-				return err
+			// Add the IP to the interface, unless the routes go through the
+			// IPAM plugin's interfaces
+			if len(result.IPs) > 0 {
+				if err := ipam.ConfigureIface(args.IfName, result); err != nil {
+					return err
+				}
 			}
 
 			if n.EnableIPv6 {
-				_, err = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/autoconf", args.IfName), "1")
+				_, err = setDefaultSysctl(sysctls, fmt.Sprintf("net/ipv6/conf/%s/autoconf", args.IfName), "1")
 				if err != nil {
 					return fmt.Errorf("could not enable IPv6 autoconf on '%s': %v", args.IfName, err)
 				}
-				_, err = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_ra", args.IfName), "1")
+				_, err = setDefaultSysctl(sysctls, fmt.Sprintf("net/ipv6/conf/%s/accept_ra", args.IfName), "1")
 				if err != nil {
 					return fmt.Errorf("could not enable IPv6 accept_ra on '%s': %v", args.IfName, err)
 				}
-				_, err = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/disable_ipv6", args.IfName), "0")
+				_, err = setDefaultSysctl(sysctls, fmt.Sprintf("net/ipv6/conf/%s/disable_ipv6", args.IfName), "0")
 				if err != nil {
 					return fmt.Errorf("could not enable IPv6 on '%s': %v", args.IfName, err)
 				}
@@ -762,138 +1435,182 @@ func cmdAdd(args *skel.CmdArgs) error {
 			if idx == len(retries)-1 {
 				return fmt.Errorf("bridge port in error state: %s", hostVeth.Attrs().OperState)
 			}
+			logger.debugf("port", "bridge port %s is %s, waiting", hostInterface.Name, hostVeth.Attrs().OperState)
 		}
 
 		var contVeth *net.Interface
 		if err := netns.Do(func(_ ns.NetNS) error {
-			// Send a gratuitous arp
 			contVeth, err = net.InterfaceByName(args.IfName)
 			if err != nil {
 				return err
 			}
 			return nil
 		}); err != nil {
-			return fmt.Errorf("failed to send gratuitous ARP: %v", err)
-		}
-
-		// Setup container routes
-		uplinkAddrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
-		if err != nil {
-			return fmt.Errorf("couldn't find IPv4 addresses for uplink interface: %v", err)
-		}
-		var gw6Ip net.IP
-		if n.EnableIPv6 {
-			uplink6Addrs, err := netlink.AddrList(br, netlink.FAMILY_V6)
-			if err != nil {
-				return fmt.Errorf("couldn't find IPv6 addresses for uplink interface: %v", err)
-			}
-			gw6Ip = uplink6Addrs[0].IP
+			return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
 		}
 
-		gwIp := uplinkAddrs[0].IP
-		err = netns.Do(func(_ ns.NetNS) error {
-			containerLink, err := netlink.LinkByName(args.IfName)
+		// in standalone mode the routes of the IPAM result are kept and the
+		// bridge is the gateway, as set up below
+		if n.Mode == bridgeModeUplink {
+			// Setup container routes
+			uplinkAddrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
 			if err != nil {
-				return fmt.Errorf("couldn't find interface '%s' even though we just created it: %v", args.IfName, err)
+				return fmt.Errorf("couldn't find IPv4 addresses for uplink interface: %v", err)
 			}
-
-			// Delete all routes. We're going to explicitly create our own routes the way we want
-			routes, _ := netlink.RouteList(containerLink, netlink.FAMILY_ALL)
-			for _, route := range routes {
-				err = netlink.RouteDel(&route)
+			var gw6Ip, gw6LinkLocal net.IP
+			if n.EnableIPv6 {
+				uplink6Addrs, err := netlink.AddrList(br, netlink.FAMILY_V6)
 				if err != nil {
-					return fmt.Errorf("couldn't delete all routes before setting up new routes: %v", err)
+					return fmt.Errorf("couldn't find IPv6 addresses for uplink interface: %v", err)
+				}
+				gw6Ip = uplink6Addrs[0].IP
+				for _, addr := range uplink6Addrs {
+					if addr.IP.IsLinkLocalUnicast() {
+						gw6LinkLocal = addr.IP
+						break
+					}
+				}
+				if gw6LinkLocal == nil {
+					return fmt.Errorf("couldn't find an IPv6 link-local address on %s", br.Attrs().Name)
 				}
 			}
 
-			// Add the local scope
-			// This tells the container to forward everything to the host stack
-			err = addRouteToHost(containerLink, gwIp, ipamResult.IPs[0].Address.IP)
-			if err != nil {
-				return fmt.Errorf("couldn't create ipv4 route in container to host: %v", err)
-			}
+			gwIp := uplinkAddrs[0].IP
+			err = netns.Do(func(_ ns.NetNS) error {
+				containerLink, err := netlink.LinkByName(args.IfName)
+				if err != nil {
+					return fmt.Errorf("couldn't find interface '%s' even though we just created it: %v", args.IfName, err)
+				}
 
-			if n.EnableIPv6 {
-				err = netlink.RouteAdd(&netlink.Route{
-					LinkIndex: containerLink.Attrs().Index,
-					Scope:     netlink.SCOPE_LINK,
-					Dst:       netlink.NewIPNet(gw6Ip),
-				})
+				// Delete all routes. We're going to explicitly create our own routes the way we want
+				routes, _ := netlink.RouteList(containerLink, netlink.FAMILY_ALL)
+				for _, route := range routes {
+					err = netlink.RouteDel(&route)
+					if err != nil {
+						return fmt.Errorf("couldn't delete all routes before setting up new routes: %v", err)
+					}
+				}
 
+				// Add the local scope
+				// This tells the container to forward everything to the host stack
+				err = addRouteToHost(containerLink, gwIp, ipamResult.IPs[0].Address.IP)
 				if err != nil {
-					return fmt.Errorf("couldn't create ipv6 route in container to host for ip (%s): %v", gw6Ip, err)
+					return fmt.Errorf("couldn't create ipv4 route in container to host: %v", err)
 				}
 
-				for idx, sleep := range retries {
-					containerIpv6, err := netlink.AddrList(containerLink, netlink.FAMILY_V6)
+				if n.EnableIPv6 {
+					err = netlink.RouteAdd(&netlink.Route{
+						LinkIndex: containerLink.Attrs().Index,
+						Scope:     netlink.SCOPE_LINK,
+						Dst:       netlink.NewIPNet(gw6Ip),
+					})
+
 					if err != nil {
-						return fmt.Errorf("couldn't get IPv6 addresses for container interface '%s': %v", args.IfName, err)
+						return fmt.Errorf("couldn't create ipv6 route in container to host for ip (%s): %v", gw6Ip, err)
 					}
 
-					var foundAddr = false
-					for _, addr := range containerIpv6 {
-						if addr.Scope == int(netlink.SCOPE_UNIVERSE) {
-							result.IPs = append(result.IPs, &current.IPConfig{
-								Interface: &containerLink.Attrs().Index,
-								Address:   *addr.IPNet,
-							})
-							foundAddr = true
+					for idx, sleep := range retries {
+						containerIpv6, err := netlink.AddrList(containerLink, netlink.FAMILY_V6)
+						if err != nil {
+							return fmt.Errorf("couldn't get IPv6 addresses for container interface '%s': %v", args.IfName, err)
+						}
+
+						var foundAddr = false
+						for _, addr := range containerIpv6 {
+							if addr.Scope == int(netlink.SCOPE_UNIVERSE) {
+								result.IPs = append(result.IPs, &current.IPConfig{
+									Interface: &containerLink.Attrs().Index,
+									Address:   *addr.IPNet,
+								})
+								foundAddr = true
+								break
+							}
+						}
+						if foundAddr {
 							break
 						}
-					}
-					if foundAddr {
-						break
-					}
 
-					time.Sleep(time.Duration(sleep) * time.Millisecond)
+						time.Sleep(time.Duration(sleep) * time.Millisecond)
 
-					if idx == len(retries)-1 {
-						return fmt.Errorf("timed out waiting for IPv6 autoconfig: %s", hostVeth.Attrs().OperState)
+						if idx == len(retries)-1 {
+							return fmt.Errorf("timed out waiting for IPv6 autoconfig: %s", hostVeth.Attrs().OperState)
+						}
 					}
 				}
-			}
 
-			brMac, err := net.ParseMAC(brInterface.Mac)
-			err = netlink.NeighSet(&netlink.Neigh{
-				LinkIndex:    containerLink.Attrs().Index,
-				Family:       netlink.FAMILY_V4,
-				State:        netlink.NUD_PERMANENT,
-				IP:           gwIp,
-				HardwareAddr: brMac,
-			})
+				brMac, err := net.ParseMAC(brInterface.Mac)
+				// with proxy ARP the neighbors are resolved the usual way
+				if !n.ProxyArp {
+					err = netlink.NeighSet(&netlink.Neigh{
+						LinkIndex:    containerLink.Attrs().Index,
+						Family:       netlink.FAMILY_V4,
+						State:        netlink.NUD_PERMANENT,
+						IP:           gwIp,
+						HardwareAddr: brMac,
+					})
 
-			if err != nil {
-				return fmt.Errorf("failed to add permanent neighbor of bridge to container interface: %v", err)
-			}
+					if err != nil {
+						return fmt.Errorf("failed to add permanent neighbor of bridge to container interface: %v", err)
+					}
+				}
 
-			return nil
-		})
-		if err != nil {
-			return fmt.Errorf("couldn't setup container routes: %v", err)
-		}
+				if n.EnableIPv6 {
+					if err := addIPv6RouteToHost(containerLink, gw6LinkLocal, brMac); err != nil {
+						return fmt.Errorf("couldn't create ipv6 route in container to host: %v", err)
+					}
+				}
 
-		// Configure route from host to container
-		for _, containerIp := range ipamResult.IPs {
-			err = netlink.NeighSet(&netlink.Neigh{
-				LinkIndex:    hostVeth.Attrs().Index,
-				Family:       netlink.FAMILY_V4,
-				State:        netlink.NUD_PERMANENT,
-				IP:           containerIp.Address.IP,
-				HardwareAddr: contVeth.HardwareAddr,
+				return nil
 			})
 			if err != nil {
-				return fmt.Errorf("couldn't add ARP route from host to container: %v", err)
+				return fmt.Errorf("couldn't setup container routes: %v", err)
 			}
 
-			err = netlink.RouteAdd(&netlink.Route{
-				LinkIndex: hostVeth.Attrs().Index,
-				Dst:       netlink.NewIPNet(containerIp.Address.IP),
-				Scope:     netlink.SCOPE_LINK,
-			})
+			// Configure route from host to container
+			// result.IPs also holds the autoconfigured IPv6 addresses
+			for _, containerIp := range result.IPs {
+				family := netlink.FAMILY_V4
+				if containerIp.Address.IP.To4() == nil {
+					family = netlink.FAMILY_V6
+				}
+				// pinned even with proxy ARP: the bridge consumes the ARP
+				// replies arriving on its ports, so the host veth can't
+				// resolve the container
+				err = netlink.NeighSet(&netlink.Neigh{
+					LinkIndex:    hostVeth.Attrs().Index,
+					Family:       family,
+					State:        netlink.NUD_PERMANENT,
+					IP:           containerIp.Address.IP,
+					HardwareAddr: contVeth.HardwareAddr,
+				})
+				if err != nil {
+					return fmt.Errorf("couldn't add ARP route from host to container: %v", err)
+				}
 
-			if err != nil {
-				return fmt.Errorf("couldn't route from host to container: %v", err)
+				err = netlink.RouteAdd(&netlink.Route{
+					LinkIndex: hostVeth.Attrs().Index,
+					Dst:       netlink.NewIPNet(containerIp.Address.IP),
+					Scope:     netlink.SCOPE_LINK,
+				})
+
+				if err != nil {
+					return fmt.Errorf("couldn't route from host to container: %v", err)
+				}
+			}
+		}
+
+		// announced once the host routes the replies to the container
+		if *n.AnnounceCount > 0 {
+			var announced []net.IP
+			for _, ipc := range result.IPs {
+				announced = append(announced, ipc.Address.IP)
+			}
+			if err := netns.Do(func(_ ns.NetNS) error {
+				return announceAddrs(args.IfName, announced, *n.AnnounceCount)
+			}); err != nil {
+				return err
 			}
+			logger.debugf("announce", "%d announcement(s) sent for %s", *n.AnnounceCount, args.IfName)
 		}
 
 		if n.IsGW {
@@ -906,7 +1623,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 						firstV4Addr = gw.IP
 					}
 					if n.Vlan != 0 {
-						vlanIface, err := ensureVlanInterface(br, n.Vlan)
+						vlanIface, err := ensureVlanInterface(br, n.Vlan, undo)
 						if err != nil {
 							return fmt.Errorf("failed to create vlan interface: %v", err)
 						}
@@ -917,12 +1634,12 @@ func cmdAdd(args *skel.CmdArgs) error {
 							result.Interfaces = append(result.Interfaces, vlanInterface)
 						}
 
-						err = ensureAddr(vlanIface, gws.family, &gw, n.ForceAddress)
+						err = ensureAddr(vlanIface, gws.family, &gw, n.ForceAddress, undo)
 						if err != nil {
 							return fmt.Errorf("failed to set vlan interface for bridge with addr: %v", err)
 						}
 					} else {
-						err = ensureAddr(br, gws.family, &gw, n.ForceAddress)
+						err = ensureAddr(br, gws.family, &gw, n.ForceAddress, undo)
 						if err != nil {
 							return fmt.Errorf("failed to set bridge addr: %v", err)
 						}
@@ -951,8 +1668,13 @@ func cmdAdd(args *skel.CmdArgs) error {
 				if err = ip.SetupIPMasq(&ipc.Address, chain, comment); err != nil {
 					return err
 				}
+				ipn := ipc.Address
+				undo.push("masquerading of "+ipn.IP.String(), func() error {
+					return ip.TeardownIPMasq(&ipn, chain, comment)
+				})
 			}
 		}
+		ipam.AppendForeignIPs(result, ipamResult, foreignIPs)
 	} else {
 		if err := netns.Do(func(_ ns.NetNS) error {
 			link, err := netlink.LinkByName(args.IfName)
@@ -989,6 +1711,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	success = true
+	logger.infof("done", "container interface %s is set up", args.IfName)
 
 	return types.PrintResult(result, cniVersion)
 }
@@ -1022,6 +1745,37 @@ func addRouteToHost(containerLink netlink.Link, gwIp net.IP, srcAddress net.IP)
 	return nil
 }
 
+// addIPv6RouteToHost routes the IPv6 traffic of the container through the
+// link-local address of the bridge, pinned to its MAC so that neither
+// depends on router advertisements or neighbor discovery.
+func addIPv6RouteToHost(containerLink netlink.Link, gwIp net.IP, gwMac net.HardwareAddr) error {
+	err := netlink.NeighSet(&netlink.Neigh{
+		LinkIndex:    containerLink.Attrs().Index,
+		Family:       netlink.FAMILY_V6,
+		State:        netlink.NUD_PERMANENT,
+		IP:           gwIp,
+		HardwareAddr: gwMac,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add permanent neighbor %s dev %s (container): %v", gwIp, containerLink.Attrs().Name, err)
+	}
+
+	// another interface may hold the default route already, as with IPv4
+	err = netlink.RouteAdd(&netlink.Route{
+		LinkIndex: containerLink.Attrs().Index,
+		Gw:        gwIp,
+		Dst: &net.IPNet{
+			IP:   net.IPv6zero,
+			Mask: net.CIDRMask(0, 128),
+		},
+		Priority: 1024,
+	})
+	if err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("failed to add route: default via %s dev %s (container): %v", gwIp, containerLink.Attrs().Name, err)
+	}
+	return nil
+}
+
 func dnsConfSet(dnsConf types.DNS) bool {
 	return dnsConf.Nameservers != nil ||
 		dnsConf.Search != nil ||
@@ -1046,6 +1800,18 @@ func cmdDel(args *skel.CmdArgs) error {
 		return nil
 	}
 
+	// the forward rules don't depend on the container's addresses, so they
+	// are removed even if its netns is gone
+	if isLayer3 {
+		fw, err := newFirewallBackend(n.FirewallBackend)
+		if err != nil {
+			return err
+		}
+		if err := fw.teardownContainerRules(newContainerFirewall(n, args.ContainerID, args.IfName)); err != nil {
+			return err
+		}
+	}
+
 	if args.Netns == "" {
 		return ipamDel()
 	}
@@ -1168,6 +1934,105 @@ func validateCniBrInterface(intf current.Interface, n *NetConf) (cniBridgeIf, er
 	return brFound, nil
 }
 
+// validateUplink checks the node-level state ADD sets up: the uplink is a
+// port of the bridge, the bridge carries the uplink's address and the
+// uplink's routes were moved to the bridge.
+func validateUplink(n *NetConf, brIf cniBridgeIf) error {
+	var uplink netlink.Link
+	if n.BondMode != "" {
+		var err error
+		if uplink, err = netlink.LinkByName(n.BondName); err != nil {
+			return fmt.Errorf("Uplink bond %s not found: %v", n.BondName, err)
+		}
+		members, err := findMatchingInterfaces(n.UplinkInterface, n.BrName, n.BondName)
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			if m.Attrs().MasterIndex != uplink.Attrs().Index {
+				return fmt.Errorf("Uplink interface %s is not enslaved to bond %s", m.Attrs().Name, n.BondName)
+			}
+		}
+	} else {
+		var err error
+		if uplink, err = findMatchingInterface(n.UplinkInterface); err != nil {
+			return err
+		}
+	}
+	uplinkName := uplink.Attrs().Name
+
+	if uplink.Attrs().MasterIndex != brIf.ifIndex {
+		return fmt.Errorf("Uplink interface %s is not enslaved to bridge %s", uplinkName, brIf.Name)
+	}
+
+	br, err := netlink.LinkByIndex(brIf.ifIndex)
+	if err != nil {
+		return fmt.Errorf("failed to lookup bridge %s: %v", brIf.Name, err)
+	}
+	brAddrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("couldn't get addrs for interface '%s': %v", brIf.Name, err)
+	}
+	uplinkAddrs, err := netlink.AddrList(uplink, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("couldn't get addrs for interface '%s': %v", uplinkName, err)
+	}
+	if len(uplinkAddrs) > 0 {
+		found := false
+		for _, addr := range brAddrs {
+			if addr.Equal(uplinkAddrs[0]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Bridge %s doesn't carry the address %s of uplink interface %s", brIf.Name, uplinkAddrs[0].IPNet, uplinkName)
+		}
+	} else if len(brAddrs) == 0 {
+		return fmt.Errorf("Bridge %s has no IPv4 address", brIf.Name)
+	}
+
+	movable, err := movableAddrs(uplink)
+	if err != nil {
+		return err
+	}
+	brAddrs, err = netlink.AddrList(br, netlink.FAMILY_V6)
+	if err != nil {
+		return fmt.Errorf("couldn't get addrs for interface '%s': %v", brIf.Name, err)
+	}
+	for _, uplinkAddr := range movable {
+		if uplinkAddr.IP.To4() != nil {
+			continue
+		}
+		found := false
+		for _, addr := range brAddrs {
+			if addr.Equal(uplinkAddr) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Bridge %s doesn't carry the address %s of uplink interface %s", brIf.Name, uplinkAddr.IPNet, uplinkName)
+		}
+	}
+
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteList(uplink, family)
+		if err != nil {
+			return fmt.Errorf("couldn't get routes for uplink interface %s: %v", uplinkName, err)
+		}
+		for _, route := range routes {
+			// the kernel adds the link-local route back as the uplink keeps
+			// its link-local address
+			if route.Dst != nil && route.Dst.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			return fmt.Errorf("Route %s on uplink interface %s wasn't moved to bridge %s", route, uplinkName, brIf.Name)
+		}
+	}
+	return nil
+}
+
 func validateCniVethInterface(intf *current.Interface, brIf cniBridgeIf, contIf cniBridgeIf) (cniBridgeIf, error) {
 
 	vethFound, link, err := validateInterface(*intf, false)
@@ -1341,6 +2206,11 @@ func cmdCheck(args *skel.CmdArgs) error {
 	if !brCNI.found {
 		return fmt.Errorf("CNI created bridge %s in host namespace was not found", n.BrName)
 	}
+	if n.Mode == bridgeModeUplink {
+		if err := validateUplink(n, brCNI); err != nil {
+			return err
+		}
+	}
 	if !contCNI.found {
 		return fmt.Errorf("CNI created interface in container %s not found", args.IfName)
 	}
@@ -1364,9 +2234,154 @@ func cmdCheck(args *skel.CmdArgs) error {
 		return err
 	}
 
+	if n.IPAM.Type != "" && n.Mode == bridgeModeUplink {
+		// the routes and neighbor entries ADD adds besides the result
+		br, err := netlink.LinkByIndex(brCNI.ifIndex)
+		if err != nil {
+			return fmt.Errorf("failed to lookup bridge %s: %v", brCNI.Name, err)
+		}
+		brAddrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
+		if err != nil {
+			return fmt.Errorf("couldn't get addrs for interface '%s': %v", brCNI.Name, err)
+		}
+		if len(brAddrs) == 0 {
+			return fmt.Errorf("Bridge %s has no IPv4 address", brCNI.Name)
+		}
+		var contMac net.HardwareAddr
+		if err := netns.Do(func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(args.IfName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+			}
+			contMac = link.Attrs().HardwareAddr
+			brMac := br.Attrs().HardwareAddr
+			if n.ProxyArp {
+				brMac = nil
+			}
+			return validateContainerRoutes(args.IfName, brAddrs[0].IP, brMac)
+		}); err != nil {
+			return err
+		}
+		if err := validateHostRoutes(vethCNI.Name, result.IPs, contMac); err != nil {
+			return err
+		}
+	}
+
+	if n.ProxyArp {
+		proxyArp, err := sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", brCNI.Name))
+		if err != nil {
+			return fmt.Errorf("couldn't read proxy_arp of %s: %v", brCNI.Name, err)
+		}
+		if proxyArp != "1" {
+			return fmt.Errorf("proxy_arp is not enabled on %s", brCNI.Name)
+		}
+	}
+
+	return nil
+}
+
+// validateContainerRoutes checks the routes and neighbor entry ADD sets up
+// in the container for the gateway on the bridge. It must be called in the
+// container's namespace. Without brMac, as in proxy-ARP mode, the neighbor
+// entry isn't checked.
+func validateContainerRoutes(ifName string, gwIP net.IP, brMac net.HardwareAddr) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("couldn't get routes of %s: %v", ifName, err)
+	}
+	var gwRoute, defaultRoute bool
+	for _, route := range routes {
+		if route.Dst != nil && route.Dst.IP.Equal(gwIP) && route.Scope == netlink.SCOPE_LINK {
+			gwRoute = true
+		}
+		if (route.Dst == nil || route.Dst.IP.Equal(net.IPv4zero)) && route.Gw.Equal(gwIP) && route.Priority == 1024 {
+			defaultRoute = true
+		}
+	}
+	if !gwRoute {
+		return fmt.Errorf("Route to gateway %s on %s not found", gwIP, ifName)
+	}
+	if !defaultRoute {
+		// ADD doesn't fail when the container has a default route through
+		// another interface already, e.g. with Multus
+		all, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+		if err != nil {
+			return fmt.Errorf("couldn't get routes: %v", err)
+		}
+		other := false
+		for _, route := range all {
+			if route.Dst == nil && route.LinkIndex != link.Attrs().Index {
+				other = true
+				break
+			}
+		}
+		if !other {
+			return fmt.Errorf("Default route via %s on %s not found", gwIP, ifName)
+		}
+	}
+
+	if brMac == nil {
+		return nil
+	}
+	return validatePermanentNeigh(link, gwIP, brMac)
+}
+
+// validateHostRoutes checks the neighbor entries and routes ADD sets up on
+// the host veth for the container's IPv4 addresses.
+func validateHostRoutes(hostVethName string, ips []*current.IPConfig, contMac net.HardwareAddr) error {
+	link, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("couldn't get routes of %s: %v", hostVethName, err)
+	}
+
+	for _, ipc := range ips {
+		ip := ipc.Address.IP
+		if ip.To4() == nil {
+			continue
+		}
+		found := false
+		for _, route := range routes {
+			if route.Dst != nil && route.Dst.IP.Equal(ip) && route.Scope == netlink.SCOPE_LINK {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Route to container address %s on %s not found", ip, hostVethName)
+		}
+		if err := validatePermanentNeigh(link, ip, contMac); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func validatePermanentNeigh(link netlink.Link, ip net.IP, mac net.HardwareAddr) error {
+	neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("couldn't get neighbors of %s: %v", link.Attrs().Name, err)
+	}
+	for _, neigh := range neighs {
+		if !neigh.IP.Equal(ip) {
+			continue
+		}
+		if neigh.State != netlink.NUD_PERMANENT || neigh.HardwareAddr.String() != mac.String() {
+			return fmt.Errorf("Neighbor %s on %s is %s, expected permanent %s", ip, link.Attrs().Name, neigh.HardwareAddr, mac)
+		}
+		return nil
+	}
+	return fmt.Errorf("Permanent neighbor %s on %s not found", ip, link.Attrs().Name)
+}
+
 func uniqueID(containerID, cniIface string) string {
 	return containerID + "-" + cniIface
 }
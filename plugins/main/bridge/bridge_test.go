@@ -15,16 +15,21 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/networkplumbing/go-nft/nft"
+	"github.com/networkplumbing/go-nft/nft/schema"
 	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -33,6 +38,7 @@ import (
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 
 	"github.com/vishvananda/netlink"
 
@@ -1660,7 +1666,7 @@ var _ = Describe("bridge Operations", func() {
 			err := originalNS.Do(func(ns.NetNS) error {
 				defer GinkgoRecover()
 
-				bridge, _, err := setupBridge(conf)
+				bridge, _, err := setupBridge(conf, nil)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(bridge.Attrs().Name).To(Equal(BRNAME))
 
@@ -1692,7 +1698,7 @@ var _ = Describe("bridge Operations", func() {
 				tc := testCase{cniVersion: ver, isGW: false}
 				conf := tc.netConf()
 
-				bridge, _, err := setupBridge(conf)
+				bridge, _, err := setupBridge(conf, nil)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(bridge.Attrs().Name).To(Equal(BRNAME))
 				Expect(bridge.Attrs().Index).To(Equal(ifindex))
@@ -1932,7 +1938,7 @@ var _ = Describe("bridge Operations", func() {
 					defer GinkgoRecover()
 
 					// Create the bridge
-					bridge, _, err := setupBridge(conf)
+					bridge, _, err := setupBridge(conf, nil)
 					Expect(err).NotTo(HaveOccurred())
 
 					// Function to check IP address(es) on bridge
@@ -1952,13 +1958,13 @@ var _ = Describe("bridge Operations", func() {
 					Expect(conf.ForceAddress).To(Equal(false))
 
 					// Set first address on bridge
-					err = ensureAddr(bridge, family, &gwnFirst, conf.ForceAddress)
+					err = ensureAddr(bridge, family, &gwnFirst, conf.ForceAddress, nil)
 					Expect(err).NotTo(HaveOccurred())
 					checkBridgeIPs(tc.gwCIDRFirst, "")
 
 					// Attempt to set the second address on the bridge
 					// with ForceAddress set to false.
-					err = ensureAddr(bridge, family, &gwnSecond, false)
+					err = ensureAddr(bridge, family, &gwnSecond, false, nil)
 					if family == netlink.FAMILY_V4 || subnetsOverlap {
 						// IPv4 or overlapping IPv6 subnets:
 						// Expect an error, and address should remain the same
@@ -1974,7 +1980,8 @@ var _ = Describe("bridge Operations", func() {
 
 					// Set the second address on the bridge
 					// with ForceAddress set to true.
-					err = ensureAddr(bridge, family, &gwnSecond, true)
+					undo := &undoStack{}
+					err = ensureAddr(bridge, family, &gwnSecond, true, undo)
 					Expect(err).NotTo(HaveOccurred())
 					if family == netlink.FAMILY_V4 || subnetsOverlap {
 						// IPv4 or overlapping IPv6 subnets:
@@ -1986,6 +1993,14 @@ var _ = Describe("bridge Operations", func() {
 						checkBridgeIPs(tc.gwCIDRSecond, tc.gwCIDRFirst)
 					}
 
+					// the rollback gives the first address back
+					undo.rollback(&stepLogger{})
+					if family == netlink.FAMILY_V4 || subnetsOverlap {
+						checkBridgeIPs(tc.gwCIDRFirst, "")
+					} else {
+						checkBridgeIPs(tc.gwCIDRSecond, tc.gwCIDRFirst)
+					}
+
 					return nil
 				})
 				Expect(err).NotTo(HaveOccurred())
@@ -2017,7 +2032,7 @@ var _ = Describe("bridge Operations", func() {
 				defer GinkgoRecover()
 
 				conf.NetConf.CNIVersion = ver
-				_, _, err := setupBridge(conf)
+				_, _, err := setupBridge(conf, nil)
 				Expect(err).NotTo(HaveOccurred())
 				// Check if ForceAddress has default value
 				Expect(conf.ForceAddress).To(Equal(false))
@@ -2047,7 +2062,7 @@ var _ = Describe("bridge Operations", func() {
 					defer GinkgoRecover()
 
 					tc.cniVersion = ver
-					_, _, err := setupBridge(tc.netConf())
+					_, _, err := setupBridge(tc.netConf(), nil)
 					Expect(err).NotTo(HaveOccurred())
 					link, err := netlink.LinkByName(BRNAME)
 					Expect(err).NotTo(HaveOccurred())
@@ -2132,7 +2147,7 @@ var _ = Describe("bridge Operations", func() {
 					subnet:     "10.1.2.0/24",
 				}
 
-				_, _, err := setupBridge(tc.netConf())
+				_, _, err := setupBridge(tc.netConf(), nil)
 				Expect(err).NotTo(HaveOccurred())
 
 				args := tc.createCmdArgs(originalNS, dataDir)
@@ -2293,8 +2308,1252 @@ var _ = Describe("bridge Operations", func() {
 			}
 		}
 	})
+
+	It("checks the vlan trunk when loading net conf", func() {
+		n, _, err := loadNetConf([]byte(`{"name": "net", "type": "bridge",
+			"vlanTrunk": [{"id": 10}, {"minID": 20, "maxID": 22}, {"id": 21}]}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.vlans).To(Equal([]int{10, 20, 21, 22}))
+
+		for conf, msg := range map[string]string{
+			`"vlanTrunk": [{"id": 0}]`:                   "invalid vlanTrunk id 0 (must be between 1 and 4094)",
+			`"vlanTrunk": [{"minID": 0, "maxID": 5}]`:    "invalid vlanTrunk minID 0 (must be between 1 and 4094)",
+			`"vlanTrunk": [{"minID": 5, "maxID": 5000}]`: "invalid vlanTrunk maxID 5000 (must be between 1 and 4094)",
+			`"vlanTrunk": [{"minID": 5}]`:                "vlanTrunk minID and maxID must be set together",
+			`"vlanTrunk": [{"minID": 6, "maxID": 5}]`:    "vlanTrunk minID 6 is greater than maxID 5",
+			`"vlan": 5, "vlanTrunk": [{"id": 6}]`:        "cannot set vlan and vlanTrunk at the same time",
+		} {
+			_, _, err := loadNetConf([]byte(`{"name": "net", "type": "bridge", `+conf+`}`), "")
+			Expect(err).To(MatchError(msg), conf)
+		}
+	})
+
+	It("adds the trunk VLANs to the host veth", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			vlanFiltering := true
+			probe := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "probe"}, VlanFiltering: &vlanFiltering}
+			if err := netlink.LinkAdd(probe); err == syscall.EOPNOTSUPP {
+				Skip("the kernel doesn't support VLAN filtering")
+			}
+			Expect(netlink.LinkDel(probe)).To(Succeed())
+
+			br, err := ensureBridge(bridgeConf{name: BRNAME, vlanFiltering: true}, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			hostIface, _, _, err := setupVeth(targetNS, br, IFNAME, 0, 0, false, 0, []int{10, 20}, "", nil)
+			Expect(err).NotTo(HaveOccurred())
+			hostVeth, err := netlink.LinkByName(hostIface.Name)
+			Expect(err).NotTo(HaveOccurred())
+
+			vlans, err := netlink.BridgeVlanList()
+			Expect(err).NotTo(HaveOccurred())
+			var tagged []uint16
+			for _, info := range vlans[int32(hostVeth.Attrs().Index)] {
+				if !info.PortVID() && !info.EngressUntag() {
+					tagged = append(tagged, info.Vid)
+				}
+			}
+			Expect(tagged).To(ConsistOf(uint16(10), uint16(20)))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("checks the STP settings when loading net conf", func() {
+		for conf, expErr := range map[string]string{
+			`{"name": "net", "type": "bridge", "stp": true, "forwardDelay": 4, "bridgePriority": 0}`: "",
+			`{"name": "net", "type": "bridge", "forwardDelay": 4}`:                                   "forwardDelay and bridgePriority require stp",
+			`{"name": "net", "type": "bridge", "stp": true, "forwardDelay": 1}`:                      "invalid forwardDelay 1 (must be between 2 and 30 seconds)",
+			`{"name": "net", "type": "bridge", "stp": true, "bridgePriority": 65536}`:                "invalid bridgePriority 65536 (must be between 0 and 65535)",
+		} {
+			_, _, err := loadNetConf([]byte(conf), "")
+			if expErr == "" {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(MatchError(expErr))
+			}
+		}
+	})
+
+	It("enables STP on a bridge", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: BRNAME}})).To(Succeed())
+			br, err := bridgeByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+
+			priority := 4096
+			Expect(enableSTP(br, 4, &priority)).To(Succeed())
+
+			// /sys shows the links of the namespace it was mounted in, so
+			// mount a sysfs of originalNS
+			sysfs, err := ioutil.TempDir("", "bridge-sysfs")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(sysfs)
+			Expect(unix.Mount("sysfs", sysfs, "sysfs", 0, "")).To(Succeed())
+			defer unix.Unmount(sysfs, 0)
+
+			for attr, value := range map[string]string{
+				"stp_state":     "1",
+				"forward_delay": "400",
+				"priority":      "4096",
+			} {
+				data, err := ioutil.ReadFile(filepath.Join(sysfs, "class/net", BRNAME, "bridge", attr))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(strings.TrimSpace(string(data))).To(Equal(value), attr)
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("checks the bond settings when loading net conf", func() {
+		n, _, err := loadNetConf([]byte(`{"name": "net", "type": "bridge", "bondMode": "802.3ad"}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.BondName).To(Equal(defaultBondName))
+		_, _, err = loadNetConf([]byte(`{"name": "net", "type": "bridge", "bondMode": "balance-rr"}`), "")
+		Expect(err).To(MatchError(`invalid bondMode "balance-rr" (must be active-backup or 802.3ad)`))
+		_, _, err = loadNetConf([]byte(`{"name": "net", "type": "bridge", "bondName": "bond1"}`), "")
+		Expect(err).To(MatchError("bondName requires bondMode"))
+	})
+
+	It("leaves the ports of the bridge out of the bond", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: BRNAME}})).To(Succeed())
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			// the host side of a container veth whose name matches too
+			for _, name := range []string{"eth0", "eth1"} {
+				Expect(netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: name},
+					PeerName:  name + "-peer",
+				})).To(Succeed())
+			}
+			port, err := netlink.LinkByName("eth1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetMaster(port, br)).To(Succeed())
+
+			members, err := findMatchingInterfaces("^eth[0-9]$", BRNAME, defaultBondName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(members).To(HaveLen(1))
+			Expect(members[0].Attrs().Name).To(Equal("eth0"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("bonds the uplink interfaces", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for _, name := range []string{"uplink0", "uplink1"} {
+				Expect(netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: name},
+					PeerName:  name + "-peer",
+				})).To(Succeed())
+			}
+			uplink0, err := netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(uplink0)).To(Succeed())
+			addr, err := netlink.ParseAddr("192.0.2.10/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(uplink0, addr)).To(Succeed())
+			addr6, err := netlink.ParseAddr("2001:db8::10/64")
+			Expect(err).NotTo(HaveOccurred())
+			addr6.Flags = unix.IFA_F_NODAD
+			Expect(netlink.AddrAdd(uplink0, addr6)).To(Succeed())
+			_, dst6, _ := net.ParseCIDR("2001:db8:1::/64")
+			Expect(netlink.RouteAdd(&netlink.Route{
+				LinkIndex: uplink0.Attrs().Index,
+				Dst:       dst6,
+				Gw:        net.ParseIP("2001:db8::1"),
+			})).To(Succeed())
+
+			members, err := findMatchingInterfaces("^uplink[0-9]$", BRNAME, defaultBondName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(members).To(HaveLen(2))
+
+			probe := netlink.NewLinkBond(netlink.LinkAttrs{Name: "probe"})
+			if err := netlink.LinkAdd(probe); err == syscall.EOPNOTSUPP {
+				Skip("the kernel doesn't support bonds")
+			} else if err == nil {
+				netlink.LinkDel(probe)
+			}
+
+			bond, err := ensureBond(defaultBondName, "active-backup", members, nil)
+			Expect(err).NotTo(HaveOccurred())
+			for _, name := range []string{"uplink0", "uplink1"} {
+				l, err := netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(l.Attrs().MasterIndex).To(Equal(bond.Index))
+			}
+			addrs, err := netlink.AddrList(bond, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(HaveLen(1))
+			Expect(addrs[0].IPNet.String()).To(Equal("192.0.2.10/24"))
+			addrs, err = movableAddrs(bond)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(ContainElement(WithTransform(func(a netlink.Addr) string {
+				return a.IPNet.String()
+			}, Equal("2001:db8::10/64"))))
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{
+				LinkIndex: bond.Index,
+				Dst:       dst6,
+			}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_DST)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(1))
+
+			// the bond is taken over by later calls
+			_, err = ensureBond(defaultBondName, "active-backup", members, nil)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = ensureBond(defaultBondName, "802.3ad", members, nil)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("moves the IPv6 routes of the uplink to the bridge", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: BRNAME}})).To(Succeed())
+			br, err := bridgeByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(br)).To(Succeed())
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "uplink0"},
+				PeerName:  "uplink0-peer",
+			})).To(Succeed())
+			uplink, err := netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(uplink)).To(Succeed())
+
+			addr, err := netlink.ParseAddr("2001:db8::10/64")
+			Expect(err).NotTo(HaveOccurred())
+			addr.Flags = unix.IFA_F_NODAD
+			Expect(netlink.AddrAdd(uplink, addr)).To(Succeed())
+			Expect(netlink.RouteAdd(&netlink.Route{
+				LinkIndex: uplink.Attrs().Index,
+				Gw:        net.ParseIP("2001:db8::1"),
+			})).To(Succeed())
+
+			Expect(moveRoutes(uplink, br, netlink.FAMILY_V6)).To(Succeed())
+
+			routes, err := netlink.RouteList(uplink, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(BeEmpty())
+			routes, err = netlink.RouteList(br, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			var dsts []string
+			for _, r := range routes {
+				if r.Dst == nil {
+					Expect(r.Gw.String()).To(Equal("2001:db8::1"))
+					dsts = append(dsts, "default")
+				} else {
+					dsts = append(dsts, r.Dst.String())
+				}
+			}
+			Expect(dsts).To(ConsistOf("2001:db8::/64", "fe80::/64", "default"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("sets multicast snooping on the bridge", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "uplink0"},
+				PeerName:  "uplink0-peer",
+			})).To(Succeed())
+			uplink, err := netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			addr, err := netlink.ParseAddr("192.0.2.10/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(uplink, addr)).To(Succeed())
+
+			for _, snooping := range []bool{false, true} {
+				_, err := ensureBridge(bridgeConf{name: BRNAME, uplink: uplink, mcast: multicastConf{snooping: &snooping}}, nil)
+				Expect(err).NotTo(HaveOccurred())
+				br, err := bridgeByName(BRNAME)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(*br.MulticastSnooping).To(Equal(snooping))
+
+				// the uplink is a port of the bridge now
+				uplink, err = netlink.LinkByName("uplink0")
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			querier := true
+			_, err = ensureBridge(bridgeConf{name: BRNAME, uplink: uplink, enableIPv6: true, mcast: multicastConf{querier: &querier, mldVersion: 2}}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("enables proxy ARP on the bridge", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "uplink0"},
+				PeerName:  "uplink0-peer",
+			})).To(Succeed())
+			uplink, err := netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			addr, err := netlink.ParseAddr("192.0.2.10/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(uplink, addr)).To(Succeed())
+
+			n, _, err := loadNetConf([]byte(fmt.Sprintf(`{"name": "net", "type": "bridge", "bridge": %q,
+				"uplinkInterface": "^uplink0$", "proxyArp": true}`, BRNAME)), "")
+			Expect(err).NotTo(HaveOccurred())
+			_, _, err = setupBridge(n, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			proxyArp, err := sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", BRNAME))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(proxyArp).To(Equal("1"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("sets the ageing time of the bridge", func() {
+		_, _, err := loadNetConf([]byte(`{"name": "net", "type": "bridge", "ageingTime": -1}`), "")
+		Expect(err).To(MatchError("invalid ageingTime -1 (must be between 0 and 1000000 seconds)"))
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: BRNAME}})).To(Succeed())
+			br, err := bridgeByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(setAgeingTime(br, 600)).To(Succeed())
+			br, err = bridgeByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(br.AgeingTime).NotTo(BeNil())
+			Expect(*br.AgeingTime).To(Equal(uint32(60000)))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("pins the container MAC to its port", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: BRNAME}})).To(Succeed())
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "hveth0", MasterIndex: br.Attrs().Index},
+				PeerName:  "peer0",
+			})).To(Succeed())
+			port, err := netlink.LinkByName("hveth0")
+			Expect(err).NotTo(HaveOccurred())
+
+			mac := "02:00:00:00:00:05"
+			Expect(addStaticFdb("hveth0", mac, []int{0})).To(Succeed())
+			// ADD may be repeated
+			Expect(addStaticFdb("hveth0", mac, []int{0})).To(Succeed())
+
+			entries, err := netlink.NeighList(port.Attrs().Index, syscall.AF_BRIDGE)
+			Expect(err).NotTo(HaveOccurred())
+			var found int
+			for _, entry := range entries {
+				if entry.HardwareAddr.String() == mac {
+					Expect(entry.State).To(Equal(netlink.NUD_NOARP))
+					found++
+				}
+			}
+			Expect(found).To(Equal(1))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("pins the container MAC on the VLANs of a trunk port", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			vlanFiltering := true
+			err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: BRNAME}, VlanFiltering: &vlanFiltering})
+			if err == syscall.EOPNOTSUPP {
+				Skip("the kernel doesn't support VLAN filtering")
+			}
+			Expect(err).NotTo(HaveOccurred())
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "hveth0", MasterIndex: br.Attrs().Index},
+				PeerName:  "peer0",
+			})).To(Succeed())
+			port, err := netlink.LinkByName("hveth0")
+			Expect(err).NotTo(HaveOccurred())
+			for _, vid := range []uint16{10, 11} {
+				Expect(netlink.BridgeVlanAdd(port, vid, false, false, false, true)).To(Succeed())
+			}
+
+			vlans, err := portVlans("hveth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vlans).To(ConsistOf(1, 10, 11))
+
+			mac := "02:00:00:00:00:05"
+			Expect(addStaticFdb("hveth0", mac, vlans)).To(Succeed())
+
+			entries, err := netlink.NeighList(port.Attrs().Index, syscall.AF_BRIDGE)
+			Expect(err).NotTo(HaveOccurred())
+			var pinned []int
+			for _, entry := range entries {
+				if entry.HardwareAddr.String() == mac {
+					Expect(entry.State).To(Equal(netlink.NUD_NOARP))
+					pinned = append(pinned, entry.Vlan)
+				}
+			}
+			Expect(pinned).To(ConsistOf(1, 10, 11))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("makes the uplink a multicast router port", func() {
+		_, _, err := loadNetConf([]byte(`{"name": "net", "type": "bridge", "multicastSnooping": false, "uplinkMulticastRouter": true}`), "")
+		Expect(err).To(MatchError("uplinkMulticastRouter requires multicastSnooping"))
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "uplink0"},
+				PeerName:  "uplink0-peer",
+			})).To(Succeed())
+			uplink, err := netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			addr, err := netlink.ParseAddr("192.0.2.10/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(uplink, addr)).To(Succeed())
+
+			_, err = ensureBridge(bridgeConf{name: BRNAME, uplink: uplink, mcast: multicastConf{uplinkRouter: true}}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(portMulticastRouter(uplink)).To(Equal(uint8(mcastRouterPermanent)))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("announces the container addresses", func() {
+		n, _, err := loadNetConf([]byte(`{"name": "net", "type": "bridge"}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*n.AnnounceCount).To(Equal(0))
+		_, _, err = loadNetConf([]byte(`{"name": "net", "type": "bridge", "announceCount": -1}`), "")
+		Expect(err).To(MatchError("invalid announceCount -1"))
+
+		ip4 := net.ParseIP("10.1.2.5")
+		ip6 := net.ParseIP("2001:db8::5")
+		oldMac, _ := net.ParseMAC("02:00:00:00:00:99")
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: IFNAME},
+				PeerName:  "peer0",
+			})).To(Succeed())
+			cont, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(cont)).To(Succeed())
+			peer, err := netlink.LinkByName("peer0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(peer)).To(Succeed())
+
+			// the ARP announcements are taken for gratuitous only once
+			// the neighbor has a local table, i.e. an address
+			peerAddr, err := netlink.ParseAddr("10.1.2.1/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(peer, peerAddr)).To(Succeed())
+
+			// the announcements update the entries of the neighbors
+			for _, ip := range []net.IP{ip4, ip6} {
+				Expect(netlink.NeighSet(&netlink.Neigh{
+					LinkIndex:    peer.Attrs().Index,
+					State:        netlink.NUD_STALE,
+					IP:           ip,
+					HardwareAddr: oldMac,
+				})).To(Succeed())
+			}
+
+			Expect(announceAddrs(IFNAME, []net.IP{ip4, ip6}, 1)).To(Succeed())
+
+			Eventually(func() []string {
+				var macs []string
+				for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+					neighs, err := netlink.NeighList(peer.Attrs().Index, family)
+					Expect(err).NotTo(HaveOccurred())
+					for _, neigh := range neighs {
+						if neigh.IP.Equal(ip4) || neigh.IP.Equal(ip6) {
+							macs = append(macs, neigh.HardwareAddr.String())
+						}
+					}
+				}
+				return macs
+			}).Should(ConsistOf(cont.Attrs().HardwareAddr.String(), cont.Attrs().HardwareAddr.String()))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("sets the configured sysctls in the container", func() {
+		_, _, err := loadNetConf([]byte(`{"name": "net", "type": "bridge", "sysctls": {"kernel.hostname": "x"}}`), "")
+		Expect(err).To(MatchError(`invalid net sysctl key: "kernel.hostname"`))
+		_, _, err = loadNetConf([]byte(`{"name": "net", "type": "bridge", "sysctls": {"net.ipv4/../../kernel.hostname": "x"}}`), "")
+		Expect(err).To(MatchError(`invalid net sysctl key: "net.ipv4/../../kernel.hostname"`))
+
+		sysctls := containerSysctls(map[string]string{"net.ipv4.conf.IFNAME.rp_filter": "2"}, IFNAME)
+		Expect(sysctls).To(Equal(map[string]string{"net.ipv4.conf." + IFNAME + ".rp_filter": "2"}))
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: IFNAME},
+				PeerName:  "peer0",
+			})).To(Succeed())
+			Expect(setSysctls(sysctls)).To(Succeed())
+			value, err := sysctl.Sysctl("net/ipv4/conf/" + IFNAME + "/rp_filter")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("2"))
+
+			// the defaults of the plugin leave the configured ones alone
+			_, err = setDefaultSysctl(sysctls, "net/ipv4/conf/"+IFNAME+"/rp_filter", "0")
+			Expect(err).NotTo(HaveOccurred())
+			value, err = sysctl.Sysctl("net/ipv4/conf/" + IFNAME + "/rp_filter")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("2"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("sets up a standalone bridge without uplink", func() {
+		_, _, err := loadNetConf([]byte(`{"name": "net", "type": "bridge", "mode": "routed"}`), "")
+		Expect(err).To(MatchError(`invalid mode "routed" (must be uplink or standalone)`))
+		_, _, err = loadNetConf([]byte(`{"name": "net", "type": "bridge", "mode": "standalone", "uplinkInterface": "eth0"}`), "")
+		Expect(err).To(MatchError("uplinkInterface, bondMode, uplinkMulticastRouter and proxyArp require the uplink mode"))
+
+		n, _, err := loadNetConf([]byte(`{"name": "net", "type": "bridge"}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.Mode).To(Equal(bridgeModeUplink))
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			n, _, err := loadNetConf([]byte(fmt.Sprintf(`{"name": "net", "type": "bridge", "bridge": %q, "mode": "standalone"}`, BRNAME)), "")
+			Expect(err).NotTo(HaveOccurred())
+			br, brInterface, err := setupBridge(n, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(brInterface.Name).To(Equal(BRNAME))
+
+			addrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(BeEmpty())
+			links, err := netlink.LinkList()
+			Expect(err).NotTo(HaveOccurred())
+			for _, link := range links {
+				Expect(link.Attrs().MasterIndex).NotTo(Equal(br.Attrs().Index))
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("reaches the containers from the host in proxy ARP mode", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "uplink0"},
+				PeerName:  "uplink0-peer",
+			})).To(Succeed())
+			uplink, err := netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(uplink)).To(Succeed())
+			addr, err := netlink.ParseAddr("192.0.2.10/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(uplink, addr)).To(Succeed())
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData: []byte(fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "net", "type": "bridge",
+					"bridge": %q, "uplinkInterface": "^uplink0$", "proxyArp": true,
+					"ipam": {"type": "host-local", "dataDir": %q,
+						"ranges": [[{"subnet": "192.0.2.0/24", "rangeStart": "192.0.2.100"}]]}}`, BRNAME, dataDir)),
+			}
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+
+			// the replies reach the bridge, not the host veth the route
+			// to the container goes through
+			Expect(testutils.Ping("192.0.2.10", result.IPs[0].Address.IP.String(), 5)).To(Succeed())
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("sets the txqueuelen of the bridge and veths", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "uplink0"},
+				PeerName:  "uplink0-peer",
+			})).To(Succeed())
+			uplink, err := netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			addr, err := netlink.ParseAddr("192.0.2.10/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(uplink, addr)).To(Succeed())
+
+			br, err := ensureBridge(bridgeConf{name: BRNAME, txQueueLen: 500, uplink: uplink}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(br.TxQLen).To(Equal(500))
+
+			hostIface, _, _, err := setupVeth(targetNS, br, IFNAME, 0, 500, false, 0, nil, "", nil)
+			Expect(err).NotTo(HaveOccurred())
+			hostVeth, err := netlink.LinkByName(hostIface.Name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hostVeth.Attrs().TxQLen).To(Equal(500))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().TxQLen).To(Equal(500))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("takes over the veth of a former ADD", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge(bridgeConf{name: BRNAME}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			hostIface, contIface, reused, err := setupVeth(targetNS, br, IFNAME, 0, 0, false, 0, nil, "", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reused).To(BeFalse())
+
+			// what the former ADD configured
+			hostVeth, err := netlink.LinkByName(hostIface.Name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.RouteAdd(&netlink.Route{
+				LinkIndex: hostVeth.Attrs().Index,
+				Dst:       netlink.NewIPNet(net.ParseIP("10.1.2.5")),
+				Scope:     netlink.SCOPE_LINK,
+			})).To(Succeed())
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				addr, err := netlink.ParseAddr("10.1.2.5/24")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.AddrAdd(link, addr)).To(Succeed())
+				Expect(netlink.LinkSetUp(link)).To(Succeed())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			hostIface2, contIface2, reused, err := setupVeth(targetNS, br, IFNAME, 0, 0, false, 0, nil, "02:00:00:00:00:42", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reused).To(BeTrue())
+			Expect(hostIface2.Name).To(Equal(hostIface.Name))
+			Expect(contIface2.Mac).NotTo(Equal(contIface.Mac))
+			Expect(contIface2.Mac).To(Equal("02:00:00:00:00:42"))
+
+			routes, err := netlink.RouteList(hostVeth, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(BeEmpty())
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(addrs).To(BeEmpty())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// an interface of another kind isn't
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				Expect(netlink.LinkDel(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: IFNAME}})).To(Succeed())
+				return netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: IFNAME}})
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, _, _, err = setupVeth(targetNS, br, IFNAME, 0, 0, false, 0, nil, "", nil)
+			Expect(err).To(MatchError(fmt.Sprintf("container interface %q already exists and is not a veth", IFNAME)))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("mirrors the traffic of the host veth", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for _, name := range []string{"monitor0", "port0"} {
+				Expect(netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: name},
+					PeerName:  name + "-peer",
+				})).To(Succeed())
+			}
+
+			Expect(setupMirroring("port0", "monitor0")).To(Succeed())
+			port, err := netlink.LinkByName("port0")
+			Expect(err).NotTo(HaveOccurred())
+			monitor, err := netlink.LinkByName("monitor0")
+			Expect(err).NotTo(HaveOccurred())
+			// one filter per direction, the hash tables of u32 are shared by
+			// both, so they're listed for each
+			mirred := map[int]*netlink.MirredAction{}
+			for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+				filters, err := netlink.FilterList(port, parent)
+				Expect(err).NotTo(HaveOccurred())
+				for _, f := range filters {
+					for _, a := range f.(*netlink.U32).Actions {
+						mirred[a.Attrs().Index] = a.(*netlink.MirredAction)
+					}
+				}
+			}
+			Expect(mirred).To(HaveLen(2))
+			for _, a := range mirred {
+				Expect(a.MirredAction).To(Equal(netlink.TCA_EGRESS_MIRROR))
+				Expect(a.Ifindex).To(Equal(monitor.Attrs().Index))
+			}
+
+			Expect(setupMirroring("port0", "missing0")).To(MatchError(ContainSubstring(`failed to lookup mirror interface "missing0"`)))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("validates the uplink of the bridge", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "uplink0"},
+				PeerName:  "uplink0-peer",
+			})).To(Succeed())
+			uplink, err := netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(uplink)).To(Succeed())
+			addr, err := netlink.ParseAddr("192.0.2.10/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(uplink, addr)).To(Succeed())
+			addr6, err := netlink.ParseAddr("2001:db8::10/64")
+			Expect(err).NotTo(HaveOccurred())
+			addr6.Flags = unix.IFA_F_NODAD
+			Expect(netlink.AddrAdd(uplink, addr6)).To(Succeed())
+
+			br, err := ensureBridge(bridgeConf{name: BRNAME, uplink: uplink}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			brAddrs, err := movableAddrs(br)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(brAddrs).To(ContainElement(WithTransform(func(a netlink.Addr) string {
+				return a.IPNet.String()
+			}, Equal("2001:db8::10/64"))))
+			n := &NetConf{BrName: BRNAME, UplinkInterface: "^uplink0$"}
+			brIf := cniBridgeIf{Name: BRNAME, ifIndex: br.Index}
+			Expect(validateUplink(n, brIf)).To(Succeed())
+
+			Expect(netlink.AddrDel(br, addr6)).To(Succeed())
+			Expect(validateUplink(n, brIf)).To(MatchError(ContainSubstring("doesn't carry the address 2001:db8::10/64")))
+			Expect(netlink.AddrAdd(br, addr6)).To(Succeed())
+
+			// a route the bridge should own
+			Expect(netlink.RouteAdd(&netlink.Route{
+				LinkIndex: uplink.Attrs().Index,
+				Dst:       &net.IPNet{IP: net.ParseIP("198.51.100.0"), Mask: net.CIDRMask(24, 32)},
+				Scope:     netlink.SCOPE_LINK,
+			})).To(Succeed())
+			Expect(validateUplink(n, brIf)).To(MatchError(ContainSubstring("wasn't moved to bridge")))
+			Expect(moveRoutes(uplink, br, netlink.FAMILY_V4)).To(Succeed())
+			Expect(validateUplink(n, brIf)).To(Succeed())
+
+			Expect(netlink.AddrDel(br, addr)).To(Succeed())
+			Expect(validateUplink(n, brIf)).To(MatchError(ContainSubstring("doesn't carry the address 192.0.2.10/24")))
+
+			Expect(netlink.LinkSetNoMaster(uplink)).To(Succeed())
+			Expect(validateUplink(n, brIf)).To(MatchError("Uplink interface uplink0 is not enslaved to bridge " + BRNAME))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rolls the changes back in reverse order", func() {
+		var buf bytes.Buffer
+		logger := &stepLogger{w: &buf, level: logLevels["debug"], args: &skel.CmdArgs{}}
+		var undone []string
+		undo := &undoStack{}
+		for _, step := range []string{"first", "second", "third"} {
+			step := step
+			undo.push(step, func() error {
+				undone = append(undone, step)
+				if step == "second" {
+					return fmt.Errorf("busy")
+				}
+				return nil
+			})
+		}
+		undo.rollback(logger)
+		// a failed undo doesn't stop the others
+		Expect(undone).To(Equal([]string{"third", "second", "first"}))
+		Expect(buf.String()).To(ContainSubstring("failed to undo second: busy"))
+
+		// a rollback is done once
+		undo.rollback(logger)
+		Expect(undone).To(HaveLen(3))
+
+		// a nil stack records nothing
+		var none *undoStack
+		none.push("step", func() error { return nil })
+		Expect(none).To(BeNil())
+	})
+
+	It("gives the uplink back when the bridge setup is rolled back", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "uplink0"},
+				PeerName:  "uplink0-peer",
+			})).To(Succeed())
+			uplink, err := netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(uplink)).To(Succeed())
+			addr, err := netlink.ParseAddr("192.0.2.10/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(uplink, addr)).To(Succeed())
+			_, dst, _ := net.ParseCIDR("198.51.100.0/24")
+			Expect(netlink.RouteAdd(&netlink.Route{
+				LinkIndex: uplink.Attrs().Index,
+				Dst:       dst,
+				Gw:        net.ParseIP("192.0.2.1"),
+			})).To(Succeed())
+
+			undo := &undoStack{}
+			br, err := ensureBridge(bridgeConf{name: BRNAME, uplink: uplink}, undo)
+			Expect(err).NotTo(HaveOccurred())
+			routes, err := netlink.RouteList(br, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routeDsts(routes)).To(ContainElement(dst.String()))
+
+			var buf bytes.Buffer
+			undo.rollback(&stepLogger{w: &buf, level: logLevels["error"], args: &skel.CmdArgs{}})
+			Expect(buf.String()).To(BeEmpty())
+
+			_, err = netlink.LinkByName(BRNAME)
+			Expect(err).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+			uplink, err = netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(uplink.Attrs().MasterIndex).To(BeZero())
+			addrs, err := netlink.AddrList(uplink, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(HaveLen(1))
+			Expect(addrs[0].IPNet.String()).To(Equal("192.0.2.10/24"))
+			routes, err = netlink.RouteList(uplink, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routeDsts(routes)).To(ContainElement(dst.String()))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("logs the setup steps to the log file", func() {
+		dir, err := ioutil.TempDir("", "bridge-log")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		logFile := filepath.Join(dir, "bridge.log")
+
+		_, _, err = loadNetConf([]byte(`{"name": "net", "type": "bridge", "logLevel": "trace"}`), "")
+		Expect(err).To(MatchError(`invalid logLevel "trace" (must be error, info or debug)`))
+
+		args := &skel.CmdArgs{ContainerID: "dummy", IfName: IFNAME}
+		for i := 0; i < 2; i++ {
+			logger, closeLog, err := newLogger(&NetConf{LogLevel: "info", LogFile: logFile}, "ADD", args)
+			Expect(err).NotTo(HaveOccurred())
+			logger.debugf("port", "not logged")
+			logger.infof("bridge", "bridge %s is set up", BRNAME)
+			closeLog()
+		}
+
+		data, err := ioutil.ReadFile(logFile)
+		Expect(err).NotTo(HaveOccurred())
+		// the file is appended to
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		Expect(lines).To(HaveLen(2))
+		var e logEntry
+		Expect(json.Unmarshal([]byte(lines[0]), &e)).To(Succeed())
+		Expect(e.Level).To(Equal("info"))
+		Expect(e.Command).To(Equal("ADD"))
+		Expect(e.ContainerID).To(Equal("dummy"))
+		Expect(e.Step).To(Equal("bridge"))
+		Expect(e.Message).To(Equal("bridge " + BRNAME + " is set up"))
+
+		// nothing is logged by default
+		logger, closeLog, err := newLogger(&NetConf{LogFile: filepath.Join(dir, "off.log")}, "ADD", args)
+		Expect(err).NotTo(HaveOccurred())
+		logger.errorf("add", "not logged")
+		closeLog()
+		_, err = os.Stat(filepath.Join(dir, "off.log"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("validates the routes and neighbors ADD synthesizes", func() {
+		gwIP := net.ParseIP("10.1.2.1").To4()
+		contIP := net.ParseIP("10.1.2.5").To4()
+		brMac, _ := net.ParseMAC("02:00:00:00:00:01")
+		var contMac net.HardwareAddr
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "hveth0"},
+				PeerName:  IFNAME,
+			})).To(Succeed())
+			cont, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			contMac = cont.Attrs().HardwareAddr
+			Expect(netlink.LinkSetNsFd(cont, int(targetNS.Fd()))).To(Succeed())
+
+			host, err := netlink.LinkByName("hveth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(host)).To(Succeed())
+			Expect(netlink.NeighSet(&netlink.Neigh{
+				LinkIndex:    host.Attrs().Index,
+				Family:       netlink.FAMILY_V4,
+				State:        netlink.NUD_PERMANENT,
+				IP:           contIP,
+				HardwareAddr: contMac,
+			})).To(Succeed())
+			hostRoute := &netlink.Route{
+				LinkIndex: host.Attrs().Index,
+				Dst:       netlink.NewIPNet(contIP),
+				Scope:     netlink.SCOPE_LINK,
+			}
+			Expect(netlink.RouteAdd(hostRoute)).To(Succeed())
+
+			ips := []*types100.IPConfig{{Address: net.IPNet{IP: contIP, Mask: net.CIDRMask(24, 32)}}}
+			Expect(validateHostRoutes("hveth0", ips, contMac)).To(Succeed())
+			Expect(netlink.RouteDel(hostRoute)).To(Succeed())
+			Expect(validateHostRoutes("hveth0", ips, contMac)).To(MatchError("Route to container address 10.1.2.5 on hveth0 not found"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			cont, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(cont)).To(Succeed())
+			Expect(netlink.AddrAdd(cont, &netlink.Addr{IPNet: &net.IPNet{IP: contIP, Mask: net.CIDRMask(24, 32)}})).To(Succeed())
+			Expect(addRouteToHost(cont, gwIP, contIP)).To(Succeed())
+			Expect(validateContainerRoutes(IFNAME, gwIP, brMac)).To(MatchError("Permanent neighbor 10.1.2.1 on " + IFNAME + " not found"))
+
+			neigh := &netlink.Neigh{
+				LinkIndex:    cont.Attrs().Index,
+				Family:       netlink.FAMILY_V4,
+				State:        netlink.NUD_PERMANENT,
+				IP:           gwIP,
+				HardwareAddr: brMac,
+			}
+			Expect(netlink.NeighSet(neigh)).To(Succeed())
+			Expect(validateContainerRoutes(IFNAME, gwIP, brMac)).To(Succeed())
+
+			Expect(netlink.RouteDel(&netlink.Route{LinkIndex: cont.Attrs().Index, Gw: gwIP, Priority: 1024})).To(Succeed())
+			Expect(validateContainerRoutes(IFNAME, gwIP, brMac)).To(MatchError("Default route via 10.1.2.1 on " + IFNAME + " not found"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("routes the container IPv6 traffic through the bridge link-local address", func() {
+		gwIP := net.ParseIP("fe80::1")
+		brMac, _ := net.ParseMAC("02:00:00:00:00:01")
+
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: IFNAME},
+				PeerName:  "peer0",
+			})).To(Succeed())
+			cont, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(cont)).To(Succeed())
+
+			Expect(addIPv6RouteToHost(cont, gwIP, brMac)).To(Succeed())
+			// the default route may exist already
+			Expect(addIPv6RouteToHost(cont, gwIP, brMac)).To(Succeed())
+
+			neighs, err := netlink.NeighList(cont.Attrs().Index, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			var found bool
+			for _, neigh := range neighs {
+				if neigh.IP.Equal(gwIP) {
+					Expect(neigh.State).To(Equal(netlink.NUD_PERMANENT))
+					Expect(neigh.HardwareAddr).To(Equal(brMac))
+					found = true
+				}
+			}
+			Expect(found).To(BeTrue())
+
+			routes, err := netlink.RouteList(cont, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			found = false
+			for _, route := range routes {
+				if route.Dst == nil && route.Gw.Equal(gwIP) {
+					Expect(route.Priority).To(Equal(1024))
+					found = true
+				}
+			}
+			Expect(found).To(BeTrue())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("checks the MLD settings when loading net conf", func() {
+		n, _, err := loadNetConf([]byte(`{"name": "net", "type": "bridge", "enableIPv6": true, "mldVersion": 2}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.MulticastQuerier).NotTo(BeNil())
+		Expect(*n.MulticastQuerier).To(BeTrue())
+
+		n, _, err = loadNetConf([]byte(`{"name": "net", "type": "bridge", "enableIPv6": true, "multicastSnooping": false}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.MulticastQuerier).To(BeNil())
+
+		_, _, err = loadNetConf([]byte(`{"name": "net", "type": "bridge", "mldVersion": 3}`), "")
+		Expect(err).To(MatchError("invalid mldVersion 3 (must be 1 or 2)"))
+		_, _, err = loadNetConf([]byte(`{"name": "net", "type": "bridge", "multicastSnooping": false, "mldVersion": 1}`), "")
+		Expect(err).To(MatchError("mldVersion requires multicastSnooping"))
+	})
+
+	It("checks the firewall backend when loading net conf", func() {
+		_, _, err := loadNetConf([]byte(`{"name": "net", "type": "bridge", "firewallBackend": "nftables"}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = loadNetConf([]byte(`{"name": "net", "type": "bridge", "firewallBackend": "ebtables"}`), "")
+		Expect(err).To(MatchError(`invalid firewallBackend "ebtables" (must be iptables or nftables)`))
+	})
+
+	It("adds the nftables rules of a container once", func() {
+		c := &nftConfigurerStub{}
+		fw := &nftablesBackend{configurer: c}
+		fwc := newContainerFirewall(&NetConf{NetConf: types.NetConf{Name: "testConfig"}, BrName: BRNAME}, "dummy", IFNAME)
+		ips := []net.IP{net.ParseIP("10.1.2.2")}
+
+		Expect(fw.setupContainerRules(fwc, "0a:58:0a:01:02:02", ips)).To(Succeed())
+		Expect(c.applied).To(HaveLen(2))
+		Expect(c.applied[0].LookupChain(&schema.Chain{
+			Family: schema.FamilyIP,
+			Table:  nftTableName,
+			Name:   nftForwardChainName,
+		})).NotTo(BeNil())
+		Expect(c.applied[0].LookupChain(fwc.nftChain())).NotTo(BeNil())
+		// the chain returns other MACs, accepts the address and drops the rest
+		chainRules := c.applied[1].LookupRule(&schema.Rule{
+			Family: schema.FamilyIP,
+			Table:  nftTableName,
+			Chain:  fwc.chain,
+		})
+		Expect(chainRules).To(HaveLen(3))
+		Expect(chainRules[0].Expr[1].Verdict.Return).To(BeTrue())
+		Expect(chainRules[1].Expr[1].Verdict.Accept).To(BeTrue())
+		Expect(chainRules[2].Expr[0].Verdict.Drop).To(BeTrue())
+		Expect(fwc.lookupNftJumpRules(c.applied[1])).To(HaveLen(1))
+
+		// the ruleset now holds the jump rule and the accept rule of former
+		// versions, the rule is deleted and only the chain's rules are added
+		// again
+		c.current = nft.NewConfig()
+		c.current.AddChain(fwc.nftChain())
+		c.current.AddRule(fwc.nftJumpRule())
+		brName := BRNAME
+		c.current.AddRule(&schema.Rule{
+			Family: schema.FamilyIP,
+			Table:  nftTableName,
+			Chain:  nftForwardChainName,
+			Expr: []schema.Statement{
+				{Match: &schema.Match{
+					Op:    schema.OperEQ,
+					Left:  schema.Expression{RowData: []byte(`{"meta":{"key":"iifname"}}`)},
+					Right: schema.Expression{String: &brName},
+				}},
+				{Verdict: schema.Verdict{SimpleVerdict: schema.SimpleVerdict{Accept: true}}},
+			},
+			Comment: "cni-bridge-" + BRNAME,
+		})
+		Expect(fw.setupContainerRules(fwc, "0a:58:0a:01:02:02", ips)).To(Succeed())
+		Expect(c.applied).To(HaveLen(4))
+		Expect(fwc.lookupNftJumpRules(c.applied[3])).To(BeEmpty())
+		jsonConfig, err := c.applied[3].ToJSON()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(jsonConfig)).To(ContainSubstring(`{"delete":{"rule":{"family":"ip","table":"cni-bridge","chain":"forward"`))
+	})
+
+	It("refuses to add the nftables rules if another table drops forwarded packets", func() {
+		c := &nftConfigurerStub{current: nft.NewConfig()}
+		prio := 10
+		firewalld := &schema.Chain{
+			Family: schema.FamilyINET,
+			Table:  "firewalld",
+			Name:   "filter_FORWARD",
+			Type:   schema.TypeFilter,
+			Hook:   schema.HookForward,
+			Prio:   &prio,
+			Policy: schema.PolicyAccept,
+		}
+		c.current.AddChain(firewalld)
+		c.current.AddChain(&schema.Chain{Family: schema.FamilyINET, Table: "firewalld", Name: "filter_FWD_public"})
+		c.current.AddChain(&schema.Chain{
+			Family: schema.FamilyIP,
+			Table:  nftTableName,
+			Name:   nftForwardChainName,
+			Type:   schema.TypeFilter,
+			Hook:   schema.HookForward,
+			Prio:   &prio,
+		})
+		fw := &nftablesBackend{configurer: c}
+		fwc := newContainerFirewall(&NetConf{NetConf: types.NetConf{Name: "testConfig"}, BrName: BRNAME}, "dummy", IFNAME)
+		ips := []net.IP{net.ParseIP("10.1.2.2")}
+
+		// a forward chain accepting by default doesn't get in the way
+		Expect(fw.setupContainerRules(fwc, "0a:58:0a:01:02:02", ips)).To(Succeed())
+		Expect(c.applied).To(HaveLen(2))
+
+		firewalld.Policy = schema.PolicyDrop
+		err := fw.setupContainerRules(fwc, "0a:58:0a:01:02:02", ips)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix("chain filter_FORWARD of the inet firewalld table drops forwarded packets by default"))
+		Expect(c.applied).To(HaveLen(2))
+	})
+
+	It("removes the nftables rules of a container", func() {
+		c := &nftConfigurerStub{}
+		fw := &nftablesBackend{configurer: c}
+		fwc := newContainerFirewall(&NetConf{NetConf: types.NetConf{Name: "testConfig"}, BrName: BRNAME}, "dummy", IFNAME)
+
+		// nothing to remove
+		Expect(fw.teardownContainerRules(fwc)).To(Succeed())
+		Expect(c.applied).To(BeEmpty())
+
+		c.current = nft.NewConfig()
+		c.current.AddChain(fwc.nftChain())
+		c.current.AddRule(fwc.nftJumpRule())
+		Expect(fw.teardownContainerRules(fwc)).To(Succeed())
+		Expect(c.applied).To(HaveLen(1))
+		jsonConfig, err := c.applied[0].ToJSON()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(jsonConfig)).To(MatchJSON(fmt.Sprintf(`{"nftables": [
+			{"delete": {"rule": {"family": "ip", "table": "cni-bridge", "chain": "forward",
+				"expr": [
+					{"match": {"op": "==", "left": {"meta": {"key": "iifname"}}, "right": %q}},
+					{"jump": {"target": %q}}
+				],
+				"comment": %q}}},
+			{"flush": {"chain": {"family": "ip", "table": "cni-bridge", "name": %q}}},
+			{"delete": {"chain": {"family": "ip", "table": "cni-bridge", "name": %q}}}
+		]}`, BRNAME, fwc.chain, fwc.comment, fwc.chain, fwc.chain)))
+	})
 })
 
+func routeDsts(routes []netlink.Route) []string {
+	var dsts []string
+	for _, r := range routes {
+		if r.Dst != nil {
+			dsts = append(dsts, r.Dst.String())
+		}
+	}
+	return dsts
+}
+
+// portMulticastRouter reads the multicast_router of a bridge port, which
+// netlink.LinkGetProtinfo doesn't parse.
+func portMulticastRouter(port netlink.Link) uint8 {
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_DUMP)
+	req.AddData(nl.NewIfInfomsg(unix.AF_BRIDGE))
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+	for _, m := range msgs {
+		ans := nl.DeserializeIfInfomsg(m)
+		if int(ans.Index) != port.Attrs().Index {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[ans.Len():])
+		ExpectWithOffset(1, err).NotTo(HaveOccurred())
+		for _, attr := range attrs {
+			if attr.Attr.Type != unix.IFLA_PROTINFO|unix.NLA_F_NESTED {
+				continue
+			}
+			infos, err := nl.ParseRouteAttr(attr.Value)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			for _, info := range infos {
+				if info.Attr.Type == unix.IFLA_BRPORT_MULTICAST_ROUTER {
+					return info.Value[0]
+				}
+			}
+		}
+	}
+	Fail(fmt.Sprintf("no multicast_router found for %s", port.Attrs().Name))
+	return 0
+}
+
+type nftConfigurerStub struct {
+	applied []*nft.Config
+	current *nft.Config
+}
+
+func (s *nftConfigurerStub) Apply(c *nft.Config) error {
+	s.applied = append(s.applied, c)
+	return nil
+}
+
+func (s *nftConfigurerStub) Read() (*nft.Config, error) {
+	if s.current == nil {
+		return nft.NewConfig(), nil
+	}
+	return s.current, nil
+}
+
 func assertMacSpoofCheckRulesExist() {
 	assertMacSpoofCheckRules(
 		func(actual interface{}, expectedLen int) {
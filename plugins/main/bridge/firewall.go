@@ -0,0 +1,344 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/networkplumbing/go-nft/nft"
+	"github.com/networkplumbing/go-nft/nft/schema"
+
+	"github.com/containernetworking/plugins/pkg/link"
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+const (
+	firewallBackendIptables = "iptables"
+	firewallBackendNftables = "nftables"
+)
+
+// containerFirewall identifies the rules of a container attachment: a chain
+// of its own, jumped to for the traffic from the bridge. The chain returns
+// the traffic of other MACs, accepts the container's addresses and drops the
+// rest. Both can be found again without the addresses on DEL.
+type containerFirewall struct {
+	brName  string
+	chain   string
+	comment string
+}
+
+func newContainerFirewall(n *NetConf, containerID, ifName string) containerFirewall {
+	id := uniqueID(containerID, ifName)
+	return containerFirewall{
+		brName:  n.BrName,
+		chain:   utils.MustFormatChainNameWithPrefix(n.Name, id, "FW-"),
+		comment: utils.FormatComment(n.Name, id),
+	}
+}
+
+// firewallBackend installs the filter rules letting the traffic of a
+// container be forwarded.
+type firewallBackend interface {
+	// setupContainerRules also deletes the rule accepting all the traffic
+	// from the bridge that former versions added
+	setupContainerRules(c containerFirewall, mac string, ips []net.IP) error
+	// teardownContainerRules doesn't fail if the rules are gone already
+	teardownContainerRules(c containerFirewall) error
+}
+
+// newFirewallBackend returns the configured backend. Without one, iptables
+// is used if installed, nftables otherwise.
+func newFirewallBackend(backend string) (firewallBackend, error) {
+	if backend == "" {
+		backend = firewallBackendIptables
+		if _, err := exec.LookPath("iptables"); err != nil {
+			backend = firewallBackendNftables
+		}
+	}
+
+	switch backend {
+	case firewallBackendIptables:
+		ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open IPTables: %v", err)
+		}
+		return &iptablesBackend{ipt: ipt}, nil
+	case firewallBackendNftables:
+		return &nftablesBackend{configurer: nftConfigurer{}}, nil
+	default:
+		return nil, fmt.Errorf("unknown firewallBackend %q", backend)
+	}
+}
+
+const iptablesForwardChain = "CNI-FORWARD"
+
+type iptablesBackend struct {
+	ipt *iptables.IPTables
+}
+
+func (c containerFirewall) iptablesJumpRule() []string {
+	return []string{"-i", c.brName, "-m", "comment", "--comment", c.comment, "-j", c.chain}
+}
+
+func (b *iptablesBackend) setupContainerRules(c containerFirewall, mac string, ips []net.IP) error {
+	if err := utils.EnsureChain(b.ipt, "filter", iptablesForwardChain); err != nil {
+		return fmt.Errorf("failed to create chain: %v", err)
+	}
+	if err := utils.EnsureFirstChainRule(b.ipt, "FORWARD", utils.GenerateFilterRule(iptablesForwardChain)); err != nil {
+		return err
+	}
+	if err := utils.DeleteRule(b.ipt, "filter", iptablesForwardChain, "-i", c.brName, "-j", "ACCEPT"); err != nil {
+		return err
+	}
+
+	// the chain is cleared in case a former ADD left it behind
+	if err := utils.ClearChain(b.ipt, "filter", c.chain); err != nil {
+		return fmt.Errorf("failed to create chain %s: %v", c.chain, err)
+	}
+	if err := b.ipt.Append("filter", c.chain, "-m", "mac", "!", "--mac-source", mac, "-j", "RETURN"); err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if err := b.ipt.Append("filter", c.chain, "-s", ip.String()+"/32", "-j", "ACCEPT"); err != nil {
+			return err
+		}
+	}
+	if err := b.ipt.Append("filter", c.chain, "-j", "DROP"); err != nil {
+		return err
+	}
+	return b.ipt.AppendUnique("filter", iptablesForwardChain, c.iptablesJumpRule()...)
+}
+
+func (b *iptablesBackend) teardownContainerRules(c containerFirewall) error {
+	if err := utils.DeleteRule(b.ipt, "filter", iptablesForwardChain, c.iptablesJumpRule()...); err != nil {
+		return err
+	}
+	// deleting a chain fails unless it's empty
+	if err := b.ipt.ClearChain("filter", c.chain); err != nil {
+		if eerr, ok := err.(*iptables.Error); !ok || !eerr.IsNotExist() {
+			return err
+		}
+	}
+	return utils.DeleteChain(b.ipt, "filter", c.chain)
+}
+
+// The nftables rules live in a table of their own, so that hosts without
+// the iptables-nft compatibility layer don't need its filter table. Unlike
+// in the iptables FORWARD chain, an accept there doesn't override the base
+// chains of other tables hooked on forward, such as firewalld's: a packet
+// must be accepted by all of them. The rules aren't set up if one of those
+// chains drops by default, as the container's traffic would never get through.
+const (
+	nftTableName        = "cni-bridge"
+	nftForwardChainName = "forward"
+)
+
+type nftConfigurer struct{}
+
+func (nftConfigurer) Apply(cfg *nft.Config) error {
+	return nft.ApplyConfig(cfg)
+}
+
+func (nftConfigurer) Read() (*nft.Config, error) {
+	return nft.ReadConfig()
+}
+
+type nftablesBackend struct {
+	configurer link.NftConfigurer
+}
+
+func (c containerFirewall) nftChain() *schema.Chain {
+	return &schema.Chain{Family: schema.FamilyIP, Table: nftTableName, Name: c.chain}
+}
+
+func (c containerFirewall) nftJumpRule() *schema.Rule {
+	return &schema.Rule{
+		Family: schema.FamilyIP,
+		Table:  nftTableName,
+		Chain:  nftForwardChainName,
+		Expr: []schema.Statement{
+			{Match: &schema.Match{
+				Op:    schema.OperEQ,
+				Left:  schema.Expression{RowData: []byte(`{"meta":{"key":"iifname"}}`)},
+				Right: schema.Expression{String: &c.brName},
+			}},
+			{Verdict: schema.Verdict{Jump: &schema.ToTarget{Target: c.chain}}},
+		},
+		Comment: c.comment,
+	}
+}
+
+func (c containerFirewall) nftReturnRule(mac string) *schema.Rule {
+	return &schema.Rule{
+		Family: schema.FamilyIP,
+		Table:  nftTableName,
+		Chain:  c.chain,
+		Expr: []schema.Statement{
+			{Match: &schema.Match{
+				Op: schema.OperNEQ,
+				Left: schema.Expression{Payload: &schema.Payload{
+					Protocol: schema.PayloadProtocolEther,
+					Field:    schema.PayloadFieldEtherSAddr,
+				}},
+				Right: schema.Expression{String: &mac},
+			}},
+			{Verdict: schema.Verdict{SimpleVerdict: schema.SimpleVerdict{Return: true}}},
+		},
+		Comment: c.comment,
+	}
+}
+
+func (c containerFirewall) nftAcceptRule(ip net.IP) *schema.Rule {
+	addr := ip.String()
+	return &schema.Rule{
+		Family: schema.FamilyIP,
+		Table:  nftTableName,
+		Chain:  c.chain,
+		Expr: []schema.Statement{
+			{Match: &schema.Match{
+				Op: schema.OperEQ,
+				Left: schema.Expression{Payload: &schema.Payload{
+					Protocol: schema.PayloadProtocolIP4,
+					Field:    schema.PayloadFieldIPSAddr,
+				}},
+				Right: schema.Expression{String: &addr},
+			}},
+			{Verdict: schema.Verdict{SimpleVerdict: schema.SimpleVerdict{Accept: true}}},
+		},
+		Comment: c.comment,
+	}
+}
+
+func (c containerFirewall) nftDropRule() *schema.Rule {
+	return &schema.Rule{
+		Family: schema.FamilyIP,
+		Table:  nftTableName,
+		Chain:  c.chain,
+		Expr: []schema.Statement{
+			{Verdict: schema.Verdict{SimpleVerdict: schema.SimpleVerdict{Drop: true}}},
+		},
+		Comment: c.comment,
+	}
+}
+
+// lookupNftLegacyRules returns the rule accepting all the traffic from the
+// bridge that former versions added, matched by its comment.
+func (c containerFirewall) lookupNftLegacyRules(current *nft.Config) []*schema.Rule {
+	return current.LookupRule(&schema.Rule{
+		Family:  schema.FamilyIP,
+		Table:   nftTableName,
+		Chain:   nftForwardChainName,
+		Comment: "cni-bridge-" + c.brName,
+	})
+}
+
+// Like the spoof check, the table and chains are declared in a transaction
+// of their own, so that the container's chain can be flushed in the second
+// one even if it didn't exist.
+func (b *nftablesBackend) setupContainerRules(c containerFirewall, mac string, ips []net.IP) error {
+	current, err := b.configurer.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read the nftables ruleset: %v", err)
+	}
+	if chain := nftDroppingForwardChain(current); chain != nil {
+		return fmt.Errorf("chain %s of the %s %s table drops forwarded packets by default, which the %s table can't override: "+
+			"accept the bridge traffic there or use the iptables firewallBackend", chain.Name, chain.Family, chain.Table, nftTableName)
+	}
+
+	chainPriority := 0
+	base := nft.NewConfig()
+	base.AddTable(&schema.Table{Family: schema.FamilyIP, Name: nftTableName})
+	base.AddChain(&schema.Chain{
+		Family: schema.FamilyIP,
+		Table:  nftTableName,
+		Name:   nftForwardChainName,
+		Type:   schema.TypeFilter,
+		Hook:   schema.HookForward,
+		Prio:   &chainPriority,
+		Policy: schema.PolicyAccept,
+	})
+	base.AddChain(c.nftChain())
+	if err := b.configurer.Apply(base); err != nil {
+		return fmt.Errorf("failed to create the nftables chains: %v", err)
+	}
+
+	rules := nft.NewConfig()
+	for _, rule := range c.lookupNftLegacyRules(current) {
+		rules.DeleteRule(rule)
+	}
+	rules.FlushChain(c.nftChain())
+	rules.AddRule(c.nftReturnRule(mac))
+	for _, ip := range ips {
+		rules.AddRule(c.nftAcceptRule(ip))
+	}
+	rules.AddRule(c.nftDropRule())
+	if len(c.lookupNftJumpRules(current)) == 0 {
+		rules.AddRule(c.nftJumpRule())
+	}
+	if err := b.configurer.Apply(rules); err != nil {
+		return fmt.Errorf("failed to add the nftables rules: %v", err)
+	}
+	return nil
+}
+
+// nftDroppingForwardChain returns an IPv4 base chain hooked on forward with
+// a drop policy outside of the cni-bridge table, nil if there's none.
+func nftDroppingForwardChain(current *nft.Config) *schema.Chain {
+	for _, entry := range current.Nftables {
+		chain := entry.Chain
+		if chain == nil || chain.Hook != schema.HookForward || chain.Table == nftTableName {
+			continue
+		}
+		if chain.Policy != schema.PolicyDrop {
+			continue
+		}
+		if chain.Family == schema.FamilyIP || chain.Family == schema.FamilyINET {
+			return chain
+		}
+	}
+	return nil
+}
+
+func (b *nftablesBackend) teardownContainerRules(c containerFirewall) error {
+	current, err := b.configurer.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read the nftables ruleset: %v", err)
+	}
+	if current.LookupChain(c.nftChain()) == nil {
+		return nil
+	}
+
+	cfg := nft.NewConfig()
+	for _, rule := range c.lookupNftJumpRules(current) {
+		cfg.DeleteRule(rule)
+	}
+	cfg.FlushChain(c.nftChain())
+	cfg.DeleteChain(c.nftChain())
+	if err := b.configurer.Apply(cfg); err != nil {
+		return fmt.Errorf("failed to delete the nftables rules: %v", err)
+	}
+	return nil
+}
+
+// lookupNftJumpRules matches the jump rule by its comment only, as the
+// kernel may add statements to it, e.g. counters.
+func (c containerFirewall) lookupNftJumpRules(current *nft.Config) []*schema.Rule {
+	toFind := c.nftJumpRule()
+	toFind.Expr = nil
+	return current.LookupRule(toFind)
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// The announcements are off unless configured, and repeated in case the
+// first ones get lost.
+const (
+	defaultAnnounceCount = 0
+	announceInterval     = 500 * time.Millisecond
+	naOverrideFlag       = 0x20
+	icmpv6NeighborAdv    = 136
+	ndOptTargetLinkAddr  = 2
+)
+
+var allNodesIP = net.ParseIP("ff02::1")
+
+// htons returns v in network byte order, as the protocol of a packet
+// socket address is expected.
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return nl.NativeEndian().Uint16(b[:])
+}
+
+// announceAddrs sends a gratuitous ARP for each IPv4 address of ips and an
+// unsolicited neighbor advertisement for each IPv6 one, count times, so that
+// the devices upstream learn the MAC of the link right away rather than
+// when their entries time out. It must be called in the link's namespace.
+func announceAddrs(ifName string, ips []net.IP, count int) error {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	// the packets are built with their network header, so the DAD state
+	// of the addresses doesn't matter
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	arpDst := unix.SockaddrLinklayer{
+		Ifindex:  iface.Index,
+		Protocol: htons(unix.ETH_P_ARP),
+		Halen:    6,
+	}
+	copy(arpDst.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	naDst := unix.SockaddrLinklayer{
+		Ifindex:  iface.Index,
+		Protocol: htons(unix.ETH_P_IPV6),
+		Halen:    6,
+	}
+	copy(naDst.Addr[:], []byte{0x33, 0x33, 0x00, 0x00, 0x00, 0x01})
+
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(announceInterval)
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				if err := unix.Sendto(fd, gratuitousARP(iface.HardwareAddr, ip), 0, &arpDst); err != nil {
+					return fmt.Errorf("failed to send gratuitous ARP for %s: %v", ip, err)
+				}
+				continue
+			}
+			if err := unix.Sendto(fd, unsolicitedNA(iface.HardwareAddr, ip), 0, &naDst); err != nil {
+				return fmt.Errorf("failed to send neighbor advertisement for %s: %v", ip, err)
+			}
+		}
+	}
+	return nil
+}
+
+// gratuitousARP builds an ARP request for ip sent by ip itself.
+func gratuitousARP(mac net.HardwareAddr, ip net.IP) []byte {
+	pkt := make([]byte, 28)
+	binary.BigEndian.PutUint16(pkt[0:2], 1)      // Ethernet
+	binary.BigEndian.PutUint16(pkt[2:4], 0x0800) // IPv4
+	pkt[4] = 6
+	pkt[5] = 4
+	binary.BigEndian.PutUint16(pkt[6:8], 1) // request
+	copy(pkt[8:14], mac)
+	copy(pkt[14:18], ip.To4())
+	copy(pkt[24:28], ip.To4())
+	return pkt
+}
+
+// unsolicitedNA builds a neighbor advertisement of ip to all the nodes, as
+// described in RFC 4861 section 7.2.6. The override flag makes the
+// receivers replace the MAC of their existing entries.
+func unsolicitedNA(mac net.HardwareAddr, ip net.IP) []byte {
+	icmp := make([]byte, 32)
+	icmp[0] = icmpv6NeighborAdv
+	icmp[4] = naOverrideFlag
+	copy(icmp[8:24], ip.To16())
+	icmp[24] = ndOptTargetLinkAddr
+	icmp[25] = 1 // in units of 8 bytes
+	copy(icmp[26:32], mac)
+
+	pkt := make([]byte, 40, 40+len(icmp))
+	pkt[0] = 0x60 // version
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(len(icmp)))
+	pkt[6] = unix.IPPROTO_ICMPV6
+	pkt[7] = 255 // the receivers drop the ones that may have been routed
+	copy(pkt[8:24], ip.To16())
+	copy(pkt[24:40], allNodesIP)
+
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(pkt[8:24], pkt[24:40], icmp))
+	return append(pkt, icmp...)
+}
+
+// icmpv6Checksum computes the checksum of msg including the IPv6
+// pseudo-header.
+func icmpv6Checksum(src, dst net.IP, msg []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(src)
+	add(dst)
+	sum += uint32(len(msg))
+	sum += unix.IPPROTO_ICMPV6
+	add(msg)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+// The levels of the log entries, logging is off unless a level is set.
+var logLevels = map[string]int{
+	"error": 1,
+	"info":  2,
+	"debug": 3,
+}
+
+// logEntry is written as a line of JSON.
+type logEntry struct {
+	Time        time.Time `json:"time"`
+	Level       string    `json:"level"`
+	Command     string    `json:"command"`
+	ContainerID string    `json:"containerID"`
+	IfName      string    `json:"ifName"`
+	Step        string    `json:"step"`
+	Message     string    `json:"msg"`
+}
+
+// stepLogger writes the entries of the configured level and above. The zero
+// value discards them.
+type stepLogger struct {
+	w       io.Writer
+	level   int
+	command string
+	args    *skel.CmdArgs
+}
+
+// newLogger returns the logger of the network, writing to stderr unless a
+// log file is configured. The returned function closes the file.
+func newLogger(n *NetConf, command string, args *skel.CmdArgs) (*stepLogger, func(), error) {
+	l := &stepLogger{level: logLevels[n.LogLevel], command: command, args: args, w: os.Stderr}
+	if l.level == 0 || n.LogFile == "" {
+		return l, func() {}, nil
+	}
+	f, err := os.OpenFile(n.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open log file %q: %v", n.LogFile, err)
+	}
+	l.w = f
+	return l, func() { f.Close() }, nil
+}
+
+func (l *stepLogger) log(level, step, format string, a ...interface{}) {
+	if logLevels[level] > l.level {
+		return
+	}
+	e, err := json.Marshal(logEntry{
+		Time:        time.Now(),
+		Level:       level,
+		Command:     l.command,
+		ContainerID: l.args.ContainerID,
+		IfName:      l.args.IfName,
+		Step:        step,
+		Message:     fmt.Sprintf(format, a...),
+	})
+	if err != nil {
+		return
+	}
+	l.w.Write(append(e, '\n'))
+}
+
+func (l *stepLogger) errorf(step, format string, a ...interface{}) {
+	l.log("error", step, format, a...)
+}
+
+func (l *stepLogger) infof(step, format string, a ...interface{}) {
+	l.log("info", step, format, a...)
+}
+
+func (l *stepLogger) debugf(step, format string, a ...interface{}) {
+	l.log("debug", step, format, a...)
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// setupMirroring mirrors the traffic to and from the container, as seen on
+// its host veth, to the monitor interface mirrorTo. The filters go away
+// with the veth.
+func setupMirroring(hostVethName, mirrorTo string) error {
+	monitor, err := netlink.LinkByName(mirrorTo)
+	if err != nil {
+		return fmt.Errorf("failed to lookup mirror interface %q: %v", mirrorTo, err)
+	}
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+
+	// clsact has hooks for both directions, unlike the ingress qdisc
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: hostVeth.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err := netlink.QdiscAdd(qdisc); err != nil {
+		return fmt.Errorf("failed to add clsact qdisc to %q: %v", hostVethName, err)
+	}
+
+	// traffic from the container enters the host veth, traffic to it leaves
+	// through the host veth
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		// u32 without a selector matches all packets, and unlike matchall
+		// is available on older kernels
+		filter := &netlink.U32{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: hostVeth.Attrs().Index,
+				Parent:    parent,
+				Priority:  1,
+				Protocol:  unix.ETH_P_ALL,
+			},
+			Actions: []netlink.Action{&netlink.MirredAction{
+				ActionAttrs: netlink.ActionAttrs{
+					// the packet goes on to the container or bridge
+					Action: netlink.TC_ACT_PIPE,
+				},
+				MirredAction: netlink.TCA_EGRESS_MIRROR,
+				Ifindex:      monitor.Attrs().Index,
+			}},
+		}
+		if err := netlink.FilterAdd(filter); err != nil {
+			return fmt.Errorf("failed to add mirroring filter to %q: %v", hostVethName, err)
+		}
+	}
+	return nil
+}
+
+// removeMirroring deletes the filters of setupMirroring from the host veth
+// of a retried ADD, the clsact qdisc taking them along.
+func removeMirroring(hostVeth netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(hostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %q: %v", hostVeth.Attrs().Name, err)
+	}
+	for _, qdisc := range qdiscs {
+		if qdisc.Type() != "clsact" {
+			continue
+		}
+		if err := netlink.QdiscDel(qdisc); err != nil {
+			return fmt.Errorf("failed to delete clsact qdisc from %q: %v", hostVeth.Attrs().Name, err)
+		}
+	}
+	return nil
+}
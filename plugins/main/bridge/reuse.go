@@ -0,0 +1,156 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// existingVeth returns the container interface a former ADD of the same
+// attachment left behind, e.g. when the runtime retries one that timed out,
+// and the name of its host end. It returns a nil link if there is none. The
+// interface is only taken over if it's a veth whose peer is a port of the
+// bridge, or of no bridge yet.
+func existingVeth(ifName string, hostNS ns.NetNS, br *netlink.Bridge) (netlink.Link, string, error) {
+	l, err := netlink.LinkByName(ifName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	veth, ok := l.(*netlink.Veth)
+	if !ok {
+		return nil, "", fmt.Errorf("container interface %q already exists and is not a veth", ifName)
+	}
+	peerIndex, err := netlink.VethPeerIndex(veth)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get the peer of %q: %v", ifName, err)
+	}
+
+	var hostVethName string
+	err = hostNS.Do(func(_ ns.NetNS) error {
+		peer, err := netlink.LinkByIndex(peerIndex)
+		if err != nil {
+			return err
+		}
+		// the index may be another link's if the peer is in a third netns
+		if _, ok := peer.(*netlink.Veth); !ok {
+			return fmt.Errorf("%q is not a veth", peer.Attrs().Name)
+		}
+		if index, err := netlink.VethPeerIndex(peer.(*netlink.Veth)); err != nil || index != veth.Index {
+			return fmt.Errorf("%q is not the peer", peer.Attrs().Name)
+		}
+		if master := peer.Attrs().MasterIndex; master != 0 && master != br.Index {
+			return fmt.Errorf("%q is a port of another master", peer.Attrs().Name)
+		}
+		hostVethName = peer.Attrs().Name
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("container veth %q already exists and its peer can't be taken over: %v", ifName, err)
+	}
+	return veth, hostVethName, nil
+}
+
+// resetContainerVeth converges a taken over container veth to the desired
+// MTU and MAC address, and clears what the former ADD configured on it.
+func resetContainerVeth(veth netlink.Link, mtu int, mac string) error {
+	name := veth.Attrs().Name
+	if mtu != 0 && veth.Attrs().MTU != mtu {
+		if err := netlink.LinkSetMTU(veth, mtu); err != nil {
+			return fmt.Errorf("failed to set MTU of %q: %v", name, err)
+		}
+	}
+	if mac != "" {
+		hwAddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return fmt.Errorf("failed to parse MAC address %q: %v", mac, err)
+		}
+		if veth.Attrs().HardwareAddr.String() != hwAddr.String() {
+			if err := netlink.LinkSetHardwareAddr(veth, hwAddr); err != nil {
+				return fmt.Errorf("failed to set MAC address of %q: %v", name, err)
+			}
+		}
+	}
+	return flushLink(veth)
+}
+
+// resetHostVeth is the host end counterpart of resetContainerVeth, the
+// mirroring being set up again too.
+func resetHostVeth(veth netlink.Link, mtu int) error {
+	if mtu != 0 && veth.Attrs().MTU != mtu {
+		if err := netlink.LinkSetMTU(veth, mtu); err != nil {
+			return fmt.Errorf("failed to set MTU of %q: %v", veth.Attrs().Name, err)
+		}
+	}
+	if err := removeMirroring(veth); err != nil {
+		return err
+	}
+	return flushLink(veth)
+}
+
+// flushLink removes the addresses, routes and permanent neighbors set up on
+// a veth end by a former ADD, so that the retried one starts from a clean
+// interface. What the kernel sets up for IPv6 link-local stays.
+func flushLink(link netlink.Link) error {
+	name := link.Attrs().Name
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of %q: %v", name, err)
+	}
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if err := netlink.AddrDel(link, &addr); err != nil {
+			return fmt.Errorf("failed to delete address %s from %q: %v", addr.IPNet, name, err)
+		}
+	}
+
+	// after the addresses, as some routes go away with them
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list routes of %q: %v", name, err)
+	}
+	for _, route := range routes {
+		if route.Dst != nil && route.Dst.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if err := netlink.RouteDel(&route); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("failed to delete route %s from %q: %v", route, name, err)
+		}
+	}
+
+	neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list neighbors of %q: %v", name, err)
+	}
+	for _, neigh := range neighs {
+		if neigh.State&netlink.NUD_PERMANENT == 0 {
+			continue
+		}
+		if err := netlink.NeighDel(&neigh); err != nil && err != syscall.ENOENT {
+			return fmt.Errorf("failed to delete neighbor %s from %q: %v", neigh.IP, name, err)
+		}
+	}
+	return nil
+}
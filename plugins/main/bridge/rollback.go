@@ -0,0 +1,48 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// undoStack records how to revert the changes of an ADD, so that a failed
+// one leaves the node as it was, most importantly with the uplink still
+// carrying the host's connectivity. A nil stack records nothing.
+type undoStack struct {
+	undos []undoStep
+}
+
+type undoStep struct {
+	step string
+	undo func() error
+}
+
+func (s *undoStack) push(step string, undo func() error) {
+	if s == nil {
+		return
+	}
+	s.undos = append(s.undos, undoStep{step: step, undo: undo})
+}
+
+// rollback reverts the changes, the last one first. It carries on past the
+// failures, which are logged, to revert as much as possible.
+func (s *undoStack) rollback(logger *stepLogger) {
+	for i := len(s.undos) - 1; i >= 0; i-- {
+		u := s.undos[i]
+		if err := u.undo(); err != nil {
+			logger.errorf("rollback", "failed to undo %s: %v", u.step, err)
+			continue
+		}
+		logger.debugf("rollback", "undid %s", u.step)
+	}
+	s.undos = nil
+}
@@ -285,6 +285,9 @@ func cmdAdd(args *skel.CmdArgs) error {
 			return errors.New("IPAM plugin returned missing IP config")
 		}
 
+		// addresses the IPAM plugin configured on interfaces of its own,
+		// e.g. VLAN subinterfaces, are only reported
+		foreignIPs := ipam.SplitForeignIPs(ipamResult, args.IfName)
 		result.IPs = ipamResult.IPs
 		result.Routes = ipamResult.Routes
 
@@ -296,6 +299,14 @@ func cmdAdd(args *skel.CmdArgs) error {
 		err = netns.Do(func(_ ns.NetNS) error {
 			_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/arp_notify", args.IfName), "1")
 
+			if len(result.IPs) == 0 {
+				// the routes go through the IPAM plugin's interfaces
+				link, err := netlink.LinkByName(args.IfName)
+				if err != nil {
+					return fmt.Errorf("failed to find interface name %q: %v", args.IfName, err)
+				}
+				return netlink.LinkSetUp(link)
+			}
 			if err := ipam.ConfigureIface(args.IfName, result); err != nil {
 				return err
 			}
@@ -304,6 +315,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		if err != nil {
 			return err
 		}
+		ipam.AppendForeignIPs(result, ipamResult, foreignIPs)
 	} else {
 		// For L2 just change interface status to up
 		err = netns.Do(func(_ ns.NetNS) error {